@@ -0,0 +1,185 @@
+package cmd
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/gobs/cmd/internal"
+)
+
+// the maximum number of aliases expanded for a command line
+const maxAliasDepth = 10
+
+// AddAlias adds (or replaces) an alias: a command line starting with name is executed
+// with name replaced by expansion (i.e. AddAlias("ll", "ls -l"))
+func (cmd *Cmd) AddAlias(name, expansion string) {
+	cmd.registry.Lock()
+	if cmd.aliases == nil {
+		cmd.aliases = map[string]string{}
+	}
+	cmd.aliases[name] = expansion
+	cmd.registry.Unlock()
+}
+
+// RemoveAlias removes an alias, returning false if there was no alias with the specified name
+func (cmd *Cmd) RemoveAlias(name string) bool {
+	cmd.registry.Lock()
+	defer cmd.registry.Unlock()
+
+	if _, ok := cmd.aliases[name]; !ok {
+		return false
+	}
+
+	delete(cmd.aliases, name)
+	return true
+}
+
+// GetAlias returns the expansion of the alias with the specified name
+func (cmd *Cmd) GetAlias(name string) (expansion string, ok bool) {
+	cmd.registry.RLock()
+	expansion, ok = cmd.aliases[name]
+	cmd.registry.RUnlock()
+	return
+}
+
+// Aliases returns a copy of the defined aliases
+func (cmd *Cmd) Aliases() map[string]string {
+	cmd.registry.RLock()
+	defer cmd.registry.RUnlock()
+
+	aliases := make(map[string]string, len(cmd.aliases))
+	for name, expansion := range cmd.aliases {
+		aliases[name] = expansion
+	}
+
+	return aliases
+}
+
+// AliasNames returns the sorted list of defined aliases
+func (cmd *Cmd) AliasNames() []string {
+	cmd.registry.RLock()
+	names := make([]string, 0, len(cmd.aliases))
+	for name := range cmd.aliases {
+		names = append(names, name)
+	}
+	cmd.registry.RUnlock()
+
+	sort.Strings(names)
+	return names
+}
+
+// ExpandAlias replaces the first word of line with its alias expansion, repeating the process
+// for the new first word unless it's an alias that was already expanded (i.e. alias ls "ls -l").
+// It returns false if the first word is not an alias.
+//
+// OneCmd resolves the aliases before executing a command line. A plugin that expands the line
+// before calling the original OneCmd should resolve them first, and call it via RunExpanded
+// (for each command, if the expansion contains multiple commands: see RunCommands).
+func (cmd *Cmd) ExpandAlias(line string) (string, bool) {
+	expanded := map[string]bool{}
+
+	for i := 0; i < maxAliasDepth; i++ {
+		name, rest, _ := strings.Cut(line, " ")
+		if expanded[name] {
+			break
+		}
+
+		expansion, ok := cmd.GetAlias(name)
+		if !ok {
+			break
+		}
+
+		expanded[name] = true
+
+		line = expansion
+		if rest = strings.TrimSpace(rest); rest != "" {
+			line += " " + rest
+		}
+	}
+
+	return line, len(expanded) > 0
+}
+
+// commandAndAliasNames returns the sorted list of commands and aliases, for completion
+func (cmd *Cmd) commandAndAliasNames() []string {
+	names := append(cmd.VisibleCommandNames(), cmd.AliasNames()...)
+	sort.Strings(names)
+	return names
+}
+
+func (cmd *Cmd) command_alias(line string) (stop bool) {
+	name, expansion, _ := strings.Cut(strings.TrimSpace(line), " ")
+	expansion = internal.Unquote(strings.TrimSpace(expansion))
+
+	switch {
+	case name == "": // list all
+		if cmd.JSONOutput() {
+			cmd.PrintJSON(cmd.Aliases())
+			break
+		}
+
+		cmd.WithPager(func() {
+			for _, name := range cmd.AliasNames() {
+				expansion, _ := cmd.GetAlias(name)
+				cmd.Printf("alias %v %q\n", name, expansion)
+			}
+		})
+
+	case expansion == "": // show one
+		if expansion, ok := cmd.GetAlias(name); !ok {
+			cmd.Println("no alias", name)
+		} else if cmd.JSONOutput() {
+			cmd.PrintJSON(map[string]string{name: expansion})
+		} else {
+			cmd.Printf("alias %v %q\n", name, expansion)
+		}
+
+	default:
+		cmd.AddAlias(name, expansion)
+	}
+
+	return
+}
+
+func (cmd *Cmd) command_unalias(line string) (stop bool) {
+	line = strings.TrimSpace(line)
+
+	switch {
+	case line == "":
+		cmd.Println("usage: unalias [-a|--all] name...")
+
+	case line == "-a" || line == "--all":
+		for _, name := range cmd.AliasNames() {
+			cmd.RemoveAlias(name)
+		}
+
+	default:
+		for _, name := range strings.Fields(line) {
+			if !cmd.RemoveAlias(name) {
+				cmd.Println("no alias", name)
+			}
+		}
+	}
+
+	return
+}
+
+// RunExpanded calls next (usually the OneCmd function wrapped by a plugin) with a command line
+// that the plugin expanded, after resolving the aliases (see ExpandAlias), so that OneCmd doesn't resolve them again
+// (i.e. in the expanded values, or in the result of a self referencing alias).
+func (cmd *Cmd) RunExpanded(line string, next func(string) bool) bool {
+	cmd.Lock()
+	cmd.expanded = true
+	cmd.Unlock()
+
+	defer cmd.takeExpanded()
+	return next(line)
+}
+
+// takeExpanded returns true if the line passed to OneCmd was already expanded (see RunExpanded), resetting the flag
+func (cmd *Cmd) takeExpanded() (expanded bool) {
+	cmd.Lock()
+	expanded, cmd.expanded = cmd.expanded, false
+	cmd.Unlock()
+	return
+}
@@ -0,0 +1,409 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gobs/args"
+)
+
+// ArgType is the type of the value of a flag or positional argument
+type ArgType int
+
+const (
+	StringArg ArgType = iota
+	IntArg
+	FloatArg
+	BoolArg
+	DurationArg
+)
+
+func (t ArgType) String() string {
+	switch t {
+	case StringArg:
+		return "string"
+	case IntArg:
+		return "int"
+	case FloatArg:
+		return "float"
+	case BoolArg:
+		return "bool"
+	case DurationArg:
+		return "duration"
+	default:
+		return "invalid type"
+	}
+}
+
+// parse converts the value to the specified type
+func (t ArgType) parse(v string) (interface{}, error) {
+	switch t {
+	case IntArg:
+		return strconv.Atoi(v)
+	case FloatArg:
+		return strconv.ParseFloat(v, 64)
+	case BoolArg:
+		return strconv.ParseBool(v)
+	case DurationArg:
+		return time.ParseDuration(v)
+	default:
+		return v, nil
+	}
+}
+
+// Flag describes a command option, passed as --name=value, --name value or -s value
+// (boolean flags don't require a value)
+type Flag struct {
+	Name     string
+	Short    string // optional one letter alias
+	Type     ArgType
+	Default  string
+	Help     string
+	Required bool
+}
+
+// Arg describes a positional argument
+type Arg struct {
+	Name     string
+	Type     ArgType
+	Default  string // the value of an optional argument, if not passed
+	Help     string
+	Optional bool
+	Variadic bool // collects all the remaining arguments (only valid for the last argument)
+}
+
+// ArgsSpec describes the flags and positional arguments of a command.
+//
+// When a command has an ArgsSpec, the command parameters are parsed and validated before the command
+// is called, and the command help includes the usage.
+type ArgsSpec struct {
+	Flags []Flag
+	Args  []Arg
+}
+
+// ParsedArgs are the flags and arguments of a command, parsed according to its ArgsSpec
+type ParsedArgs struct {
+	// the typed values by flag or argument name (a variadic argument is a slice)
+	Values map[string]interface{}
+	// true for the flags and arguments passed on the command line (false if set to the default value)
+	Passed map[string]bool
+	// the command parameters
+	Line string
+}
+
+// Has returns true if the flag or argument was passed on the command line
+func (p *ParsedArgs) Has(name string) bool {
+	return p.Passed[name]
+}
+
+// String returns the value of a flag or argument as a string
+func (p *ParsedArgs) String(name string) string {
+	switch v := p.Values[name].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// Int returns the value of an int flag or argument
+func (p *ParsedArgs) Int(name string) int {
+	v, _ := p.Values[name].(int)
+	return v
+}
+
+// Float returns the value of a float flag or argument
+func (p *ParsedArgs) Float(name string) float64 {
+	v, _ := p.Values[name].(float64)
+	return v
+}
+
+// Bool returns the value of a bool flag or argument
+func (p *ParsedArgs) Bool(name string) bool {
+	v, _ := p.Values[name].(bool)
+	return v
+}
+
+// Duration returns the value of a duration flag or argument
+func (p *ParsedArgs) Duration(name string) time.Duration {
+	v, _ := p.Values[name].(time.Duration)
+	return v
+}
+
+// List returns the values of a variadic argument
+func (p *ParsedArgs) List(name string) []interface{} {
+	v, _ := p.Values[name].([]interface{})
+	return v
+}
+
+func (spec *ArgsSpec) flag(name string) *Flag {
+	for i, f := range spec.Flags {
+		if f.Name == name || (f.Short != "" && f.Short == name) {
+			return &spec.Flags[i]
+		}
+	}
+
+	return nil
+}
+
+// FlagNames returns the sorted list of flags, with the leading "--"
+func (spec *ArgsSpec) FlagNames() []string {
+	names := make([]string, 0, len(spec.Flags))
+	for _, f := range spec.Flags {
+		names = append(names, "--"+f.Name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func (spec *ArgsSpec) setValue(parsed *ParsedArgs, name string, t ArgType, v string) error {
+	value, err := t.parse(v)
+	if err != nil {
+		return fmt.Errorf("invalid value for %v: %q is not a valid %v", name, v, t)
+	}
+
+	parsed.Values[name] = value
+	parsed.Passed[name] = true
+	return nil
+}
+
+// Parse parses the command parameters according to the spec
+func (spec *ArgsSpec) Parse(line string) (*ParsedArgs, error) {
+	parsed := &ParsedArgs{Values: map[string]interface{}{}, Passed: map[string]bool{}, Line: line}
+
+	tokens := args.GetArgs(line)
+
+	for len(tokens) > 0 && strings.HasPrefix(tokens[0], "-") && tokens[0] != "-" {
+		token := tokens[0]
+		if _, err := strconv.ParseFloat(token, 64); err == nil { // a negative number
+			break
+		}
+
+		tokens = tokens[1:]
+
+		if token == "--" { // stop parsing flags
+			break
+		}
+
+		name, value, hasValue := strings.Cut(strings.TrimLeft(token, "-"), "=")
+
+		f := spec.flag(name)
+		if f == nil {
+			return nil, fmt.Errorf("unknown flag %v", token)
+		}
+
+		if !hasValue {
+			if f.Type == BoolArg {
+				value = "true"
+			} else if len(tokens) == 0 {
+				return nil, fmt.Errorf("missing value for --%v", f.Name)
+			} else {
+				value, tokens = tokens[0], tokens[1:]
+			}
+		}
+
+		if err := spec.setValue(parsed, f.Name, f.Type, value); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range spec.Flags {
+		if parsed.Passed[f.Name] {
+			continue
+		}
+
+		if f.Required {
+			return nil, fmt.Errorf("missing required flag --%v", f.Name)
+		}
+
+		if f.Default != "" || f.Type != StringArg {
+			def := f.Default
+			if def == "" {
+				def = zeroValue(f.Type)
+			}
+
+			if err := spec.setValue(parsed, f.Name, f.Type, def); err != nil {
+				return nil, err
+			}
+
+			parsed.Passed[f.Name] = false
+		} else {
+			parsed.Values[f.Name] = ""
+		}
+	}
+
+	for i, a := range spec.Args {
+		if a.Variadic && i == len(spec.Args)-1 {
+			if len(tokens) == 0 && !a.Optional {
+				return nil, fmt.Errorf("missing argument %v", a.Name)
+			}
+
+			list := make([]interface{}, 0, len(tokens))
+			for _, t := range tokens {
+				v, err := a.Type.parse(t)
+				if err != nil {
+					return nil, fmt.Errorf("invalid value for %v: %q is not a valid %v", a.Name, t, a.Type)
+				}
+
+				list = append(list, v)
+			}
+
+			parsed.Values[a.Name] = list
+			parsed.Passed[a.Name] = len(tokens) > 0
+			tokens = nil
+			break
+		}
+
+		value, passed := a.Default, len(tokens) > 0
+
+		if passed {
+			value, tokens = tokens[0], tokens[1:]
+		} else if !a.Optional {
+			return nil, fmt.Errorf("missing argument %v", a.Name)
+		} else if value == "" {
+			value = zeroValue(a.Type)
+		}
+
+		if err := spec.setValue(parsed, a.Name, a.Type, value); err != nil {
+			return nil, err
+		}
+
+		parsed.Passed[a.Name] = passed
+	}
+
+	if len(tokens) > 0 {
+		return nil, fmt.Errorf("too many arguments: %v", strings.Join(tokens, " "))
+	}
+
+	return parsed, nil
+}
+
+func zeroValue(t ArgType) string {
+	switch t {
+	case IntArg, FloatArg:
+		return "0"
+	case BoolArg:
+		return "false"
+	case DurationArg:
+		return "0s"
+	default:
+		return ""
+	}
+}
+
+// Usage returns the usage of a command with this spec, i.e.:
+//
+//	usage: name [--flag=int] arg [optional] [variadic...]
+//
+//	  --flag int    help (default 1)
+//	  arg           help
+func (spec *ArgsSpec) Usage(name string) string {
+	var b strings.Builder
+
+	b.WriteString("usage: " + name)
+
+	for _, f := range spec.Flags {
+		s := "--" + f.Name
+		if f.Type != BoolArg {
+			s += "=" + f.Type.String()
+		}
+		if !f.Required {
+			s = "[" + s + "]"
+		}
+		b.WriteString(" " + s)
+	}
+
+	for _, a := range spec.Args {
+		s := a.Name
+		if a.Variadic {
+			s += "..."
+		}
+		if a.Optional {
+			s = "[" + s + "]"
+		}
+		b.WriteString(" " + s)
+	}
+
+	b.WriteString("\n")
+
+	if len(spec.Flags)+len(spec.Args) > 0 {
+		b.WriteString("\n")
+	}
+
+	for _, f := range spec.Flags {
+		s := "--" + f.Name
+		if f.Short != "" {
+			s = "-" + f.Short + ", " + s
+		}
+		if f.Type != BoolArg {
+			s += " " + f.Type.String()
+		}
+		b.WriteString(usageLine(s, f.Help, f.Default))
+	}
+
+	for _, a := range spec.Args {
+		s := a.Name
+		if a.Type != StringArg {
+			s += " " + a.Type.String()
+		}
+		b.WriteString(usageLine(s, a.Help, a.Default))
+	}
+
+	return b.String()
+}
+
+func usageLine(name, help, def string) string {
+	if def != "" {
+		help = strings.TrimSpace(fmt.Sprintf("%v (default %v)", help, def))
+	}
+
+	return strings.TrimRight(fmt.Sprintf("  %-20v %v", name, help), " ") + "\n"
+}
+
+// flagCompleter completes the flag names of the command being typed, if it has an ArgsSpec,
+// or its Options
+type flagCompleter struct {
+	cmd *Cmd
+}
+
+func (c *flagCompleter) Complete(start, line string) (matches []string) {
+	if !strings.HasPrefix(start, "-") {
+		return
+	}
+
+	command, found := c.cmd.lookupPrefix(strings.Fields(strings.TrimSuffix(line, start)))
+	if !found {
+		return
+	}
+
+	names := command.Options
+
+	if command.Args != nil {
+		names = nil
+
+		for _, f := range command.Args.Flags {
+			name := "--" + f.Name
+			if f.Type != BoolArg { // the value follows
+				name += "="
+			}
+
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+	}
+
+	for _, name := range names {
+		if strings.HasPrefix(name, start) {
+			matches = append(matches, name)
+		}
+	}
+
+	return
+}
@@ -18,29 +18,43 @@ import (
 	"github.com/alitto/pond"
 	"github.com/gobs/args"
 	"github.com/gobs/cmd/internal"
-	"github.com/gobs/pretty"
 	"golang.org/x/sync/errgroup"
 
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"os/signal"
 	"regexp"
+	"runtime/debug"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
-	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"log"
 )
 
 var (
-	reArg       = regexp.MustCompile(`\$(\w+|\(\w+\)|\(env.\w+\)|[\*#]|\([\*#]\))`) // $var or $(var)
-	reVarAssign = regexp.MustCompile(`([\d\w]+)(=(.*))?`)                           // name=value
-	sep         = string(0xFFFD)                                                    // unicode replacement char
+	reVarAssign = regexp.MustCompile(`([\d\w]+)(=(.*))?`) // name=value
+	sep         = string(rune(0xFFFD))                    // unicode replacement char
+
+	// ErrIdleTimeout is returned when the prompt has been idle for longer than Cmd.IdleTimeout
+	ErrIdleTimeout = errors.New("idle timeout")
+
+	// ErrMaxCallDepth is the failure of a function call nested more than Cmd.MaxCallDepth levels
+	ErrMaxCallDepth = errors.New("maximum recursion depth exceeded")
+
+	// ErrPromptAborted should be returned by LineReader.Prompt when Ctrl-C is pressed
+	ErrPromptAborted = internal.ErrPromptAborted
+
+	// ErrKeyBindings is returned by BindKey when the line reader doesn't support key bindings (see KeyBinder)
+	ErrKeyBindings = internal.ErrKeyBindings
 
 	// NoVar is passed to Command.OnChange to indicate that the variable is not set or needs to be deleted
 	NoVar = &struct{}{}
@@ -48,6 +62,26 @@ var (
 
 type arguments = map[string]string
 
+// LineReader is the interactive line editor used by the command loop (see SetLineReader)
+type LineReader = internal.LineReader
+
+// CtrlCMode specifies what happens when Ctrl-C is pressed at the prompt
+type CtrlCMode int
+
+const (
+	// CtrlCClear clears the current line
+	CtrlCClear CtrlCMode = iota
+
+	// CtrlCInterrupt calls the Interrupt hook, and terminates the command loop if it returns true
+	CtrlCInterrupt
+
+	// CtrlCExitTwice clears the current line, and terminates the command loop
+	// if Ctrl-C is pressed again within 2 seconds
+	CtrlCExitTwice
+)
+
+const ctrlCExitWindow = 2 * time.Second
+
 // This is used to describe a new command
 type Command struct {
 	// command name
@@ -56,10 +90,62 @@ type Command struct {
 	Help string
 	// the function to call to execute the command
 	Call func(string) bool
+	// the function to call to execute the command, if it can fail (instead of Call).
+	// A non-nil error is stored in the "error" variable and passed to Cmd.OnError.
+	CallE func(string) (bool, error)
 	// the function to call to print the help string
 	HelpFunc func()
+	// the function to call when the command panics (overrides Cmd.OnPanic)
+	OnPanic func(PanicInfo) RecoverAction
+	// the subcommands, for a command group (see Cmd.Group)
+	Subcommands map[string]Command
+	// the flags and arguments, parsed and validated before calling the command (optional)
+	Args *ArgsSpec
+	// the function to call with the parsed arguments (instead of Call), if Args is set
+	Run func(args *ParsedArgs) bool
+	// if true the command is not listed by help and it's not completed (but it can be executed)
+	Hidden bool
+	// if not empty the command is deprecated: it's not listed by help and it's not completed,
+	// and this message is printed as a warning when the command is executed (i.e. "use xxx instead")
+	Deprecated string
+	// the options completed after "-" (i.e. "--count=" or "--all"), for commands without Args
+	Options []string
+	// the function to call to complete the command arguments: it receives the word being completed
+	// and the whole line, and returns the completions (see also Cmd.AddCompleter)
+	Complete func(start, line string) []string
+	// if true the command only changes the interpreter state (i.e. variables or control flow),
+	// so it's executed also in dry-run mode (see Cmd.DryRun)
+	Safe bool
+}
+
+// listed returns true if the command should be listed by help and completed
+func (c *Command) listed() bool {
+	return !c.Hidden && c.Deprecated == ""
+}
+
+// PanicInfo describes a panic recovered while executing a command
+type PanicInfo struct {
+	Command string      // the command name
+	Line    string      // the command line
+	Value   interface{} // the value passed to panic
+	Stack   []byte      // the stack trace of the panicking goroutine
+	Attempt int         // 1 for the first execution, incremented on each retry
 }
 
+// RecoverAction is what to do after a command panicked
+type RecoverAction int
+
+const (
+	// RecoverAbort terminates the current script (or the interpreter, in the command loop)
+	RecoverAbort RecoverAction = iota
+
+	// RecoverContinue continues with the next command
+	RecoverContinue
+
+	// RecoverRetry executes the command again
+	RecoverRetry
+)
+
 func (c *Command) DefaultHelp() {
 	if len(c.Help) > 0 {
 		fmt.Println(c.Help)
@@ -166,15 +252,30 @@ func (r *pooled) Wait() {
 
 // This the the "context" for the command interpreter
 type Cmd struct {
-	// the prompt string
+	// the prompt string, that can contain variables and colors (see ExpandPrompt)
 	Prompt string
 
+	// the right aligned prompt segment (i.e. to display the time or the current mode), that can contain
+	// variables and colors (see ExpandPrompt).
+	//
+	// Limitation: the segment is not displayed on the input line, as zsh's RPROMPT, since the line editor
+	// clears the whole input line when redrawing it. It's displayed at the end of the line above the input line
+	// (the last line of a multi-line prompt, or a line of its own for a single line prompt).
+	RightPrompt string
+
 	// the continuation prompt string
 	ContinuationPrompt string
 
 	// the history file
 	HistoryFile string
 
+	// the maximum number of history entries, in memory and in the history file (0 for the line editor limit)
+	HistoryLimit int
+
+	// the lines matching one of these regular expressions (i.e. "password") are not added to the history
+	// (an invalid expression is matched literally)
+	HistoryExclude []string
+
 	// this function is called to fetch the current prompt
 	// so it can be overridden to provide a dynamic prompt
 	GetPrompt func(bool) string
@@ -186,6 +287,7 @@ type Cmd struct {
 	PostLoop func()
 
 	// this function is called before executing the selected command
+	// (see also Use, to add a middleware to the command execution)
 	PreCmd func(string)
 
 	// this function is called after a command has been executed
@@ -218,56 +320,252 @@ type Cmd struct {
 	// newv will be nil if the variable is being deleted
 	OnChange func(name string, oldv, newv interface{}) interface{}
 
-	// this function is called when the user tries to interrupt a running
-	// command. If it returns true, the application will be terminated.
+	// if true, all variable changes (including the results set by commands and plugins via SetVar,
+	// UnsetVar and UpdateVar) are passed to OnChange, not only the ones from the set/var commands
+	ObserveAllVars bool
+
+	// the variables that are not passed to OnChange even if ObserveAllVars is true
+	// (i.e. high-frequency internals like the "index" and "item" variables in loops)
+	UnobservedVars []string
+
+	// this function is called when the user tries to interrupt the command loop while no command is running
+	// (an interrupt cancels the running command instead, see Context).
+	// If it returns true, the application will be terminated.
 	Interrupt func(os.Signal) bool
 
 	// this function is called when recovering from a panic.
 	// If it returns true, the application will be terminated.
 	Recover func(interface{}) bool
 
+	// this function is called when recovering from a panic, after printing the stack trace
+	// and setting the "error" variable. If it returns true the next command is executed, otherwise the current
+	// script (or the command loop) is terminated. If set, it's called instead of Recover.
+	OnRecover func(interface{}) bool
+
+	// this function is called when recovering from a panic, with the command and the stack trace,
+	// and returns what to do next. If set, it's called instead of OnRecover and Recover
+	// (and the stack trace is not printed).
+	OnPanic func(PanicInfo) RecoverAction
+
+	// this function is called when a command returns an error (see Command.CallE),
+	// after setting the "error" variable. If it returns true the current script is terminated
+	// (or the interpreter, in the command loop). The default prints the error.
+	OnError func(command string, err error) bool
+
+	// this function is called when the prompt has been idle for IdleTimeout.
+	// If it returns true the session is terminated, otherwise it waits for another IdleTimeout.
+	// If not set, the session is terminated.
+	OnIdle func() bool
+
+	// if not zero, the time the prompt can sit unused before OnIdle is called
+	IdleTimeout time.Duration
+
+	// this function is called when the terminal is resized, with the new size
+	// (i.e. to update prompts with width-dependent segments)
+	OnResize func(width, height int)
+
+	// this function is called by the reload command, and when the process receives SIGHUP
+	// (i.e. to read the configuration again, or register the dynamic commands).
+	// On SIGHUP it's called from another goroutine, possibly while a command is running.
+	OnReload func()
+
+	// this function is called by NewSession with the new session, after its plugins are initialized,
+	// to add the commands (and completers) that refer to the interpreter, so that they act on the session
+	// that executes them (i.e. with s.Println or s.SetVar, instead of the original interpreter).
+	// It can be set after Init, and it's also used for the sessions created by a session
+	// and for the interpreter of each job started by the go command.
+	OnSession func(s *Cmd)
+
+	// if set, it's notified when a command starts and terminates (i.e. to collect metrics)
+	Observer Observer
+
+	// this function is called to expand a $(command ...) reference (a $(...) containing spaces, see ExpandVariables)
+	// with the output of the command. If not set, or if it returns false, the reference is left as is.
+	// The controlflow plugin sets it to execute the command (see CaptureOutput).
+	CommandSubstitution func(command string) (string, bool)
+
 	// if true, enable shell commands
 	EnableShell bool
 
+	// the shell used to execute the shell commands, with its arguments (the command is passed as the last one),
+	// i.e. []string{"bash", "-c"} or []string{"powershell", "-Command"}.
+	// The default is "sh -c" ("cmd /S /C" on Windows).
+	Shell []string
+
+	// the maximum nesting level of function calls, to stop runaway recursion (default 100, negative for no limit)
+	MaxCallDepth int
+
 	// if true, print elapsed time
 	Timing bool
 
 	// if true, print command before executing
 	Echo bool
 
+	// if true, print each command (after variable expansion) and function call to stderr before executing it,
+	// prefixed by a "+" for each level of nesting (see Trace)
+	Trace bool
+
 	// if true, don't print result of some operations (stored in result variables)
 	Silent bool
 
-	// if true, a Ctrl-C should return an error
-	// CtrlCAborts bool
+	// if true, commands are not executed: the command line, after alias and variable expansion, is printed instead.
+	// The commands marked as Safe (i.e. set or if) are executed, so that the script flow can be followed.
+	DryRun bool
+
+	// if true, a failed command (invalid command, panic or "error" variable set) terminates the block
+	// (function, loop or conditional body) being executed, and the enclosing ones, as "set -e" in bash,
+	// and terminates the script (see RunScript, or the commands read by CmdLoop when the input is not a terminal).
+	// It has no effect on the commands executed at the prompt.
+	ErrExit bool
+
+	// what to do when Ctrl-C is pressed at the prompt (the default is to clear the current line)
+	CtrlC CtrlCMode
+
+	// the number of consecutive EOF (Ctrl-D) at the prompt to ignore before exiting (as bash's ignoreeof)
+	IgnoreEOF int
+
+	// this function is called when EOF (Ctrl-D) is read at the prompt, after the ones ignored because of IgnoreEOF.
+	// If it returns false the command loop continues, otherwise it terminates (the default).
+	// It can be used to ask for confirmation, or to execute a command instead (i.e. cmd.OneCmd("disconnect")).
+	OnEOF func() bool
+
+	// the pager for long listings (i.e. "help --all"), when the output is a terminal.
+	// The default is $PAGER, or less (more on Windows). Set to "off" to disable paging.
+	Pager string
+
+	// the input stream for the command loop (default is os.Stdin, via the line editor).
+	// If this is not a terminal, lines are read directly from it (no prompt, history or completion).
+	Input io.Reader
+
+	// the output stream for the command output (default is os.Stdout)
+	Output io.Writer
 
 	// this is the list of available commands indexed by command name
 	Commands map[string]Command
 
 	///////// private stuff /////////////
 	completers *linkedCompleter
+	promptMax  int // the maximum length of the prompt (see SetPrompt)
+	aliases    map[string]string
+	middleware []*Middleware // pointers, so that the middlewares added by a plugin can be identified
+	registry   sync.RWMutex  // protects Commands, completers, aliases and middleware, that can be changed while commands are running
 
-	commandNames      []string
 	commandCompleter  *WordCompleter
 	functionCompleter *WordCompleter
 
-	runner GoRunner
+	runner  GoRunner
+	jobs    []*Job // the jobs started with the go command
+	lastJob int    // the id of the last job
+	parent  *Cmd   // the interpreter that started the job executed by this one (see fork)
+
+	dir     string   // the working directory (see Dir)
+	prevDir string   // the previous working directory (for "cd -")
+	dirs    []string // the directory stack (pushd and popd)
+
+	exported map[string]bool // the variables added to the environment of the shell commands
+
+	running context.Context    // the context of the command running in the command loop, or of the job (see Context)
+	cancel  context.CancelFunc // cancels the running command
+
+	exitFuncs []func() // the functions to call when the command loop terminates (see OnExit)
+
+	plugins []Plugin       // the plugins passed to Init, in initialization order
+	loaded  []loadedPlugin // the initialized plugins, with the changes they made
+	config  *Cmd           // the configuration before Init, used to create new sessions
 
 	interrupted bool
+	failure     error           // the first failure in the current script
+	failures    int             // the number of failures, to detect if a command failed
+	errExited   bool            // true if the blocks being executed were terminated by a failure (see ErrExit)
+	lastFailure error           // the last failure (see Observer)
+	status      int             // the exit status of the last command
+	statusSet   bool            // true if the status was set by the command (see SetStatus)
+	bound       map[string]bool // the last synced values of the control variables
+	blockDepth  int             // the number of nested blocks being executed
+	scripts     int             // the number of scripts being executed (see startScript)
+	callDepth   int             // the number of nested function calls (blocks with a name)
+	blockExit   BlockExit       // how the current block should terminate
+	deferred    [][]string      // the commands deferred by each block being executed (see Defer)
 	context     *internal.Context
-	stdout      *os.File // original stdout
+	stderr      io.Writer      // the error output (default is os.Stderr)
+	redirect    io.WriteCloser // the output set via the output command, if any
+	redirected  string         // the name of the redirected output
+	capture     io.Writer      // the output captured by Execute, if any
+	expanded    bool           // true if the line passed to OneCmd was already expanded (see RunExpanded)
+	execLock    sync.Mutex
+	syncLock    sync.Mutex // serializes the control variables sync
 	sync.RWMutex
 }
 
+// copyConfig copies the user configuration (prompts, hooks and flags) from src to dst
+func copyConfig(dst, src *Cmd) {
+	dst.Prompt = src.Prompt
+	dst.ContinuationPrompt = src.ContinuationPrompt
+	dst.HistoryFile = src.HistoryFile
+	dst.HistoryLimit = src.HistoryLimit
+	dst.HistoryExclude = src.HistoryExclude
+	dst.MaxCallDepth = src.MaxCallDepth
+	dst.RightPrompt = src.RightPrompt
+	dst.GetPrompt = src.GetPrompt
+	dst.PreLoop = src.PreLoop
+	dst.PostLoop = src.PostLoop
+	dst.PreCmd = src.PreCmd
+	dst.PostCmd = src.PostCmd
+	dst.OneCmd = src.OneCmd
+	dst.middleware = src.middleware[:len(src.middleware):len(src.middleware)]
+	dst.EmptyLine = src.EmptyLine
+	dst.Default = src.Default
+	dst.Help = src.Help
+	dst.Complete = src.Complete
+	dst.OnChange = src.OnChange
+	dst.ObserveAllVars = src.ObserveAllVars
+	dst.UnobservedVars = src.UnobservedVars
+	dst.Interrupt = src.Interrupt
+	dst.Recover = src.Recover
+	dst.OnRecover = src.OnRecover
+	dst.OnPanic = src.OnPanic
+	dst.OnError = src.OnError
+	dst.OnIdle = src.OnIdle
+	dst.IdleTimeout = src.IdleTimeout
+	dst.OnResize = src.OnResize
+	dst.OnReload = src.OnReload
+	dst.Observer = src.Observer
+	dst.CommandSubstitution = src.CommandSubstitution
+	dst.EnableShell = src.EnableShell
+	dst.Shell = src.Shell
+	dst.Timing = src.Timing
+	dst.Echo = src.Echo
+	dst.Trace = src.Trace
+	dst.Silent = src.Silent
+	dst.DryRun = src.DryRun
+	dst.ErrExit = src.ErrExit
+	dst.CtrlC = src.CtrlC
+	dst.IgnoreEOF = src.IgnoreEOF
+	dst.OnEOF = src.OnEOF
+	dst.Pager = src.Pager
+	dst.Input = src.Input
+	dst.Output = src.Output
+}
+
 // Initialize the command interpreter context
 func (cmd *Cmd) Init(plugins ...Plugin) {
+	cmd.config = &Cmd{}
+	copyConfig(cmd.config, cmd)
+
+	plugins, err := sortPlugins(plugins)
+	if err != nil {
+		panic("plugin initialization failed: " + err.Error())
+	}
+
+	cmd.plugins = plugins
+
 	if cmd.GetPrompt == nil {
 		cmd.GetPrompt = func(cont bool) string {
 			if cont {
-				return cmd.ContinuationPrompt
+				return cmd.ExpandPrompt(cmd.ContinuationPrompt)
 			}
 
-			return cmd.Prompt
+			return truncatePrompt(cmd.ExpandPrompt(cmd.Prompt), cmd.promptMax)
 		}
 	}
 	if cmd.PreLoop == nil {
@@ -289,7 +587,7 @@ func (cmd *Cmd) Init(plugins ...Plugin) {
 		cmd.EmptyLine = func() {}
 	}
 	if cmd.Default == nil {
-		cmd.Default = func(line string) { fmt.Printf("invalid command: %v\n", line) }
+		cmd.Default = func(line string) { cmd.Printf("invalid command: %v\n", line) }
 	}
 	if cmd.OnChange == nil {
 		cmd.OnChange = func(name string, oldv, newv interface{}) interface{} { return newv }
@@ -303,31 +601,212 @@ func (cmd *Cmd) Init(plugins ...Plugin) {
 	if cmd.Help == nil {
 		cmd.Help = cmd.help
 	}
-	cmd.context = internal.NewContext()
-	cmd.context.PushScope(nil, nil)
-
-	cmd.stdout = os.Stdout
+	if cmd.OnError == nil {
+		cmd.OnError = func(command string, err error) bool {
+			cmd.Println(err)
+			return false
+		}
+	}
+	if cmd.parent != nil { // a job, that shares the global variables (see fork)
+		cmd.context = cmd.parent.context.Fork()
+	} else {
+		cmd.context = internal.NewContext()
+		cmd.context.PushScope(nil, nil)
+	}
+	cmd.context.SetVar("status", 0, internal.LocalScope)
 
 	cmd.Commands = make(map[string]Command)
-	cmd.Add(Command{"help", `list available commands`, func(line string) bool {
+	cmd.Add(Command{Name: "help", Help: `help [--all|--export {markdown|man}|command]: list available commands`, Options: []string{"--all", "--export"}, Call: func(line string) bool {
 		return cmd.Help(line)
-	}, nil})
-	cmd.Add(Command{"echo", `echo input line`, cmd.command_echo, nil})
-	cmd.Add(Command{"go", `go cmd: asynchronous execution of cmd, or 'go [--start [n]|--pool [w [cap]]|--wait]'`,
-		cmd.command_go, nil})
-	cmd.Add(Command{"time", `time [starttime]`, cmd.command_time, nil})
-	cmd.Add(Command{"output", `output [filename|--]`, cmd.command_output, nil})
-	cmd.Add(Command{"exit", `exit program`, cmd.command_exit, nil})
+	}, Safe: true})
+	cmd.Add(Command{Name: "echo", Help: `echo [-n] [-e] [-2] [-f format] input line: print the input line (-n: no newline, -e: interpret escapes, -2: to stderr, -f: printf-style)`, Options: []string{"-n", "-e", "-2", "-f"}, Call: cmd.command_echo})
+	cmd.Add(Command{Name: "go", Help: `go cmd: asynchronous execution of cmd, or 'go [--start [n]|--pool [w [cap]]|--wait]'`,
+		Options: []string{"--start", "--pool", "--wait"}, Call: cmd.command_go})
+	cmd.Add(Command{Name: "jobs", Help: `jobs [--clear]: list the jobs started with go (--clear removes the terminated ones)`, Options: []string{"--clear"}, Call: cmd.command_jobs, Safe: true})
+	cmd.Add(Command{Name: "history", Help: `history [n|clear|save file]: list the history entries (the last n), to recall them with !n or !!, clear or save them`,
+		Call: cmd.command_history, Complete: cmd.completeHistory})
+	cmd.Add(Command{Name: "wait", Help: `wait [id...]: wait for the specified jobs (or all jobs) to terminate`, Call: cmd.command_wait})
+	cmd.Add(Command{Name: "kill", Help: `kill id...: kill the specified jobs`, Call: cmd.command_kill})
+	cmd.Add(Command{Name: "time", Help: `time [starttime]`, Call: cmd.command_time, Safe: true})
+	cmd.Add(Command{Name: "watch", Help: `watch [--interval=2s] command: execute command repeatedly, redrawing its output, until interrupted`, Options: []string{"--interval="}, Call: cmd.command_watch})
+	cmd.Add(Command{Name: "output", Help: `output [filename|--]`, Call: cmd.command_output, Complete: cmd.fileCompleter("", false)})
+	cmd.Add(Command{Name: "exit", Help: `exit program`, Call: cmd.command_exit})
+	cmd.Add(Command{Name: "reload", Help: `reload: reload the configuration (see Cmd.OnReload)`, Call: cmd.command_reload})
+	cmd.Add(Command{Name: "cd", Help: `cd [dir|-]: change the working directory (default is the home directory, - is the previous one)`, Call: cmd.command_cd, Complete: cmd.fileCompleter("", true), Safe: true})
+	cmd.Add(Command{Name: "pwd", Help: `pwd: print the working directory`, Call: cmd.command_pwd, Safe: true})
+	cmd.Add(Command{Name: "pushd", Help: `pushd [dir]: change the working directory, saving the current one in the directory stack (or swap the top two directories)`, Call: cmd.command_pushd, Complete: cmd.fileCompleter("", true), Safe: true})
+	cmd.Add(Command{Name: "popd", Help: `popd: change the working directory to the one at the top of the directory stack, removing it`, Call: cmd.command_popd, Safe: true})
+	cmd.Add(Command{Name: "env", Help: `env [-u|--unset name] [name [value]]: list, print, set or remove environment variables`, Options: []string{"--unset"}, Call: cmd.command_env})
+	cmd.Add(Command{Name: "shell", Help: `shell [--capture var] command: execute a shell command (as !command), optionally storing its output in var`, Options: []string{"--capture"}, Call: cmd.command_shell})
+	cmd.Add(Command{Name: "alias", Help: `alias [name [expansion]]`, Call: cmd.command_alias, Safe: true})
+	cmd.Add(Command{Name: "unalias", Help: `unalias [-a|--all] name...`, Options: []string{"--all"}, Call: cmd.command_unalias, Safe: true})
 
 	for _, p := range plugins {
-		if err := p.PluginInit(cmd, cmd.context); err != nil {
+		if err := cmd.initPlugin(p); err != nil {
 			panic("plugin initialization failed: " + err.Error())
 		}
 	}
 
-	cmd.SetVar("echo", cmd.Echo)
-	cmd.SetVar("print", !cmd.Silent)
-	cmd.SetVar("timing", cmd.Timing)
+	cmd.bound = map[string]bool{}
+
+	if cmd.parent != nil { // the control variables are already set
+		for _, b := range cmd.controlVars() {
+			v := cmd.GetBoolVar(b.name)
+			*b.field = v != b.invert
+			cmd.bound[b.name] = v
+		}
+
+		return
+	}
+
+	for _, b := range cmd.controlVars() {
+		v := *b.field != b.invert
+		cmd.SetVar(b.name, v)
+		cmd.bound[b.name] = v
+	}
+
+	cmd.SetVar("outputformat", "text")
+	cmd.SetVar("cwd", cmd.Dir())
+}
+
+// controlVar binds a Cmd field to a control variable
+type controlVar struct {
+	name   string
+	field  *bool
+	invert bool // the variable is the opposite of the field
+}
+
+func (cmd *Cmd) controlVars() []controlVar {
+	return []controlVar{
+		{name: "echo", field: &cmd.Echo},
+		{name: "trace", field: &cmd.Trace},
+		{name: "print", field: &cmd.Silent, invert: true},
+		{name: "timing", field: &cmd.Timing},
+		{name: "dryrun", field: &cmd.DryRun},
+		{name: "errexit", field: &cmd.ErrExit},
+	}
+}
+
+// syncControlVars keeps the Echo, Silent and Timing fields in sync with the echo, print and timing variables.
+//
+// If a field was changed since the last sync the variable is updated (calling OnChange),
+// otherwise the field is updated from the variable (that may have been changed via set/var).
+func (cmd *Cmd) syncControlVars() {
+	if cmd.bound == nil { // not initialized
+		return
+	}
+
+	cmd.syncLock.Lock()
+	defer cmd.syncLock.Unlock()
+
+	for _, b := range cmd.controlVars() {
+		if v := *b.field != b.invert; v != cmd.bound[b.name] {
+			cmd.changeVar(b.name, v, internal.GlobalScope)
+		}
+
+		v := cmd.GetBoolVar(b.name)
+		if f := v != b.invert; *b.field != f { // only write on changes, since other goroutines may read the field
+			*b.field = f
+		}
+		cmd.bound[b.name] = v
+	}
+}
+
+// NewSession creates a new interpreter session with the same configuration, plugins, commands and completers
+// of cmd, but with its own variables, prompt, history, interrupted flag and input/output streams,
+// so that multiple sessions can run concurrently (i.e. in a server).
+//
+// The plugins are initialized for the new session, and then OnSession is called, so the commands
+// they add act on the session. The other commands and completers added to cmd after Init are shared
+// with the new session, so if they refer to cmd (i.e. to set variables or print) they act on the original session:
+// the commands that refer to the interpreter should be added by a plugin or by OnSession.
+func (cmd *Cmd) NewSession(input io.Reader, output io.Writer) *Cmd {
+	s := &Cmd{}
+	copyConfig(s, cmd.config)
+	s.Input, s.Output = input, output
+	s.Init(cmd.plugins...)
+
+	if s.OnSession = cmd.OnSession; s.OnSession != nil {
+		s.OnSession(s)
+	}
+
+	cmd.registry.RLock()
+	commands, completers := make(map[string]Command, len(cmd.Commands)), cmd.completers
+	for name, c := range cmd.Commands {
+		commands[name] = c
+	}
+	cmd.registry.RUnlock()
+
+	for name, c := range commands {
+		if _, ok := s.GetCommand(name); !ok {
+			s.Add(c)
+		}
+	}
+
+	for name, expansion := range cmd.Aliases() {
+		s.AddAlias(name, expansion)
+	}
+
+	for c := completers; c != nil; c = c.next {
+		if c.name == "" || c.name == "help" || c.name == "subcommands" || c.name == "flags" { // these are bound to the command list of each session
+			continue
+		}
+
+		if s.GetCompleter(c.name) == nil {
+			s.AddCompleter(c.name, c.completer)
+		}
+	}
+
+	return s
+}
+
+// fork creates the interpreter for a background job, that runs concurrently with cmd: it has the same configuration,
+// plugins, commands and aliases, it shares the global variables but it has a copy of the local ones
+// (see internal.Context.Fork), and its own block state, output capture and interrupted flag.
+// Its context is ctx, so that the commands of the job see when it's killed (see Context).
+func (cmd *Cmd) fork(ctx context.Context) *Cmd {
+	f := &Cmd{parent: cmd}
+	copyConfig(f, cmd.config)
+
+	cmd.RLock()
+	f.Input, f.Output, f.stderr = nil, cmd.Output, cmd.stderr
+	if cmd.redirect != nil { // the output set via the output command, but not the one captured by the running command
+		f.Output = cmd.redirect
+	}
+	f.dir, f.prevDir, f.dirs = cmd.dir, cmd.prevDir, append([]string(nil), cmd.dirs...)
+	cmd.RUnlock()
+
+	f.Init(cmd.plugins...)
+	f.running = ctx
+
+	if f.OnSession = cmd.OnSession; f.OnSession != nil {
+		f.OnSession(f)
+	}
+
+	cmd.registry.RLock()
+	commands := make(map[string]Command, len(cmd.Commands))
+	for name, c := range cmd.Commands {
+		commands[name] = c
+	}
+	cmd.registry.RUnlock()
+
+	for name, c := range commands {
+		if _, ok := f.GetCommand(name); !ok {
+			f.Add(c)
+		}
+	}
+
+	for name, expansion := range cmd.Aliases() {
+		f.AddAlias(name, expansion)
+	}
+
+	return f
+}
+
+// Parent returns the interpreter that started the background job executed by cmd (see the go command),
+// or nil if cmd doesn't execute a job. Plugins can use it to copy their state (i.e. the functions) to the job.
+func (cmd *Cmd) Parent() *Cmd {
+	return cmd.parent
 }
 
 func (cmd *Cmd) setInterrupted(interrupted bool) {
@@ -343,213 +822,850 @@ func (cmd *Cmd) Interrupted() (interrupted bool) {
 	return
 }
 
-// Plugin is the interface implemented by plugins
-type Plugin interface {
-	PluginInit(cmd *Cmd, ctx *internal.Context) error
+// Context returns the context of the command being executed by the command loop, that is cancelled
+// when the command is interrupted (Ctrl-C), so that a long running command can be aborted
+// (i.e. with http.NewRequestWithContext). For a job started by the go command it's the job context,
+// that is cancelled when the job is killed. Otherwise, outside of the command loop, it returns context.Background().
+func (cmd *Cmd) Context() context.Context {
+	cmd.RLock()
+	defer cmd.RUnlock()
+
+	if cmd.running == nil {
+		return context.Background()
+	}
+
+	return cmd.running
 }
 
-func (cmd *Cmd) SetPrompt(prompt string, max int) {
-	l := len(prompt)
+// Sleep waits for d, returning true (before d elapsed) if the running command is interrupted
+func (cmd *Cmd) Sleep(d time.Duration) (interrupted bool) {
+	t := time.NewTimer(d)
+	defer t.Stop()
 
-	if max > 3 && l > max {
-		max -= 3 // for "..."
-		prompt = "..." + prompt[l-max:]
+	select {
+	case <-t.C:
+		return cmd.Interrupted()
+	case <-cmd.Context().Done():
+		return true
 	}
-
-	cmd.Prompt = prompt
 }
 
-// Update function completer (when function list changes)
-func (cmd *Cmd) updateCompleters() {
-	if c := cmd.GetCompleter(""); c == nil { // default completer
-		cmd.commandNames = make([]string, 0, len(cmd.Commands))
-		for name := range cmd.Commands {
-			cmd.commandNames = append(cmd.commandNames, name)
-		}
-		sort.Strings(cmd.commandNames) // for help listing
+// startCommand creates the context of a command executed by the command loop
+func (cmd *Cmd) startCommand() {
+	ctx, cancel := context.WithCancel(context.Background())
 
-		cmd.AddCompleter("", NewWordCompleter(func() []string {
-			return cmd.commandNames
-		}, func(s, l string) bool {
-			return s == l // check if we are at the beginning of the line
-		}))
+	cmd.Lock()
+	cmd.interrupted = false
+	cmd.running, cmd.cancel = ctx, cancel
+	cmd.Unlock()
+}
 
-		cmd.AddCompleter("help", NewWordCompleter(func() []string {
-			return cmd.commandNames
-		}, func(s, l string) bool {
-			return strings.HasPrefix(l, "help ")
-		}))
+// endCommand cancels the context of the command executed by the command loop, when it returns
+func (cmd *Cmd) endCommand() {
+	cmd.Lock()
+	cancel := cmd.cancel
+	cmd.running, cmd.cancel = nil, nil
+	cmd.Unlock()
+
+	if cancel != nil {
+		cancel()
 	}
 }
 
-func (cmd *Cmd) wordCompleter(line string, pos int) (head string, completions []string, tail string) {
-	start := strings.LastIndex(line[:pos], " ")
+// interruptCommand interrupts the command running in the command loop, cancelling its context.
+// It returns false if no command is running.
+func (cmd *Cmd) interruptCommand() bool {
+	cmd.Lock()
+	cancel := cmd.cancel
+	if cancel != nil {
+		cmd.interrupted = true
+	}
+	cmd.Unlock()
 
-	for c := cmd.completers; c != nil; c = c.next {
-		if completions = c.completer.Complete(line[start+1:], line); completions != nil {
-			return line[:start+1], completions, line[pos:]
-		}
+	if cancel == nil {
+		return false
 	}
 
-	if cmd.Complete != nil {
-		return line[:start+1], cmd.Complete(line[start+1:], line), line[pos:]
+	cancel()
+	return true
+}
+
+// setFailure records a command failure (only the first one is kept), or resets it if err is nil
+func (cmd *Cmd) setFailure(err error) {
+	cmd.Lock()
+	if err == nil || cmd.failure == nil {
+		cmd.failure = err
+	}
+	if err != nil {
+		cmd.failures++
+		cmd.lastFailure = err
 	}
+	cmd.Unlock()
+}
 
+func (cmd *Cmd) getFailure() (err error) {
+	cmd.RLock()
+	err = cmd.failure
+	cmd.RUnlock()
 	return
 }
 
-func (cmd *Cmd) AddCompleter(name string, c Completer) {
-	lc := &linkedCompleter{name: name, completer: c, next: cmd.completers}
-	cmd.completers = lc
+// Failed returns true if any command failed since the start of the current script (see RunScript)
+func (cmd *Cmd) Failed() bool {
+	return cmd.getFailure() != nil
 }
 
-func (cmd *Cmd) GetCompleter(name string) Completer {
-	for c := cmd.completers; c != nil; c = c.next {
-		if c.name == name {
-			return c.completer
-		}
-	}
+// Failures returns the number of commands that failed, so that a command executing other commands
+// (i.e. a script) can check if one of them failed
+func (cmd *Cmd) Failures() int {
+	cmd.RLock()
+	defer cmd.RUnlock()
+	return cmd.failures
+}
 
-	return nil
+// SetStatus sets the exit status of the command being executed.
+// If not set, the status is 1 if the command failed (i.e. it set the "error" variable) and 0 otherwise.
+//
+// After each command the status is available as $? or $status (and via Status).
+// A non-zero status doesn't mark the command as failed.
+func (cmd *Cmd) SetStatus(n int) {
+	cmd.Lock()
+	cmd.status, cmd.statusSet = n, true
+	cmd.Unlock()
 }
 
-// execute shell command
-func shellExec(command string) {
-	args := args.GetArgs(command)
-	if len(args) < 1 {
-		fmt.Println("No command to exec")
-	} else {
-		if strings.ContainsAny(command, "$*~") {
-			if _, err := exec.LookPath("sh"); err == nil {
-				args = []string{"sh", "-c", command}
-			}
-		}
-		cmd := exec.Command(args[0])
-		cmd.Args = args
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+// Status returns the exit status of the last command
+func (cmd *Cmd) Status() int {
+	cmd.RLock()
+	defer cmd.RUnlock()
+	return cmd.status
+}
+
+// startStatus resets the status before executing a command, returning the current failure count
+func (cmd *Cmd) startStatus() (failures int) {
+	cmd.Lock()
+	cmd.statusSet = false
+	failures = cmd.failures
+	cmd.Unlock()
+	return
+}
 
-		if err := cmd.Run(); err != nil {
-			fmt.Println(err)
+// endStatus sets the status of the command just executed and the "status" variable.
+// The status is left set, so that a command executing a block (i.e. a function) gets the status
+// of the last command in the block, unless it sets its own.
+func (cmd *Cmd) endStatus(failures int) {
+	cmd.Lock()
+	if !cmd.statusSet {
+		cmd.status = 0
+		if cmd.failures != failures {
+			cmd.status = 1
 		}
 	}
+	cmd.statusSet = true
+	status := cmd.status
+	cmd.Unlock()
+
+	// not via SetVar, to avoid calling OnChange after every command
+	cmd.context.SetVar("status", status, internal.LocalScope)
 }
 
-// execute shell command and pipe input and/or output
-func pipeExec(command string) *os.File {
-	args := args.GetArgs(command)
-	if len(args) < 1 {
-		fmt.Println("No command to exec")
-	} else {
-		if strings.ContainsAny(command, "$*~") {
-			if _, err := exec.LookPath("sh"); err == nil {
-				args = []string{"sh", "-c", command}
-			}
-		}
-		cmd := exec.Command(args[0])
-		cmd.Args = args
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+// SetStdout sets the writer for the command output (the same as setting Output)
+func (cmd *Cmd) SetStdout(w io.Writer) {
+	cmd.Lock()
+	cmd.Output = w
+	cmd.Unlock()
+}
 
-		pr, pw, err := os.Pipe()
-		if err != nil {
-			fmt.Println("cannot create pipe:", err)
-			return nil
-		}
+// SetStderr sets the writer for the error messages
+func (cmd *Cmd) SetStderr(w io.Writer) {
+	cmd.Lock()
+	cmd.stderr = w
+	cmd.Unlock()
+}
 
-		cmd.Stdin = pr
+// Stdout returns the writer for the command output: the output set via the output command, if any,
+// or Output (default is os.Stdout)
+func (cmd *Cmd) Stdout() io.Writer {
+	cmd.RLock()
+	defer cmd.RUnlock()
 
-		go func() {
-			if err := cmd.Run(); err != nil {
-				fmt.Println(err)
-			}
-		}()
+	if cmd.redirect != nil && cmd.capture == nil {
+		return cmd.redirect
+	}
 
-		return pw
+	return cmd.output()
+}
+
+// output returns the command output, ignoring the output command redirection
+func (cmd *Cmd) output() io.Writer {
+	if cmd.capture != nil {
+		return cmd.capture
+	}
+	if cmd.Output != nil {
+		return cmd.Output
 	}
 
-	return nil
+	return os.Stdout
 }
 
-// Add a command to the command interpreter.
-// Overrides a command with the same name, if there was one
-func (cmd *Cmd) Add(command Command) {
-	if command.HelpFunc == nil {
-		command.HelpFunc = command.DefaultHelp
+// Stderr returns the writer for the error messages (default is os.Stderr)
+func (cmd *Cmd) Stderr() io.Writer {
+	cmd.RLock()
+	defer cmd.RUnlock()
+
+	if cmd.stderr != nil {
+		return cmd.stderr
 	}
 
-	cmd.Commands[command.Name] = command
+	return os.Stderr
 }
 
-// Default help command.
-// It lists all available commands or it displays the help for the specified command
-func (cmd *Cmd) help(line string) (stop bool) {
-	fmt.Println("")
+// Print formats using the default formats and writes to the command output
+func (cmd *Cmd) Print(a ...interface{}) {
+	fmt.Fprint(cmd.Stdout(), a...)
+}
 
-	if line == "--all" {
-		fmt.Println("Available commands (use 'help <topic>'):")
-		fmt.Println("================================================================")
-		for _, c := range cmd.commandNames {
-			fmt.Printf("%v: ", c)
-			cmd.Commands[c].HelpFunc()
-		}
-	} else if len(line) == 0 {
-		fmt.Println("Available commands (use 'help <topic>'):")
-		fmt.Println("================================================================")
+// Println formats using the default formats and writes to the command output, followed by a newline
+func (cmd *Cmd) Println(a ...interface{}) {
+	fmt.Fprintln(cmd.Stdout(), a...)
+}
 
-		max := 0
+// Printf formats according to a format specifier and writes to the command output
+func (cmd *Cmd) Printf(format string, a ...interface{}) {
+	fmt.Fprintf(cmd.Stdout(), format, a...)
+}
 
-		for _, c := range cmd.commandNames {
-			if len(c) > max {
-				max = len(c)
-			}
+// TerminalSize returns the size (columns and rows) of the terminal the command output is written to,
+// or 80x24 if the output is not a terminal
+func (cmd *Cmd) TerminalSize() (width, height int) {
+	f, ok := cmd.Stdout().(*os.File)
+	if ok {
+		if width, height, ok = terminalSize(f); ok {
+			return
 		}
+	}
 
-		tp := pretty.NewTabPrinter(80 / (max + 1))
-		tp.TabWidth(max + 1)
+	return 80, 24
+}
 
-		for _, c := range cmd.commandNames {
-			tp.Print(c)
-		}
-		tp.Println()
-	} else if c, ok := cmd.Commands[line]; ok {
-		c.HelpFunc()
-	} else {
-		fmt.Println("unknown command or function")
+// isTerminal returns true if the reader is a terminal (character device)
+func isTerminal(r io.Reader) bool {
+	f, ok := r.(*os.File)
+	if !ok {
+		return false
 	}
 
-	fmt.Println("")
-	return
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
 }
 
-func (cmd *Cmd) command_echo(line string) (stop bool) {
-	if strings.HasPrefix(line, "-n ") {
-		fmt.Print(strings.TrimSpace(line[3:]))
-	} else {
-		fmt.Println(line)
+// input returns the input stream for the command loop
+func (cmd *Cmd) input() io.Reader {
+	if cmd.Input == nil {
+		return os.Stdin
 	}
-	return
+
+	return cmd.Input
 }
 
-func (cmd *Cmd) command_go(line string) (stop bool) {
-	if strings.HasPrefix(line, "-") {
-		// should be --start, --pool or --wait
+// interactive returns true if the command loop should use the line editor
+// (i.e. not when the input is a file or a pipe, as in `myapp < script.cmd` or `echo cmd | myapp`)
+func (cmd *Cmd) interactive() bool {
+	return cmd.input() == os.Stdin && isTerminal(os.Stdin)
+}
 
-		args := args.ParseArgs(line)
+// Plugin is the interface implemented by plugins.
+//
+// Plugins can also implement PluginCleaner, PluginConfigurer, PluginNamer and PluginDependent
+// to take part in the plugin lifecycle.
+type Plugin interface {
+	PluginInit(cmd *Cmd, ctx *internal.Context) error
+}
 
-		if v, ok := args.Options["start"]; ok {
-			max := -1
+// SetLineReader sets the function that creates the interactive line editor, to replace the default one
+// (based on github.com/peterh/liner). It's a function since the line editor is closed and created again
+// when the process is suspended (Ctrl-Z) and resumed. It should be called after Init and before CmdLoop.
+func (cmd *Cmd) SetLineReader(newReader func() LineReader) {
+	cmd.context.SetLineReader(newReader)
+}
 
-			if v != "" {
-				max, _ = strconv.Atoi(v)
-			}
+// KeyHandler is called when a bound key is pressed while editing a line (see BindKey).
+// It receives the line and the cursor position and returns the new line and cursor position.
+type KeyHandler = internal.KeyHandler
 
-			if len(args.Arguments) > 0 {
-				max, _ = strconv.Atoi(args.Arguments[0])
-			}
+// BindKey binds a key (ctrl-a to ctrl-z, alt-a to alt-z or f1 to f12) to a handler, that can change
+// the line being edited (i.e. insert a snippet) or do something else (i.e. run a command)
+// and return the line unchanged. A nil handler removes the binding.
+//
+// The bindings are used by line readers that implement KeyBinder (see SetLineReader, that should be called first):
+// the default line reader, based on github.com/peterh/liner, has no API for custom keys, so BindKey returns
+// ErrKeyBindings with it.
+func (cmd *Cmd) BindKey(key string, f KeyHandler) error {
+	return cmd.context.BindKey(key, f)
+}
 
-			fmt.Println("start with", max, "workers")
-			cmd.runner = GroupRunner(max)
+// KeyBinder is implemented by the line readers that support key bindings (see BindKey)
+type KeyBinder = internal.KeyBinder
+
+// ReadPassword reads a line from the terminal without echoing it (i.e. to ask for a password).
+// In a script, it reads the next line.
+func (cmd *Cmd) ReadPassword(prompt string) (string, error) {
+	return cmd.context.ReadPassword(prompt)
+}
+
+// ReadInput reads a line entered by the user, from the terminal even when executing a script or a function
+// (when the command loop is not interactive, it reads the next input line). If silent the line is not echoed.
+func (cmd *Cmd) ReadInput(prompt string, silent bool) (string, error) {
+	return cmd.context.ReadInput(prompt, silent)
+}
+
+// SetPrompt sets the prompt template (see ExpandPrompt).
+// If max > 3, the expanded prompt is shortened to max characters, replacing the beginning with "...".
+func (cmd *Cmd) SetPrompt(prompt string, max int) {
+	cmd.Prompt = prompt
+	cmd.promptMax = max
+}
+
+// CommandNames returns the sorted list of registered commands
+func (cmd *Cmd) CommandNames() []string {
+	cmd.registry.RLock()
+	names := make([]string, 0, len(cmd.Commands))
+	for name := range cmd.Commands {
+		names = append(names, name)
+	}
+	cmd.registry.RUnlock()
+
+	sort.Strings(names)
+	return names
+}
+
+// VisibleCommandNames returns the sorted list of commands, excluding the hidden and deprecated ones
+func (cmd *Cmd) VisibleCommandNames() []string {
+	cmd.registry.RLock()
+	defer cmd.registry.RUnlock()
+
+	return listedNames(cmd.Commands)
+}
+
+// Update function completer (when function list changes)
+func (cmd *Cmd) updateCompleters() {
+	if c := cmd.GetCompleter(""); c == nil { // default completer
+		cmd.AddCompleter("", NewWordCompleter(cmd.commandAndAliasNames, func(s, l string) bool {
+			return s == l // check if we are at the beginning of the line
+		}))
+
+		cmd.AddCompleter("help", NewWordCompleter(cmd.commandAndAliasNames, func(s, l string) bool {
+			return strings.HasPrefix(l, "help ")
+		}))
+
+		cmd.AddCompleter("arguments", &argumentCompleter{cmd: cmd})
+		cmd.AddCompleter("subcommands", &subcommandCompleter{cmd: cmd})
+		cmd.AddCompleter("flags", &flagCompleter{cmd: cmd})
+	}
+}
+
+func (cmd *Cmd) wordCompleter(line string, pos int) (head string, completions []string, tail string) {
+	start := strings.LastIndex(line[:pos], " ")
+
+	cmd.registry.RLock()
+	completers := cmd.completers // the list nodes are never modified, only replaced
+	cmd.registry.RUnlock()
+
+	for c := completers; c != nil; c = c.next {
+		if completions = c.completer.Complete(line[start+1:], line); completions != nil {
+			return line[:start+1], completions, line[pos:]
+		}
+	}
+
+	if cmd.Complete != nil {
+		return line[:start+1], cmd.Complete(line[start+1:], line), line[pos:]
+	}
+
+	return
+}
+
+func (cmd *Cmd) AddCompleter(name string, c Completer) {
+	cmd.registry.Lock()
+	lc := &linkedCompleter{name: name, completer: c, next: cmd.completers}
+	cmd.completers = lc
+	cmd.registry.Unlock()
+}
+
+func (cmd *Cmd) GetCompleter(name string) Completer {
+	cmd.registry.RLock()
+	defer cmd.registry.RUnlock()
+
+	for c := cmd.completers; c != nil; c = c.next {
+		if c.name == name {
+			return c.completer
+		}
+	}
+
+	return nil
+}
+
+// shellCommand returns the command to execute a shell escape with the configured shell (see Shell).
+// It returns nil if there is no command to execute.
+func (cmd *Cmd) shellCommand(command string) *exec.Cmd {
+	if len(cmd.Shell) == 0 {
+		return shellCommand(command)
+	}
+
+	if strings.TrimSpace(command) == "" {
+		return nil
+	}
+
+	return exec.Command(cmd.Shell[0], append(cmd.Shell[1:len(cmd.Shell):len(cmd.Shell)], command)...)
+}
+
+// execute shell command, writing its output to stdout and reading its input from a file or a string,
+// if redirected (see shellInput). A failure is recorded, so that it's reflected in the command status.
+func (cmd *Cmd) shellExec(command string, stdout io.Writer) {
+	command, file, text, redirected := shellInput(command)
+
+	if sh := cmd.shellCommand(command); sh == nil {
+		cmd.Println("No command to exec")
+	} else {
+		sh.Dir = cmd.Dir()
+		sh.Env = cmd.environ()
+		sh.Stdout = stdout
+		sh.Stderr = cmd.Stderr()
+
+		if file != "" {
+			f, err := os.Open(cmd.Path(file))
+			if err != nil {
+				cmd.setFailure(err)
+				cmd.Println(err)
+				return
+			}
+
+			defer f.Close()
+			sh.Stdin = f
+		} else if redirected {
+			sh.Stdin = strings.NewReader(text)
+		}
+
+		if err := sh.Run(); err != nil {
+			cmd.setFailure(err)
+			cmd.Println(err)
+		}
+	}
+}
+
+// execute shell command and pipe input and/or output
+// (the shell command output goes to the command output, ignoring any redirection)
+func (cmd *Cmd) pipeExec(command string) io.WriteCloser {
+	if sh := cmd.shellCommand(command); sh == nil {
+		cmd.Println("No command to exec")
+	} else {
+		sh.Dir = cmd.Dir()
+		sh.Env = cmd.environ()
+		cmd.RLock()
+		sh.Stdout = cmd.output()
+		cmd.RUnlock()
+		sh.Stderr = cmd.Stderr()
+
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			cmd.Println("cannot create pipe:", err)
+			return nil
+		}
+
+		sh.Stdin = pr
+
+		go func() {
+			if err := sh.Run(); err != nil {
+				fmt.Fprintln(sh.Stderr, err)
+			}
+		}()
+
+		return pw
+	}
+
+	return nil
+}
+
+// Add a command to the command interpreter.
+// Overrides a command with the same name, if there was one
+func (cmd *Cmd) Add(command Command) {
+	cmd.setHelpFunc(&command, []string{command.Name})
+
+	cmd.registry.Lock()
+	cmd.Commands[command.Name] = command
+	cmd.registry.Unlock()
+}
+
+// GetCommand returns the command with the specified name
+func (cmd *Cmd) GetCommand(name string) (command Command, ok bool) {
+	cmd.registry.RLock()
+	command, ok = cmd.Commands[name]
+	cmd.registry.RUnlock()
+	return
+}
+
+// RemoveCommand removes a command from the command interpreter, together with the completer with the same name
+// (see AddCompleter), so that the command is not completed anymore.
+// It returns false if there was no command with the specified name.
+// It's safe to call while other commands are running.
+func (cmd *Cmd) RemoveCommand(name string) bool {
+	cmd.registry.Lock()
+	defer cmd.registry.Unlock()
+
+	return cmd.removeCommand(name)
+}
+
+// ReplaceCommand replaces an existing command (with the same name) and returns true,
+// or returns false if there was no command to replace.
+// It's safe to call while other commands are running.
+func (cmd *Cmd) ReplaceCommand(command Command) bool {
+	cmd.setHelpFunc(&command, []string{command.Name})
+
+	cmd.registry.Lock()
+	defer cmd.registry.Unlock()
+
+	if _, ok := cmd.Commands[command.Name]; !ok {
+		return false
+	}
+
+	cmd.Commands[command.Name] = command
+	return true
+}
+
+// UpdateCommands removes and adds commands in one step, so that a command running concurrently
+// (or the completion) never sees a partial update, i.e.:
+//
+//	commander.UpdateCommands([]string{"connect"}, disconnectCommand, queryCommand)
+//
+// The removed commands are removed together with their completers, as in RemoveCommand.
+func (cmd *Cmd) UpdateCommands(remove []string, add ...Command) {
+	for i := range add {
+		cmd.setHelpFunc(&add[i], []string{add[i].Name})
+	}
+
+	cmd.registry.Lock()
+	defer cmd.registry.Unlock()
+
+	for _, name := range remove {
+		cmd.removeCommand(name)
+	}
+
+	for _, command := range add {
+		cmd.Commands[command.Name] = command
+	}
+}
+
+// removeCommand removes a command and its completer (the registry should be locked)
+func (cmd *Cmd) removeCommand(name string) bool {
+	if _, ok := cmd.Commands[name]; !ok {
+		return false
+	}
+
+	delete(cmd.Commands, name)
+
+	found := false
+	for c := cmd.completers; c != nil && !found; c = c.next {
+		found = c.name == name
+	}
+	if !found {
+		return true
+	}
+
+	var head, tail *linkedCompleter
+
+	for c := cmd.completers; c != nil; c = c.next {
+		if c.name == name {
+			continue
+		}
+
+		lc := &linkedCompleter{name: c.name, completer: c.completer}
+		if tail == nil {
+			head = lc
+		} else {
+			tail.next = lc
+		}
+		tail = lc
+	}
+
+	cmd.completers = head
+	return true
+}
+
+// Default help command.
+// It lists all available commands or it displays the help for the specified command
+func (cmd *Cmd) help(line string) (stop bool) {
+	if format, ok := strings.CutPrefix(line, "--export"); ok {
+		format = strings.TrimSpace(format)
+		if format == "" {
+			format = "markdown"
+		}
+
+		if err := cmd.GenerateDocs(cmd.Stdout(), format); err != nil {
+			cmd.setFailure(err)
+			cmd.Println(err)
+		}
+
+		return
+	}
+
+	if cmd.JSONOutput() {
+		if line == "" || line == "--all" {
+			var list []map[string]string
+
+			for _, name := range cmd.VisibleCommandNames() {
+				c, _ := cmd.GetCommand(name)
+				list = append(list, map[string]string{"name": name, "help": strings.TrimSpace(c.Help)})
+			}
+
+			for _, name := range cmd.AliasNames() {
+				expansion, _ := cmd.GetAlias(name)
+				list = append(list, map[string]string{"name": name, "alias": expansion})
+			}
+
+			cmd.PrintJSON(list)
+		} else if c, ok := cmd.LookupCommand(line); ok {
+			h := map[string]string{"name": line, "help": strings.TrimSpace(c.Help)}
+			if c.Subcommands != nil {
+				cmd.registry.RLock()
+				h["subcommands"] = strings.Join(listedNames(c.Subcommands), " ")
+				cmd.registry.RUnlock()
+			}
+			if c.Deprecated != "" {
+				h["deprecated"] = c.Deprecated
+			}
+			cmd.PrintJSON(h)
+		} else if expansion, ok := cmd.GetAlias(line); ok {
+			cmd.PrintJSON(map[string]string{"name": line, "alias": expansion})
+		} else {
+			cmd.PrintJSON(map[string]string{"error": "unknown command or function"})
+		}
+
+		return
+	}
+
+	cmd.Println("")
+
+	if line == "--all" {
+		cmd.WithPager(func() {
+			cmd.Println("Available commands (use 'help <topic>'):")
+			cmd.Println("================================================================")
+			for _, c := range cmd.VisibleCommandNames() {
+				cmd.Printf("%v: ", c)
+				if c, ok := cmd.GetCommand(c); ok {
+					c.HelpFunc()
+				}
+			}
+		})
+	} else if len(line) == 0 {
+		cmd.WithPager(func() {
+			cmd.Println("Available commands (use 'help <topic>'):")
+			cmd.Println("================================================================")
+			width, _ := cmd.TerminalSize()
+			PrintColumns(cmd.Stdout(), cmd.VisibleCommandNames(), width)
+
+			if aliases := cmd.AliasNames(); len(aliases) > 0 {
+				cmd.Println("")
+				cmd.Println("Aliases:")
+				cmd.Println("================================================================")
+				PrintColumns(cmd.Stdout(), aliases, width)
+			}
+		})
+	} else if c, ok := cmd.LookupCommand(line); ok {
+		c.HelpFunc()
+	} else if expansion, ok := cmd.GetAlias(line); ok {
+		cmd.Printf("%v is an alias for %q\n", line, expansion)
+	} else {
+		cmd.Println("unknown command or function")
+	}
+
+	cmd.Println("")
+	return
+}
+
+// PrintColumns prints a list of words in tab-aligned columns, fitting the specified width
+func PrintColumns(w io.Writer, words []string, width int) {
+	max := 0
+
+	for _, word := range words {
+		if len(word) > max {
+			max = len(word)
+		}
+	}
+
+	cols := width / (max + 1)
+	if cols < 1 {
+		cols = 1
+	}
+
+	tw := tabwriter.NewWriter(w, max+1, 0, 1, ' ', 0)
+
+	for i, word := range words {
+		if i > 0 {
+			if i%cols == 0 {
+				fmt.Fprintln(tw)
+			} else {
+				fmt.Fprint(tw, "\t")
+			}
+		}
+
+		fmt.Fprint(tw, word)
+	}
+
+	if len(words) > 0 {
+		fmt.Fprintln(tw)
+	}
+
+	tw.Flush()
+}
+
+// echoEscapes are the escape sequences interpreted by "echo -e"
+var echoEscapes = strings.NewReplacer(append([]string{`\\`, `\`}, escapeSequences...)...)
+
+// formatEscapes are the escape sequences interpreted by "echo -f", before the arguments are parsed
+// (that takes care of \\ and \")
+var formatEscapes = strings.NewReplacer(append([]string{`\\`, `\\`, `\"`, `\"`}, escapeSequences...)...)
+
+var escapeSequences = []string{
+	`\n`, "\n",
+	`\t`, "\t",
+	`\r`, "\r",
+	`\a`, "\a",
+	`\e`, "\033",
+	`\033`, "\033",
+	`\x1b`, "\033",
+}
+
+// formatArgs converts the arguments for the printf-style format, according to the verbs
+// (i.e. %d expects an int and %f a float), so that "echo -f '%5.2f' 1" works as expected
+func formatArgs(format string, args []string) []interface{} {
+	values := make([]interface{}, len(args))
+	for i, a := range args {
+		values[i] = a
+	}
+
+	n := 0
+
+	for i := 0; i < len(format) && n < len(values); i++ {
+		if format[i] != '%' {
+			continue
+		}
+
+		// skip flags, width and precision
+		for i++; i < len(format) && strings.IndexByte("+-# 0123456789.", format[i]) >= 0; i++ {
+		}
+		if i >= len(format) || format[i] == '%' {
+			continue
+		}
+
+		a := args[n]
+
+		switch format[i] {
+		case 'd', 'x', 'X', 'o', 'b', 'c':
+			if v, err := strconv.ParseInt(a, 0, 64); err == nil {
+				values[n] = v
+			}
+
+		case 'e', 'E', 'f', 'F', 'g', 'G':
+			if v, err := strconv.ParseFloat(a, 64); err == nil {
+				values[n] = v
+			}
+
+		case 't':
+			if v, err := strconv.ParseBool(a); err == nil {
+				values[n] = v
+			}
+		}
+
+		n++
+	}
+
+	return values
+}
+
+// echo [-n] [-e] [-2] [-f format] args...
+//
+//	-n: don't print the final newline
+//	-e: interpret escape sequences (\n, \t, \r, \a, \\ and \e or \033 for ANSI colors)
+//	-2: print to stderr
+//	-f: print the arguments according to a printf-style format, interpreting escape sequences (no newline is added)
+func (cmd *Cmd) command_echo(line string) (stop bool) {
+	newline, escapes, format := true, false, false
+	w := cmd.Stdout()
+
+	for strings.HasPrefix(line, "-") {
+		opt, rest, _ := strings.Cut(line, " ")
+		if strings.Trim(opt[1:], "ne2f") != "" || opt == "-" { // not an option
+			break
+		}
+
+		for _, c := range opt[1:] {
+			switch c {
+			case 'n':
+				newline = false
+			case 'e':
+				escapes = true
+			case '2':
+				w = cmd.Stderr()
+			case 'f':
+				format = true
+			}
+		}
+
+		line = strings.TrimSpace(rest)
+	}
+
+	if format {
+		args := args.GetArgs(formatEscapes.Replace(line))
+		if len(args) == 0 {
+			cmd.Println("usage: echo -f format args...")
+			return
+		}
+
+		fmt.Fprintf(w, args[0], formatArgs(args[0], args[1:])...)
+		return
+	}
+
+	if escapes {
+		line = echoEscapes.Replace(line)
+	}
+
+	if newline {
+		fmt.Fprintln(w, line)
+	} else {
+		fmt.Fprint(w, line)
+	}
+
+	return
+}
+
+// setRunner sets the runner for the go command and returns the previous one
+func (cmd *Cmd) setRunner(runner GoRunner) (prev GoRunner) {
+	owner := cmd.jobOwner()
+
+	owner.Lock()
+	prev, owner.runner = owner.runner, runner
+	owner.Unlock()
+	return
+}
+
+func (cmd *Cmd) command_go(line string) (stop bool) {
+	if strings.HasPrefix(line, "-") {
+		// should be --start, --pool or --wait
+
+		args := args.ParseArgs(line)
+
+		if v, ok := args.Options["start"]; ok {
+			max := -1
+
+			if v != "" {
+				max, _ = strconv.Atoi(v)
+			}
+
+			if len(args.Arguments) > 0 {
+				max, _ = strconv.Atoi(args.Arguments[0])
+			}
+
+			cmd.Println("start with", max, "workers")
+			cmd.setRunner(GroupRunner(max))
 		} else if v, ok := args.Options["pool"]; ok {
 			pmax := 1
 			pcap := 10
@@ -568,31 +1684,30 @@ func (cmd *Cmd) command_go(line string) (stop bool) {
 				pcap = pmax
 			}
 
-			fmt.Println("pool with", pmax, "workers", pcap, "capacity")
-			cmd.runner = PoolRunner(pmax, pcap)
+			cmd.Println("pool with", pmax, "workers", pcap, "capacity")
+			cmd.setRunner(PoolRunner(pmax, pcap))
 		} else if _, ok := args.Options["wait"]; ok {
-			if cmd.runner == nil {
-				fmt.Println("nothing to wait on")
+			if runner := cmd.setRunner(nil); runner == nil {
+				cmd.Println("nothing to wait on")
 			} else {
-				cmd.runner.Wait()
-				cmd.runner = nil
+				runner.Wait()
 			}
 		} else {
-			fmt.Println("invalid option")
+			cmd.Println("invalid option")
 		}
 
 		return
 	}
 
 	if strings.HasPrefix(line, "go ") {
-		fmt.Println("Don't go go me!")
-	} else if cmd.runner == nil {
-		go cmd.OneCmd(line)
+		cmd.Println("Don't go go me!")
 	} else {
-		cmd.runner.Run(func() {
-			fmt.Println("RUN", line)
-			cmd.OneCmd(line)
-		})
+		job := cmd.startJob(line)
+		cmd.SetVar("job", job.ID)
+
+		if !cmd.SilentResult() {
+			fmt.Fprintf(cmd.Stderr(), "[%v] %v\n", job.ID, line)
+		}
 	}
 
 	return
@@ -601,131 +1716,604 @@ func (cmd *Cmd) command_go(line string) (stop bool) {
 func (cmd *Cmd) command_time(line string) (stop bool) {
 	if line == "-m" || line == "--milli" || line == "--millis" {
 		t := time.Now().UnixNano() / int64(time.Millisecond)
-		if !cmd.SilentResult() {
-			fmt.Println(t)
+		if cmd.SilentResult() {
+			// no output
+		} else if cmd.JSONOutput() {
+			cmd.PrintJSON(map[string]interface{}{"time": t})
+		} else {
+			cmd.Println(t)
 		}
 
 		cmd.SetVar("time", t)
 	} else if line == "" {
 		t := time.Now().Format(time.RFC3339)
-		if !cmd.SilentResult() {
-			fmt.Println(t)
+		if cmd.SilentResult() {
+			// no output
+		} else if cmd.JSONOutput() {
+			cmd.PrintJSON(map[string]interface{}{"time": t})
+		} else {
+			cmd.Println(t)
 		}
 
 		cmd.SetVar("time", t)
 	} else {
 		if t, err := time.Parse(time.RFC3339, line); err != nil {
-			fmt.Println("invalid start time")
+			if cmd.JSONOutput() {
+				cmd.PrintJSON(map[string]interface{}{"error": "invalid start time"})
+			} else {
+				cmd.Println("invalid start time")
+			}
 		} else {
 			d := time.Since(t).Round(time.Millisecond)
-			if !cmd.SilentResult() {
-				fmt.Println(d)
+			if cmd.SilentResult() {
+				// no output
+			} else if cmd.JSONOutput() {
+				cmd.PrintJSON(map[string]interface{}{"elapsed": d.Seconds()})
+			} else {
+				cmd.Println(d)
 			}
 			cmd.SetVar("elapsed", d.Seconds())
 		}
 	}
 
-	return
+	return
+}
+
+// setRedirect replaces the output set via the output command (nil restores the command output),
+// closing the previous one
+func (cmd *Cmd) setRedirect(w io.WriteCloser, name string) {
+	cmd.Lock()
+	prev := cmd.redirect
+	cmd.redirect, cmd.redirected = w, name
+	cmd.Unlock()
+
+	if prev != nil {
+		prev.Close()
+	}
+}
+
+func (cmd *Cmd) command_output(line string) (stop bool) {
+	if line != "" {
+		if line == "--" { // default output
+			cmd.setRedirect(nil, "")
+		} else if strings.HasPrefix(line, "|") { // pipe
+			line = strings.TrimSpace(line[1:])
+
+			w := cmd.pipeExec(line)
+			if w == nil {
+				return
+			}
+
+			cmd.setRedirect(w, "| "+line)
+		} else {
+			f, err := os.Create(cmd.Path(line))
+			if err != nil {
+				fmt.Fprintln(cmd.Stderr(), err)
+				return
+			}
+
+			cmd.setRedirect(f, f.Name())
+		}
+	}
+
+	cmd.RLock()
+	name := cmd.redirected
+	if name == "" {
+		if f, ok := cmd.output().(*os.File); ok {
+			name = f.Name()
+		} else {
+			name = "(output writer)"
+		}
+	}
+	cmd.RUnlock()
+
+	fmt.Fprintln(cmd.Stderr(), "output:", name)
+	return
+}
+
+func (cmd *Cmd) command_shell(line string) (stop bool) {
+	if !cmd.EnableShell {
+		cmd.setFailure(errors.New("shell commands are disabled"))
+		cmd.Println("shell commands are disabled")
+		return
+	}
+
+	if rest, ok := strings.CutPrefix(line, "--capture"); ok {
+		name, command, _ := strings.Cut(strings.TrimSpace(strings.TrimPrefix(rest, "=")), " ")
+		if name == "" {
+			cmd.Println("usage: shell --capture var command")
+			return
+		}
+
+		var output strings.Builder
+
+		cmd.shellExec(strings.TrimSpace(command), &output)
+		cmd.SetVar(name, strings.TrimRight(output.String(), "\r\n"))
+		return
+	}
+
+	cmd.shellExec(line, cmd.Stdout())
+	return
+}
+
+func (cmd *Cmd) command_exit(line string) (stop bool) {
+	if !cmd.SilentResult() {
+		cmd.Println("goodbye!")
+	}
+	return true
+}
+
+func (cmd *Cmd) command_reload(line string) (stop bool) {
+	if cmd.OnReload == nil {
+		cmd.Println("nothing to reload")
+		return
+	}
+
+	cmd.OnReload()
+	return
+}
+
+// This method executes one command
+func (cmd *Cmd) oneCmd(line string) (stop bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			/*
+			   if !cmd.SilentResult() {
+			       cmd.Println("recovered:", r)
+			   }
+			*/
+
+			info := PanicInfo{Command: strings.SplitN(line, " ", 2)[0], Line: line, Value: r, Stack: debug.Stack(), Attempt: 1}
+			stop = cmd.recovered(nil, info) == RecoverAbort
+		}
+	}()
+
+	expanded := cmd.takeExpanded()
+	if !expanded {
+		var aliased bool
+
+		// an alias can expand to multiple commands, that are not expanded again
+		if line, aliased = cmd.ExpandAlias(line); aliased {
+			if commands := SplitCommands(line); len(commands) > 1 {
+				return cmd.RunCommands(commands, func(line string) bool {
+					return cmd.RunExpanded(line, cmd.OneCmd)
+				})
+			}
+		}
+	}
+
+	if cmd.GetBoolVar("timing") {
+		start := time.Now()
+		defer func() {
+			d := time.Since(start).Truncate(time.Millisecond)
+			cmd.SetVar("elapsed", d.Seconds())
+
+			if !cmd.SilentResult() {
+				cmd.Println("Elapsed:", d)
+			}
+		}()
+	}
+
+	if cmd.GetBoolVar("echo") {
+		cmd.Println(cmd.GetPrompt(false), line)
+	}
+
+	cmd.TraceLine(line)
+
+	if cmd.GetBoolVar("dryrun") && !cmd.dryRunSafe(line) {
+		cmd.Println("(dry-run)", line)
+		return
+	}
+
+	if cmd.EnableShell && strings.HasPrefix(line, "!") {
+		cmd.shellExec(line[1:], cmd.Stdout())
+		return
+	}
+
+	if stages := SplitPipeline(line); len(stages) > 1 && !expanded {
+		return cmd.runPipeline(stages)
+	}
+
+	cname, params, _ := strings.Cut(line, " ")
+	params = strings.TrimSpace(params)
+
+	if command, ok := cmd.GetCommand(cname); ok {
+		stop = cmd.dispatch(command, line, params)
+	} else {
+		cmd.setFailure(fmt.Errorf("invalid command: %v", cname))
+		cmd.Default(line)
+	}
+
+	return
+}
+
+// dryRunSafe returns true if the command line should be executed in dry-run mode:
+// Safe commands, and invalid commands so that they are reported
+func (cmd *Cmd) dryRunSafe(line string) bool {
+	if strings.HasPrefix(line, "!") || len(SplitPipeline(line)) > 1 {
+		return false
+	}
+
+	cname, _, _ := strings.Cut(line, " ")
+	command, ok := cmd.GetCommand(cname)
+	return !ok || command.Safe
+}
+
+// errorCall converts a function returning an error (Command.CallE) to a Command.Call,
+// recording the error and calling OnError
+func (cmd *Cmd) errorCall(name string, call func(string) (bool, error)) func(string) bool {
+	return func(line string) bool {
+		stop, err := call(line)
+		if err != nil {
+			cmd.setFailure(err)
+			cmd.SetVar("error", err)
+			stop = cmd.OnError(name, err) || stop
+		}
+
+		return stop
+	}
+}
+
+// callCommand calls the command, handling a panic according to the recovery policy
+func (cmd *Cmd) callCommand(command Command, line, params string) (stop bool) {
+	for attempt := 1; ; attempt++ {
+		stop, info := tryCall(command.Call, params)
+		if info == nil {
+			return stop
+		}
+
+		info.Command, info.Line, info.Attempt = command.Name, line, attempt
+
+		switch cmd.recovered(&command, *info) {
+		case RecoverRetry:
+			continue
+
+		case RecoverContinue:
+			return false
+
+		default:
+			return true
+		}
+	}
+}
+
+// tryCall calls the command function, returning the panic information if it panics
+func tryCall(call func(string) bool, params string) (stop bool, info *PanicInfo) {
+	defer func() {
+		if r := recover(); r != nil {
+			info = &PanicInfo{Value: r, Stack: debug.Stack()}
+		}
+	}()
+
+	return call(params), nil
+}
+
+// recovered asks the command (or the application) what to do after a panic
+// and, unless the command is retried, records the panic as a failure and in the "error" variable.
+// Without an OnPanic hook, the stack trace is printed.
+//
+// If command is nil the panic didn't happen in a command call, and it can't be retried.
+func (cmd *Cmd) recovered(command *Command, info PanicInfo) (action RecoverAction) {
+	err := fmt.Errorf("panic: %v", info.Value)
+
+	switch {
+	case command != nil && command.OnPanic != nil:
+		action = command.OnPanic(info)
+
+	case cmd.OnPanic != nil:
+		action = cmd.OnPanic(info)
+
+	default:
+		fmt.Fprintf(cmd.Stderr(), "%v [%v]\n%s", err, info.Command, info.Stack)
+		cmd.setFailure(err)
+		cmd.SetVar("error", err)
+
+		switch {
+		case cmd.OnRecover != nil:
+			if !cmd.OnRecover(info.Value) {
+				return RecoverAbort
+			}
+
+		case cmd.Recover(info.Value):
+			return RecoverAbort
+		}
+
+		return RecoverContinue
+	}
+
+	if action == RecoverRetry && command == nil {
+		action = RecoverContinue
+	}
+
+	if action != RecoverRetry {
+		cmd.setFailure(err)
+		cmd.SetVar("error", err)
+	}
+
+	return
+}
+
+// runOne executes one command via the middleware chain and OneCmd, recording a failure if the command sets the "error" variable
+// and setting the command status. A line with multiple commands (see SplitCommands) executes them in order,
+// until one returns true. In a block or a script, a failure returns true if errexit is set.
+func (cmd *Cmd) runOne(line string) (stop bool) {
+	if commands := SplitCommands(line); len(commands) != 1 {
+		return cmd.RunCommands(commands, cmd.OneCmd)
+	}
+
+	return cmd.runHandler(line, cmd.OneCmd)
+}
+
+// RunCommands executes the commands (see SplitCommands) in order with run, as separate commands
+// (via the middleware chain, recording their failure and status), until one returns true or the execution is interrupted.
+//
+// OneCmd executes the commands of an alias expansion that contains ";", but a plugin that resolves the aliases
+// before calling the original OneCmd (see ExpandAlias) should split the expansion and run the commands with RunCommands.
+func (cmd *Cmd) RunCommands(commands []string, run func(string) bool) (stop bool) {
+	for _, c := range commands {
+		if stop = cmd.runHandler(c, run); stop || cmd.Interrupted() {
+			break
+		}
+	}
+
+	return
+}
+
+// runCommand executes a command line as is, via the middleware chain: the first word is the command name
+// and the rest are the parameters, without alias or variable expansion, pipelines or multiple commands
+// (i.e. for a command requested via HTTP).
+func (cmd *Cmd) runCommand(line string) (stop bool) {
+	return cmd.runHandler(line, func(line string) bool {
+		cname, params, _ := strings.Cut(line, " ")
+
+		command, ok := cmd.GetCommand(cname)
+		if !ok {
+			cmd.setFailure(fmt.Errorf("invalid command: %v", cname))
+			cmd.Default(line)
+			return false
+		}
+
+		return cmd.dispatch(command, line, strings.TrimSpace(params))
+	})
+}
+
+// runHandler executes one command line via the middleware chain and h, recording the failure and setting the status as runOne
+func (cmd *Cmd) runHandler(line string, h Handler) (stop bool) {
+	cmd.syncControlVars()
+	defer cmd.syncControlVars()
+
+	preverr, _ := cmd.GetVar("error")
+	failures := cmd.startStatus()
+
+	stop = cmd.handler(h)(line)
+
+	if curerr, _ := cmd.GetVar("error"); curerr != "" && curerr != preverr {
+		cmd.setFailure(errors.New(curerr))
+	}
+
+	cmd.endStatus(failures)
+	cmd.checkErrExit(failures, &stop)
+	return
+}
+
+// checkErrExit sets stop if the command failed in a block or a script and errexit is set, so that the blocks
+// and the script being executed are terminated, and resets it when the outermost block terminated
+// outside of a script (so that the interactive command loop continues)
+func (cmd *Cmd) checkErrExit(failures int, stop *bool) {
+	errexit := cmd.GetBoolVar("errexit")
+
+	cmd.Lock()
+	defer cmd.Unlock()
+
+	switch {
+	case cmd.blockDepth == 0 && cmd.scripts == 0:
+		if cmd.errExited {
+			*stop, cmd.errExited = false, false
+		}
+
+	case cmd.errExited:
+		*stop = true
+
+	case errexit && !*stop && cmd.failures != failures:
+		*stop, cmd.errExited = true, true
+	}
+}
+
+// startScript marks the start of a script (see RunScript), so that with errexit a failed command terminates it
+// as it terminates a block, and returns the function to call when the script terminates
+func (cmd *Cmd) startScript() (end func()) {
+	cmd.Lock()
+	cmd.scripts++
+	exited := cmd.errExited
+	cmd.Unlock()
+
+	return func() {
+		cmd.Lock()
+		cmd.scripts--
+		cmd.errExited = exited
+		cmd.Unlock()
+	}
+}
+
+// CaptureOutput executes one command line (as typed in the command loop, but without adding it to the history),
+// and returns its output, without the trailing newlines, instead of printing it.
+// Unlike Execute, it can be called by a running command (i.e. to expand a command substitution).
+func (cmd *Cmd) CaptureOutput(line string) (output string, stop bool) {
+	var b strings.Builder
+
+	cmd.streamOutput(func() {
+		stop = cmd.runOne(line)
+	}, func(p []byte) { b.Write(p) })
+
+	return strings.TrimRight(b.String(), "\r\n"), stop
+}
+
+// Result is the result of a command executed via Execute
+type Result struct {
+	Output   string            // the command output
+	Stop     bool              // the value returned by the command
+	Duration time.Duration     // the command execution time
+	Status   int               // the command status: 0 if the command succeeded, 1 if it failed (see also SetStatus)
+	Vars     map[string]string // the variables set or changed by the command
+}
+
+// streamWriter is a writer that calls send, until closed
+type streamWriter struct {
+	sync.Mutex
+	send   func([]byte)
+	closed bool
+}
+
+func (w *streamWriter) Write(b []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+
+	w.send(b)
+	return len(b), nil
+}
+
+func (w *streamWriter) Close() error {
+	w.Lock()
+	w.closed = true
+	w.Unlock()
+	return nil
 }
 
-func (cmd *Cmd) command_output(line string) (stop bool) {
-	if line != "" {
-		if line == "--" {
-			if cmd.stdout != nil && os.Stdout != cmd.stdout { // default stdout
-				os.Stdout.Close()
-				os.Stdout = cmd.stdout
-			}
-		} else if strings.HasPrefix(line, "|") { // pipe
-			line = strings.TrimSpace(line[1:])
+// streamOutput executes f with the command output captured by a writer that calls send with what is written to it
+// (this takes precedence over the output set via the output command)
+func (cmd *Cmd) streamOutput(f func(), send func([]byte)) {
+	w := &streamWriter{send: send}
 
-			w := pipeExec(line)
-			if w == nil {
-				return
-			}
+	cmd.Lock()
+	prev := cmd.capture // nested captures (i.e. pipelines) restore the previous one
+	cmd.capture = w
+	cmd.Unlock()
 
-			if cmd.stdout == nil {
-				cmd.stdout = os.Stdout
-			} else if cmd.stdout != os.Stdout {
-				os.Stdout.Close()
-			}
+	defer func() {
+		cmd.Lock()
+		cmd.capture = prev
+		cmd.Unlock()
 
-			os.Stdout = w
-		} else {
-			f, err := os.Create(line)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
-				return
-			}
+		w.Close()
+	}()
+
+	f()
+}
 
-			if cmd.stdout == nil {
-				cmd.stdout = os.Stdout
-			} else if cmd.stdout != os.Stdout {
-				os.Stdout.Close()
+// changedVars returns the variables that are different in after compared to before
+func changedVars(before, after arguments) (changed map[string]string) {
+	for k, v := range after {
+		if prev, ok := before[k]; !ok || prev != v {
+			if changed == nil {
+				changed = map[string]string{}
 			}
 
-			os.Stdout = f
+			changed[k] = v
 		}
 	}
 
-	fmt.Fprintln(os.Stderr, "output:", os.Stdout.Name())
 	return
 }
 
-func (cmd *Cmd) command_exit(line string) (stop bool) {
-	if !cmd.SilentResult() {
-		fmt.Println("goodbye!")
-	}
-	return true
+// Execute executes one command line, capturing its output, and returns the command result.
+// The returned error is not nil if the command failed (invalid command, panic or "error" variable set).
+//
+// Commands executed via Execute are serialized.
+func (cmd *Cmd) Execute(line string) (Result, error) {
+	return cmd.execute(line, cmd.runOne, nil)
 }
 
-// This method executes one command
-func (cmd *Cmd) oneCmd(line string) (stop bool) {
-	defer func() {
-		if r := recover(); r != nil {
-			/*
-			   if !cmd.SilentResult() {
-			       fmt.Println("recovered:", r)
-			   }
-			*/
+// execute executes one command line with run (runOne or runCommand), capturing its output and any variable that was set.
+// If stream is not nil the output is sent to it, instead of being returned in the result.
+func (cmd *Cmd) execute(line string, run Handler, stream func([]byte)) (res Result, err error) {
+	cmd.execLock.Lock()
+	defer cmd.execLock.Unlock()
 
-			stop = cmd.Recover(r)
-		}
-	}()
+	prevFailure := cmd.getFailure()
+	cmd.setFailure(nil)
 
-	if cmd.GetBoolVar("timing") {
-		start := time.Now()
-		defer func() {
-			d := time.Since(start).Truncate(time.Millisecond)
-			cmd.SetVar("elapsed", d.Seconds())
+	before := cmd.context.GetAllVars()
+	if before["error"] != "" {
+		cmd.SetVar("error", "")
+		before["error"] = ""
+	}
 
-			if !cmd.SilentResult() {
-				fmt.Println("Elapsed:", d)
-			}
-		}()
+	var output strings.Builder
+
+	if stream == nil {
+		stream = func(b []byte) { output.Write(b) }
 	}
 
-	if cmd.GetBoolVar("echo") {
-		fmt.Println(cmd.GetPrompt(false), line)
+	start := time.Now()
+
+	cmd.streamOutput(func() {
+		res.Stop = run(line)
+	}, stream)
+
+	res.Duration = time.Since(start)
+	res.Output = output.String()
+	res.Vars = changedVars(before, cmd.context.GetAllVars())
+	delete(res.Vars, "status") // already in the result
+
+	res.Status = cmd.Status()
+	if err = cmd.getFailure(); err != nil && res.Status == 0 {
+		res.Status = 1
 	}
 
-	if cmd.EnableShell && strings.HasPrefix(line, "!") {
-		shellExec(line[1:])
-		return
+	if prevFailure != nil {
+		cmd.setFailure(nil)
+		cmd.setFailure(prevFailure)
 	}
 
-	var cname, params string
+	return
+}
+
+// RunScript executes the commands read from r (without prompts, history or completion)
+// until EOF or until a command returns true.
+//
+// It returns false if any of the commands failed (invalid command, panic or "error" variable set).
+func (cmd *Cmd) RunScript(r io.Reader) bool {
+	cmd.setFailure(nil)
+
+	prev := cmd.context.ScanReader(r, "")
+
+	cmd.updateCompleters()
+	cmd.PreLoop()
+
+	defer func() {
+		cmd.context.SetScanner(prev)
+		cmd.PostLoop()
+
+		cmd.setRedirect(nil, "")
+	}()
+
+	defer cmd.startScript()()
 
-	parts := strings.SplitN(line, " ", 2)
+	cmd.runLoop(true)
+	return !cmd.Failed()
+}
 
-	cname = parts[0]
-	if len(parts) > 1 {
-		params = strings.TrimSpace(parts[1])
+// RunStdin executes the commands read from os.Stdin (i.e. `myapp < script.cmd`),
+// terminating the process with a non-zero exit status if any of the commands failed.
+func (cmd *Cmd) RunStdin() {
+	if !cmd.RunScript(os.Stdin) {
+		os.Exit(1)
 	}
+}
 
-	if command, ok := cmd.Commands[cname]; ok {
-		stop = command.Call(params)
-	} else {
-		cmd.Default(line)
+// historyPatterns compiles the history exclusion patterns (see HistoryExclude)
+func historyPatterns(exclude []string) (patterns []*regexp.Regexp) {
+	for _, s := range exclude {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			re = regexp.MustCompile(regexp.QuoteMeta(s))
+		}
+
+		patterns = append(patterns, re)
 	}
 
 	return
@@ -741,8 +2329,15 @@ func (cmd *Cmd) CmdLoop() {
 		cmd.ContinuationPrompt = ": "
 	}
 
-	cmd.context.StartLiner(cmd.HistoryFile)
-	cmd.context.SetWordCompleter(cmd.wordCompleter)
+	if cmd.interactive() {
+		cmd.context.SetHistoryOptions(cmd.HistoryLimit, historyPatterns(cmd.HistoryExclude))
+		cmd.context.StartLiner(cmd.HistoryFile)
+		cmd.context.SetWordCompleter(cmd.wordCompleter)
+		cmd.context.SetCtrlCAborts(cmd.CtrlC != CtrlCClear)
+	} else {
+		cmd.context.ScanInput(cmd.input())
+		defer cmd.startScript()()
+	}
 
 	cmd.updateCompleters()
 	cmd.PreLoop()
@@ -750,26 +2345,37 @@ func (cmd *Cmd) CmdLoop() {
 	defer func() {
 		cmd.context.StopLiner()
 		cmd.PostLoop()
+		cmd.runExitFuncs()
+		cmd.Cleanup()
 
-		if os.Stdout != cmd.stdout {
-			os.Stdout.Close()
-			os.Stdout = cmd.stdout
-		}
+		cmd.setRedirect(nil, "")
 	}()
 
+	if cmd.interactive() {
+		defer enableANSI()()
+		defer cmd.handleSuspend()()
+		defer cmd.handleResize()()
+	}
+
+	defer cmd.handleReload()()
+
 	sigc := make(chan os.Signal, 1)
-	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(sigc, exitSignals...)
 
 	go func() {
 		for sig := range sigc {
+			if sig == os.Interrupt && cmd.interruptCommand() {
+				continue // back to the prompt, when the command returns
+			}
+
 			cmd.setInterrupted(true)
 			cmd.context.ResetTerminal()
 
 			if cmd.Interrupt(sig) {
 				// rethrow signal to kill app
 				signal.Stop(sigc)
-				p, _ := os.FindProcess(os.Getpid())
-				p.Signal(sig)
+				cmd.runExitFuncs()
+				killSelf(sig)
 			} else {
 				//signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
 			}
@@ -779,13 +2385,97 @@ func (cmd *Cmd) CmdLoop() {
 	cmd.runLoop(true)
 }
 
+// readLine reads the next command line.
+// In the main loop, if IdleTimeout is set, it returns ErrIdleTimeout when the prompt
+// has been idle for too long and OnIdle asked to terminate the session.
+func (cmd *Cmd) readLine(mainLoop bool) (string, error) {
+	prompt := cmd.prompt(mainLoop)
+
+	if !mainLoop || cmd.IdleTimeout <= 0 {
+		return cmd.context.ReadLine(prompt, cmd.GetPrompt(true))
+	}
+
+	type readResult struct {
+		line string
+		err  error
+	}
+
+	resc := make(chan readResult, 1)
+
+	go func() {
+		line, err := cmd.context.ReadLine(prompt, cmd.GetPrompt(true))
+		resc <- readResult{line, err}
+	}()
+
+	timer := time.NewTimer(cmd.IdleTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case res := <-resc:
+			return res.line, res.err
+
+		case <-timer.C:
+			if cmd.OnIdle == nil || cmd.OnIdle() {
+				// the pending read can't be cancelled, but we can restore the terminal
+				cmd.context.ResetTerminal()
+				cmd.Println()
+				return "", ErrIdleTimeout
+			}
+
+			timer.Reset(cmd.IdleTimeout)
+		}
+	}
+}
+
 func (cmd *Cmd) runLoop(mainLoop bool) (stop bool) {
+	var lastCtrlC time.Time
+	var eofs int
+
 	// loop until ReadLine returns nil (signalling EOF)
 	for {
-		line, err := cmd.context.ReadLine(cmd.GetPrompt(false), cmd.GetPrompt(true))
+		line, err := cmd.readLine(mainLoop)
+		if err == ErrIdleTimeout {
+			stop = true
+			break
+		}
+		if err == ErrPromptAborted {
+			eofs = 0
+
+			if cmd.CtrlC == CtrlCInterrupt {
+				if cmd.Interrupt(os.Interrupt) {
+					stop = true
+					break
+				}
+			} else if time.Since(lastCtrlC) < ctrlCExitWindow {
+				stop = true
+				break
+			} else {
+				cmd.Println("(press Ctrl-C again to exit)")
+				lastCtrlC = time.Now()
+			}
+
+			continue
+		}
+
+		lastCtrlC = time.Time{}
+
+		if err == io.EOF && mainLoop && eofs < cmd.IgnoreEOF && cmd.context.ScanningLiner() {
+			eofs++
+			cmd.Println(`Use "exit" to leave the shell.`)
+			continue
+		}
+
+		eofs = 0
+
+		if err == io.EOF && mainLoop && cmd.OnEOF != nil && cmd.context.ScanningLiner() && !cmd.OnEOF() {
+			continue
+		}
+
 		if err != nil {
 			if err != io.EOF {
-				fmt.Println(err)
+				cmd.setFailure(err)
+				cmd.Println(err)
 			}
 			break
 		}
@@ -796,17 +2486,31 @@ func (cmd *Cmd) runLoop(mainLoop bool) (stop bool) {
 		}
 
 		if mainLoop {
-			cmd.setInterrupted(false)
+			expanded, ok, err := cmd.expandHistory(line)
+			if err != nil {
+				cmd.setFailure(err)
+				cmd.Println(err)
+				continue
+			} else if ok {
+				cmd.Println(expanded)
+				line = expanded
+			}
+
 			cmd.context.UpdateHistory(line) // allow user to recall this line
+			cmd.startCommand()
 		}
 
 		m, _ := cmd.context.TerminalMode()
 		//interactive := err == nil
 
 		cmd.PreCmd(line)
-		stop = cmd.OneCmd(line)
+		stop = cmd.runOne(line)
 		stop = cmd.PostCmd(line, stop) || (mainLoop == false && cmd.Interrupted())
 
+		if mainLoop {
+			cmd.endCommand()
+		}
+
 		cmd.context.RestoreMode(m)
 		if stop {
 			break
@@ -816,71 +2520,384 @@ func (cmd *Cmd) runLoop(mainLoop bool) (stop bool) {
 	return
 }
 
+// BlockSpec describes a block of code to execute with RunBlock
+type BlockSpec struct {
+	Name     string                // the function name, or "" for unnamed blocks (i.e. if and loop bodies)
+	Body     []string              // the lines to execute
+	Pos      internal.Position     // the position of the first line of Body in the script, if known
+	Scanner  internal.BasicScanner // if not nil, the lines are read from Scanner instead of Body (see Context.StreamBlock)
+	Args     []string              // the arguments, available as $0 (the name), $1... (if not nil, or if Name is set)
+	NewScope bool                  // if true, the block is executed in a new variables scope (a function scope if Name is set)
+	Params   []Param               // the named parameters, bound to the arguments in the new scope (if not nil)
+}
+
+// Param is a named function parameter: the variable set to the corresponding argument,
+// or to the default value if the argument is missing and the parameter is optional
+type Param struct {
+	Name     string
+	Default  string // expanded when the function is called
+	Optional bool
+}
+
+func (p Param) String() string {
+	if !p.Optional {
+		return p.Name
+	}
+
+	if p.Default == "" || strings.ContainsAny(p.Default, " \t,()\"'") {
+		return p.Name + "=" + strconv.Quote(p.Default)
+	}
+
+	return p.Name + "=" + p.Default
+}
+
+// BlockExit describes how a block terminated
+type BlockExit int
+
+const (
+	// BlockDone means all the lines in the block were executed
+	BlockDone BlockExit = iota
+
+	// BlockStop means a command stopped the block (i.e. "stop" or an interrupt)
+	BlockStop
+
+	// BlockBreak means the enclosing loop should terminate
+	BlockBreak
+
+	// BlockContinue means the enclosing loop should skip to the next iteration
+	BlockContinue
+
+	// BlockReturn means the enclosing function should return
+	BlockReturn
+)
+
+func (e BlockExit) String() string {
+	switch e {
+	case BlockDone:
+		return "done"
+	case BlockStop:
+		return "stop"
+	case BlockBreak:
+		return "break"
+	case BlockContinue:
+		return "continue"
+	case BlockReturn:
+		return "return"
+	default:
+		return "invalid block exit"
+	}
+}
+
+// BlockResult is the result of RunBlock
+type BlockResult struct {
+	Exit    BlockExit     // how the block terminated
+	Err     error         // the first failure in the block, if any
+	Elapsed time.Duration // the block execution time
+}
+
 // RunBlock runs a block of code.
 //
 // Note: this is public because it's needed by the ControlFlow plugin (and can't be in interal
 // because of circular dependencies). It shouldn't be used by end-user applications.
-func (cmd *Cmd) RunBlock(name string, body []string, args []string, newscope bool) (stop bool) {
-	if args != nil {
-		args = append([]string{name}, args...)
+func (cmd *Cmd) RunBlock(spec BlockSpec) (res BlockResult) {
+	var vars map[string]string
+
+	if spec.Name != "" {
+		if err := cmd.enterCall(); err != nil {
+			cmd.setFailure(err)
+			cmd.Println(spec.Name+":", err)
+			return BlockResult{Exit: BlockStop, Err: err}
+		}
+
+		defer cmd.exitCall()
+	}
+
+	if spec.Params != nil {
+		var err error
+
+		if vars, err = cmd.bindParams(spec.Name, spec.Params, spec.Args); err != nil {
+			cmd.setFailure(err)
+			cmd.Println(err)
+			return BlockResult{Exit: BlockStop, Err: err}
+		}
+	}
+
+	args := spec.Args
+	if args != nil || spec.Name != "" {
+		args = append([]string{spec.Name}, args...)
 	}
 
-	prev := cmd.context.ScanBlock(body)
-	if newscope {
-		cmd.context.PushScope(nil, args)
+	start := time.Now()
+
+	prevFailure := cmd.getFailure()
+	cmd.setFailure(nil)
+
+	cmd.Lock()
+	cmd.blockDepth++
+	cmd.blockExit = BlockDone
+	cmd.deferred = append(cmd.deferred, nil)
+	cmd.Unlock()
+
+	var prev internal.BasicScanner
+	if spec.Scanner != nil {
+		prev = cmd.context.SetScanner(spec.Scanner)
+	} else {
+		prev = cmd.context.ScanBlock(spec.Body, spec.Pos)
 	}
-	shouldStop := cmd.runLoop(false)
-	if newscope {
+	if spec.NewScope {
+		cmd.context.PushScope(vars, args)
+	}
+	stop := cmd.runLoop(false)
+	cmd.runDeferred()
+	if spec.NewScope {
 		cmd.context.PopScope()
 	}
 	cmd.context.SetScanner(prev)
 
-	if name == "" { // if stop is called in an unamed block (i.e. not a function) we should really stop
-		stop = shouldStop
+	cmd.Lock()
+	res.Exit = cmd.blockExit
+	cmd.blockExit = BlockDone
+	cmd.blockDepth--
+	cmd.Unlock()
+
+	if stop && res.Exit == BlockDone {
+		res.Exit = BlockStop
+	}
+
+	res.Err = cmd.getFailure()
+	if prevFailure != nil {
+		cmd.setFailure(nil)
+		cmd.setFailure(prevFailure)
 	}
 
+	res.Elapsed = time.Since(start)
 	return
 }
 
+// defaultMaxCallDepth is the default for Cmd.MaxCallDepth
+const defaultMaxCallDepth = 100
+
+// enterCall increments the function call depth, or returns ErrMaxCallDepth if it's at the limit
+func (cmd *Cmd) enterCall() error {
+	cmd.Lock()
+	defer cmd.Unlock()
+
+	max := cmd.MaxCallDepth
+	if max == 0 {
+		max = defaultMaxCallDepth
+	}
+
+	if max > 0 && cmd.callDepth >= max {
+		return ErrMaxCallDepth
+	}
+
+	cmd.callDepth++
+	return nil
+}
+
+func (cmd *Cmd) exitCall() {
+	cmd.Lock()
+	cmd.callDepth--
+	cmd.Unlock()
+}
+
+// bindParams returns the values of the named parameters of a function, checking the number of arguments
+func (cmd *Cmd) bindParams(name string, params []Param, args []string) (map[string]string, error) {
+	if len(args) > len(params) {
+		return nil, fmt.Errorf("%v: too many arguments (expected %v, got %v)", name, len(params), len(args))
+	}
+
+	vars := make(map[string]string, len(params))
+
+	for i, p := range params {
+		switch {
+		case i < len(args):
+			vars[p.Name] = args[i]
+
+		case p.Optional:
+			vars[p.Name] = cmd.ExpandVariables(p.Default)
+
+		default:
+			return nil, fmt.Errorf("%v: missing argument %v", name, p.Name)
+		}
+	}
+
+	return vars, nil
+}
+
+// Defer adds a command line to execute when the current block terminates, however it terminates
+// (the deferred commands are executed in reverse order, in the scope of the block).
+// It returns false if no block is being executed.
+func (cmd *Cmd) Defer(line string) bool {
+	cmd.Lock()
+	defer cmd.Unlock()
+
+	l := len(cmd.deferred)
+	if l == 0 {
+		return false
+	}
+
+	cmd.deferred[l-1] = append(cmd.deferred[l-1], line)
+	return true
+}
+
+// runDeferred executes the commands deferred by the current block, and removes the block from the list.
+// The block exit (i.e. break or return) is preserved.
+func (cmd *Cmd) runDeferred() {
+	cmd.Lock()
+	l := len(cmd.deferred)
+	lines, exit := cmd.deferred[l-1], cmd.blockExit
+	cmd.deferred[l-1] = nil
+	cmd.Unlock()
+
+	for i := len(lines) - 1; i >= 0; i-- {
+		cmd.OneCmd(lines[i])
+	}
+
+	cmd.Lock()
+	cmd.deferred = cmd.deferred[:l-1]
+	cmd.blockExit = exit
+	cmd.Unlock()
+}
+
+// ExitBlock terminates the current block as specified (i.e. break, continue or return),
+// returning true if the command that called it should stop the block.
+// This is used by block commands to propagate the exit of a nested block (i.e. an if body)
+// to the enclosing block.
+//
+// Outside of a block (in the command loop) only BlockStop stops.
+func (cmd *Cmd) ExitBlock(exit BlockExit) (stop bool) {
+	if exit == BlockDone {
+		return false
+	}
+
+	cmd.Lock()
+	defer cmd.Unlock()
+
+	if exit != BlockStop && cmd.blockDepth > 0 {
+		cmd.blockExit = exit
+	}
+
+	return exit == BlockStop || cmd.blockDepth > 0
+}
+
+// TraceLine prints the line to stderr if the trace variable is set, prefixed by "+" and one more "+"
+// for each block (function, loop or conditional body) being executed, as "set -x" in bash.
+//
+// Note: this is public because it's needed by the ControlFlow plugin, to trace the function calls.
+func (cmd *Cmd) TraceLine(line string) {
+	if !cmd.GetBoolVar("trace") {
+		return
+	}
+
+	cmd.RLock()
+	depth := cmd.blockDepth
+	cmd.RUnlock()
+
+	fmt.Fprintln(cmd.Stderr(), strings.Repeat("+", depth+1), line)
+}
+
+// InBlock returns true if a block (function, loop or conditional body) is being executed
+func (cmd *Cmd) InBlock() bool {
+	cmd.RLock()
+	defer cmd.RUnlock()
+
+	return cmd.blockDepth > 0
+}
+
+// ObservedVar returns true if changes to the variable should be passed to OnChange
+// (see ObserveAllVars and UnobservedVars)
+func (cmd *Cmd) ObservedVar(k string) bool {
+	if !cmd.ObserveAllVars {
+		return false
+	}
+
+	for _, name := range cmd.UnobservedVars {
+		if name == k {
+			return false
+		}
+	}
+
+	return true
+}
+
 // SetVar sets a variable in the current scope
 func (cmd *Cmd) SetVar(k string, v interface{}) {
+	if cmd.ObservedVar(k) {
+		cmd.changeVar(k, v, internal.LocalScope)
+		return
+	}
+
 	cmd.context.SetVar(k, v, internal.LocalScope)
 }
 
 // UpdateVar allows to atomically change the valua of a variable. The `update` callback receives the
 // current value and should returns the new value.
+//
+// Note that if the variable is observed (see ObservedVar) the update is not atomic,
+// since OnChange is called with the variables unlocked.
 func (cmd *Cmd) UpdateVar(k string, update func(string) interface{}) string {
+	if cmd.ObservedVar(k) {
+		cur, _ := cmd.context.GetVar(k)
+		cmd.changeVar(k, update(cur), internal.LocalScope)
+
+		v, _ := cmd.context.GetVar(k)
+		return v
+	}
+
 	return cmd.context.UpdateVar(k, internal.LocalScope, update)
 }
 
 // UnsetVar removes a variable from the current scope
 func (cmd *Cmd) UnsetVar(k string) {
+	if cmd.ObservedVar(k) {
+		cmd.changeVar(k, NoVar, internal.LocalScope)
+		return
+	}
+
 	cmd.context.UnsetVar(k, internal.LocalScope)
 }
 
 // ChangeVar sets a variable in the current scope
 // and calls the OnChange method
 func (cmd *Cmd) ChangeVar(k string, v interface{}) {
+	cmd.changeVar(k, v, internal.LocalScope)
+}
+
+func (cmd *Cmd) changeVar(k string, v interface{}, scope internal.Scope) {
 	var oldv interface{} = NoVar
 	if cur, ok := cmd.context.GetVar(k); ok {
 		oldv = cur
 	}
 	if newv := cmd.OnChange(k, oldv, v); newv == NoVar {
-		cmd.context.UnsetVar(k, internal.LocalScope)
+		cmd.context.UnsetVar(k, scope)
 	} else {
-		cmd.context.SetVar(k, newv, internal.LocalScope)
+		cmd.context.SetVar(k, newv, scope)
 	}
 }
 
+// GetValue returns the value of the specified variable from the closest scope:
+// a []interface{} for list variables (set with SetVar or "var --list"), otherwise a string
+func (cmd *Cmd) GetValue(k string) (interface{}, bool) {
+	return cmd.context.GetValue(k)
+}
+
 // GetVar return the value of the specified variable from the closest scope
 func (cmd *Cmd) GetVar(k string) (string, bool) {
 	return cmd.context.GetVar(k)
 }
 
 // GetBoolVar returns the value of the variable as boolean
+// (true, 1, on and yes are true values, anything else is false)
 func (cmd *Cmd) GetBoolVar(name string) (val bool) {
 	sval, _ := cmd.context.GetVar(name)
-	val, _ = strconv.ParseBool(sval)
+
+	switch strings.ToLower(sval) {
+	case "on", "yes":
+		val = true
+	default:
+		val, _ = strconv.ParseBool(sval)
+	}
 	return
 }
 
@@ -896,3 +2913,20 @@ func (cmd *Cmd) GetIntVar(name string) (val int) {
 func (cmd *Cmd) SilentResult() bool {
 	return cmd.GetBoolVar("print") == false
 }
+
+// JSONOutput returns true if built-in commands should print their results as JSON
+// (`set outputformat json`) instead of human readable text
+func (cmd *Cmd) JSONOutput() bool {
+	format, _ := cmd.GetVar("outputformat")
+	return strings.EqualFold(format, "json")
+}
+
+// PrintJSON writes the value to the command output, encoded as JSON on a single line
+func (cmd *Cmd) PrintJSON(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{"error": err.Error()})
+	}
+
+	cmd.Println(string(b))
+}
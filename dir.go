@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gobs/cmd/internal"
+)
+
+// Dir returns the interpreter working directory, changed with cd, pushd and popd
+// (the process working directory, until changed). It's used to resolve the relative paths
+// of load, output and of the shell commands, and it's also in the "cwd" variable.
+//
+// Since it's not the process working directory, multiple interpreters can have different ones.
+func (cmd *Cmd) Dir() string {
+	cmd.RLock()
+	dir := cmd.dir
+	cmd.RUnlock()
+
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+
+	return dir
+}
+
+// Path returns the path of a file relative to the interpreter working directory (see Dir),
+// expanding a leading "~" to the home directory
+func (cmd *Cmd) Path(name string) string {
+	if name == "~" || strings.HasPrefix(name, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			name = home + name[1:]
+		}
+	}
+
+	if name == "" || filepath.IsAbs(name) {
+		return name
+	}
+
+	return filepath.Join(cmd.Dir(), name)
+}
+
+// Chdir changes the interpreter working directory (see Dir)
+func (cmd *Cmd) Chdir(dir string) error {
+	dir = cmd.Path(dir)
+
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return errors.New("not a directory: " + dir)
+	}
+
+	cmd.Lock()
+	cmd.prevDir, cmd.dir = cmd.dir, dir
+	cmd.Unlock()
+
+	cmd.SetVar("cwd", dir)
+	return nil
+}
+
+// dirStack returns the directory stack, with the working directory first
+func (cmd *Cmd) dirStack() []string {
+	cmd.RLock()
+	stack := append([]string(nil), cmd.dirs...)
+	cmd.RUnlock()
+
+	return append([]string{cmd.Dir()}, stack...)
+}
+
+func (cmd *Cmd) printDirStack() {
+	cmd.Println(strings.Join(cmd.dirStack(), " "))
+}
+
+func (cmd *Cmd) command_cd(line string) (stop bool) {
+	switch line {
+	case "":
+		line = "~"
+
+	case "-":
+		cmd.RLock()
+		line = cmd.prevDir
+		cmd.RUnlock()
+
+		if line == "" {
+			cmd.Println("no previous directory")
+			return
+		}
+	}
+
+	if err := cmd.Chdir(internal.Unquote(line)); err != nil {
+		cmd.setFailure(err)
+		cmd.Println(err)
+	}
+
+	return
+}
+
+func (cmd *Cmd) command_pwd(line string) (stop bool) {
+	cmd.Println(cmd.Dir())
+	return
+}
+
+func (cmd *Cmd) command_pushd(line string) (stop bool) {
+	cur := cmd.Dir()
+
+	if line == "" { // swap the top two directories
+		cmd.RLock()
+		if len(cmd.dirs) > 0 {
+			line = cmd.dirs[0]
+		}
+		cmd.RUnlock()
+
+		if line == "" {
+			cmd.Println("no other directory")
+			return
+		}
+
+		if err := cmd.Chdir(line); err != nil {
+			cmd.setFailure(err)
+			cmd.Println(err)
+			return
+		}
+
+		cmd.Lock()
+		cmd.dirs[0] = cur
+		cmd.Unlock()
+	} else {
+		if err := cmd.Chdir(internal.Unquote(line)); err != nil {
+			cmd.setFailure(err)
+			cmd.Println(err)
+			return
+		}
+
+		cmd.Lock()
+		cmd.dirs = append([]string{cur}, cmd.dirs...)
+		cmd.Unlock()
+	}
+
+	cmd.printDirStack()
+	return
+}
+
+func (cmd *Cmd) command_popd(line string) (stop bool) {
+	cmd.Lock()
+	if len(cmd.dirs) == 0 {
+		cmd.Unlock()
+		cmd.Println("directory stack empty")
+		return
+	}
+
+	dir := cmd.dirs[0]
+	cmd.dirs = cmd.dirs[1:]
+	cmd.Unlock()
+
+	if err := cmd.Chdir(dir); err != nil {
+		cmd.setFailure(err)
+		cmd.Println(err)
+		return
+	}
+
+	cmd.printDirStack()
+	return
+}
@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GenerateDocs writes the documentation of the registered commands (including the plugin commands,
+// the subcommands and the aliases, but not the hidden and deprecated commands) to w.
+// The format is "markdown" (or "md") or "man".
+func (cmd *Cmd) GenerateDocs(w io.Writer, format string) error {
+	name := filepath.Base(os.Args[0])
+
+	var docs []commandDoc
+	cmd.collectDocs(&docs, nil, cmd.VisibleCommandNames())
+
+	switch format {
+	case "markdown", "md":
+		return cmd.markdownDocs(w, name, docs)
+
+	case "man":
+		return cmd.manDocs(w, name, docs)
+
+	default:
+		return fmt.Errorf("invalid format %q (should be markdown or man)", format)
+	}
+}
+
+// commandDoc is the documentation of a command or subcommand
+type commandDoc struct {
+	name string // the command name, with the names of the enclosing groups
+	help string // the command help, as printed by help
+}
+
+// collectDocs appends the documentation of the commands (names, in the group at path) to docs
+func (cmd *Cmd) collectDocs(docs *[]commandDoc, path []string, names []string) {
+	for _, name := range names {
+		cpath := append(path[:len(path):len(path)], name)
+
+		c, ok := cmd.LookupCommand(strings.Join(cpath, " "))
+		if !ok {
+			continue
+		}
+
+		doc := commandDoc{name: strings.Join(cpath, " ")}
+
+		if c.Subcommands != nil {
+			doc.help = c.Help
+		} else if c.HelpFunc != nil {
+			var help strings.Builder
+			cmd.streamOutput(c.HelpFunc, func(b []byte) { help.Write(b) })
+			doc.help = help.String()
+		}
+
+		doc.help = dedent(doc.help)
+		*docs = append(*docs, doc)
+
+		if c.Subcommands != nil {
+			cmd.registry.RLock()
+			subs := listedNames(c.Subcommands)
+			cmd.registry.RUnlock()
+
+			cmd.collectDocs(docs, cpath, subs)
+		}
+	}
+}
+
+// dedent removes the leading and trailing empty lines and the indentation common to all lines
+func dedent(s string) string {
+	lines := strings.Split(strings.TrimRight(s, " \t\r\n"), "\n")
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+
+	indent := -1
+	for _, l := range lines {
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+
+		if n := len(l) - len(strings.TrimLeft(l, " \t")); indent < 0 || n < indent {
+			indent = n
+		}
+	}
+
+	for i, l := range lines {
+		if len(l) >= indent {
+			lines[i] = strings.TrimRight(l[indent:], " \t")
+		} else {
+			lines[i] = ""
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (cmd *Cmd) markdownDocs(w io.Writer, name string, docs []commandDoc) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# %v\n\n## Commands\n", name)
+
+	for _, doc := range docs {
+		fmt.Fprintf(&b, "\n### %v\n", doc.name)
+
+		if doc.help != "" {
+			fmt.Fprintf(&b, "\n```\n%v\n```\n", doc.help)
+		}
+	}
+
+	if aliases := cmd.AliasNames(); len(aliases) > 0 {
+		b.WriteString("\n## Aliases\n\n| Alias | Expansion |\n| --- | --- |\n")
+
+		for _, alias := range aliases {
+			expansion, _ := cmd.GetAlias(alias)
+			fmt.Fprintf(&b, "| `%v` | `%v` |\n", alias, strings.ReplaceAll(expansion, "|", "\\|"))
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// roff escapes s for a man page
+func roff(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\e`)
+
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		if strings.HasPrefix(l, ".") || strings.HasPrefix(l, "'") {
+			lines[i] = `\&` + l
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (cmd *Cmd) manDocs(w io.Writer, name string, docs []commandDoc) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, ".TH %v 1\n.SH NAME\n%v \\- command interpreter\n.SH COMMANDS\n", strings.ToUpper(roff(name)), roff(name))
+
+	for _, doc := range docs {
+		fmt.Fprintf(&b, ".TP\n.B %v\n", roff(doc.name))
+
+		if doc.help != "" {
+			fmt.Fprintf(&b, ".nf\n%v\n.fi\n", roff(doc.help))
+		}
+	}
+
+	if aliases := cmd.AliasNames(); len(aliases) > 0 {
+		b.WriteString(".SH ALIASES\n")
+
+		for _, alias := range aliases {
+			expansion, _ := cmd.GetAlias(alias)
+			fmt.Fprintf(&b, ".TP\n.B %v\n%v\n", roff(alias), roff(expansion))
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gobs/cmd/internal"
+)
+
+// Export marks a variable as exported: its value is added to the environment of the shell commands
+// (if the variable is set when the command is executed)
+func (cmd *Cmd) Export(name string) {
+	cmd.Lock()
+	if cmd.exported == nil {
+		cmd.exported = map[string]bool{}
+	}
+	cmd.exported[name] = true
+	cmd.Unlock()
+}
+
+// Unexport removes the export mark from a variable (see Export)
+func (cmd *Cmd) Unexport(name string) {
+	cmd.Lock()
+	delete(cmd.exported, name)
+	cmd.Unlock()
+}
+
+// environ returns the environment for the shell commands: the process environment and the exported variables
+func (cmd *Cmd) environ() []string {
+	env := os.Environ()
+
+	cmd.RLock()
+	names := make([]string, 0, len(cmd.exported))
+	for name := range cmd.exported {
+		names = append(names, name)
+	}
+	cmd.RUnlock()
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if v, ok := cmd.GetVar(name); ok {
+			env = append(env, name+"="+v)
+		}
+	}
+
+	return env
+}
+
+// env [-u|--unset name] [name [value]]
+//
+// Lists the environment of the shell commands, prints a process environment variable,
+// or sets or removes one (name value or name=value).
+func (cmd *Cmd) command_env(line string) (stop bool) {
+	if line == "" {
+		env := cmd.environ()
+		sort.Strings(env)
+
+		if cmd.JSONOutput() {
+			vars := map[string]string{}
+			for _, kv := range env {
+				k, v, _ := strings.Cut(kv, "=")
+				vars[k] = v
+			}
+
+			cmd.PrintJSON(vars)
+			return
+		}
+
+		for _, kv := range env {
+			cmd.Println(kv)
+		}
+
+		return
+	}
+
+	if opt, name, ok := strings.Cut(line, " "); ok && (opt == "-u" || opt == "--unset") {
+		os.Unsetenv(strings.TrimSpace(name))
+		return
+	}
+
+	name, value, ok := strings.Cut(line, " ")
+	if !ok {
+		name, value, ok = strings.Cut(line, "=")
+	}
+
+	if ok {
+		if err := os.Setenv(name, internal.Unquote(strings.TrimSpace(value))); err != nil {
+			cmd.setFailure(err)
+			cmd.Println(err)
+		}
+
+		return
+	}
+
+	if value, ok := os.LookupEnv(name); ok {
+		if cmd.JSONOutput() {
+			cmd.PrintJSON(map[string]string{name: value})
+		} else {
+			cmd.Println(value)
+		}
+	} else {
+		cmd.SetStatus(1)
+	}
+
+	return
+}
@@ -11,7 +11,6 @@ import (
 	"os"
 	//"strconv"
 	"strings"
-	"time"
 )
 
 var (
@@ -70,7 +69,7 @@ var recoverQuit = false
 
 func OnRecover(r interface{}) bool {
 	fmt.Println("recovering from", r)
-	return recoverQuit
+	return !recoverQuit
 }
 
 func main() {
@@ -79,18 +78,10 @@ func main() {
 		Complete:    CompletionFunction,
 		OnChange:    OnChange,
 		Interrupt:   OnInterrupt,
-		Recover:     OnRecover,
+		OnRecover:   OnRecover,
 		EnableShell: true,
 	}
 
-	commander.GetPrompt = func(cont bool) string {
-		if cont {
-			return commander.ContinuationPrompt
-		}
-
-		return strings.ReplaceAll(commander.Prompt, "%T", time.Now().Format("2006-01-02 03:04:05"))
-	}
-
 	commander.Init(controlflow.Plugin, json.Plugin, stats.Plugin)
 
 	/*
@@ -102,13 +93,12 @@ func main() {
 	*/
 
 	commander.Add(cmd.Command{
-		"ls",
-		`list stuff`,
-		func(line string) (stop bool) {
+		Name: "ls",
+		Help: `list stuff`,
+		Call: func(line string) (stop bool) {
 			fmt.Println("listing stuff")
 			return
-		},
-		nil})
+		}})
 
 	/*
 		commander.Add(cmd.Command{
@@ -131,22 +121,13 @@ func main() {
 
 	commander.Add(cmd.Command{
 		Name: ">",
-		Help: `Set prompt`,
+		Help: `Set prompt (i.e. "${time:2006-01-02 03:04:05} > ")`,
 		Call: func(line string) (stop bool) {
 			// commander.Prompt = line  // set prompt
 			commander.SetPrompt(line, 20) // set prompt with max length of 20
 			return
 		}})
 
-	commander.Add(cmd.Command{
-		Name: "timing",
-		Help: `Enable timing`,
-		Call: func(line string) (stop bool) {
-			line = strings.ToLower(line)
-			commander.Timing = line == "true" || line == "yes" || line == "1" || line == "on"
-			return
-		}})
-
 	commander.Add(cmd.Command{
 		Name: "args",
 		Help: "parse args",
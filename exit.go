@@ -0,0 +1,24 @@
+package cmd
+
+// OnExit registers a function to call when the command loop terminates: by exit, at EOF, when a command
+// or a script stops it, or on a signal that terminates the application (see Interrupt).
+// It can be used by plugins and commands to release their resources (i.e. close connections or flush files).
+//
+// The functions are called once, in reverse order of registration, before the plugins cleanup.
+func (cmd *Cmd) OnExit(f func()) {
+	cmd.Lock()
+	cmd.exitFuncs = append(cmd.exitFuncs, f)
+	cmd.Unlock()
+}
+
+// runExitFuncs calls the functions registered with OnExit, removing them so that they are only called once
+func (cmd *Cmd) runExitFuncs() {
+	cmd.Lock()
+	funcs := cmd.exitFuncs
+	cmd.exitFuncs = nil
+	cmd.Unlock()
+
+	for i := len(funcs) - 1; i >= 0; i-- {
+		funcs[i]()
+	}
+}
@@ -0,0 +1,313 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gobs/cmd/internal"
+)
+
+// the maximum nesting of $(...), $((...)) and ${...} in variable expansion
+const maxExpandDepth = 10
+
+// ExpandVariables replaces the variable references in line with their values:
+//
+//	$name or $(name)    the value of the variable (empty if not set)
+//	$name[i]            an element of a list variable (the first is 0, and negative indexes are from the end)
+//	$name[@] $name[#]   all the elements of a list variable (quoted if needed), and the number of elements
+//	$(env.NAME)         the value of the environment variable
+//	$* $# $(*) $(#)     the arguments and the number of arguments of the current function
+//	$? $(?)             the status of the last command (the same as $status)
+//	$((expr))           the result of an arithmetic expression, i.e. $((1 + $count * 2)) or $((count % 10))
+//	$(command ...)      the output of the command, if CommandSubstitution is set (i.e. by the controlflow plugin).
+//	                    Only a reference with spaces is a command, i.e. $(jsonpath $.names $json) or $( time ),
+//	                    so that $(name) is always a variable
+//	${name:-default}    the value of the variable, or default if it's not set or empty
+//	${name:+alternate}  alternate if the variable is set and not empty, otherwise empty
+//	${name:?message}    the value of the variable, or an error with message if it's not set or empty
+//	$$ or \$            a literal $
+//
+// Without the colon (i.e. ${name-default}) only a variable that is not set is replaced, not an empty one.
+// ${name} alone is left as is, since it's expanded when the prompt is displayed (see ExpandPrompt).
+//
+// The expansion is done in a single pass, so values containing $ are not expanded again.
+// The name in $(...) can itself contain references, i.e. $(item_$index).
+func (cmd *Cmd) ExpandVariables(line string) string {
+	res, _ := cmd.ExpandVariablesE(line)
+	return res
+}
+
+// ExpandVariablesE is like ExpandVariables, but it also returns the error of the first ${name:?message}
+// reference to a variable that is not set
+func (cmd *Cmd) ExpandVariablesE(line string) (string, error) {
+	if !strings.ContainsRune(line, '$') {
+		return line, nil
+	}
+
+	x := &expander{lookup: cmd.GetVar, index: cmd.context.GetVarIndex, substitute: cmd.CommandSubstitution}
+
+	res, _ := x.expand(line, 0, false)
+	return res, x.err
+}
+
+// expander expands the variable references (see ExpandVariables)
+type expander struct {
+	lookup     func(string) (string, bool)
+	index      func(string, string) (string, bool) // the elements of list variables
+	substitute func(string) (string, bool)         // the command substitution, if not nil
+	err        error                               // the first ${name:?message} error
+}
+
+// expand expands the variables in s, up to the closing parenthesis if closing is true.
+// depth is the nesting level of the references being expanded, limited to maxExpandDepth.
+// It returns the expanded string and the number of bytes consumed.
+func (x *expander) expand(s string, depth int, closing bool) (string, int) {
+	lookup := x.lookup
+
+	var b strings.Builder
+
+	for i := 0; i < len(s); {
+		c := s[i]
+
+		if closing && c == ')' {
+			return b.String(), i
+		}
+
+		if c == '\\' && i+1 < len(s) && s[i+1] == '$' { // \$
+			b.WriteByte('$')
+			i += 2
+			continue
+		}
+
+		if c != '$' || i+1 == len(s) {
+			b.WriteByte(c)
+			i++
+			continue
+		}
+
+		switch next := s[i+1]; {
+		case next == '$': // $$
+			b.WriteByte('$')
+			i += 2
+
+		case next == '*' || next == '#': // $* $#
+			v, _ := lookup(string(next))
+			b.WriteString(v)
+			i += 2
+
+		case next == '?': // $?
+			v, _ := lookup("status")
+			b.WriteString(v)
+			i += 2
+
+		case internal.IsNameChar(next): // $name
+			j := i + 1
+			for j < len(s) && internal.IsNameChar(s[j]) {
+				j++
+			}
+
+			name := s[i+1 : j]
+
+			if j < len(s) && s[j] == '[' { // $name[index]
+				if end := closingBracket(s, j); end > 0 {
+					index, _ := x.expand(s[j+1:end], depth+1, false)
+					if v, ok := x.index(name, index); ok {
+						b.WriteString(v)
+						i = end + 1
+						continue
+					}
+				}
+			}
+
+			v, _ := lookup(name)
+			b.WriteString(v)
+			i = j
+
+		case next == '(' && i+2 < len(s) && s[i+2] == '(' && depth < maxExpandDepth: // $((expr))
+			end := arithEnd(s, i+3)
+			if end < 0 { // no closing parentheses
+				b.WriteString(s[i:])
+				return b.String(), len(s)
+			}
+
+			expr, _ := x.expand(s[i+3:end], depth+1, false)
+			if v, err := internal.EvalArith(expr, lookup); err == nil {
+				b.WriteString(v)
+			} else { // not a valid expression, leave it as is
+				b.WriteString(s[i : end+2])
+			}
+
+			i = end + 2
+
+		case next == '{' && depth < maxExpandDepth: // ${name:-default}...
+			end := closingBracket(s, i+1)
+			if end < 0 { // no closing brace
+				b.WriteByte(c)
+				i++
+				continue
+			}
+
+			if v, ok := x.param(s[i+2:end], depth); ok {
+				b.WriteString(v)
+			} else { // not a reference with an operator, leave it as is
+				b.WriteString(s[i : end+1])
+			}
+
+			i = end + 1
+
+		case next == '(' && depth < maxExpandDepth: // $(name)
+			if x.substitute != nil { // $(command args...), or $( command )
+				if end := closingBracket(s, i+1); end > 0 && strings.ContainsAny(s[i+2:end], " \t") {
+					if out, ok := x.substitute(strings.TrimSpace(s[i+2 : end])); ok {
+						b.WriteString(out)
+						i = end + 1
+						continue
+					}
+				}
+			}
+
+			name, n := x.expand(s[i+2:], depth+1, true)
+			end := i + 2 + n
+			if end >= len(s) { // no closing parenthesis
+				b.WriteString(s[i:])
+				return b.String(), len(s)
+			}
+
+			switch {
+			case strings.HasPrefix(name, "env.") && internal.IsName(name[4:]):
+				b.WriteString(os.Getenv(name[4:]))
+
+			case name == "*" || name == "#" || internal.IsName(name):
+				v, _ := lookup(name)
+				b.WriteString(v)
+
+			case name == "?":
+				v, _ := lookup("status")
+				b.WriteString(v)
+
+			default: // not a variable reference, leave it as is
+				b.WriteString(s[i : end+1])
+			}
+
+			i = end + 1
+
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+
+	return b.String(), len(s)
+}
+
+// arithEnd returns the index of the "))" closing an arithmetic expression that starts at start
+// (after "$(("), or -1 if it's not closed
+func arithEnd(s string, start int) int {
+	level := 0
+
+	for i := start; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			level++
+
+		case ')':
+			if level > 0 {
+				level--
+			} else if i+1 < len(s) && s[i+1] == ')' {
+				return i
+			} else {
+				return -1
+			}
+		}
+	}
+
+	return -1
+}
+
+// param expands a ${name<op>word} reference, where op is :- :+ :? (or - + ?), returning false
+// if ref is not in this form. The word is expanded at the next nesting level (see maxExpandDepth).
+func (x *expander) param(ref string, depth int) (string, bool) {
+	n := 0
+	for n < len(ref) && (internal.IsNameChar(ref[n]) || ref[n] == '.') {
+		n++
+	}
+
+	name, rest := ref[:n], ref[n:]
+	if rest == "" {
+		return "", false
+	}
+
+	var v string
+	var ok bool
+
+	switch {
+	case strings.HasPrefix(name, "env.") && internal.IsName(name[4:]):
+		v, ok = os.LookupEnv(name[4:])
+
+	case internal.IsName(name):
+		v, ok = x.lookup(name)
+
+	default:
+		return "", false
+	}
+
+	colon := strings.HasPrefix(rest, ":")
+	if colon {
+		rest = rest[1:]
+	}
+
+	if rest == "" {
+		return "", false
+	}
+
+	set := ok && (v != "" || !colon)
+	word := rest[1:]
+
+	switch rest[0] {
+	case '-':
+		if !set {
+			v, _ = x.expand(word, depth+1, false)
+		}
+
+	case '+':
+		v = ""
+		if set {
+			v, _ = x.expand(word, depth+1, false)
+		}
+
+	case '?':
+		if !set {
+			msg, _ := x.expand(word, depth+1, false)
+			if msg == "" {
+				msg = "not set"
+			}
+
+			if x.err == nil {
+				x.err = fmt.Errorf("%v: %v", name, msg)
+			}
+		}
+
+	default:
+		return "", false
+	}
+
+	return v, true
+}
+
+// closingBracket returns the index of the bracket closing the one at start
+// (outside of quotes, and skipping the nested brackets), or -1 if it's not closed
+func closingBracket(s string, start int) (end int) {
+	end = -1
+
+	internal.ScanLine(s[start:], func(i, depth int, quoted bool) bool {
+		if i > 0 && !quoted && depth == 0 && strings.IndexByte(")]}", s[start+i]) >= 0 {
+			end = start + i
+			return false
+		}
+
+		return true
+	})
+
+	return
+}
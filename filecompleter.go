@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FilePathCompleter completes file paths, one directory level at a time
+type FilePathCompleter struct {
+	// if not empty, only the files matching this pattern (i.e. "*.cmd") are completed (directories always are)
+	Pattern string
+	// if true, only directories are completed
+	DirsOnly bool
+	// a function that returns the directory for relative paths (default is the process working directory)
+	Dir func() string
+	// a function that returns true if this completer should be executed (default is always)
+	Cond CompleterCond
+}
+
+// NewFilePathCompleter creates a FilePathCompleter for the files matching glob (all files if empty).
+// It can be added with AddCompleter (setting Cond) or used as Command.Complete:
+//
+//	commander.Add(cmd.Command{Name: "run", Call: run, Complete: cmd.NewFilePathCompleter("*.cmd").Complete})
+func NewFilePathCompleter(glob string) *FilePathCompleter {
+	return &FilePathCompleter{Pattern: glob}
+}
+
+func (c *FilePathCompleter) Complete(start, line string) (matches []string) {
+	if c.Cond != nil && !c.Cond(start, line) {
+		return
+	}
+
+	// the directory to read (as typed) and the prefix of the names to match
+	prefix, base := "", start
+	if i := strings.LastIndexAny(start, `/`+string(os.PathSeparator)); i >= 0 {
+		prefix, base = start[:i+1], start[i+1:]
+	}
+
+	dir := prefix
+	if dir == "~/" || strings.HasPrefix(dir, "~"+string(os.PathSeparator)) {
+		if home, err := os.UserHomeDir(); err == nil {
+			dir = home + dir[1:]
+		}
+	}
+	if dir == "" {
+		dir = "."
+	}
+	if !filepath.IsAbs(dir) && c.Dir != nil {
+		dir = filepath.Join(c.Dir(), dir)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+
+		if !strings.HasPrefix(name, base) || (strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".")) {
+			continue
+		}
+
+		isDir := e.IsDir()
+		if !isDir && e.Type()&os.ModeSymlink != 0 { // follow symbolic links to directories
+			if fi, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				isDir = fi.IsDir()
+			}
+		}
+
+		if isDir {
+			matches = append(matches, prefix+name+"/")
+		} else if c.DirsOnly {
+			continue
+		} else if ok, _ := filepath.Match(c.Pattern, name); c.Pattern == "" || ok {
+			matches = append(matches, prefix+name)
+		}
+	}
+
+	sort.Strings(matches)
+	return
+}
+
+// fileCompleter returns a FilePathCompleter for paths relative to the interpreter working directory
+func (cmd *Cmd) fileCompleter(glob string, dirsOnly bool) func(start, line string) []string {
+	c := &FilePathCompleter{Pattern: glob, DirsOnly: dirsOnly, Dir: cmd.Dir}
+	return c.Complete
+}
@@ -11,7 +11,11 @@ require (
 	github.com/gobs/sortedmap v1.0.0
 	github.com/montanaflynn/stats v0.7.0
 	github.com/peterh/liner v1.2.2
-	golang.org/x/sync v0.1.0
+	golang.org/x/sync v0.6.0
+	golang.org/x/sys v0.18.0
+	google.golang.org/grpc v1.64.0
+	google.golang.org/protobuf v1.33.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -20,5 +24,7 @@ require (
 	github.com/mattn/go-runewidth v0.0.3 // indirect
 	github.com/rogpeppe/go-internal v1.11.0 // indirect
 	golang.org/x/exp v0.0.0-20230515195305-f3d0a9c9a5cc // indirect
-	golang.org/x/sys v0.1.0 // indirect
+	golang.org/x/net v0.22.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240318140521-94a12d6c2237 // indirect
 )
@@ -0,0 +1,344 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CommandGroup is a command with subcommands, executed as "group subcommand params" (see Cmd.Group)
+type CommandGroup struct {
+	cmd  *Cmd
+	path []string // the names of the enclosing groups and of this group
+}
+
+// Group returns the command group with the specified name, creating it if needed.
+// If there is already a command with this name it's converted to a group, and it's called
+// when no subcommand matches.
+func (cmd *Cmd) Group(name string) *CommandGroup {
+	return cmd.group(nil, name)
+}
+
+// Group returns the nested command group with the specified name, creating it if needed
+func (g *CommandGroup) Group(name string) *CommandGroup {
+	return g.cmd.group(g.path, name)
+}
+
+// Add adds a subcommand to the group, overriding a subcommand with the same name
+func (g *CommandGroup) Add(command Command) *CommandGroup {
+	g.cmd.setHelpFunc(&command, append(g.path[:len(g.path):len(g.path)], command.Name))
+
+	g.cmd.registry.Lock()
+	g.cmd.subcommands(g.path)[command.Name] = command
+	g.cmd.registry.Unlock()
+	return g
+}
+
+// Remove removes a subcommand, returning false if there was no subcommand with the specified name
+func (g *CommandGroup) Remove(name string) bool {
+	g.cmd.registry.Lock()
+	defer g.cmd.registry.Unlock()
+
+	subs := g.cmd.subcommands(g.path)
+	if _, ok := subs[name]; !ok {
+		return false
+	}
+
+	delete(subs, name)
+	return true
+}
+
+// SetHelp sets the description of the group, displayed before the list of subcommands
+func (g *CommandGroup) SetHelp(help string) *CommandGroup {
+	g.cmd.registry.Lock()
+	defer g.cmd.registry.Unlock()
+
+	parent, name := g.cmd.Commands, g.path[len(g.path)-1]
+	if len(g.path) > 1 {
+		parent = g.cmd.subcommands(g.path[:len(g.path)-1])
+	}
+
+	c := parent[name]
+	c.Help = help
+	parent[name] = c
+	return g
+}
+
+// Names returns the sorted list of subcommands
+func (g *CommandGroup) Names() []string {
+	g.cmd.registry.RLock()
+	defer g.cmd.registry.RUnlock()
+
+	return sortedNames(g.cmd.subcommands(g.path))
+}
+
+func sortedNames(commands map[string]Command) []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// listedNames returns the sorted list of commands that are not hidden or deprecated
+func listedNames(commands map[string]Command) []string {
+	names := make([]string, 0, len(commands))
+	for name, c := range commands {
+		if c.listed() {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// subcommands returns the subcommands of the group at path (the registry should be locked)
+func (cmd *Cmd) subcommands(path []string) map[string]Command {
+	commands := cmd.Commands
+
+	for _, name := range path {
+		commands = commands[name].Subcommands
+	}
+
+	return commands
+}
+
+func (cmd *Cmd) group(parent []string, name string) *CommandGroup {
+	path := append(parent[:len(parent):len(parent)], name)
+
+	cmd.registry.Lock()
+	defer cmd.registry.Unlock()
+
+	commands := cmd.subcommands(parent)
+
+	c, ok := commands[name]
+	if !ok {
+		c = Command{Name: name}
+	}
+
+	if c.Subcommands == nil {
+		c.Subcommands = map[string]Command{}
+		c.HelpFunc = nil
+		cmd.setHelpFunc(&c, path)
+		commands[name] = c
+	}
+
+	return &CommandGroup{cmd: cmd, path: path}
+}
+
+// setHelpFunc sets the default help function, if not set.
+// For a command group it lists the subcommands.
+func (cmd *Cmd) setHelpFunc(command *Command, path []string) {
+	if command.HelpFunc != nil {
+		return
+	}
+
+	if command.Subcommands != nil {
+		command.HelpFunc = func() {
+			cmd.printGroupHelp(path)
+		}
+
+		return
+	}
+
+	name, help, spec, deprecated := command.Name, command.Help, command.Args, command.Deprecated
+
+	command.HelpFunc = func() {
+		if len(help) > 0 {
+			cmd.Println(help)
+		} else if spec == nil {
+			cmd.Println("No help for ", name)
+		}
+
+		if spec != nil {
+			cmd.Print(spec.Usage(strings.Join(path, " ")))
+		}
+
+		if deprecated != "" {
+			cmd.Println("deprecated:", deprecated)
+		}
+	}
+}
+
+func (cmd *Cmd) printGroupHelp(path []string) {
+	c, ok := cmd.LookupCommand(strings.Join(path, " "))
+	if !ok {
+		return
+	}
+
+	if c.Help != "" {
+		cmd.Println(c.Help)
+	}
+
+	cmd.Printf("%v subcommands:\n", strings.Join(path, " "))
+
+	cmd.registry.RLock()
+	names := listedNames(c.Subcommands)
+	cmd.registry.RUnlock()
+
+	for _, name := range names {
+		sub, _ := cmd.LookupCommand(strings.Join(append(path[:len(path):len(path)], name), " "))
+		help, _, _ := strings.Cut(strings.TrimSpace(sub.Help), "\n")
+		if sub.Subcommands != nil {
+			help = strings.TrimSpace("(group) " + help)
+		}
+		cmd.Printf("  %-15v %v\n", name, help)
+	}
+}
+
+// LookupCommand returns the command or subcommand identified by a list of space-separated names
+// (i.e. "net dns lookup")
+func (cmd *Cmd) LookupCommand(names string) (command Command, ok bool) {
+	cmd.registry.RLock()
+	defer cmd.registry.RUnlock()
+
+	commands := cmd.Commands
+
+	for _, name := range strings.Fields(names) {
+		if command, ok = commands[name]; !ok {
+			return
+		}
+
+		commands = command.Subcommands
+	}
+
+	return
+}
+
+// lookupPrefix returns the command (or subcommand) identified by the leading words that are not flags
+// (i.e. "net dns lookup --type=A host" returns "net dns lookup")
+func (cmd *Cmd) lookupPrefix(words []string) (command Command, found bool) {
+	for i := range words {
+		if strings.HasPrefix(words[i], "-") {
+			break
+		}
+
+		c, ok := cmd.LookupCommand(strings.Join(words[:i+1], " "))
+		if !ok {
+			break
+		}
+
+		command, found = c, true
+	}
+
+	return
+}
+
+// dispatch calls the command or, for a command group, the subcommand selected by the first word of params.
+// If the command has an ArgsSpec the parameters are parsed and validated first.
+func (cmd *Cmd) dispatch(command Command, line, params string) (stop bool) {
+	path := command.Name
+
+	for command.Subcommands != nil {
+		name, rest, _ := strings.Cut(params, " ")
+		if name == "" {
+			break
+		}
+
+		cmd.registry.RLock()
+		sub, ok := command.Subcommands[name]
+		cmd.registry.RUnlock()
+
+		if !ok {
+			if command.Call != nil || command.CallE != nil { // the group handles the unknown subcommands
+				break
+			}
+
+			cmd.setFailure(fmt.Errorf("invalid subcommand: %v", name))
+			cmd.Default(line)
+			return
+		}
+
+		command, params = sub, strings.TrimSpace(rest)
+		path += " " + name
+	}
+
+	if command.Deprecated != "" {
+		fmt.Fprintf(cmd.Stderr(), "warning: %v is deprecated: %v\n", path, command.Deprecated)
+	}
+
+	if command.CallE != nil {
+		command.Call = cmd.errorCall(path, command.CallE)
+	}
+
+	if command.Args != nil {
+		if params == "--help" && command.Args.flag("help") == nil {
+			command.HelpFunc()
+			return
+		}
+
+		parsed, err := command.Args.Parse(params)
+		if err != nil {
+			cmd.setFailure(err)
+			cmd.Println(err)
+			cmd.Print(command.Args.Usage(path))
+			return
+		}
+
+		if run := command.Run; run != nil {
+			command.Call = func(string) bool { return run(parsed) }
+		}
+	}
+
+	if command.Call == nil { // a group without subcommand
+		command.HelpFunc()
+		return
+	}
+
+	return cmd.observedCall(command, path, line, params)
+}
+
+// subcommandCompleter completes the subcommand names, after a command group
+// (also after "help")
+type subcommandCompleter struct {
+	cmd *Cmd
+}
+
+func (c *subcommandCompleter) Complete(start, line string) (matches []string) {
+	words := strings.Fields(strings.TrimSuffix(line, start))
+	if len(words) > 0 && words[0] == "help" {
+		words = words[1:]
+	}
+	if len(words) == 0 {
+		return
+	}
+
+	command, ok := c.cmd.LookupCommand(strings.Join(words, " "))
+	if !ok || command.Subcommands == nil {
+		return
+	}
+
+	c.cmd.registry.RLock()
+	names := listedNames(command.Subcommands)
+	c.cmd.registry.RUnlock()
+
+	for _, name := range names {
+		if strings.HasPrefix(name, start) {
+			matches = append(matches, name)
+		}
+	}
+
+	return
+}
+
+// argumentCompleter completes the arguments of a command (or subcommand) via Command.Complete
+type argumentCompleter struct {
+	cmd *Cmd
+}
+
+func (c *argumentCompleter) Complete(start, line string) []string {
+	words := strings.Fields(strings.TrimSuffix(line, start))
+	if len(words) == 0 { // completing the command name
+		return nil
+	}
+
+	command, found := c.cmd.lookupPrefix(words)
+	if !found || command.Complete == nil {
+		return nil
+	}
+
+	return command.Complete(start, line)
+}
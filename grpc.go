@@ -0,0 +1,436 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+//
+// The messages for the Interpreter service defined in cmd.proto.
+//
+// They are encoded by hand (see wireCodec) so that there is no need for generated code,
+// but they are wire-compatible with clients generated from cmd.proto.
+//
+
+type wireMessage interface {
+	marshal() []byte
+	unmarshal([]byte) error
+}
+
+type execRequest struct {
+	Line string
+}
+
+type outputChunk struct {
+	Data string
+}
+
+type completeRequest struct {
+	Line string
+	Pos  int
+}
+
+type completeResponse struct {
+	Head        string
+	Completions []string
+	Tail        string
+}
+
+type listCommandsRequest struct{}
+
+type commandInfo struct {
+	Name string
+	Help string
+}
+
+type listCommandsResponse struct {
+	Commands []commandInfo
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendDouble(b []byte, num protowire.Number, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(v))
+}
+
+// decodeFields calls f for each field in b, with the (still encoded) field value
+func decodeFields(b []byte, f func(num protowire.Number, typ protowire.Type, v []byte)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+
+		f(num, typ, b[:n])
+		b = b[n:]
+	}
+
+	return nil
+}
+
+func decodeString(typ protowire.Type, v []byte) string {
+	if typ != protowire.BytesType {
+		return ""
+	}
+
+	s, _ := protowire.ConsumeString(v)
+	return s
+}
+
+func decodeVarint(typ protowire.Type, v []byte) uint64 {
+	if typ != protowire.VarintType {
+		return 0
+	}
+
+	n, _ := protowire.ConsumeVarint(v)
+	return n
+}
+
+func decodeDouble(typ protowire.Type, v []byte) float64 {
+	if typ != protowire.Fixed64Type {
+		return 0
+	}
+
+	n, _ := protowire.ConsumeFixed64(v)
+	return math.Float64frombits(n)
+}
+
+func decodeBytes(typ protowire.Type, v []byte) []byte {
+	if typ != protowire.BytesType {
+		return nil
+	}
+
+	b, _ := protowire.ConsumeBytes(v)
+	return b
+}
+
+func (m *execRequest) marshal() []byte {
+	return appendString(nil, 1, m.Line)
+}
+
+func (m *execRequest) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) {
+		if num == 1 {
+			m.Line = decodeString(typ, v)
+		}
+	})
+}
+
+func (m *CommandResponse) marshal() (b []byte) {
+	b = appendString(b, 1, m.Command)
+	b = appendString(b, 2, m.Output)
+	b = appendString(b, 3, m.Status)
+	if m.Stop {
+		b = appendVarint(b, 4, 1)
+	}
+	b = appendDouble(b, 5, m.Duration)
+	for k, v := range m.Vars {
+		entry := appendString(appendString(nil, 1, k), 2, v)
+		b = appendBytes(b, 6, entry)
+	}
+	b = appendString(b, 7, m.Error)
+	b = appendVarint(b, 8, uint64(int64(m.ExitStatus)))
+	return
+}
+
+func (m *CommandResponse) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) {
+		switch num {
+		case 1:
+			m.Command = decodeString(typ, v)
+		case 2:
+			m.Output = decodeString(typ, v)
+		case 3:
+			m.Status = decodeString(typ, v)
+		case 4:
+			m.Stop = decodeVarint(typ, v) != 0
+		case 5:
+			m.Duration = decodeDouble(typ, v)
+		case 6:
+			var key, value string
+
+			decodeFields(decodeBytes(typ, v), func(num protowire.Number, typ protowire.Type, v []byte) {
+				switch num {
+				case 1:
+					key = decodeString(typ, v)
+				case 2:
+					value = decodeString(typ, v)
+				}
+			})
+
+			if m.Vars == nil {
+				m.Vars = map[string]string{}
+			}
+			m.Vars[key] = value
+		case 7:
+			m.Error = decodeString(typ, v)
+		case 8:
+			m.ExitStatus = int(int32(decodeVarint(typ, v)))
+		}
+	})
+}
+
+func (m *outputChunk) marshal() []byte {
+	return appendString(nil, 1, m.Data)
+}
+
+func (m *outputChunk) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) {
+		if num == 1 {
+			m.Data = decodeString(typ, v)
+		}
+	})
+}
+
+func (m *completeRequest) marshal() (b []byte) {
+	b = appendString(b, 1, m.Line)
+	b = appendVarint(b, 2, uint64(m.Pos))
+	return
+}
+
+func (m *completeRequest) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) {
+		switch num {
+		case 1:
+			m.Line = decodeString(typ, v)
+		case 2:
+			m.Pos = int(int32(decodeVarint(typ, v)))
+		}
+	})
+}
+
+func (m *completeResponse) marshal() (b []byte) {
+	b = appendString(b, 1, m.Head)
+	for _, c := range m.Completions {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, c)
+	}
+	b = appendString(b, 3, m.Tail)
+	return
+}
+
+func (m *completeResponse) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) {
+		switch num {
+		case 1:
+			m.Head = decodeString(typ, v)
+		case 2:
+			m.Completions = append(m.Completions, decodeString(typ, v))
+		case 3:
+			m.Tail = decodeString(typ, v)
+		}
+	})
+}
+
+func (m *listCommandsRequest) marshal() []byte {
+	return nil
+}
+
+func (m *listCommandsRequest) unmarshal(b []byte) error {
+	return decodeFields(b, func(protowire.Number, protowire.Type, []byte) {})
+}
+
+func (m *listCommandsResponse) marshal() (b []byte) {
+	for _, c := range m.Commands {
+		info := appendString(appendString(nil, 1, c.Name), 2, c.Help)
+		b = appendBytes(b, 1, info)
+	}
+	return
+}
+
+func (m *listCommandsResponse) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) {
+		if num != 1 {
+			return
+		}
+
+		var c commandInfo
+
+		decodeFields(decodeBytes(typ, v), func(num protowire.Number, typ protowire.Type, v []byte) {
+			switch num {
+			case 1:
+				c.Name = decodeString(typ, v)
+			case 2:
+				c.Help = decodeString(typ, v)
+			}
+		})
+
+		m.Commands = append(m.Commands, c)
+	})
+}
+
+// wireCodec is a grpc codec for the messages above
+type wireCodec struct{}
+
+func (wireCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return nil, fmt.Errorf("cannot marshal %T", v)
+	}
+
+	return m.marshal(), nil
+}
+
+func (wireCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return fmt.Errorf("cannot unmarshal %T", v)
+	}
+
+	return m.unmarshal(data)
+}
+
+func (wireCodec) Name() string {
+	return "proto"
+}
+
+//
+// The Interpreter service
+//
+
+// grpcExecute executes the command line as is (see runCommand): the first word is the command name
+// and the rest are its parameters
+func (cmd *Cmd) grpcExecute(line string, stream func([]byte)) (*CommandResponse, error) {
+	line = strings.TrimSpace(line)
+	name, _, _ := strings.Cut(line, " ")
+
+	if _, ok := cmd.GetCommand(name); !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown command %v", name)
+	}
+
+	res := cmd.runCaptured(name, line, cmd.runCommand, stream)
+	return &res, nil
+}
+
+func executeCommandHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+	var req execRequest
+	if err := dec(&req); err != nil {
+		return nil, err
+	}
+
+	return srv.(*Cmd).grpcExecute(req.Line, nil)
+}
+
+func streamOutputHandler(srv interface{}, stream grpc.ServerStream) error {
+	var req execRequest
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+
+	var serr error
+
+	_, err := srv.(*Cmd).grpcExecute(req.Line, func(b []byte) {
+		if serr == nil {
+			serr = stream.SendMsg(&outputChunk{Data: string(b)})
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return serr
+}
+
+func completeHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+	var req completeRequest
+	if err := dec(&req); err != nil {
+		return nil, err
+	}
+
+	if req.Pos <= 0 || req.Pos > len(req.Line) {
+		req.Pos = len(req.Line)
+	}
+
+	var res completeResponse
+	res.Head, res.Completions, res.Tail = srv.(*Cmd).wordCompleter(req.Line, req.Pos)
+	return &res, nil
+}
+
+func listCommandsHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+	var req listCommandsRequest
+	if err := dec(&req); err != nil {
+		return nil, err
+	}
+
+	cmd := srv.(*Cmd)
+
+	var res listCommandsResponse
+	for _, name := range cmd.CommandNames() {
+		c, _ := cmd.GetCommand(name)
+		res.Commands = append(res.Commands, commandInfo{Name: name, Help: c.Help})
+	}
+	return &res, nil
+}
+
+var interpreterService = grpc.ServiceDesc{
+	ServiceName: "gobs.cmd.Interpreter",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "ExecuteCommand", Handler: executeCommandHandler},
+		{MethodName: "Complete", Handler: completeHandler},
+		{MethodName: "ListCommands", Handler: listCommandsHandler},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "StreamOutput", Handler: streamOutputHandler, ServerStreams: true},
+	},
+	Metadata: "cmd.proto",
+}
+
+// GRPCServer returns a grpc.Server exposing the interpreter as the gobs.cmd.Interpreter service (see cmd.proto).
+//
+// As for the REST API, commands are executed one at a time, and only the requested command is executed:
+// the request line is passed as is, without alias or variable expansion, and ";" or "|" are not separators.
+//
+// Note that the server is configured with its own codec, so it can't be used to serve other services.
+func (cmd *Cmd) GRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	cmd.updateCompleters()
+
+	s := grpc.NewServer(append(opts, grpc.ForceServerCodec(wireCodec{}))...)
+	s.RegisterService(&interpreterService, cmd)
+	return s
+}
+
+// ServeGRPC accepts gRPC connections on the listener and serves the Interpreter service
+func (cmd *Cmd) ServeGRPC(lis net.Listener, opts ...grpc.ServerOption) error {
+	return cmd.GRPCServer(opts...).Serve(lis)
+}
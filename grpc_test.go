@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGRPCExecute(t *testing.T) {
+	c := &Cmd{Output: &bytes.Buffer{}}
+	c.Init()
+	c.SetStderr(&bytes.Buffer{})
+
+	c.Add(Command{Name: "exit", Call: func(line string) bool {
+		c.Println(line)
+		c.SetStatus(3)
+		return false
+	}})
+
+	res, err := c.grpcExecute(`exit $x; echo more | cat`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the response goes through the wire encoding
+	var dec CommandResponse
+	if err := dec.unmarshal(res.marshal()); err != nil {
+		t.Fatal(err)
+	}
+
+	if dec.Output != "$x; echo more | cat\n" {
+		t.Errorf("got output %q", dec.Output)
+	}
+
+	if dec.Status != "ok" || dec.ExitStatus != 3 {
+		t.Errorf("got status %q, exit status %v", dec.Status, dec.ExitStatus)
+	}
+
+	if _, err := c.grpcExecute("nosuchcommand", nil); err == nil {
+		t.Error("no error for an unknown command")
+	}
+}
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gobs/cmd/internal"
+)
+
+// History returns the command history: the lines entered in the command loop
+// (and those read from the history file), the oldest first
+func (cmd *Cmd) History() []string {
+	return cmd.context.History()
+}
+
+// ClearHistory removes all the history entries
+func (cmd *Cmd) ClearHistory() {
+	cmd.context.ClearHistory()
+}
+
+// a history reference at the beginning of a line: !! (the previous line), !n (entry n) or !-n (n lines back)
+var reHistoryRef = regexp.MustCompile(`^!(!|-?[0-9]+)(\s|$)`)
+
+// expandHistory replaces a history reference at the beginning of the line with the referenced entry.
+// It returns false if the line doesn't start with a reference.
+func (cmd *Cmd) expandHistory(line string) (string, bool, error) {
+	m := reHistoryRef.FindStringSubmatch(line)
+	if m == nil {
+		return line, false, nil
+	}
+
+	history := cmd.History()
+
+	i := len(history) // !!
+	if m[1] != "!" {
+		n, _ := strconv.Atoi(m[1])
+		if n < 0 {
+			i += n + 1
+		} else {
+			i = n
+		}
+	}
+
+	if i < 1 || i > len(history) {
+		return line, false, fmt.Errorf("!%v: event not found", m[1])
+	}
+
+	return history[i-1] + line[len(m[0])-len(m[2]):], true, nil
+}
+
+// history [n|clear|save file]
+//
+// Lists the history entries (the last n, if specified), numbered so that they can be recalled with !n,
+// clears the history or saves it to a file.
+func (cmd *Cmd) command_history(line string) (stop bool) {
+	sub, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+
+	switch sub {
+	case "clear":
+		cmd.ClearHistory()
+		return
+
+	case "save":
+		if arg == "" {
+			cmd.Println("usage: history save file")
+			return
+		}
+
+		if err := cmd.saveHistory(cmd.Path(internal.Unquote(arg))); err != nil {
+			cmd.setFailure(err)
+			cmd.Println(err)
+		}
+
+		return
+	}
+
+	history := cmd.History()
+	first := 0
+
+	if line != "" {
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			cmd.Println("usage: history [n|clear|save file]")
+			return
+		}
+
+		if n < len(history) {
+			first = len(history) - n
+		}
+	}
+
+	if cmd.JSONOutput() {
+		cmd.PrintJSON(history[first:])
+		return
+	}
+
+	for i, h := range history[first:] {
+		cmd.Printf("%5d  %v\n", first+i+1, h)
+	}
+
+	return
+}
+
+// completeHistory completes the history subcommands, and the file name for save
+func (cmd *Cmd) completeHistory(start, line string) (matches []string) {
+	if words := strings.Fields(line); len(words) > 2 || (len(words) == 2 && start == "") {
+		if words[1] == "save" {
+			return cmd.fileCompleter("", false)(start, line)
+		}
+
+		return nil
+	}
+
+	for _, sub := range []string{"clear", "save"} {
+		if strings.HasPrefix(sub, start) {
+			matches = append(matches, sub)
+		}
+	}
+
+	return
+}
+
+// saveHistory writes the history entries to a file, one per line
+func (cmd *Cmd) saveHistory(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, h := range cmd.History() {
+		fmt.Fprintln(w, h)
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
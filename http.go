@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gobs/cmd/internal"
+)
+
+// CommandRequest is the (optional) JSON body for `POST /commands/{name}`.
+//
+// The command parameters are Line, if set, or Args quoted as needed (see internal.QuoteWord) and joined with spaces.
+// They are passed to the command as they are: there's no alias, variable or command expansion, and ";" or "|" are not separators.
+type CommandRequest struct {
+	Line string   `json:"line,omitempty"`
+	Args []string `json:"args,omitempty"`
+}
+
+// CommandResponse is the JSON response for `POST /commands/{name}`
+type CommandResponse struct {
+	Command    string            `json:"command"`
+	Output     string            `json:"output"`
+	Status     string            `json:"status"`      // "ok" or "error"
+	ExitStatus int               `json:"exit_status"` // the command exit status (see Result.Status)
+	Stop       bool              `json:"stop"`
+	Duration   float64           `json:"duration"`        // in seconds
+	Vars       map[string]string `json:"vars,omitempty"`  // variables set or changed by the command
+	Error      string            `json:"error,omitempty"` // the reason the command failed
+}
+
+// runCaptured executes one command line with run (see execute) and returns the result as a CommandResponse.
+// If stream is not nil the output is sent to it, instead of being returned in the response.
+func (cmd *Cmd) runCaptured(name, line string, run Handler, stream func([]byte)) CommandResponse {
+	res, err := cmd.execute(line, run, stream)
+
+	cres := CommandResponse{
+		Command:    name,
+		Output:     res.Output,
+		Status:     "ok",
+		ExitStatus: res.Status,
+		Stop:       res.Stop,
+		Duration:   res.Duration.Seconds(),
+		Vars:       res.Vars,
+	}
+
+	if err != nil {
+		cres.Status = "error"
+		cres.Error = err.Error()
+	}
+
+	return cres
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// HTTPHandler returns an http.Handler that exposes the registered commands as a REST API:
+//
+//	GET /commands           returns the list of available commands
+//	POST /commands/{name}   executes the command, with an optional CommandRequest body,
+//	                        and returns a CommandResponse
+//
+// Commands are executed one at a time, with their output captured and returned in the response.
+// Only the requested command is executed, with the parameters as they are (see CommandRequest).
+func (cmd *Cmd) HTTPHandler() http.Handler {
+	cmd.updateCompleters()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimSuffix(r.URL.Path, "/")
+
+		if path == "/commands" {
+			if r.Method != http.MethodGet {
+				writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+				return
+			}
+
+			writeJSON(w, http.StatusOK, cmd.CommandNames())
+			return
+		}
+
+		name := strings.TrimPrefix(path, "/commands/")
+		if name == path || name == "" || strings.Contains(name, "/") {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		if _, ok := cmd.GetCommand(name); !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown command " + name})
+			return
+		}
+
+		var req CommandRequest
+
+		if r.Body != nil {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+
+		params := req.Line
+		if params == "" {
+			args := make([]string, len(req.Args))
+			for i, arg := range req.Args {
+				args[i] = internal.QuoteWord(arg)
+			}
+
+			params = strings.Join(args, " ")
+		}
+
+		line := name
+		if params = strings.TrimSpace(params); params != "" {
+			line += " " + params
+		}
+
+		writeJSON(w, http.StatusOK, cmd.runCaptured(name, line, cmd.runCommand, nil))
+	})
+}
+
+// ListenAndServe starts an HTTP server on the specified address, serving HTTPHandler()
+func (cmd *Cmd) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, cmd.HTTPHandler())
+}
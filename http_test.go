@@ -0,0 +1,74 @@
+package cmd_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gobs/args"
+	"github.com/gobs/cmd"
+)
+
+// post executes the command via the HTTP handler, returning the decoded response
+func post(t *testing.T, h http.Handler, name, body string) (res cmd.CommandResponse) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/commands/"+name, strings.NewReader(body)))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %v: %v", w.Code, w.Body)
+	}
+
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+func TestHTTPArgs(t *testing.T) {
+	c := &cmd.Cmd{Output: &syncBuffer{}}
+	c.Init()
+
+	c.Add(cmd.Command{Name: "args", Call: func(line string) bool {
+		for _, arg := range args.GetArgs(line) {
+			fmt.Fprintf(c.Stdout(), "[%v]", arg)
+		}
+		return false
+	}})
+
+	h := c.HTTPHandler()
+
+	if res := post(t, h, "args", `{"args": ["a", "b c", "$x;d", ""]}`); res.Output != `[a][b c][$x;d][]` {
+		t.Errorf("got %q", res.Output)
+	}
+
+	if res := post(t, h, "args", `{"line": "a \"b c\""}`); res.Output != `[a][b c]` {
+		t.Errorf("got %q", res.Output)
+	}
+}
+
+func TestHTTPExitStatus(t *testing.T) {
+	c := &cmd.Cmd{Output: &syncBuffer{}}
+	c.Init()
+	c.SetStderr(&syncBuffer{})
+
+	c.Add(cmd.Command{Name: "exit3", Call: func(string) bool {
+		c.SetStatus(3)
+		return false
+	}})
+
+	h := c.HTTPHandler()
+
+	if res := post(t, h, "exit3", ""); res.Status != "ok" || res.ExitStatus != 3 {
+		t.Errorf("got status %q, exit status %v", res.Status, res.ExitStatus)
+	}
+
+	if res := post(t, h, "echo", ""); res.Status != "ok" || res.ExitStatus != 0 {
+		t.Errorf("got status %q, exit status %v", res.Status, res.ExitStatus)
+	}
+}
@@ -0,0 +1,476 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Expressions, as in $((expr)) or the conditions of if and while:
+//
+//   - integer (decimal, 0x hex, 0o octal, 0b binary) and floating point numbers
+//   - strings in double or single quotes
+//   - variable names, replaced by their value (0 if not set) in arithmetic expressions,
+//     or words that are taken literally (numbers, or strings) in the other expressions
+//   - the operators + - * / % ** (power), the unary - + and !, and parentheses
+//   - the comparisons == != < <= > >= and the logical operators && ||, with a result of 1 (true) or 0 (false)
+//
+// Operations between integers are integer operations (i.e. 7/2 is 3), and become floating point operations
+// if one of the operands is a floating point number. Comparisons between numbers are numeric, and the others
+// compare the strings.
+
+// value is the value of an expression: a number or a string
+type value struct {
+	i        int64
+	f        float64
+	s        string
+	isFloat  bool
+	isString bool
+}
+
+func (v value) float() float64 {
+	if v.isFloat {
+		return v.f
+	}
+
+	return float64(v.i)
+}
+
+func (v value) String() string {
+	switch {
+	case v.isString:
+		return v.s
+	case v.isFloat:
+		return strconv.FormatFloat(v.f, 'f', -1, 64)
+	}
+
+	return strconv.FormatInt(v.i, 10)
+}
+
+// truth returns the boolean value: numbers are true if not 0, strings if not empty (and not "0")
+func (v value) truth() bool {
+	switch {
+	case v.isString:
+		return v.s != "" && v.s != "0"
+	case v.isFloat:
+		return v.f != 0
+	}
+
+	return v.i != 0
+}
+
+func boolValue(b bool) value {
+	if b {
+		return value{i: 1}
+	}
+
+	return value{}
+}
+
+// parseNumber parses an integer (with a base prefix) or a floating point number
+func parseNumber(s string) (value, error) {
+	s = strings.TrimSpace(s)
+
+	if i, err := strconv.ParseInt(s, 0, 64); err == nil {
+		return value{i: i}, nil
+	}
+
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return value{f: f, isFloat: true}, nil
+	}
+
+	return value{}, fmt.Errorf("not a number: %q", s)
+}
+
+// EvalArith evaluates an arithmetic expression, using lookup to get the value of the variables
+func EvalArith(expr string, lookup func(string) (string, bool)) (string, error) {
+	v, err := eval(expr, lookup)
+	if err != nil {
+		return "", err
+	}
+
+	return v.String(), nil
+}
+
+// EvalExpr evaluates an expression where the words are literal values (i.e. after the variables have been expanded)
+func EvalExpr(expr string) (string, error) {
+	v, err := eval(expr, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return v.String(), nil
+}
+
+// EvalCondition evaluates an expression (as EvalExpr) as a boolean
+func EvalCondition(expr string) (bool, error) {
+	v, err := eval(expr, nil)
+	if err != nil {
+		return false, err
+	}
+
+	return v.truth(), nil
+}
+
+func eval(expr string, lookup func(string) (string, bool)) (value, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return value{}, err
+	}
+
+	if len(tokens) == 0 {
+		return value{}, errors.New("empty expression")
+	}
+
+	p := &arithParser{tokens: tokens, lookup: lookup}
+
+	v, err := p.expr(0)
+	if err != nil {
+		return v, err
+	}
+
+	if p.pos < len(p.tokens) {
+		return v, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+
+	return v, nil
+}
+
+// the operators, longest first
+var operators = []string{"**", "==", "!=", "<=", ">=", "&&", "||", "+", "-", "*", "/", "%", "<", ">", "!", "(", ")"}
+
+// tokenize splits an expression in numbers, names, strings (with their quotes), operators and parentheses
+func tokenize(expr string) (tokens []string, err error) {
+next:
+	for i := 0; i < len(expr); {
+		c := expr[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+			continue
+
+		case c == '"' || c == '\'':
+			j := i + 1
+			for ; j < len(expr) && expr[j] != c; j++ {
+				if expr[j] == '\\' && c == '"' {
+					j++
+				}
+			}
+
+			if j >= len(expr) {
+				return nil, fmt.Errorf("missing closing quote in %v", expr[i:])
+			}
+
+			tokens = append(tokens, expr[i:j+1])
+			i = j + 1
+			continue
+
+		case IsNameChar(c) || c == '.':
+			j := i + 1
+			for j < len(expr) && (IsNameChar(expr[j]) || expr[j] == '.' ||
+				// the exponent sign of a floating point number, i.e. 1e-3
+				((expr[j] == '-' || expr[j] == '+') && (expr[j-1] == 'e' || expr[j-1] == 'E') && '0' <= c && c <= '9' && !strings.HasPrefix(expr[i:], "0x"))) {
+				j++
+			}
+
+			tokens = append(tokens, expr[i:j])
+			i = j
+			continue
+		}
+
+		for _, op := range operators {
+			if strings.HasPrefix(expr[i:], op) {
+				tokens = append(tokens, op)
+				i += len(op)
+				continue next
+			}
+		}
+
+		return nil, fmt.Errorf("invalid character %q", c)
+	}
+
+	return
+}
+
+var errDivisionByZero = errors.New("division by zero")
+
+// the precedence of the binary operators
+var arithPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3,
+	"!=": 3,
+	"<":  4,
+	"<=": 4,
+	">":  4,
+	">=": 4,
+	"+":  5,
+	"-":  5,
+	"*":  6,
+	"/":  6,
+	"%":  6,
+	"**": 8, // higher than the unary operators (7), so that -2**2 is -4
+}
+
+const unaryPrecedence = 7
+
+type arithParser struct {
+	tokens []string
+	pos    int
+	lookup func(string) (string, bool)
+}
+
+func (p *arithParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+
+	return ""
+}
+
+func (p *arithParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// expr parses the binary operations with a precedence of at least min (precedence climbing)
+func (p *arithParser) expr(min int) (value, error) {
+	left, err := p.unary()
+	if err != nil {
+		return left, err
+	}
+
+	for {
+		op := p.peek()
+
+		prec, ok := arithPrecedence[op]
+		if !ok || prec < min {
+			return left, nil
+		}
+
+		p.next()
+
+		next := prec + 1
+		if op == "**" { // right associative
+			next = prec
+		}
+
+		right, err := p.expr(next)
+		if err != nil {
+			return left, err
+		}
+
+		if left, err = binary(op, left, right); err != nil {
+			return left, err
+		}
+	}
+}
+
+// unary parses the unary operators
+func (p *arithParser) unary() (value, error) {
+	switch p.peek() {
+	case "-":
+		p.next()
+
+		v, err := p.expr(unaryPrecedence)
+		if err != nil {
+			return v, err
+		}
+		if v.isString {
+			return v, fmt.Errorf("not a number: %q", v.s)
+		}
+
+		if v.isFloat {
+			v.f = -v.f
+		} else {
+			v.i = -v.i
+		}
+		return v, nil
+
+	case "+":
+		p.next()
+		return p.expr(unaryPrecedence)
+
+	case "!":
+		p.next()
+
+		v, err := p.expr(unaryPrecedence)
+		return boolValue(!v.truth()), err
+	}
+
+	return p.primary()
+}
+
+// primary parses a number, a string, a variable or an expression in parentheses
+func (p *arithParser) primary() (value, error) {
+	t := p.next()
+
+	switch {
+	case t == "":
+		return value{}, errors.New("unexpected end of expression")
+
+	case t == "(":
+		v, err := p.expr(0)
+		if err != nil {
+			return v, err
+		}
+
+		if p.next() != ")" {
+			return v, errors.New("missing )")
+		}
+
+		return v, nil
+
+	case t[0] == '"' || t[0] == '\'':
+		return value{s: Unquote(t), isString: true}, nil
+
+	case IsName(t) && !('0' <= t[0] && t[0] <= '9') && p.lookup != nil: // a variable
+		v, _ := p.lookup(t)
+		if v == "" {
+			return value{}, nil
+		}
+
+		if n, err := parseNumber(v); err == nil {
+			return n, nil
+		}
+
+		return value{s: v, isString: true}, nil
+
+	case IsName(t) && !('0' <= t[0] && t[0] <= '9'): // a literal word
+		return value{s: t, isString: true}, nil
+
+	case t[0] == '.' || ('0' <= t[0] && t[0] <= '9'):
+		return parseNumber(t)
+	}
+
+	return value{}, fmt.Errorf("unexpected %q", t)
+}
+
+// binary applies a binary operator
+func binary(op string, a, b value) (value, error) {
+	switch op {
+	case "&&":
+		return boolValue(a.truth() && b.truth()), nil
+	case "||":
+		return boolValue(a.truth() || b.truth()), nil
+	case "==", "!=", "<", "<=", ">", ">=":
+		return boolValue(compare(op, a, b)), nil
+	}
+
+	if a.isString {
+		return value{}, fmt.Errorf("not a number: %q", a.s)
+	}
+	if b.isString {
+		return value{}, fmt.Errorf("not a number: %q", b.s)
+	}
+
+	return arith(op, a, b)
+}
+
+// compare compares two numbers, or the string values if one is not a number
+func compare(op string, a, b value) bool {
+	var c int
+
+	switch {
+	case a.isString || b.isString:
+		c = strings.Compare(a.String(), b.String())
+
+	case a.isFloat || b.isFloat:
+		if x, y := a.float(), b.float(); x < y {
+			c = -1
+		} else if x > y {
+			c = 1
+		}
+
+	case a.i < b.i:
+		c = -1
+
+	case a.i > b.i:
+		c = 1
+	}
+
+	switch op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+
+	return c >= 0
+}
+
+// arith applies an arithmetic operator
+func arith(op string, a, b value) (value, error) {
+	if a.isFloat || b.isFloat {
+		x, y := a.float(), b.float()
+
+		switch op {
+		case "+":
+			x += y
+		case "-":
+			x -= y
+		case "*":
+			x *= y
+		case "/":
+			if y == 0 {
+				return value{}, errDivisionByZero
+			}
+			x /= y
+		case "%":
+			if y == 0 {
+				return value{}, errDivisionByZero
+			}
+			x = math.Mod(x, y)
+		case "**":
+			x = math.Pow(x, y)
+		}
+
+		return value{f: x, isFloat: true}, nil
+	}
+
+	x, y := a.i, b.i
+
+	switch op {
+	case "+":
+		x += y
+	case "-":
+		x -= y
+	case "*":
+		x *= y
+	case "/":
+		if y == 0 {
+			return value{}, errDivisionByZero
+		}
+		x /= y
+	case "%":
+		if y == 0 {
+			return value{}, errDivisionByZero
+		}
+		x %= y
+	case "**":
+		if y < 0 {
+			return value{f: math.Pow(float64(x), float64(y)), isFloat: true}, nil
+		}
+
+		p := int64(1)
+		for ; y > 0; y >>= 1 { // exponentiation by squaring
+			if y&1 == 1 {
+				p *= x
+			}
+			x *= x
+		}
+		x = p
+	}
+
+	return value{i: x}, nil
+}
@@ -2,14 +2,18 @@ package internal
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
-	"path"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"unicode/utf8"
 
 	"github.com/peterh/liner"
 )
@@ -22,7 +26,7 @@ type List = []interface{}
 type Scope int
 
 const (
-	InvalidScope Scope = iota
+	InvalidScope Scope = iota // no scope specified: the closest scope where the variable is defined (see SetVar)
 	LocalScope
 	ParentScope
 	GlobalScope
@@ -42,23 +46,144 @@ func (s Scope) String() string {
 }
 
 type Context struct {
-	line    *liner.State // interactive line reader
+	line    LineReader   // interactive line reader
 	scanner BasicScanner // file based line reader
+	input   BasicScanner // the command loop input, when not interactive (see ScanInput)
+
+	// the line reader settings, to restore them when the line reader is restarted
+	newReader   func() LineReader
+	completer   func(line string, pos int) (head string, completions []string, tail string)
+	ctrlCAborts bool
+	keys        map[string]KeyHandler
+	suspended   *bytes.Buffer // the history, while the line reader is suspended
+
+	historyFile    string
+	hasHistory     bool
+	history        []string         // the recorded lines (the line reader has its own copy)
+	historyLimit   int              // the maximum number of entries (0 for no limit)
+	historyExclude []*regexp.Regexp // the lines matching these patterns are not recorded
+	scopes         []Arguments
+	values         []map[string]interface{} // the list and map values of the variables, for each scope
+
+	*sync.Mutex // shared with the forked contexts, since they share the global scope
+}
+
+func NewContext() *Context {
+	return &Context{Mutex: &sync.Mutex{}}
+}
 
-	historyFile string
-	hasHistory  bool
-	scopes      []Arguments
+// Fork returns a context for a concurrent execution (i.e. a background job): the global scope is shared
+// with ctx, the other scopes are copied, and a new scope is pushed, so that the local variables
+// set by one don't change the other. The line reader and the history are not copied.
+func (ctx *Context) Fork() *Context {
+	ctx.Lock()
+	defer ctx.Unlock()
 
-	sync.Mutex
+	if len(ctx.scopes) == 0 {
+		panic("no scopes")
+	}
+
+	if ctx.values[0] == nil { // so that the list and map values are shared too
+		ctx.values[0] = map[string]interface{}{}
+	}
+
+	f := &Context{Mutex: ctx.Mutex}
+	f.scopes = append(f.scopes, ctx.scopes[0])
+	f.values = append(f.values, ctx.values[0])
+
+	for i := 1; i < len(ctx.scopes); i++ {
+		scope := make(Arguments, len(ctx.scopes[i]))
+		for k, v := range ctx.scopes[i] {
+			scope[k] = v
+		}
+
+		var values map[string]interface{}
+		if ctx.values[i] != nil {
+			values = make(map[string]interface{}, len(ctx.values[i]))
+			for k, v := range ctx.values[i] {
+				values[k] = v
+			}
+		}
+
+		f.scopes = append(f.scopes, scope)
+		f.values = append(f.values, values)
+	}
+
+	f.scopes = append(f.scopes, Arguments{})
+	f.values = append(f.values, nil)
+	return f
 }
 
-func NewContext() *Context {
-	return &Context{}
+// SetLineReader sets the function that creates the interactive line reader (the default is NewLinerReader).
+// It should be called before StartLiner.
+func (ctx *Context) SetLineReader(newReader func() LineReader) {
+	ctx.Lock()
+	ctx.newReader = newReader
+	ctx.Unlock()
+}
+
+// newLineReader creates the interactive line reader, with the key bindings (the context should be locked)
+func (ctx *Context) newLineReader() (line LineReader) {
+	if ctx.newReader != nil {
+		line = ctx.newReader()
+	} else {
+		line = NewLinerReader()
+	}
+
+	if kb, ok := line.(KeyBinder); ok {
+		for key, f := range ctx.keys {
+			kb.BindKey(key, f)
+		}
+	}
+
+	return
+}
+
+// BindKey sets the handler for the key (or removes it, if f is nil), if the line reader supports
+// key bindings (see KeyBinder). The bindings are kept when the line reader is restarted.
+//
+// It returns ErrKeyBindings if the line reader doesn't support them: the running one, or the default one
+// (based on liner) if none is running and SetLineReader wasn't called.
+func (ctx *Context) BindKey(key string, f KeyHandler) error {
+	key, err := ParseKey(key)
+	if err != nil {
+		return err
+	}
+
+	ctx.Lock()
+	defer ctx.Unlock()
+
+	if f != nil {
+		if ctx.line != nil {
+			if _, ok := ctx.line.(KeyBinder); !ok {
+				return ErrKeyBindings
+			}
+		} else if ctx.newReader == nil {
+			return ErrKeyBindings
+		}
+	}
+
+	if f == nil {
+		delete(ctx.keys, key)
+	} else {
+		if ctx.keys == nil {
+			ctx.keys = map[string]KeyHandler{}
+		}
+
+		ctx.keys[key] = f
+	}
+
+	if kb, ok := ctx.line.(KeyBinder); ok {
+		kb.BindKey(key, f)
+	}
+
+	return nil
 }
 
 func (ctx *Context) StartLiner(history string) {
 	ctx.Lock()
-	ctx.line = liner.NewLiner()
+	ctx.line = ctx.newLineReader()
+	ctx.history = nil
 	ctx.readHistoryFile(history)
 	ctx.Unlock()
 	ctx.ScanLiner()
@@ -74,51 +199,206 @@ func (ctx *Context) StopLiner() {
 	}
 }
 
+// SetHistoryOptions sets the maximum number of history entries (0 for no limit, other than the line reader one)
+// and the patterns of the lines that should not be recorded
+func (ctx *Context) SetHistoryOptions(limit int, exclude []*regexp.Regexp) {
+	ctx.Lock()
+	defer ctx.Unlock()
+
+	ctx.historyLimit = limit
+	ctx.historyExclude = exclude
+
+	if ctx.trimHistory() && ctx.line != nil {
+		ctx.reloadHistory()
+	}
+}
+
+// UpdateHistory adds a line to the history, unless it's the same as the previous one
+// or it matches one of the exclusion patterns
 func (ctx *Context) UpdateHistory(line string) {
 	ctx.Lock()
 	defer ctx.Unlock()
 
-	if ctx.line != nil {
+	if ctx.line == nil || ctx.excluded(line) {
+		return
+	}
+
+	if n := len(ctx.history); n > 0 && ctx.history[n-1] == line {
+		return
+	}
+
+	ctx.history = append(ctx.history, line)
+	ctx.hasHistory = true
+
+	if ctx.trimHistory() {
+		ctx.reloadHistory()
+	} else {
 		ctx.line.AppendHistory(line)
-		ctx.hasHistory = true
+	}
+}
+
+// History returns a copy of the history entries
+func (ctx *Context) History() []string {
+	ctx.Lock()
+	defer ctx.Unlock()
+
+	return append([]string(nil), ctx.history...)
+}
+
+// ClearHistory removes all the history entries (the history file is also cleared, when the line reader is stopped)
+func (ctx *Context) ClearHistory() {
+	ctx.Lock()
+	defer ctx.Unlock()
+
+	ctx.history = nil
+	ctx.hasHistory = true
+
+	if hc, ok := ctx.line.(interface{ ClearHistory() }); ok {
+		hc.ClearHistory()
+	}
+}
+
+// excluded returns true if the line matches one of the history exclusion patterns
+func (ctx *Context) excluded(line string) bool {
+	for _, re := range ctx.historyExclude {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// trimHistory removes the oldest entries over the history limit, returning true if any was removed
+func (ctx *Context) trimHistory() bool {
+	if ctx.historyLimit <= 0 || len(ctx.history) <= ctx.historyLimit {
+		return false
+	}
+
+	ctx.history = append([]string(nil), ctx.history[len(ctx.history)-ctx.historyLimit:]...)
+	return true
+}
+
+// reloadHistory replaces the line reader history with the recorded one, if the line reader can clear it
+// (otherwise the line reader keeps its own history, that is not saved)
+func (ctx *Context) reloadHistory() {
+	if hc, ok := ctx.line.(interface{ ClearHistory() }); ok {
+		hc.ClearHistory()
+		ctx.line.ReadHistory(strings.NewReader(strings.Join(ctx.history, "\n") + "\n"))
+	} else if n := len(ctx.history); n > 0 {
+		ctx.line.AppendHistory(ctx.history[n-1])
+	}
+}
+
+// loadHistory reads the history entries, one per line, skipping the excluded ones
+// and keeping the last ones if over the limit
+func (ctx *Context) loadHistory(r io.Reader) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if line := sc.Text(); line != "" && !ctx.excluded(line) {
+			ctx.history = append(ctx.history, line)
+		}
+	}
+
+	ctx.trimHistory()
+
+	if len(ctx.history) > 0 {
+		ctx.line.ReadHistory(strings.NewReader(strings.Join(ctx.history, "\n") + "\n"))
 	}
 }
 
 func (ctx *Context) SetWordCompleter(completer func(line string, pos int) (head string, completions []string, tail string)) {
+	ctx.completer = completer
+
 	if ctx.line != nil {
 		ctx.line.SetWordCompleter(completer)
 	}
 }
 
+func (ctx *Context) SetCtrlCAborts(aborts bool) {
+	ctx.ctrlCAborts = aborts
+
+	if ctx.line != nil {
+		ctx.line.SetCtrlCAborts(aborts)
+	}
+}
+
+// SuspendLiner restores the original terminal mode, keeping the history in memory
+// so that the line reader can be restarted with ResumeLiner
+func (ctx *Context) SuspendLiner() {
+	ctx.Lock()
+	defer ctx.Unlock()
+
+	if ctx.line == nil || ctx.suspended != nil {
+		return
+	}
+
+	ctx.suspended = &bytes.Buffer{}
+	ctx.line.WriteHistory(ctx.suspended)
+	ctx.line.Close()
+}
+
+// ResumeLiner restarts the line reader, putting the terminal back in raw mode.
+// If the line reader wasn't suspended, it is restarted anyway (the terminal mode may have been changed
+// while the process was stopped).
+func (ctx *Context) ResumeLiner() {
+	ctx.Lock()
+	defer ctx.Unlock()
+
+	if ctx.line == nil {
+		return
+	}
+
+	if ctx.suspended == nil {
+		ctx.suspended = &bytes.Buffer{}
+		ctx.line.WriteHistory(ctx.suspended)
+		ctx.line.Close()
+	}
+
+	ctx.line = ctx.newLineReader()
+	ctx.line.ReadHistory(ctx.suspended)
+	ctx.line.SetCtrlCAborts(ctx.ctrlCAborts)
+	if ctx.completer != nil {
+		ctx.line.SetWordCompleter(ctx.completer)
+	}
+
+	ctx.suspended = nil
+}
+
 func (ctx *Context) readHistoryFile(history string) {
 	if len(history) == 0 {
 		// no history file
 		return
 	}
 
-	filepath := history // start with current directory
-	if f, err := os.Open(filepath); err == nil {
-		ctx.line.ReadHistory(f)
+	name := history // start with current directory
+	if f, err := os.Open(name); err == nil {
+		ctx.loadHistory(f)
 		f.Close()
 
-		ctx.historyFile = filepath
+		ctx.historyFile = name
 		return
 	}
 
-	filepath = path.Join(os.Getenv("HOME"), filepath) // then check home directory
-	if f, err := os.Open(filepath); err == nil {
-		ctx.line.ReadHistory(f)
+	if !filepath.IsAbs(history) { // then check home directory
+		if home, err := os.UserHomeDir(); err == nil {
+			name = filepath.Join(home, history)
+		}
+	}
+
+	if f, err := os.Open(name); err == nil {
+		ctx.loadHistory(f)
 		f.Close()
 
-		ctx.historyFile = filepath
+		ctx.historyFile = name
 		return
 	}
 
-	if f, err := os.Create(filepath); err == nil { // if we can create the history file, set the path
+	if f, err := os.Create(name); err == nil { // if we can create the history file, set the path
 		// create history file
 		f.Close()
 
-		ctx.historyFile = filepath
+		ctx.historyFile = name
 	}
 }
 
@@ -129,7 +409,14 @@ func (ctx *Context) writeHistoryFile() {
 	}
 
 	if f, err := os.Create(ctx.historyFile); err == nil {
-		ctx.line.WriteHistory(f)
+		w := bufio.NewWriter(f)
+		for _, line := range ctx.history {
+			if !ctx.excluded(line) {
+				fmt.Fprintln(w, line)
+			}
+		}
+
+		w.Flush()
 		f.Close()
 	}
 }
@@ -156,6 +443,7 @@ func (ctx *Context) PushScope(vars map[string]string, args []string) {
 	}
 
 	ctx.scopes = append(ctx.scopes, scope)
+	ctx.values = append(ctx.values, nil)
 }
 
 // PopScope removes the current scope, restoring the previous one
@@ -169,6 +457,7 @@ func (ctx *Context) PopScope() {
 	}
 
 	ctx.scopes = ctx.scopes[:l-1]
+	ctx.values = ctx.values[:l-1]
 }
 
 // GetScope returns the variable sets for the specified scope
@@ -194,7 +483,11 @@ func (ctx *Context) GetScope(scope Scope) Arguments {
 	return ctx.scopes[i]
 }
 
-// SetVar sets a variable in the current, parent or global scope
+// SetVar sets a variable in the current, parent or global scope.
+//
+// If the scope is not specified (InvalidScope) the variable is set in the closest scope where it's defined,
+// without looking past the current function scope (so that a function doesn't change the variables of the caller),
+// or in the current scope if it's not defined.
 func (ctx *Context) SetVar(k string, v interface{}, scope Scope) {
 	ctx.Lock()
 	defer ctx.Unlock()
@@ -213,6 +506,9 @@ func (ctx *Context) UnsetVar(k string, scope Scope) {
 	}
 
 	switch scope {
+	case InvalidScope:
+		i = ctx.assignScope(k)
+
 	case GlobalScope:
 		i = 0 // index of global scope
 
@@ -224,6 +520,7 @@ func (ctx *Context) UnsetVar(k string, scope Scope) {
 
 	if _, ok := ctx.scopes[i][k]; ok {
 		delete(ctx.scopes[i], k)
+		delete(ctx.values[i], k)
 	}
 }
 
@@ -256,6 +553,23 @@ func (ctx *Context) getVar(k string) (string, bool) {
 	return "", false
 }
 
+// assignScope returns the index of the closest scope where the variable is defined, without looking past
+// the current function scope (the one with the arguments), or the index of the local scope if it's not defined
+func (ctx *Context) assignScope(k string) int {
+	l := len(ctx.scopes) - 1
+
+	for i := l; i >= 0; i-- {
+		if _, ok := ctx.scopes[i][k]; ok {
+			return i
+		}
+		if _, ok := ctx.scopes[i]["#"]; ok { // function scope
+			break
+		}
+	}
+
+	return l
+}
+
 // setVar sets a variable in the current, parent or global scope
 func (ctx *Context) setVar(k string, v interface{}, scope Scope) string {
 	i := len(ctx.scopes) - 1 // index of local scope
@@ -264,6 +578,9 @@ func (ctx *Context) setVar(k string, v interface{}, scope Scope) string {
 	}
 
 	switch scope {
+	case InvalidScope:
+		i = ctx.assignScope(k)
+
 	case GlobalScope:
 		i = 0 // index of global scope
 
@@ -281,25 +598,187 @@ func (ctx *Context) setVar(k string, v interface{}, scope Scope) string {
 		}
 	}
 
-	//
-	// here we should convert complex types to a meaningful
-	// string representation (i.e. json)
-	//
+	// lists and maps are stored as they are (see GetValue), and their string value is the JSON representation
+	switch t := v.(type) {
+	case List, Dict:
+		if ctx.values[i] == nil {
+			ctx.values[i] = map[string]interface{}{}
+		}
 
-	/*
-	   switch t := v.(type) {
-	   case Dict:
-	       ;
+		ctx.values[i][k] = t
+		ctx.scopes[i][k] = jsonString(t)
 
-	   case Array:
-	       ;
-	   }
-	*/
+	default:
+		delete(ctx.values[i], k)
+		ctx.scopes[i][k] = fmt.Sprintf("%v", v)
+	}
 
-	ctx.scopes[i][k] = fmt.Sprintf("%v", v)
 	return ctx.scopes[i][k]
 }
 
+// jsonString returns the JSON representation of v (without escaping the HTML characters)
+func jsonString(v interface{}) string {
+	var b strings.Builder
+
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// GetValue returns the value of the specified variable from the closest scope:
+// a List for list variables, a Dict for map variables, or a string
+func (ctx *Context) GetValue(k string) (interface{}, bool) {
+	ctx.Lock()
+	defer ctx.Unlock()
+
+	for i := len(ctx.scopes) - 1; i >= 0; i-- {
+		if v, ok := ctx.scopes[i][k]; ok {
+			if value, ok := ctx.values[i][k]; ok {
+				return value, true
+			}
+
+			return v, true
+		}
+	}
+
+	return nil, false
+}
+
+// SortedKeys returns the keys of a map, sorted
+func SortedKeys(m Dict) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// GetVarIndex returns an element of a list or map variable: $name[i] (for lists negative indexes are from the end,
+// for maps i is the key), $name[@] (all the elements, separated by spaces and quoted if needed, in key order for maps)
+// or $name[#] (the number of elements). It returns false if the variable is not a list or a map.
+func (ctx *Context) GetVarIndex(k, index string) (string, bool) {
+	v, _ := ctx.GetValue(k)
+
+	var list List
+
+	switch t := v.(type) {
+	case List:
+		list = t
+
+	case Dict:
+		if index != "@" && index != "#" {
+			if v, ok := t[index]; ok {
+				return fmt.Sprintf("%v", v), true
+			}
+
+			return "", true
+		}
+
+		for _, key := range SortedKeys(t) {
+			list = append(list, t[key])
+		}
+
+	default:
+		return "", false
+	}
+
+	switch index {
+	case "@":
+		items := make([]string, len(list))
+		for i, item := range list {
+			items[i] = QuoteWord(fmt.Sprintf("%v", item))
+		}
+
+		return strings.Join(items, " "), true
+
+	case "#":
+		return strconv.Itoa(len(list)), true
+	}
+
+	i, ok := listIndex(list, index)
+	if !ok {
+		return "", true
+	}
+
+	return fmt.Sprintf("%v", list[i]), true
+}
+
+// listIndex parses the index of a list element (negative indexes are from the end),
+// returning false if it's not valid
+func listIndex(list List, index string) (int, bool) {
+	i, err := strconv.Atoi(strings.TrimSpace(index))
+	if err != nil {
+		return 0, false
+	}
+
+	if i < 0 {
+		i += len(list)
+	}
+
+	return i, i >= 0 && i < len(list)
+}
+
+// SetVarIndex sets an element of a list or map variable, in the closest scope where it's defined,
+// or removes it if v is nil
+func (ctx *Context) SetVarIndex(k, index string, v interface{}) error {
+	ctx.Lock()
+	defer ctx.Unlock()
+
+	for i := len(ctx.scopes) - 1; i >= 0; i-- {
+		if _, ok := ctx.scopes[i][k]; !ok {
+			continue
+		}
+
+		var value interface{}
+
+		switch t := ctx.values[i][k].(type) {
+		case List:
+			j, ok := listIndex(t, index)
+			if !ok {
+				return fmt.Errorf("%v: invalid index %v", k, index)
+			}
+
+			list := append(List(nil), t...) // a copy, since the previous value may be in use
+			if v == nil {
+				list = append(list[:j], list[j+1:]...)
+			} else {
+				list[j] = fmt.Sprintf("%v", v)
+			}
+
+			value = list
+
+		case Dict:
+			m := make(Dict, len(t))
+			for key, val := range t {
+				m[key] = val
+			}
+
+			if v == nil {
+				delete(m, index)
+			} else {
+				m[index] = fmt.Sprintf("%v", v)
+			}
+
+			value = m
+
+		default:
+			return fmt.Errorf("%v is not a list or a map", k)
+		}
+
+		ctx.values[i][k] = value
+		ctx.scopes[i][k] = jsonString(value)
+		return nil
+	}
+
+	return fmt.Errorf("%v is not set", k)
+}
+
 // GetAllVars return a copy of all variables available at the current scope
 func (ctx *Context) GetAllVars() (all Arguments) {
 	ctx.Lock()
@@ -326,8 +805,16 @@ func (ctx *Context) GetVarNames() (names []string) {
 	return
 }
 
+// ShiftArgs shifts the arguments of the local scope by n
 func (ctx *Context) ShiftArgs(n int) {
-	vars := ctx.GetScope(LocalScope)
+	ctx.Lock()
+	defer ctx.Unlock()
+
+	if len(ctx.scopes) == 0 {
+		panic("no scopes")
+	}
+
+	vars := ctx.scopes[len(ctx.scopes)-1]
 	if _, ok := vars["#"]; !ok {
 		return // no arguments
 	}
@@ -362,9 +849,63 @@ type BasicScanner interface {
 	Err() error
 }
 
+// Position is the position of a line in a script
+type Position struct {
+	Source string // the script name (i.e. the file name), if known
+	Line   int    // the line number, starting from 1 (0 if not known)
+}
+
+// String returns the position as source:line (or "line n" if the source is not known), or "" if the line is not known
+func (p Position) String() string {
+	switch {
+	case p.Line <= 0:
+		return ""
+	case p.Source == "":
+		return "line " + strconv.Itoa(p.Line)
+	default:
+		return p.Source + ":" + strconv.Itoa(p.Line)
+	}
+}
+
+// Errorf returns an error prefixed by the position, if known
+func (p Position) Errorf(format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+	if p.Line <= 0 {
+		return err
+	}
+
+	return fmt.Errorf("%v: %w", p, err)
+}
+
+// after returns the position n lines after p
+func (p Position) after(n int) Position {
+	if p.Line > 0 {
+		p.Line += n
+	}
+
+	return p
+}
+
+// position returns the position of the last line read by the scanner, if available
+func position(scanner BasicScanner) Position {
+	if s, ok := scanner.(interface{ Position() Position }); ok {
+		return s.Position()
+	}
+
+	return Position{}
+}
+
+// Block is the body of a block command (see ReadBlock)
+type Block struct {
+	Lines []string
+	Pos   Position // the position of the first line
+}
+
 // An implementation of basicScanner that works on a list of lines
 type ScanLines struct {
 	lines []string
+	n     int      // the number of lines read
+	pos   Position // the position of the first line
 }
 
 func (s *ScanLines) Scan(prompt string) bool {
@@ -377,6 +918,7 @@ func (s *ScanLines) Text() (text string) {
 	}
 
 	text, s.lines = s.lines[0], s.lines[1:]
+	s.n++
 	return
 }
 
@@ -384,15 +926,229 @@ func (s *ScanLines) Err() (err error) {
 	return
 }
 
+// Position returns the position of the last line read
+func (s *ScanLines) Position() Position {
+	return s.pos.after(s.n - 1)
+}
+
+// readBlock returns the lines up to the matching closing brace as a slice of the current lines, without copying them,
+// and the closing line
+func (s *ScanLines) readBlock() (block Block, last string, err error) {
+	start := s.Position()
+	b := braces{opened: 1}
+
+	for i, line := range s.lines {
+		if _, closed := b.next(line); closed {
+			block = Block{Lines: s.lines[:i:i], Pos: start.after(1)}
+			s.lines = s.lines[i+1:]
+			s.n += i + 1
+			return block, b.last, nil
+		}
+	}
+
+	s.n += len(s.lines)
+	s.lines = nil
+	return Block{}, "", start.Errorf("missing }")
+}
+
+// braces finds the end of a block in the lines that follow the opening one, as ReadLine reads them:
+// a line ending with "\\" continues on the next one, and the lines of a heredoc are not part of the block structure.
+type braces struct {
+	opened  int    // the nesting level (0 when the block is closed)
+	cont    string // the beginning of a line that continues on the next one
+	heredoc string // the terminator of the heredoc being read, if any
+	last    string // the last complete line (i.e. the closing one)
+}
+
+// next processes the next line, returning it as it should be stored in a block (trimmed, but for the heredoc lines)
+// and true if it closed the block
+func (b *braces) next(line string) (string, bool) {
+	if b.heredoc != "" {
+		if strings.TrimSpace(line) == b.heredoc {
+			b.heredoc = ""
+		}
+
+		return line, false
+	}
+
+	line = strings.TrimSpace(line)
+
+	l := line
+	if b.cont != "" {
+		l = b.cont + " " + line
+	}
+
+	if strings.HasSuffix(l, "\\") {
+		b.cont = strings.TrimSpace(strings.TrimRight(l, "\\"))
+		return line, false
+	}
+
+	b.cont = ""
+	b.last = stripComment(l)
+
+	if _, word, ok := heredoc(b.last); ok {
+		b.heredoc = word
+	}
+
+	b.opened = Nesting(b.last, b.opened)
+	return line, b.opened == 0
+}
+
+// ScanBraces is a scanner that reads the lines of a block from the enclosing scanner, up to the matching closing brace,
+// so that the block is executed as it's read, without storing it (see StreamBlock)
+type ScanBraces struct {
+	parent BasicScanner
+	start  Position // the position of the opening line
+	braces braces
+	text   string
+	closed bool
+}
+
+func (s *ScanBraces) Scan(prompt string) bool {
+	if s.closed || !s.parent.Scan(prompt) {
+		return false
+	}
+
+	s.text, s.closed = s.braces.next(s.parent.Text())
+	return !s.closed
+}
+
+func (s *ScanBraces) Text() string {
+	return s.text
+}
+
+func (s *ScanBraces) Err() error {
+	if s.closed {
+		return nil
+	}
+
+	return s.parent.Err()
+}
+
+// Position returns the position of the last line read
+func (s *ScanBraces) Position() Position {
+	return position(s.parent)
+}
+
+// Skip reads the rest of the block, if it was not executed or it was terminated (i.e. by break),
+// and returns the closing line (i.e. "} else {"), or an error if the block is not closed
+func (s *ScanBraces) Skip() (last string, err error) {
+	for s.Scan("") {
+	}
+
+	if !s.closed {
+		if err = s.Err(); err == nil {
+			err = s.start.Errorf("missing }")
+		}
+
+		return "", err
+	}
+
+	return s.braces.last, nil
+}
+
+// ReadPassword reads a line from the interactive line reader without echoing it.
+// If the line reader is not active (i.e. when reading from a file) it reads the next line from the current scanner.
+func (ctx *Context) ReadPassword(prompt string) (string, error) {
+	ctx.Lock()
+	line, scanning := ctx.line, ctx.scanner
+	ctx.Unlock()
+
+	if _, ok := scanning.(*ScanLiner); ok && line != nil {
+		return line.PasswordPrompt(prompt)
+	}
+
+	return ctx.readOneLine(prompt)
+}
+
+// ReadInput reads a line entered by the user (i.e. the answer to a question asked by a script) from the interactive
+// line reader, even when the commands are read from a file or a block, optionally without echoing it.
+// If the line reader is not active it reads the next line of the command loop input (see ScanInput),
+// or of the current scanner.
+func (ctx *Context) ReadInput(prompt string, silent bool) (string, error) {
+	ctx.Lock()
+	line, input := ctx.line, ctx.input
+	if input == nil {
+		input = ctx.scanner
+	}
+	ctx.Unlock()
+
+	if line == nil {
+		return scanLine(input, prompt)
+	}
+
+	prompt = StripANSI(prompt)
+
+	if silent {
+		text, err := line.PasswordPrompt(prompt)
+		if err == nil || err == io.EOF || err == ErrPromptAborted {
+			return text, err
+		}
+
+		// not supported by the terminal (i.e. the input is not a terminal): read the line as is
+	}
+
+	return line.Prompt(prompt)
+}
+
+// the ANSI escape sequences (colors and cursor movements)
+var reANSI = regexp.MustCompile("\x1b\\[[0-9;]*[A-Za-z]")
+
+// StripANSI removes the ANSI escape sequences from s
+func StripANSI(s string) string {
+	if !strings.Contains(s, "\x1b") {
+		return s
+	}
+
+	return reANSI.ReplaceAllString(s, "")
+}
+
+// RightPrompt adds a right aligned segment to a prompt, for a terminal with the specified width.
+//
+// Since the line editor redraws the whole input line, the segment is displayed at the end of the line above it:
+// the last line before the input line for a multi-line prompt, or a new line for a single line prompt.
+func RightPrompt(prompt, right string, width int) string {
+	header, input := "", prompt
+	if i := strings.LastIndexByte(prompt, '\n'); i >= 0 {
+		header, input = prompt[:i], prompt[i+1:]
+	}
+
+	prefix, last := "", header
+	if i := strings.LastIndexByte(header, '\n'); i >= 0 {
+		prefix, last = header[:i+1], header[i+1:]
+	}
+
+	// width-1, since writing the last column may wrap the line
+	pad := width - 1 - utf8.RuneCountInString(StripANSI(last)) - utf8.RuneCountInString(StripANSI(right))
+	if pad < 1 {
+		pad = 1
+	}
+
+	return prefix + last + strings.Repeat(" ", pad) + right + "\n" + input
+}
+
 // An implementation of basicScanner that works with "liner"
 type ScanLiner struct {
-	line *liner.State
+	ctx  *Context // the line reader may be restarted, so always get the current one
 	text string
 	err  error
 }
 
 func (s *ScanLiner) Scan(prompt string) bool {
-	s.text, s.err = s.line.Prompt(prompt)
+	s.ctx.Lock()
+	line := s.ctx.line
+	s.ctx.Unlock()
+
+	// the line editor only supports single line prompts without escape sequences,
+	// so the lines before the last one are printed here
+	if i := strings.LastIndexByte(prompt, '\n'); i >= 0 {
+		fmt.Print(prompt[:i+1])
+		prompt = prompt[i+1:]
+	}
+
+	prompt = StripANSI(prompt)
+
+	s.text, s.err = line.Prompt(prompt)
 	return s.err == nil
 }
 
@@ -406,11 +1162,18 @@ func (s *ScanLiner) Err() error {
 
 // An implementation of basicScanner that works with an io.Reader (wrapped in a bufio.Scanner)
 type ScanReader struct {
-	sr *bufio.Scanner
+	sr     *bufio.Scanner
+	n      int    // the number of lines read
+	source string // the script name, if known
 }
 
 func (s *ScanReader) Scan(prompt string) bool {
-	return s.sr.Scan()
+	if s.sr.Scan() {
+		s.n++
+		return true
+	}
+
+	return false
 }
 
 func (s *ScanReader) Text() string {
@@ -421,6 +1184,21 @@ func (s *ScanReader) Err() error {
 	return s.sr.Err()
 }
 
+// Position returns the position of the last line read
+func (s *ScanReader) Position() Position {
+	return Position{Source: s.source, Line: s.n}
+}
+
+// Position returns the position in the script of the last line read by the current scanner
+// (for a block, the position in the script that defined it), if available
+func (ctx *Context) Position() Position {
+	ctx.Lock()
+	scanner := ctx.scanner
+	ctx.Unlock()
+
+	return position(scanner)
+}
+
 // SetScanner sets the current scanner and return the previos one
 func (ctx *Context) SetScanner(curr BasicScanner) (prev BasicScanner) {
 	ctx.Lock()
@@ -432,17 +1210,52 @@ func (ctx *Context) SetScanner(curr BasicScanner) (prev BasicScanner) {
 
 // ScanLiner sets the current scanner to a "liner" scanner
 func (ctx *Context) ScanLiner() BasicScanner {
-	return ctx.SetScanner(&ScanLiner{line: ctx.line})
+	return ctx.SetScanner(&ScanLiner{ctx: ctx})
+}
+
+// ScanningLiner returns true if the current scanner is the "liner" scanner
+func (ctx *Context) ScanningLiner() bool {
+	ctx.Lock()
+	defer ctx.Unlock()
+
+	_, ok := ctx.scanner.(*ScanLiner)
+	return ok
+}
+
+// ScanBlock sets the current scanner to a block scanner, for the lines of a block starting at the specified position
+func (ctx *Context) ScanBlock(block []string, pos Position) BasicScanner {
+	return ctx.SetScanner(&ScanLines{lines: block, pos: pos})
+}
+
+// ScanReader sets the current scanner to an io.Reader scanner. The source is the script name (i.e. the file name),
+// to report the position of the lines (see Position), or "" if not known.
+func (ctx *Context) ScanReader(r io.Reader, source string) BasicScanner {
+	return ctx.SetScanner(&ScanReader{sr: bufio.NewScanner(r), source: source})
 }
 
-// ScanBlock sets the current scanner to a block scanner
-func (ctx *Context) ScanBlock(block []string) BasicScanner {
-	return ctx.SetScanner(&ScanLines{lines: block})
+// StreamBlock returns a scanner that reads the lines of the block opened by the last line read (that ends with "{")
+// from the current scanner, so that the block is executed as it's read (see ScanBraces).
+// It returns nil when reading from the interactive line reader: the block should be read with ReadBlock, before executing it.
+func (ctx *Context) StreamBlock() *ScanBraces {
+	ctx.Lock()
+	defer ctx.Unlock()
+
+	if _, ok := ctx.scanner.(*ScanLiner); ok || ctx.scanner == nil {
+		return nil
+	}
+
+	return &ScanBraces{parent: ctx.scanner, start: position(ctx.scanner), braces: braces{opened: 1}}
 }
 
-// ScanReader sets the current scanner to an io.Reader scanner
-func (ctx *Context) ScanReader(r io.Reader) BasicScanner {
-	return ctx.SetScanner(&ScanReader{sr: bufio.NewScanner(r)})
+// ScanInput sets the current scanner to a reader scanner, and records it as the command loop input (see ReadInput)
+func (ctx *Context) ScanInput(r io.Reader) BasicScanner {
+	prev := ctx.ScanReader(r, "")
+
+	ctx.Lock()
+	ctx.input = ctx.scanner
+	ctx.Unlock()
+
+	return prev
 }
 
 func (ctx *Context) readOneLine(prompt string) (line string, err error) {
@@ -450,6 +1263,11 @@ func (ctx *Context) readOneLine(prompt string) (line string, err error) {
 	scanner := ctx.scanner
 	ctx.Unlock()
 
+	return scanLine(scanner, prompt)
+}
+
+// scanLine reads the next line from the scanner, returning io.EOF at the end of the input
+func scanLine(scanner BasicScanner, prompt string) (line string, err error) {
 	if scanner == nil {
 		panic("nil scanner")
 	}
@@ -469,6 +1287,9 @@ func (ctx *Context) readOneLine(prompt string) (line string, err error) {
 func (ctx *Context) ReadLine(prompt, cont string) (line string, err error) {
 	line, err = ctx.readOneLine(prompt)
 	if err != nil {
+		if pos := ctx.Position(); pos.Line > 0 && err != io.EOF {
+			err = pos.Errorf("%w", err)
+		}
 		return
 	}
 
@@ -490,94 +1311,207 @@ func (ctx *Context) ReadLine(prompt, cont string) (line string, err error) {
 		line += " " + strings.TrimSpace(l)
 	}
 
+	line = stripComment(line)
+
+	//
+	// replace a heredoc marker with the following lines, up to the terminator
+	//
+	if prefix, word, ok := heredoc(line); ok {
+		var body []string
+
+		for {
+			l, err := ctx.readOneLine(cont)
+			if err != nil {
+				return "", ctx.Position().Errorf("missing heredoc terminator %q", word)
+			}
+
+			if strings.TrimSpace(l) == word {
+				break
+			}
+
+			body = append(body, l)
+		}
+
+		line = prefix + strings.Join(body, "\n")
+	}
+
 	return
 }
 
-func (ctx *Context) ReadBlock(body, next, cont string) ([]string, []string, error) {
-	if !strings.HasSuffix(body, "{") { // one line body
-		body := strings.Replace(body, "\\$", "$", -1) // for one-liners variables should be escaped
-		return []string{body}, nil, nil
+// stripComment removes a trailing comment from the line: a "#" at the beginning of the line or after a space,
+// outside of quotes (so that "$#" or "a#b" are not comments)
+func stripComment(line string) string {
+	if !strings.Contains(line, "#") || strings.HasPrefix(line, "#") { // a comment line is skipped as is
+		return line
 	}
 
-	if body != "{" { // we can't do inline command + body
-		return nil, nil, fmt.Errorf("unexpected body and block")
+	ScanLine(line, func(i, depth int, quoted bool) bool {
+		if !quoted && line[i] == '#' && (line[i-1] == ' ' || line[i-1] == '\t') {
+			line = strings.TrimSpace(line[:i])
+			return false
+		}
+
+		return true
+	})
+
+	return line
+}
+
+var reHeredocWord = regexp.MustCompile(`^([A-Za-z_]\w*|'[A-Za-z_]\w*'|"[A-Za-z_]\w*")$`)
+
+// heredoc checks if the line ends with a heredoc marker (<<WORD, <<'WORD' or <<"WORD", outside quotes)
+// and returns the line before the marker and the terminator word.
+//
+// The marker should follow the command (and its arguments) after a space, and the word should be an identifier
+// right after the <<, so that a shift (i.e. "let y = 1 << 2" or "x<<y") is not taken for a heredoc.
+func heredoc(line string) (prefix, word string, ok bool) {
+	i := strings.LastIndex(line, "<<")
+	if i <= 0 || line[i-1] != ' ' || strings.TrimSpace(line[:i]) == "" {
+		return
 	}
 
-	opened := 1
-	var block1, block2 []string
-	var line string
-	var err error
+	word = line[i+2:]
+	if !reHeredocWord.MatchString(word) {
+		return
+	}
 
-	for {
+	ScanLine(line[:i+1], func(j, depth int, quoted bool) bool {
+		ok = j == i && !quoted
+		return true
+	})
 
-		line, err = ctx.ReadLine(cont, cont)
-		if err != nil {
-			return nil, nil, err
-		}
+	if !ok {
+		return "", "", false
+	}
 
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "#") || line == "" {
-			block1 = append(block1, line)
-			continue
+	return line[:i], strings.Trim(word, `'"`), true
+}
+
+// HeredocTerminator returns the terminator of the heredoc started by the line, if it ends with a heredoc marker
+// (the following lines, up to the terminator, are the content of the heredoc)
+func HeredocTerminator(line string) (string, bool) {
+	_, word, ok := heredoc(stripComment(strings.TrimSpace(line)))
+	return word, ok
+}
+
+// Nesting returns the nesting level after line, given the current one (0 means that the block is closed)
+func Nesting(line string, opened int) int {
+	if strings.HasPrefix(line, "#") || line == "" {
+		return opened
+	}
+
+	if strings.HasPrefix(line, "}") {
+		opened -= 1
+		if opened <= 0 {
+			return 0
 		}
+	}
+	if strings.HasSuffix(line, "{") {
+		opened += 1
+	}
 
-		if strings.HasPrefix(line, "}") {
-			opened -= 1
-			if opened <= 0 { // close first block
-				break
-			}
+	return opened
+}
+
+// readBraces reads the lines up to the matching closing brace and returns them, with the closing line.
+//
+// When reading from a block (i.e. a nested block in a function or loop body) the lines are sliced from
+// the enclosing block instead of being copied, so that the memory used doesn't grow with the nesting level.
+// The lines are stored as they are read (see braces), so that the position of each line in the script is known.
+func (ctx *Context) readBraces(cont string) (block Block, last string, err error) {
+	ctx.Lock()
+	scanner := ctx.scanner
+	ctx.Unlock()
+
+	if sl, ok := scanner.(*ScanLines); ok {
+		return sl.readBlock()
+	}
+
+	start := position(scanner)
+	block.Pos = start.after(1)
+	b := braces{opened: 1}
+
+	for {
+		line, err := scanLine(scanner, cont)
+		if err == io.EOF {
+			return Block{}, "", start.Errorf("missing }")
 		}
-		if strings.HasSuffix(line, "{") {
-			opened += 1
+		if err != nil {
+			return Block{}, "", err
+		}
+
+		line, closed := b.next(line)
+		if closed {
+			return block, b.last, nil
 		}
 
-		block1 = append(block1, line)
+		block.Lines = append(block.Lines, line)
 	}
+}
 
-	line = strings.TrimPrefix(line, "}")
-	line = strings.TrimSpace(line)
+// ReadBlock reads a block (one line body, or lines enclosed in braces), optionally followed by a
+// second block introduced by `next` (i.e. "else").
+//
+// When next is "else" the first block can also be followed by "} elif condition {", and the second block
+// is the rest of the chain as an if command: "if condition {", followed by the lines up to the last closing brace.
+func (ctx *Context) ReadBlock(body, next, cont string) (Block, Block, error) {
+	if !strings.HasSuffix(body, "{") { // one line body
+		body := strings.Replace(body, "\\$", "$", -1) // for one-liners variables should be escaped
+		return Block{Lines: []string{body}, Pos: ctx.Position()}, Block{}, nil
+	}
 
-	if strings.HasPrefix(line, "#") || line == "" {
-		return block1, nil, nil
+	if body != "{" { // we can't do inline command + body
+		return Block{}, Block{}, ctx.Position().Errorf("unexpected body and block")
 	}
 
-	if next != "" && !strings.HasPrefix(line, next) {
-		return nil, nil, fmt.Errorf("expected %q, got %q", next, line)
+	block1, line, err := ctx.readBraces(cont)
+	if err != nil {
+		return Block{}, Block{}, err
 	}
 
-	line = line[len(next):]
+	line = strings.TrimPrefix(line, "}")
 	line = strings.TrimSpace(line)
 
-	if line != "{" {
-		return nil, nil, fmt.Errorf("expected }, got %q", line)
+	if strings.HasPrefix(line, "#") || line == "" {
+		return block1, Block{}, nil
 	}
 
-	opened = 1
+	if cond, ok := strings.CutPrefix(line, "elif "); ok && next == "else" {
+		if cond = strings.TrimSpace(cond); !strings.HasSuffix(cond, "{") {
+			return Block{}, Block{}, ctx.Position().Errorf("expected {, got %q", line)
+		}
 
-	for {
+		// "if condition {" replaces "} elif condition {", so that the lines keep their position
+		block2 := Block{Lines: []string{"if " + cond}, Pos: ctx.Position()}
 
-		line, err = ctx.ReadLine(cont, cont)
-		if err != nil {
-			return nil, nil, err
-		}
+		for {
+			part, last, err := ctx.readBraces(cont)
+			if err != nil {
+				return Block{}, Block{}, err
+			}
 
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "#") || line == "" {
-			block2 = append(block2, line)
-			continue
-		}
+			block2.Lines = append(append(block2.Lines, part.Lines...), last)
 
-		if strings.HasPrefix(line, "}") {
-			opened -= 1
-			if opened <= 0 { // close second block
-				break
+			if rest := strings.TrimSpace(strings.TrimPrefix(last, "}")); !strings.HasPrefix(rest, "else") && !strings.HasPrefix(rest, "elif ") {
+				return block1, block2, nil
 			}
 		}
-		if strings.HasSuffix(line, "{") {
-			opened += 1
-		}
+	}
+
+	if next != "" && !strings.HasPrefix(line, next) {
+		return Block{}, Block{}, ctx.Position().Errorf("expected %q, got %q", next, line)
+	}
 
-		block2 = append(block2, line)
+	line = line[len(next):]
+	line = strings.TrimSpace(line)
+
+	if line != "{" {
+		return Block{}, Block{}, ctx.Position().Errorf("expected }, got %q", line)
+	}
+
+	block2, _, err := ctx.readBraces(cont)
+	if err != nil {
+		return Block{}, Block{}, err
 	}
 
 	return block1, block2, nil
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/peterh/liner"
+)
+
+// ErrPromptAborted is returned by LineReader.Prompt when Ctrl-C is pressed, if SetCtrlCAborts(true) was called
+var ErrPromptAborted = liner.ErrPromptAborted
+
+// LineReader is the interactive line editor used by the command loop
+// (the default implementation is based on github.com/peterh/liner)
+type LineReader interface {
+	// Prompt displays the prompt and returns the line entered by the user (without the newline)
+	Prompt(prompt string) (string, error)
+	// PasswordPrompt displays the prompt and returns the line entered by the user, without echoing it
+	PasswordPrompt(prompt string) (string, error)
+
+	// AppendHistory adds a line to the history
+	AppendHistory(line string)
+	// ReadHistory loads the history, one line per entry
+	ReadHistory(r io.Reader) (int, error)
+	// WriteHistory saves the history, one line per entry
+	WriteHistory(w io.Writer) (int, error)
+
+	// SetWordCompleter sets the completion function, that returns the completions for the word at pos
+	// and the text before (head) and after (tail) it
+	SetWordCompleter(f func(line string, pos int) (head string, completions []string, tail string))
+	// SetCtrlCAborts sets if Ctrl-C should abort Prompt, returning ErrPromptAborted
+	SetCtrlCAborts(aborts bool)
+
+	// Close restores the terminal mode
+	Close() error
+}
+
+// linerReader is a LineReader based on github.com/peterh/liner
+type linerReader struct {
+	*liner.State
+}
+
+// NewLinerReader returns the default LineReader
+func NewLinerReader() LineReader {
+	return linerReader{liner.NewLiner()}
+}
+
+func (r linerReader) SetWordCompleter(f func(line string, pos int) (head string, completions []string, tail string)) {
+	r.State.SetWordCompleter(f)
+}
+
+// ErrKeyBindings is returned by Context.BindKey when the line reader doesn't implement KeyBinder
+var ErrKeyBindings = errors.New("the line reader doesn't support key bindings")
+
+// KeyHandler is called when a bound key is pressed while editing a line.
+// It receives the line and the cursor position and returns the new line and cursor position.
+type KeyHandler func(line string, pos int) (string, int)
+
+// KeyBinder is implemented by the LineReaders that support custom key bindings
+// (the default one, based on liner, doesn't)
+type KeyBinder interface {
+	// BindKey sets the handler for the key (see ParseKey for the key names), or removes it if f is nil
+	BindKey(key string, f KeyHandler)
+}
+
+// ParseKey validates a key name and returns it in canonical form.
+// Valid names are ctrl-a to ctrl-z, alt-a to alt-z and f1 to f12 (case insensitive, "+" is also accepted as separator).
+func ParseKey(name string) (string, error) {
+	key := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(name), "+", "-"))
+
+	if mod, k, ok := strings.Cut(key, "-"); ok && (mod == "ctrl" || mod == "alt") {
+		if len(k) == 1 && k[0] >= 'a' && k[0] <= 'z' {
+			return key, nil
+		}
+	} else if n, err := strconv.Atoi(strings.TrimPrefix(key, "f")); err == nil && key[0] == 'f' && n >= 1 && n <= 12 {
+		return key, nil
+	}
+
+	return "", fmt.Errorf("invalid key: %q", name)
+}
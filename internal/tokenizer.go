@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"strconv"
+	"strings"
+)
+
+// The tokenizer shared by the command line parsing (pipelines, multiple commands, comments, heredocs,
+// shell redirections) and the plugins, so that quoting works the same everywhere:
+//
+//   - "...", '...' and `...` are quoted strings
+//   - a backslash escapes the next character (also in quoted strings)
+//   - (...), [...], {...} and the variable references $(...) and ${...} are nested, and their content
+//     is not split
+
+// ScanLine calls f for each character of line with its index, the nesting level of the brackets at that index
+// (the opening and closing brackets are at the outer level) and true if the character is quoted or escaped
+// (including the quotes and the backslash). The scan stops when f returns false.
+func ScanLine(line string, f func(i, depth int, quoted bool) bool) {
+	var quote byte
+	var escape bool
+	var depth int
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		quoted := true
+
+		switch {
+		case escape:
+			escape = false
+
+		case c == '\\':
+			escape = true
+
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+
+		case c == '"' || c == '\'' || c == '`':
+			quote = c
+
+		case c == ')' || c == ']' || c == '}':
+			if depth > 0 {
+				depth--
+			}
+			quoted = false
+
+		default:
+			quoted = false
+		}
+
+		if !f(i, depth, quoted) {
+			return
+		}
+
+		if !quoted && (c == '(' || c == '[' || c == '{') {
+			depth++
+		}
+	}
+}
+
+// SplitLine splits the line at the separators (the indexes for which isSep returns true)
+// outside of quotes and brackets, and trims the parts
+func SplitLine(line string, isSep func(i int) bool) (parts []string) {
+	start := 0
+
+	ScanLine(line, func(i, depth int, quoted bool) bool {
+		if !quoted && depth == 0 && isSep(i) {
+			parts = append(parts, strings.TrimSpace(line[start:i]))
+			start = i + 1
+		}
+
+		return true
+	})
+
+	return append(parts, strings.TrimSpace(line[start:]))
+}
+
+// Words splits the line in words separated by spaces outside of quotes and brackets
+// (i.e. name="a b" or $.items[?(@.name == 'x y')] are single words), removing the enclosing quotes (see Unquote).
+// If n > 0 the line is split in at most n words, and the last one is the rest of the line, as is.
+func Words(line string, n int) (words []string) {
+	start := -1
+
+	ScanLine(line, func(i, depth int, quoted bool) bool {
+		space := !quoted && depth == 0 && (line[i] == ' ' || line[i] == '\t')
+
+		switch {
+		case space && start >= 0:
+			words = append(words, Unquote(line[start:i]))
+			start = -1
+
+		case !space && start < 0:
+			if n > 0 && len(words) == n-1 {
+				words = append(words, strings.TrimSpace(line[i:]))
+				start = len(line)
+				return false
+			}
+
+			start = i
+		}
+
+		return true
+	})
+
+	if start >= 0 && start < len(line) {
+		words = append(words, Unquote(line[start:]))
+	}
+
+	return
+}
+
+// Unquote removes the quotes enclosing s, if any ("..." is unquoted as a Go string, '...' and `...` as is)
+func Unquote(s string) string {
+	if len(s) >= 2 {
+		switch s[0] {
+		case '"':
+			if u, err := strconv.Unquote(s); err == nil {
+				return u
+			}
+
+		case '\'', '`':
+			if s[len(s)-1] == s[0] {
+				return s[1 : len(s)-1]
+			}
+		}
+	}
+
+	return s
+}
+
+// QuoteWord quotes s if it's empty or it contains spaces, quotes or brackets, so that it's split as a single word
+func QuoteWord(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"'`\\()[]{}") {
+		return strconv.Quote(s)
+	}
+
+	return s
+}
+
+// IsNameChar returns true if c can be part of a variable name
+func IsNameChar(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+// IsName returns true if s is a valid variable name
+func IsName(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if !IsNameChar(s[i]) {
+			return false
+		}
+	}
+
+	return true
+}
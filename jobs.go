@@ -0,0 +1,286 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JobState is the state of a background job
+type JobState int
+
+const (
+	// JobRunning means the job command is running (or waiting for a worker, with go --start or go --pool)
+	JobRunning JobState = iota
+
+	// JobDone means the job command returned
+	JobDone
+
+	// JobKilled means the job was killed with the kill command (or KillJob)
+	JobKilled
+)
+
+func (s JobState) String() string {
+	switch s {
+	case JobRunning:
+		return "running"
+	case JobDone:
+		return "done"
+	case JobKilled:
+		return "killed"
+	default:
+		return "invalid job state"
+	}
+}
+
+// Job is a command started in background with the go command
+type Job struct {
+	ID    int
+	Line  string
+	State JobState
+	Start time.Time
+	End   time.Time // zero while the job is running
+
+	ctx    context.Context // cancelled when the job terminates
+	cancel context.CancelFunc
+	cmd    *Cmd // the interpreter that executes the job (see fork)
+}
+
+// Elapsed returns the job running time
+func (j *Job) Elapsed() time.Duration {
+	if j.End.IsZero() {
+		return time.Since(j.Start)
+	}
+
+	return j.End.Sub(j.Start)
+}
+
+// Context returns the job context, that is cancelled when the job terminates or it's killed
+func (j *Job) Context() context.Context {
+	return j.ctx
+}
+
+// jobOwner returns the interpreter that keeps the list of jobs: the jobs started by a job are listed with the others
+func (cmd *Cmd) jobOwner() *Cmd {
+	for cmd.parent != nil {
+		cmd = cmd.parent
+	}
+
+	return cmd
+}
+
+// startJob executes the command line in a new goroutine (or via the runner, if set) and returns the job.
+// The job is executed by its own interpreter (see fork), with the job context.
+func (cmd *Cmd) startJob(line string) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{Line: line, State: JobRunning, Start: time.Now(), ctx: ctx, cancel: cancel, cmd: cmd.fork(ctx)}
+
+	owner := cmd.jobOwner()
+
+	owner.Lock()
+	owner.lastJob++
+	job.ID = owner.lastJob
+	owner.jobs = append(owner.jobs, job)
+	runner := owner.runner
+	owner.Unlock()
+
+	run := func() {
+		if ctx.Err() == nil { // not killed while waiting for a worker
+			if runner != nil {
+				job.cmd.Println("RUN", line)
+			}
+
+			job.cmd.runOne(line)
+		}
+
+		cmd.endJob(job, JobDone)
+	}
+
+	if runner == nil {
+		go run()
+	} else {
+		runner.Run(run)
+	}
+
+	return job
+}
+
+// endJob sets the final state of the job, if it's still running, and cancels its context
+func (cmd *Cmd) endJob(job *Job, state JobState) {
+	owner := cmd.jobOwner()
+
+	owner.Lock()
+	if job.State == JobRunning {
+		job.State, job.End = state, time.Now()
+	}
+	owner.Unlock()
+
+	job.cancel()
+}
+
+// Jobs returns a copy of the jobs started with the go command, running or terminated
+// (until removed with "jobs --clear")
+func (cmd *Cmd) Jobs() []Job {
+	owner := cmd.jobOwner()
+
+	owner.RLock()
+	defer owner.RUnlock()
+
+	jobs := make([]Job, 0, len(owner.jobs))
+	for _, j := range owner.jobs {
+		jobs = append(jobs, *j)
+	}
+
+	return jobs
+}
+
+// getJob returns the job with the specified id
+func (cmd *Cmd) getJob(id int) (*Job, error) {
+	owner := cmd.jobOwner()
+
+	owner.RLock()
+	defer owner.RUnlock()
+
+	for _, j := range owner.jobs {
+		if j.ID == id {
+			return j, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no such job: %v", id)
+}
+
+// WaitJob waits for the job with the specified id to terminate
+func (cmd *Cmd) WaitJob(id int) error {
+	job, err := cmd.getJob(id)
+	if err != nil {
+		return err
+	}
+
+	<-job.ctx.Done()
+	return nil
+}
+
+// KillJob kills the job with the specified id, cancelling its context.
+//
+// A job waiting for a worker is not started. A running command is interrupted as with Ctrl-C:
+// the loops and scripts terminate, and the context returned by Context is cancelled (so Sleep returns).
+// Since a goroutine can't be stopped, a command that doesn't check them keeps running until it returns,
+// but the job is terminated and it's not waited on anymore.
+func (cmd *Cmd) KillJob(id int) error {
+	job, err := cmd.getJob(id)
+	if err != nil {
+		return err
+	}
+
+	job.cmd.setInterrupted(true)
+	cmd.endJob(job, JobKilled)
+	return nil
+}
+
+// clearJobs removes the terminated jobs
+func (cmd *Cmd) clearJobs() {
+	owner := cmd.jobOwner()
+
+	owner.Lock()
+	defer owner.Unlock()
+
+	jobs := owner.jobs[:0]
+	for _, j := range owner.jobs {
+		if j.State == JobRunning {
+			jobs = append(jobs, j)
+		}
+	}
+
+	owner.jobs = jobs
+}
+
+// parseJobID parses a job id, as "n" or "%n"
+func parseJobID(s string) (int, error) {
+	id, err := strconv.Atoi(strings.TrimPrefix(s, "%"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid job id: %v", s)
+	}
+
+	return id, nil
+}
+
+func (cmd *Cmd) command_jobs(line string) (stop bool) {
+	if line == "--clear" {
+		cmd.clearJobs()
+		return
+	} else if line != "" {
+		cmd.Println("usage: jobs [--clear]")
+		return
+	}
+
+	jobs := cmd.Jobs()
+
+	if cmd.JSONOutput() {
+		list := make([]map[string]interface{}, 0, len(jobs))
+		for _, j := range jobs {
+			list = append(list, map[string]interface{}{
+				"id":      j.ID,
+				"state":   j.State.String(),
+				"elapsed": j.Elapsed().Seconds(),
+				"command": j.Line,
+			})
+		}
+
+		cmd.PrintJSON(list)
+		return
+	}
+
+	for _, j := range jobs {
+		cmd.Printf("[%v] %-8v %10v  %v\n", j.ID, j.State, j.Elapsed().Round(time.Millisecond), j.Line)
+	}
+
+	return
+}
+
+func (cmd *Cmd) command_wait(line string) (stop bool) {
+	if line == "" { // wait for all jobs
+		for _, j := range cmd.Jobs() {
+			cmd.WaitJob(j.ID)
+		}
+
+		return
+	}
+
+	for _, s := range strings.Fields(line) {
+		id, err := parseJobID(s)
+		if err == nil {
+			err = cmd.WaitJob(id)
+		}
+
+		if err != nil {
+			cmd.setFailure(err)
+			cmd.Println(err)
+		}
+	}
+
+	return
+}
+
+func (cmd *Cmd) command_kill(line string) (stop bool) {
+	if line == "" {
+		cmd.Println("usage: kill id...")
+		return
+	}
+
+	for _, s := range strings.Fields(line) {
+		id, err := parseJobID(s)
+		if err == nil {
+			err = cmd.KillJob(id)
+		}
+
+		if err != nil {
+			cmd.setFailure(err)
+			cmd.Println(err)
+		}
+	}
+
+	return
+}
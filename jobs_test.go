@@ -0,0 +1,211 @@
+package cmd_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gobs/cmd"
+	"github.com/gobs/cmd/plugins/controlflow"
+)
+
+// syncBuffer is a buffer that can be written by concurrent jobs
+type syncBuffer struct {
+	sync.Mutex
+	b bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.b.String()
+}
+
+// newInterpreter returns an interpreter with the controlflow plugin, and a "record" command
+// that records its parameters (added for each job, via OnSession)
+func newInterpreter(records *syncBuffer) *cmd.Cmd {
+	c := &cmd.Cmd{Output: &syncBuffer{}}
+	c.Init(controlflow.Plugin)
+	c.SetStderr(&syncBuffer{})
+
+	c.OnSession = func(s *cmd.Cmd) {
+		s.Add(cmd.Command{Name: "record", Call: func(line string) bool {
+			fmt.Fprintln(records, line)
+			return false
+		}})
+	}
+	c.OnSession(c)
+	return c
+}
+
+func TestJobsLocalVariables(t *testing.T) {
+	var records syncBuffer
+	c := newInterpreter(&records)
+
+	script := `
+function f(n) {
+    foreach --range=0:49 {
+        var --local seen $n
+        record $n $item $seen
+    }
+}
+go f 1
+go f 2
+go f 3
+wait
+`
+	if !c.RunScript(strings.NewReader(script)) {
+		t.Fatal("script failed")
+	}
+
+	next := map[string]int{}
+
+	for _, line := range strings.Split(strings.TrimSpace(records.String()), "\n") {
+		var n, seen string
+		var item int
+
+		if _, err := fmt.Sscan(line, &n, &item, &seen); err != nil {
+			t.Fatalf("invalid record %q: %v", line, err)
+		}
+
+		if seen != n || item != next[n] {
+			t.Errorf("job %v: got %q, want item %v", n, line, next[n])
+		}
+
+		next[n] = item + 1
+	}
+
+	for _, n := range []string{"1", "2", "3"} {
+		if next[n] != 50 {
+			t.Errorf("job %v: got %v iterations, want 50", n, next[n])
+		}
+	}
+
+	if v, ok := c.GetVar("n"); ok {
+		t.Errorf("the job arguments changed the caller variables: n=%q", v)
+	}
+}
+
+func TestJobsGlobalVariables(t *testing.T) {
+	c := newInterpreter(&syncBuffer{})
+
+	script := `
+var total 0
+function add {
+    foreach --range=0:19 var --global --incr total
+}
+go add
+go add
+wait
+`
+	if !c.RunScript(strings.NewReader(script)) {
+		t.Fatal("script failed")
+	}
+
+	if v, _ := c.GetVar("total"); v != "40" {
+		t.Errorf("got total=%v, want 40", v)
+	}
+}
+
+func TestJobsOutputCapture(t *testing.T) {
+	c := newInterpreter(&syncBuffer{})
+
+	if !c.RunScript(strings.NewReader("go repeat --count=200 echo job")) {
+		t.Fatal("script failed")
+	}
+
+	for i := 0; i < 100; i++ {
+		if out, _ := c.CaptureOutput("echo main"); out != "main" {
+			t.Fatalf("captured %q, want %q", out, "main")
+		}
+	}
+
+	c.RunScript(strings.NewReader("wait"))
+
+	if out := c.Output.(*syncBuffer).String(); strings.Contains(out, "main") || !strings.Contains(out, "job") {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestKillJob(t *testing.T) {
+	var records syncBuffer
+	c := newInterpreter(&records)
+	started, done := make(chan bool), make(chan error, 1)
+
+	onSession := c.OnSession
+	c.OnSession = func(s *cmd.Cmd) {
+		onSession(s)
+		s.Add(cmd.Command{Name: "block", Call: func(string) bool {
+			close(started)
+			<-s.Context().Done()
+			done <- s.Context().Err()
+			return false
+		}})
+	}
+
+	script := `
+function nap {
+    record napping
+    sleep 10s
+    record slept
+}
+go block
+go nap
+`
+	if !c.RunScript(strings.NewReader(script)) {
+		t.Fatal("script failed")
+	}
+
+	<-started
+
+	for !strings.Contains(records.String(), "napping") {
+		time.Sleep(time.Millisecond)
+	}
+
+	jobs := c.Jobs()
+	if len(jobs) != 2 {
+		t.Fatalf("got %v jobs, want 2", len(jobs))
+	}
+
+	start := time.Now()
+
+	for _, j := range jobs {
+		if err := c.KillJob(j.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("the job context was not cancelled")
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("the killed job is still running")
+	}
+
+	for _, j := range c.Jobs() {
+		if j.State != cmd.JobKilled {
+			t.Errorf("job %v: got state %v, want killed", j.ID, j.State)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond) // the sleep job returns, without executing the next command
+	if out := records.String(); out != "napping\n" {
+		t.Errorf("the killed job executed %q", out)
+	}
+
+	if time.Since(start) > 5*time.Second {
+		t.Error("the job was not interrupted")
+	}
+}
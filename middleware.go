@@ -0,0 +1,66 @@
+package cmd
+
+// Handler executes a command line, returning true to terminate the interpreter
+type Handler func(line string) (stop bool)
+
+// Middleware wraps a Handler, to add behavior before and/or after the command execution
+// (i.e. timing, logging, access control, retries).
+// It can also skip the execution, by not calling next.
+type Middleware func(next Handler) Handler
+
+// Use adds one or more middlewares to the command execution chain.
+//
+// The first middleware added is the outermost one, so it's called first and it returns last.
+// The innermost handler is OneCmd, so the middlewares are called for each command line executed
+// by the interpreter (interactively, via RunScript, Execute or inside blocks), after PreCmd
+// and before PostCmd.
+//
+// Unlike PreCmd, PostCmd and OneCmd, that can only be set once, middlewares added by different
+// plugins and by the application don't replace each other.
+func (cmd *Cmd) Use(m ...Middleware) {
+	cmd.registry.Lock()
+	for i := range m {
+		cmd.middleware = append(cmd.middleware, &m[i])
+	}
+	cmd.registry.Unlock()
+}
+
+// removeMiddleware removes the specified middlewares from the chain
+func (cmd *Cmd) removeMiddleware(remove []*Middleware) {
+	if len(remove) == 0 {
+		return
+	}
+
+	cmd.registry.Lock()
+	defer cmd.registry.Unlock()
+
+	middleware := cmd.middleware[:0:0]
+
+	for _, m := range cmd.middleware {
+		removed := false
+		for _, r := range remove {
+			if m == r {
+				removed = true
+				break
+			}
+		}
+
+		if !removed {
+			middleware = append(middleware, m)
+		}
+	}
+
+	cmd.middleware = middleware
+}
+
+// handler returns the middleware chain, wrapped around h
+func (cmd *Cmd) handler(h Handler) Handler {
+	cmd.registry.RLock()
+	defer cmd.registry.RUnlock()
+
+	for i := len(cmd.middleware) - 1; i >= 0; i-- {
+		h = (*cmd.middleware[i])(h)
+	}
+
+	return h
+}
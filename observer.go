@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"time"
+)
+
+// Observer is notified of the execution of the commands (see Cmd.Observer),
+// i.e. to collect metrics about the interactive usage
+type Observer interface {
+	// CommandStarted is called before executing a command, with its name
+	// (for a subcommand, the group and subcommand names, i.e. "net ping")
+	CommandStarted(name string)
+
+	// CommandFinished is called after executing a command, with the execution time
+	// and the error if it failed (the last one, if it recorded more than one)
+	CommandFinished(name string, duration time.Duration, err error)
+}
+
+// observedCall calls the command, notifying the Observer (if set)
+func (cmd *Cmd) observedCall(command Command, name, line, params string) (stop bool) {
+	obs := cmd.Observer
+	if obs == nil {
+		return cmd.callCommand(command, line, params)
+	}
+
+	cmd.RLock()
+	failures := cmd.failures
+	cmd.RUnlock()
+
+	obs.CommandStarted(name)
+	start := time.Now()
+
+	defer func() {
+		var err error
+
+		cmd.RLock()
+		if cmd.failures != failures {
+			err = cmd.lastFailure
+		}
+		cmd.RUnlock()
+
+		obs.CommandFinished(name, time.Since(start), err)
+	}()
+
+	return cmd.callCommand(command, line, params)
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"os"
+	"strings"
+)
+
+// pager returns the pager command, or "" if paging is disabled
+func (cmd *Cmd) pager() string {
+	switch cmd.Pager {
+	case "off":
+		return ""
+
+	case "":
+		if p := os.Getenv("PAGER"); p != "" {
+			return p
+		}
+
+		return defaultPager
+
+	default:
+		return cmd.Pager
+	}
+}
+
+// WithPager executes f, that prints a long listing, and pipes its output through the pager (see Pager)
+// if the output is a terminal and it doesn't fit in the screen. Otherwise the output is printed as usual.
+func (cmd *Cmd) WithPager(f func()) {
+	out, ok := cmd.Stdout().(*os.File)
+	if !ok || !isTerminal(out) {
+		f()
+		return
+	}
+
+	pager := cmd.pager()
+	if pager == "" {
+		f()
+		return
+	}
+
+	var output strings.Builder
+
+	cmd.streamOutput(f, func(b []byte) { output.Write(b) })
+
+	_, height := cmd.TerminalSize()
+
+	if strings.Count(output.String(), "\n") < height-1 {
+		out.WriteString(output.String())
+		return
+	}
+
+	sh := cmd.shellCommand(pager)
+	if sh == nil {
+		out.WriteString(output.String())
+		return
+	}
+
+	sh.Stdin = strings.NewReader(output.String())
+	sh.Stdout = out
+	sh.Stderr = cmd.Stderr()
+
+	if err := sh.Run(); err != nil && sh.ProcessState == nil { // the pager couldn't be started
+		out.WriteString(output.String())
+	}
+}
@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/gobs/cmd/internal"
+)
+
+// SplitPipeline splits a command line in the stages of a pipeline ("cmd1 | cmd2 | cmd3"),
+// returning nil if it's not a pipeline.
+//
+// The separator is a "|" surrounded by spaces, outside of quotes, parentheses, brackets and braces.
+// The output command is not split, since "output | command" pipes the output to an external command.
+func SplitPipeline(line string) (stages []string) {
+	if !strings.Contains(line, " | ") {
+		return nil
+	}
+	if name, _, _ := strings.Cut(line, " "); name == "output" {
+		return nil
+	}
+
+	stages = internal.SplitLine(line, func(i int) bool {
+		return line[i] == '|' && i > 0 && line[i-1] == ' ' && i+1 < len(line) && line[i+1] == ' '
+	})
+
+	for _, s := range stages {
+		if s == "" { // i.e. "cmd |  | cmd", not a pipeline
+			return nil
+		}
+	}
+
+	return
+}
+
+// SplitCommands splits a line in the commands separated by ";" ("var x 1; echo $x"),
+// outside of quotes, parentheses, brackets and braces, skipping the empty ones.
+// Shell commands ("!command" or "shell command") are not split, since ";" is part of the shell syntax.
+func SplitCommands(line string) (commands []string) {
+	if !strings.Contains(line, ";") {
+		return []string{line}
+	}
+	if name, _, _ := strings.Cut(line, " "); name == "shell" || strings.HasPrefix(name, "!") {
+		return []string{line}
+	}
+
+	for _, c := range internal.SplitLine(line, func(i int) bool { return line[i] == ';' }) {
+		if c != "" {
+			commands = append(commands, c)
+		}
+	}
+
+	return
+}
+
+// RunPipeline executes the stages of a pipeline (see SplitPipeline) with run, passing the output of each stage
+// (without the trailing newlines) as input to the next one: run should append it to the stage, after expanding it,
+// as the last parameter (i.e. "json {...} | jsonpath $.items" executes "jsonpath $.items {the json output}").
+// The input is quoted as a single word, and it's empty for the first stage or if the previous one didn't print anything.
+//
+// OneCmd runs the pipelines, but a plugin that expands the line before calling the original OneCmd
+// should split it first and run the stages with RunPipeline, so that the expanded values are not split.
+//
+// The status of the pipeline is the status of the last stage.
+func (cmd *Cmd) RunPipeline(stages []string, run func(line, input string) bool) (stop bool) {
+	var input string
+
+	for i, line := range stages {
+		failures := cmd.startStatus()
+
+		if i == len(stages)-1 {
+			stop = run(line, input) || stop
+			cmd.endStatus(failures)
+			return
+		}
+
+		var output strings.Builder
+
+		cmd.streamOutput(func() {
+			stop = run(line, input) || stop
+		}, func(b []byte) { output.Write(b) })
+
+		cmd.endStatus(failures)
+
+		if cmd.Interrupted() {
+			return
+		}
+
+		input = ""
+		if out := strings.TrimRight(output.String(), "\r\n"); out != "" {
+			input = internal.QuoteWord(out)
+		}
+	}
+
+	return
+}
+
+// runPipeline executes the stages of a pipeline via OneCmd, resolving the aliases of each stage
+// but the first (that was already resolved)
+func (cmd *Cmd) runPipeline(stages []string) (stop bool) {
+	first := true
+
+	return cmd.RunPipeline(stages, func(line, input string) bool {
+		if !first {
+			line, _ = cmd.ExpandAlias(line)
+		}
+		first = false
+
+		if input != "" {
+			line += " " + input
+		}
+
+		return cmd.RunExpanded(line, cmd.OneCmd)
+	})
+}
+
+// shellInput splits the input redirection from a shell command line, returning the command
+// and the redirection: "command < file" reads the input from file, and "command <<< text"
+// passes the text (with a final newline) as input.
+//
+// The redirection operator should be surrounded by spaces, outside of quotes and brackets.
+func shellInput(line string) (command, file, text string, redirected bool) {
+	command = line
+
+	internal.ScanLine(line, func(i, depth int, quoted bool) bool {
+		if quoted || depth > 0 || line[i] != '<' || i == 0 || line[i-1] != ' ' {
+			return true
+		}
+
+		op, rest, _ := strings.Cut(line[i:], " ")
+		if op != "<" && op != "<<<" {
+			return true
+		}
+
+		head, rest := strings.TrimSpace(line[:i]), strings.TrimSpace(rest)
+		if head == "" || rest == "" {
+			return false
+		}
+
+		if op == "<" {
+			command, file = head, internal.Unquote(rest)
+		} else {
+			command, text = head, internal.Unquote(rest)+"\n"
+		}
+
+		redirected = true
+		return false
+	})
+
+	return
+}
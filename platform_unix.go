@@ -0,0 +1,150 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// the pager used if $PAGER is not set
+const defaultPager = "less"
+
+// the signals that interrupt the command loop
+var exitSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// killSelf terminates the process with the specified signal
+func killSelf(sig os.Signal) {
+	p, _ := os.FindProcess(os.Getpid())
+	p.Signal(sig)
+}
+
+// enableANSI does nothing, since terminals process the ANSI escape sequences
+func enableANSI() (restore func()) {
+	return func() {}
+}
+
+// terminalSize returns the size of the terminal associated with f
+func terminalSize(f *os.File) (width, height int, ok bool) {
+	ws, err := unix.IoctlGetWinsize(int(f.Fd()), unix.TIOCGWINSZ)
+	if err != nil || ws.Col == 0 {
+		return 0, 0, false
+	}
+
+	return int(ws.Col), int(ws.Row), true
+}
+
+// shellCommand returns the command to execute a shell escape with the default shell ("sh -c").
+// It returns nil if there is no command to execute.
+func shellCommand(command string) *exec.Cmd {
+	if strings.TrimSpace(command) == "" {
+		return nil
+	}
+
+	return exec.Command("sh", "-c", command)
+}
+
+// handleSuspend handles Ctrl-Z (SIGTSTP) while a command is running, restoring the terminal
+// before suspending the process and restarting the line editor when the process is resumed.
+//
+// It returns a function that stops handling the signals.
+func (cmd *Cmd) handleSuspend() (stop func()) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTSTP, syscall.SIGCONT)
+
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			var sig os.Signal
+
+			select {
+			case sig = <-sigc:
+			case <-done:
+				return
+			}
+
+			switch sig {
+			case syscall.SIGTSTP:
+				cmd.context.SuspendLiner()
+
+				// suspend for real (until SIGCONT)
+				signal.Reset(syscall.SIGTSTP)
+				syscall.Kill(syscall.Getpid(), syscall.SIGTSTP)
+				signal.Notify(sigc, syscall.SIGTSTP)
+
+			case syscall.SIGCONT:
+				cmd.context.ResumeLiner()
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigc)
+		close(done)
+	}
+}
+
+// handleReload calls OnReload when the process receives SIGHUP
+// (if OnReload is not set, SIGHUP terminates the process, as usual).
+//
+// It returns a function that stops handling the signal.
+func (cmd *Cmd) handleReload() (stop func()) {
+	if cmd.OnReload == nil {
+		return func() {}
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP)
+
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-sigc:
+				cmd.OnReload()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigc)
+		close(done)
+	}
+}
+
+// handleResize calls OnResize when the terminal is resized (SIGWINCH).
+//
+// It returns a function that stops handling the signal.
+func (cmd *Cmd) handleResize() (stop func()) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGWINCH)
+
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-sigc:
+				if cmd.OnResize != nil {
+					cmd.OnResize(cmd.TerminalSize())
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigc)
+		close(done)
+	}
+}
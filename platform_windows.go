@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// the pager used if $PAGER is not set
+const defaultPager = "more"
+
+// the signals that interrupt the command loop (Ctrl-C and Ctrl-Break are both delivered as os.Interrupt,
+// closing the console window as SIGTERM)
+var exitSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// killSelf terminates the process (signals can't be sent on Windows)
+func killSelf(sig os.Signal) {
+	os.Exit(1)
+}
+
+// enableANSI enables the processing of the ANSI escape sequences (prompt colors, clear screen) in the console,
+// returning a function that restores the console mode
+func enableANSI() (restore func()) {
+	var restores []func()
+
+	for _, f := range []*os.File{os.Stdout, os.Stderr} {
+		h := windows.Handle(f.Fd())
+
+		var mode uint32
+		if err := windows.GetConsoleMode(h, &mode); err != nil || mode&windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING != 0 {
+			continue // not a console, or already enabled
+		}
+
+		if err := windows.SetConsoleMode(h, mode|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING); err == nil {
+			restores = append(restores, func() { windows.SetConsoleMode(h, mode) })
+		}
+	}
+
+	return func() {
+		for _, restore := range restores {
+			restore()
+		}
+	}
+}
+
+// terminalSize returns the size of the console window associated with f
+func terminalSize(f *os.File) (width, height int, ok bool) {
+	var info windows.ConsoleScreenBufferInfo
+	if err := windows.GetConsoleScreenBufferInfo(windows.Handle(f.Fd()), &info); err != nil {
+		return 0, 0, false
+	}
+
+	return int(info.Window.Right-info.Window.Left) + 1, int(info.Window.Bottom-info.Window.Top) + 1, true
+}
+
+// shellCommand returns the command to execute a shell escape, via "cmd /C"
+// (so that built-in commands like "dir" are available).
+// It returns nil if there is no command to execute.
+func shellCommand(command string) *exec.Cmd {
+	if strings.TrimSpace(command) == "" {
+		return nil
+	}
+
+	shell := os.Getenv("COMSPEC")
+	if shell == "" {
+		shell = "cmd.exe"
+	}
+
+	cmd := exec.Command(shell)
+	// cmd.exe has its own quoting rules, so pass the command line as is
+	cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: fmt.Sprintf(`%v /S /C "%v"`, syscall.EscapeArg(shell), command)}
+	return cmd
+}
+
+// handleSuspend does nothing on Windows, where there is no job control
+func (cmd *Cmd) handleSuspend() (stop func()) {
+	return func() {}
+}
+
+// handleReload does nothing on Windows, where there is no SIGHUP (use the reload command)
+func (cmd *Cmd) handleReload() (stop func()) {
+	return func() {}
+}
+
+// handleResize does nothing on Windows, where there is no resize signal
+// (TerminalSize always returns the current size)
+func (cmd *Cmd) handleResize() (stop func()) {
+	return func() {}
+}
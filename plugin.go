@@ -0,0 +1,362 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+)
+
+// PluginCleaner is implemented by plugins that need to release resources
+// when the interpreter terminates (see Cleanup) or when the plugin is unloaded (see UnloadPlugin)
+type PluginCleaner interface {
+	PluginCleanup(cmd *Cmd)
+}
+
+// PluginConfigurer is implemented by plugins that accept a configuration (see WithConfig)
+type PluginConfigurer interface {
+	PluginConfig(config interface{}) error
+}
+
+// PluginNamer is implemented by plugins that can be referenced as dependencies by other plugins
+type PluginNamer interface {
+	PluginName() string
+}
+
+// PluginDependent is implemented by plugins that need to be initialized after other plugins
+// (i.e. because they wrap the hooks installed by them)
+type PluginDependent interface {
+	PluginDependencies() []string
+}
+
+// configuredPlugin is a plugin with its configuration
+type configuredPlugin struct {
+	Plugin
+	config interface{}
+}
+
+// WithConfig returns a plugin that, when passed to Init, is configured (via PluginConfig) before being initialized
+func WithConfig(p Plugin, config interface{}) Plugin {
+	return &configuredPlugin{Plugin: p, config: config}
+}
+
+// unwrapPlugin returns the plugin without its configuration
+func unwrapPlugin(p Plugin) Plugin {
+	if cp, ok := p.(*configuredPlugin); ok {
+		return cp.Plugin
+	}
+
+	return p
+}
+
+// PluginName returns the name of the plugin (as returned by PluginName, or its type if not available)
+func PluginName(p Plugin) string {
+	if n, ok := unwrapPlugin(p).(PluginNamer); ok {
+		return n.PluginName()
+	}
+
+	return fmt.Sprintf("%T", unwrapPlugin(p))
+}
+
+func pluginDependencies(p Plugin) []string {
+	if d, ok := unwrapPlugin(p).(PluginDependent); ok {
+		return d.PluginDependencies()
+	}
+
+	return nil
+}
+
+// sortPlugins returns the plugins in initialization order: a plugin comes after its dependencies,
+// otherwise the original order is preserved
+func sortPlugins(plugins []Plugin) ([]Plugin, error) {
+	index := map[string]int{}
+	for i, p := range plugins {
+		index[PluginName(p)] = i
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+
+	state := make([]int, len(plugins))
+	sorted := make([]Plugin, 0, len(plugins))
+
+	var visit func(i int) error
+
+	visit = func(i int) error {
+		switch state[i] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("circular dependency for plugin %v", PluginName(plugins[i]))
+		}
+
+		state[i] = visiting
+
+		for _, dep := range pluginDependencies(plugins[i]) {
+			j, ok := index[dep]
+			if !ok {
+				return fmt.Errorf("plugin %v requires plugin %v", PluginName(plugins[i]), dep)
+			}
+
+			if err := visit(j); err != nil {
+				return err
+			}
+		}
+
+		state[i] = visited
+		sorted = append(sorted, plugins[i])
+		return nil
+	}
+
+	for i := range plugins {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+
+	return sorted, nil
+}
+
+// hooks are the Cmd functions that plugins can wrap
+type hooks struct {
+	GetPrompt func(bool) string
+	PreLoop   func()
+	PostLoop  func()
+	PreCmd    func(string)
+	PostCmd   func(string, bool) bool
+	OneCmd    func(string) bool
+	EmptyLine func()
+	Default   func(string)
+	Help      func(string) bool
+	Complete  func(string, string) []string
+	OnChange  func(name string, oldv, newv interface{}) interface{}
+	Interrupt func(os.Signal) bool
+	Recover   func(interface{}) bool
+	OnRecover func(interface{}) bool
+	OnPanic   func(PanicInfo) RecoverAction
+	OnError   func(string, error) bool
+	OnIdle    func() bool
+	OnEOF     func() bool
+	OnResize  func(width, height int)
+	OnReload  func()
+
+	CommandSubstitution func(string) (string, bool)
+}
+
+func (cmd *Cmd) saveHooks() hooks {
+	return hooks{
+		GetPrompt: cmd.GetPrompt,
+		PreLoop:   cmd.PreLoop,
+		PostLoop:  cmd.PostLoop,
+		PreCmd:    cmd.PreCmd,
+		PostCmd:   cmd.PostCmd,
+		OneCmd:    cmd.OneCmd,
+		EmptyLine: cmd.EmptyLine,
+		Default:   cmd.Default,
+		Help:      cmd.Help,
+		Complete:  cmd.Complete,
+		OnChange:  cmd.OnChange,
+		Interrupt: cmd.Interrupt,
+		Recover:   cmd.Recover,
+		OnRecover: cmd.OnRecover,
+		OnPanic:   cmd.OnPanic,
+		OnError:   cmd.OnError,
+		OnIdle:    cmd.OnIdle,
+		OnEOF:     cmd.OnEOF,
+		OnResize:  cmd.OnResize,
+		OnReload:  cmd.OnReload,
+
+		CommandSubstitution: cmd.CommandSubstitution,
+	}
+}
+
+func (cmd *Cmd) restoreHooks(h hooks) {
+	cmd.GetPrompt = h.GetPrompt
+	cmd.PreLoop = h.PreLoop
+	cmd.PostLoop = h.PostLoop
+	cmd.PreCmd = h.PreCmd
+	cmd.PostCmd = h.PostCmd
+	cmd.OneCmd = h.OneCmd
+	cmd.EmptyLine = h.EmptyLine
+	cmd.Default = h.Default
+	cmd.Help = h.Help
+	cmd.Complete = h.Complete
+	cmd.OnChange = h.OnChange
+	cmd.Interrupt = h.Interrupt
+	cmd.Recover = h.Recover
+	cmd.OnRecover = h.OnRecover
+	cmd.OnPanic = h.OnPanic
+	cmd.OnError = h.OnError
+	cmd.OnIdle = h.OnIdle
+	cmd.OnEOF = h.OnEOF
+	cmd.OnResize = h.OnResize
+	cmd.OnReload = h.OnReload
+	cmd.CommandSubstitution = h.CommandSubstitution
+}
+
+// loadedPlugin is a plugin, with the changes it made to the interpreter when initialized
+type loadedPlugin struct {
+	plugin     Plugin
+	hooks      hooks            // the hooks before the plugin was initialized
+	commands   []string         // the commands added by the plugin
+	completers *linkedCompleter // the completers before the plugin was initialized
+	added      *linkedCompleter // the completers after the plugin was initialized
+	middleware []*Middleware    // the middlewares added by the plugin
+}
+
+// initPlugin configures and initializes the plugin, recording its changes so that it can be unloaded
+func (cmd *Cmd) initPlugin(p Plugin) error {
+	cmd.registry.RLock()
+	lp := loadedPlugin{plugin: p, hooks: cmd.saveHooks(), completers: cmd.completers}
+	nmiddleware := len(cmd.middleware)
+	cmd.registry.RUnlock()
+
+	before := map[string]bool{}
+	for _, name := range cmd.CommandNames() {
+		before[name] = true
+	}
+
+	if cp, ok := p.(*configuredPlugin); ok {
+		c, ok := cp.Plugin.(PluginConfigurer)
+		if !ok {
+			return fmt.Errorf("plugin %v doesn't accept a configuration", PluginName(p))
+		}
+
+		if err := c.PluginConfig(cp.config); err != nil {
+			return err
+		}
+	}
+
+	if err := p.PluginInit(cmd, cmd.context); err != nil {
+		return err
+	}
+
+	for _, name := range cmd.CommandNames() {
+		if !before[name] {
+			lp.commands = append(lp.commands, name)
+		}
+	}
+
+	cmd.registry.RLock()
+	lp.added = cmd.completers
+	lp.middleware = append(lp.middleware, cmd.middleware[nmiddleware:]...)
+	cmd.registry.RUnlock()
+	cmd.loaded = append(cmd.loaded, lp)
+	return nil
+}
+
+func cleanupPlugin(cmd *Cmd, p Plugin) {
+	if c, ok := unwrapPlugin(p).(PluginCleaner); ok {
+		c.PluginCleanup(cmd)
+	}
+}
+
+// Cleanup calls PluginCleanup for all the loaded plugins (in reverse order of initialization).
+// It's called when CmdLoop terminates.
+func (cmd *Cmd) Cleanup() {
+	for i := len(cmd.loaded) - 1; i >= 0; i-- {
+		cleanupPlugin(cmd, cmd.loaded[i].plugin)
+	}
+
+	cmd.loaded = nil
+}
+
+// UnloadPlugin removes a plugin, restoring the hooks it wrapped and removing the commands, completers
+// and middlewares it added.
+//
+// Since the plugins initialized after it may have wrapped its hooks, they are cleaned up and initialized again.
+// Note that the hooks set by the application after Init are also reset.
+func (cmd *Cmd) UnloadPlugin(p Plugin) error {
+	i := -1
+	for j, lp := range cmd.loaded {
+		if lp.plugin == p || unwrapPlugin(lp.plugin) == p {
+			i = j
+			break
+		}
+	}
+
+	if i < 0 {
+		return fmt.Errorf("plugin %v is not loaded", PluginName(p))
+	}
+
+	name := PluginName(p)
+	later := cmd.loaded[i+1:]
+
+	for _, lp := range later {
+		for _, dep := range pluginDependencies(lp.plugin) {
+			if dep == name {
+				return fmt.Errorf("plugin %v depends on plugin %v", PluginName(lp.plugin), name)
+			}
+		}
+	}
+
+	for j := len(cmd.loaded) - 1; j >= i; j-- {
+		lp := cmd.loaded[j]
+
+		cleanupPlugin(cmd, lp.plugin)
+
+		// the plugin completers are removed by identity, below, so don't use Remove
+		cmd.registry.Lock()
+		for _, c := range lp.commands {
+			delete(cmd.Commands, c)
+		}
+		cmd.registry.Unlock()
+
+		cmd.removeCompleters(lp.added, lp.completers)
+		cmd.removeMiddleware(lp.middleware)
+		cmd.restoreHooks(lp.hooks)
+	}
+
+	unloaded := cmd.loaded[i].plugin
+
+	reload := make([]Plugin, 0, len(later))
+	for _, lp := range later {
+		reload = append(reload, lp.plugin)
+	}
+
+	cmd.loaded = cmd.loaded[:i]
+
+	for j, lp := range cmd.plugins { // so that new sessions don't load it
+		if lp == unloaded {
+			cmd.plugins = append(cmd.plugins[:j:j], cmd.plugins[j+1:]...)
+			break
+		}
+	}
+
+	for _, lp := range reload {
+		if err := cmd.initPlugin(lp); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeCompleters removes the completers from first up to (not including) last
+func (cmd *Cmd) removeCompleters(first, last *linkedCompleter) {
+	cmd.registry.Lock()
+	defer cmd.registry.Unlock()
+
+	remove := map[*linkedCompleter]bool{}
+	for c := first; c != nil && c != last; c = c.next {
+		remove[c] = true
+	}
+
+	var head, tail *linkedCompleter
+
+	for c := cmd.completers; c != nil; c = c.next {
+		if remove[c] {
+			continue
+		}
+
+		lc := &linkedCompleter{name: c.name, completer: c.completer}
+		if tail == nil {
+			head = lc
+		} else {
+			tail.next = lc
+		}
+		tail = lc
+	}
+
+	cmd.completers = head
+}
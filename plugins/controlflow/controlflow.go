@@ -1,17 +1,24 @@
 package controlflow
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"math/rand"
+	"net/http"
 	"os"
+	"path"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gobs/args"
 	"github.com/gobs/cmd"
@@ -31,7 +38,19 @@ type controlFlow struct {
 	_help      func(string) bool
 	_interrupt func(os.Signal) bool
 
-	functions map[string][]string
+	functions map[string]*function
+	modules   []module // the modules loaded by import (see findModule)
+	namespace []string // the namespaces of the modules being imported, and of the functions being called
+
+	traps []traps // the traps of the session, and of each script being loaded
+
+	debug       bool            // the debugger is enabled (see command_debug)
+	stepping    bool            // the debugger pauses before the next line
+	aborting    bool            // the debugger is terminating the scripts and functions being executed
+	breakpoints map[string]bool // the functions where the debugger pauses
+
+	profiling bool                     // record the execution times of the commands and functions
+	profile   map[string]*profileEntry // the execution times recorded by the profiler
 
 	interruptCount int
 	inLoop         bool
@@ -39,6 +58,90 @@ type controlFlow struct {
 	sync.RWMutex
 }
 
+// module is a script loaded by import, in a namespace (if imported with --as)
+type module struct {
+	path      string
+	namespace string
+}
+
+func (m module) String() string {
+	if m.namespace == "" {
+		return m.path
+	}
+
+	return m.path + " (as " + m.namespace + ")"
+}
+
+// function is a user defined function
+type function struct {
+	params    []cmd.Param // the named parameters (nil if not declared)
+	body      []string
+	pos       internal.Position // the position of the first line of the body in the script that defined it
+	namespace string            // the namespace of the module that defined it, if imported with --as
+	complete  []string          // the words to complete the arguments with (see --complete)
+}
+
+// signature returns the function name with the named parameters, i.e. name(a, b=1)
+func (f *function) signature(name string) string {
+	if f.params == nil {
+		return name
+	}
+
+	params := make([]string, len(f.params))
+	for i, p := range f.params {
+		params[i] = p.String()
+	}
+
+	return name + "(" + strings.Join(params, ", ") + ")"
+}
+
+// definition returns the function signature followed by the --complete option, if set
+func (f *function) definition(name string) string {
+	if len(f.complete) == 0 {
+		return f.signature(name)
+	}
+
+	return f.signature(name) + " --complete=" + strconv.Quote(strings.Join(f.complete, " "))
+}
+
+// parseParams parses a list of named parameters, i.e. "a, b=default"
+func parseParams(line string) (params []cmd.Param, err error) {
+	params = []cmd.Param{}
+
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+
+	seen := map[string]bool{}
+
+	for _, p := range internal.SplitLine(line, func(i int) bool { return line[i] == ',' }) {
+		name, value, optional := strings.Cut(p, "=")
+		name = strings.TrimSpace(name)
+
+		if !internal.IsName(name) {
+			return nil, fmt.Errorf("invalid parameter name %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate parameter %q", name)
+		}
+
+		seen[name] = true
+		params = append(params, cmd.Param{Name: name, Default: internal.Unquote(strings.TrimSpace(value)), Optional: optional})
+	}
+
+	return
+}
+
+// traps are the commands to execute on a signal (INT, TERM) or when the script terminates (EXIT)
+type traps map[string]string
+
+// trapNames maps the accepted signal names to the trap names
+var trapNames = map[string]string{
+	"INT": "INT", "SIGINT": "INT",
+	"TERM": "TERM", "SIGTERM": "TERM",
+	"EXIT": "EXIT",
+}
+
 type loop struct {
 	start, end, step, Index int64
 }
@@ -81,10 +184,13 @@ func (l *loop) Reset() {
 	l.Index = 0
 }
 
+// parseWait parses a duration, or a number of seconds (i.e. 5 or 0.5)
 func parseWait(line string) (wait time.Duration) {
 	w, err := strconv.Atoi(line)
 	if err == nil {
 		wait = time.Duration(w) * time.Second
+	} else if f, err := strconv.ParseFloat(line, 64); err == nil {
+		wait = time.Duration(f * float64(time.Second))
 	} else {
 		wait, _ = time.ParseDuration(line)
 	}
@@ -95,11 +201,13 @@ func parseWait(line string) (wait time.Duration) {
 var (
 	Plugin = &controlFlow{}
 
-	reArg       = regexp.MustCompile(`\$(\w+|\(\w+\)|\(env.\w+\)|[\*#]|\([\*#]\))`) // $var or $(var)
-	reVarAssign = regexp.MustCompile(`([\d\w]+)(=(.*))`)                            // name=value
+	reVarAssign = regexp.MustCompile(`([\d\w]+)(=(.*))`) // name=value
 )
 
 func (cf *controlFlow) functionNames() (names []string, max int) {
+	cf.RLock()
+	defer cf.RUnlock()
+
 	for name, _ := range cf.functions {
 		names = append(names, name)
 		if len(name) > max {
@@ -110,1001 +218,3009 @@ func (cf *controlFlow) functionNames() (names []string, max int) {
 	return
 }
 
-func (cf *controlFlow) sleepInterrupted(wait time.Duration) bool {
-	for ; wait > time.Second; wait -= time.Second {
-		time.Sleep(time.Second)
-		if cf.cmd.Interrupted() {
-			return true
-		}
-	}
+// getFunction returns the function
+func (cf *controlFlow) getFunction(name string) (f *function, ok bool) {
+	cf.RLock()
+	f, ok = cf.functions[name]
+	cf.RUnlock()
+	return
+}
 
-	if wait > 0 {
-		time.Sleep(wait)
+// findFunction returns the function, looking first in the current namespace (see pushNamespace)
+func (cf *controlFlow) findFunction(name string) (string, *function, bool) {
+	if ns := cf.currentNamespace(); ns != "" {
+		if f, ok := cf.getFunction(ns + "." + name); ok {
+			return ns + "." + name, f, true
+		}
 	}
 
-	return cf.cmd.Interrupted()
+	f, ok := cf.getFunction(name)
+	return name, f, ok
 }
 
-func (cf *controlFlow) command_function(line string) (stop bool) {
-	// function
-	if line == "" {
-		names, _ := cf.functionNames()
+// pushNamespace sets the current namespace, while importing a module or calling one of its functions
+func (cf *controlFlow) pushNamespace(ns string) {
+	cf.Lock()
+	cf.namespace = append(cf.namespace, ns)
+	cf.Unlock()
+}
 
-		if len(names) == 0 {
-			fmt.Println("no functions")
-		} else {
-			fmt.Println("functions:")
-			for _, fn := range names {
-				fmt.Println(" ", fn)
-			}
-		}
-		return
-	}
+func (cf *controlFlow) popNamespace() {
+	cf.Lock()
+	cf.namespace = cf.namespace[:len(cf.namespace)-1]
+	cf.Unlock()
+}
 
-	parts := strings.SplitN(line, " ", 2)
-	// function name
-	if len(parts) == 1 {
-		fn := parts[0]
-		body, ok := cf.functions[fn]
-		if !ok {
-			fmt.Println("no function", fn)
-		} else {
-			fmt.Println("function", fn, "{")
-			for _, l := range body {
-				fmt.Println(" ", l)
-			}
-			fmt.Println("}")
-		}
-		return
+func (cf *controlFlow) currentNamespace() (ns string) {
+	cf.RLock()
+	if l := len(cf.namespace); l > 0 {
+		ns = cf.namespace[l-1]
 	}
+	cf.RUnlock()
+	return
+}
 
-	// function name body
-	fname, body := parts[0], strings.TrimSpace(parts[1])
-	if body == "--delete" {
-		if _, ok := cf.functions[fname]; ok {
-			delete(cf.functions, fname)
-			fmt.Println("function", fname, "deleted")
-		} else {
-			fmt.Println("no function", fname)
-		}
+// setFunction sets the function, or deletes it if f is nil.
+// It returns false if the function to delete doesn't exist.
+func (cf *controlFlow) setFunction(name string, f *function) bool {
+	cf.Lock()
+	defer cf.Unlock()
 
-		return
+	if f != nil {
+		cf.functions[name] = f
+		return true
 	}
 
-	lines, _, err := cf.ctx.ReadBlock(body, "", cf.cmd.ContinuationPrompt)
-	if err != nil {
-		fmt.Println(err)
-		return true
+	if _, ok := cf.functions[name]; !ok {
+		return false
 	}
 
-	cf.functions[fname] = lines
-	return
+	delete(cf.functions, name)
+	return true
 }
 
-type opType int
-
-const (
-	opNone = iota
-	opSet
-	opRemove
-	opIncr
-	opDecr
-)
+// saveFunctions writes the definitions of all the functions to a file, that can be read with loadFunctions
+// (or executed as a script)
+func (cf *controlFlow) saveFunctions(filename string) error {
+	names, _ := cf.functionNames()
 
-func (cf *controlFlow) command_variable(aline string) (stop bool) {
-	options, line := args.GetOptions(aline)
+	var sb strings.Builder
 
-	var scope internal.Scope
-	var op = opSet
+	for _, name := range names {
+		f, ok := cf.getFunction(name)
+		if !ok {
+			continue
+		}
 
-	for _, opt := range options {
-		switch opt {
-		case "-g", "--global":
-			scope = internal.GlobalScope
+		fmt.Fprintln(&sb, "function", f.definition(name), "{")
 
-		case "-p", "--parent", "--return":
-			scope = internal.ParentScope
+		depth, heredoc := 1, ""
+		for _, l := range f.body {
+			if heredoc != "" {
+				// the content of a heredoc is written as it is
+				if strings.TrimSpace(l) == heredoc {
+					heredoc = ""
+				}
 
-		case "-r", "-rm", "--remove", "-u", "--unset":
-			op = opRemove
+				fmt.Fprintln(&sb, l)
+				continue
+			}
 
-		case "-i", "-incr", "--incr":
-			op = opIncr
+			if strings.HasPrefix(l, "}") && depth > 1 {
+				depth--
+			}
 
-		case "-d", "-decr", "--decr":
-			op = opDecr
+			fmt.Fprintln(&sb, strings.Repeat("    ", depth)+l)
 
-		default:
-			fmt.Printf("invalid option -%v in %q\n", op, aline)
-			return
+			if term, ok := internal.HeredocTerminator(l); ok {
+				heredoc = term
+			} else if strings.HasSuffix(l, "{") && !strings.HasPrefix(l, "#") {
+				depth++
+			}
 		}
-	}
 
-	// var
-	if len(line) == 0 {
-		if scope != internal.InvalidScope {
-			fmt.Printf("invalid use of %v scope option in %q\n", scope, aline)
-			return
-		}
+		fmt.Fprintln(&sb, "}")
+		fmt.Fprintln(&sb)
+	}
 
-		for _, kv := range sortedmap.AsSortedMap(cf.ctx.GetAllVars()) {
-			fmt.Println(" ", kv)
-		}
+	return os.WriteFile(filename, []byte(sb.String()), 0644)
+}
 
-		return
+// loadFunctions reads the function definitions saved by saveFunctions (only function definitions are allowed)
+func (cf *controlFlow) loadFunctions(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
 	}
 
-	parts := args.GetArgsN(line, 2) // [ name, value ]
-	if len(parts) == 1 {            // see if it's name=value
-		matches := reVarAssign.FindStringSubmatch(line)
-		if len(matches) > 0 { // [name=var name =var var]
-			parts = []string{matches[1], matches[3]}
-		}
-	}
+	defer f.Close()
 
-	name := parts[0]
+	prev := cf.ctx.ScanReader(f, filename)
+	defer cf.ctx.SetScanner(prev)
 
-	// var name value
-	if len(parts) == 2 {
-		if op != opSet {
-			fmt.Println("invalid option with name and value in %q\n", aline)
-			return
+	for {
+		line, err := cf.ctx.ReadLine("", "")
+		if err == io.EOF {
+			return nil
 		}
-
-		var oldv interface{} = cmd.NoVar
-		if cur, ok := cf.ctx.GetVar(name); ok {
-			oldv = cur
+		if err != nil {
+			return err
 		}
 
-		if newv := cf.cmd.OnChange(name, oldv, parts[1]); newv == cmd.NoVar {
-			cf.ctx.UnsetVar(name, scope)
-		} else {
-			cf.ctx.SetVar(name, newv, scope)
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
 		}
-		return
-	}
 
-	// var -r|-incr|-decr name|
-	switch op {
-	case opRemove:
-		var oldv interface{} = cmd.NoVar
-		if cur, ok := cf.ctx.GetVar(name); ok {
-			oldv = cur
+		def, ok := strings.CutPrefix(line, "function ")
+		if !ok || strings.HasPrefix(def, "-") {
+			return cf.ctx.Position().Errorf("expected a function definition, got %q", line)
 		}
 
-		if newv := cf.cmd.OnChange(name, oldv, cmd.NoVar); newv == cmd.NoVar {
-			cf.ctx.UnsetVar(name, scope)
-		} else {
-			cf.ctx.SetVar(name, newv, scope)
+		if cf.command_function(strings.TrimSpace(def)) {
+			return cf.ctx.Position().Errorf("invalid function definition")
 		}
-		return
+	}
+}
 
-	case opIncr:
-		cf.ctx.UpdateVar(name, scope, func(cur string) interface{} {
-			v, _ := parseInt(cur)
-			return v + 1
-		})
-		return
+func (cf *controlFlow) sleepInterrupted(wait time.Duration) bool {
+	return cf.cmd.Sleep(wait)
+}
 
-	case opDecr:
-		cf.ctx.UpdateVar(name, scope, func(cur string) interface{} {
-			v, _ := parseInt(cur)
-			return v - 1
-		})
-		return
+// functionCompleter completes the function names, grouped by namespace (see completeFunctions)
+type functionCompleter struct {
+	cf   *controlFlow
+	cond cmd.CompleterCond
+}
+
+func (c *functionCompleter) Complete(start, line string) []string {
+	if !c.cond(start, line) {
+		return nil
 	}
 
-	// var name
-	if scope != internal.InvalidScope {
-		fmt.Printf("invalid use of %v scope option in %q\n", scope, aline)
-		return
+	return c.cf.completeFunctions(start)
+}
+
+// argumentCompleter completes the arguments of the functions defined with --complete
+type argumentCompleter struct {
+	cf *controlFlow
+}
+
+func (c *argumentCompleter) Complete(start, line string) (matches []string) {
+	name, _, _ := strings.Cut(strings.TrimSpace(strings.TrimSuffix(line, start)), " ")
+	if name == "" { // completing the command name
+		return nil
 	}
 
-	value, ok := cf.ctx.GetVar(name)
-	if ok {
-		fmt.Println(name, "=", value)
+	f, ok := c.cf.getFunction(name)
+	if !ok {
+		return nil
+	}
+
+	for _, w := range f.complete {
+		if strings.HasPrefix(w, start) {
+			matches = append(matches, w)
+		}
 	}
+
 	return
 }
 
-func (cf *controlFlow) command_shift(line string) (stop bool) {
-	start := 1
-	args := args.GetArgs(line)
-	if len(args) > 1 {
-		fmt.Println("too many arguments")
-		return
+// namespaceFunctions returns the names of the functions in the namespace (i.e. lib for lib.name),
+// or all the names if ns is empty
+func (cf *controlFlow) namespaceFunctions(ns string) (names []string) {
+	all, _ := cf.functionNames()
+	if ns == "" {
+		return all
 	}
 
-	if len(args) == 1 {
-		if n, err := parseInt(args[0]); err != nil {
-			fmt.Println(err)
-			return
-		} else {
-			start = n
+	for _, name := range all {
+		if strings.HasPrefix(name, ns+".") {
+			names = append(names, name)
 		}
 	}
 
-	cf.ctx.ShiftArgs(start)
 	return
 }
 
-func (cf *controlFlow) expandVariables(line string) string {
-	line = strings.Replace(line, "$$", "💲", -1) // replace $$ with fat $
+// matchFunctions returns the names of the functions matching the pattern (i.e. lib.*, see path.Match)
+func (cf *controlFlow) matchFunctions(pattern string) (names []string, err error) {
+	if _, err = path.Match(pattern, ""); err != nil {
+		return
+	}
 
-	for {
-		// fmt.Println("before expand:", line)
-		found := false
+	all, _ := cf.functionNames()
+	for _, name := range all {
+		if ok, _ := path.Match(pattern, name); ok {
+			names = append(names, name)
+		}
+	}
 
-		line = reArg.ReplaceAllStringFunc(line, func(s string) string {
-			found = true
+	return
+}
 
-			// ReplaceAll doesn't return submatches so we need to cleanup
-			arg := strings.TrimLeft(s, "$(")
-			arg = strings.TrimRight(arg, ")")
+// completeFunctions returns the function names starting with start, grouped by namespace:
+// lib.name and lib.other are completed as lib. (and then as lib.name and lib.other)
+func (cf *controlFlow) completeFunctions(start string) (matches []string) {
+	names, _ := cf.functionNames()
 
-			if strings.HasPrefix(arg, "env.") {
-				return os.Getenv(arg[4:])
-			}
+	for _, name := range names {
+		if !strings.HasPrefix(name, start) {
+			continue
+		}
 
-			v, _ := cf.ctx.GetVar(arg)
-			return v
-		})
+		if i := strings.Index(name[len(start):], "."); i >= 0 {
+			name = name[:len(start)+i+1]
+		}
 
-		// fmt.Println("after expand:", line)
-		if !found {
-			break
+		if l := len(matches); l == 0 || matches[l-1] != name { // the names are sorted
+			matches = append(matches, name)
 		}
 	}
 
-	line = strings.Replace(line, "💲", "$", -1) // restore and unescape
-	return line
+	return
 }
 
-func (cf *controlFlow) command_conditional(line string) (stop bool) {
-	negate := false
-
-	if strings.HasPrefix(line, "!") { // negate condition
-		negate = true
-		line = line[1:]
-	}
+func (cf *controlFlow) command_function(line string) (stop bool) {
+	// function, function --list [namespace]
+	if opt, ns, _ := strings.Cut(line, " "); line == "" || opt == "--list" {
+		ns = strings.TrimSuffix(strings.TrimSpace(ns), ".")
+		names := cf.namespaceFunctions(ns)
 
-	if len(line) == 0 {
-		fmt.Println("missing condition")
+		if len(names) == 0 {
+			cf.cmd.Println("no functions")
+		} else {
+			cf.cmd.WithPager(func() {
+				cf.cmd.Println("functions:")
+				for _, fn := range names {
+					cf.cmd.Println(" ", fn)
+				}
+			})
+		}
 		return
 	}
 
-	parts := args.GetArgsN(line, 2) // [ condition, body ]
-	if len(parts) != 2 {
-		fmt.Println("missing body")
+	// function --delete pattern
+	if opt, pattern, _ := strings.Cut(line, " "); opt == "--delete" {
+		if pattern = internal.Unquote(strings.TrimSpace(pattern)); pattern == "" {
+			cf.cmd.Println("usage: function --delete pattern")
+			return
+		}
+
+		names, err := cf.matchFunctions(pattern)
+		if err != nil {
+			cf.cmd.Println(err)
+			return
+		}
+
+		if len(names) == 0 {
+			cf.cmd.Println("no function", pattern)
+			return
+		}
+
+		for _, name := range names {
+			cf.setFunction(name, nil)
+		}
+
+		cf.cmd.Println(len(names), "functions deleted")
 		return
 	}
 
-	res, err := cf.evalConditional(parts[0])
-	if err != nil {
-		fmt.Println(err)
-		return true
-	}
+	// function --save file, function --load file
+	if opt, file, _ := strings.Cut(line, " "); opt == "--save" || opt == "--load" {
+		if file = internal.Unquote(strings.TrimSpace(file)); file == "" {
+			cf.cmd.Println("usage: function --save|--load file")
+			return
+		}
 
-	trueBlock, falseBlock, err := cf.ctx.ReadBlock(parts[1], "else", cf.cmd.ContinuationPrompt)
-	if err != nil {
-		fmt.Println(err)
-		return true
-	}
+		var err error
+		if opt == "--save" {
+			if cf.cmd.GetBoolVar("dryrun") { // function is Safe, to define functions, but this writes a file
+				cf.cmd.Println("(dry-run) function", line)
+				return
+			}
+
+			err = cf.saveFunctions(cf.cmd.Path(file))
+		} else {
+			err = cf.loadFunctions(cf.cmd.Path(file))
+		}
+		if err != nil {
+			cf.cmd.Println(err)
+		}
 
-	if negate {
-		res = !res
+		return
 	}
 
-	if res {
-		stop = cf.cmd.RunBlock("", trueBlock, nil, false)
-	} else {
-		stop = cf.cmd.RunBlock("", falseBlock, nil, false)
+	fname, body := line, ""
+	if i := strings.IndexAny(line, " ("); i >= 0 {
+		fname, body = line[:i], strings.TrimSpace(line[i:])
 	}
 
-	return
-}
+	// function name(params) body
+	var params []cmd.Param
 
-func compare(args []string, num bool) (int, error) {
-	l := len(args)
+	if strings.HasPrefix(body, "(") {
+		end := -1
+		internal.ScanLine(body, func(i, depth int, quoted bool) bool {
+			if !quoted && depth == 0 && body[i] == ')' {
+				end = i
+				return false
+			}
 
-	if l > 2 || (num && l != 2) {
-		return 0, fmt.Errorf("expected 2 arguments, got %v", len(args))
-	}
+			return true
+		})
+
+		if end < 0 {
+			cf.cmd.Println("missing ) in", line)
+			return true
+		}
+
+		var err error
+		if params, err = parseParams(body[1:end]); err != nil {
+			cf.cmd.Println(err)
+			return true
+		}
+
+		if body = strings.TrimSpace(body[end+1:]); body == "" {
+			cf.cmd.Println("missing body")
+			return true
+		}
+	}
+
+	// function name --complete="words" [body]
+	var complete []string
+
+	if strings.HasPrefix(body, "--complete=") {
+		words := internal.Words(body, 2)
+		complete = strings.Fields(internal.Unquote(strings.TrimPrefix(words[0], "--complete=")))
+
+		if body = ""; len(words) > 1 {
+			body = words[1]
+		}
+
+		// set the completion of an existing function
+		if body == "" && params == nil {
+			f, ok := cf.getFunction(fname)
+			if !ok {
+				cf.cmd.Println("no function", fname)
+				return
+			}
+
+			cf.setFunction(fname, &function{params: f.params, body: f.body, pos: f.pos, namespace: f.namespace, complete: complete})
+			return
+		}
+
+		if body == "" {
+			cf.cmd.Println("missing body")
+			return true
+		}
+	}
+
+	// function name
+	if body == "" {
+		f, ok := cf.getFunction(fname)
+		if !ok {
+			cf.cmd.Println("no function", fname)
+		} else {
+			cf.cmd.WithPager(func() {
+				cf.cmd.Println("function", f.definition(fname), "{")
+				for _, l := range f.body {
+					cf.cmd.Println(" ", l)
+				}
+				cf.cmd.Println("}")
+			})
+		}
+		return
+	}
+
+	// function name body
+	if body == "--delete" {
+		if cf.setFunction(fname, nil) {
+			cf.cmd.Println("function", fname, "deleted")
+		} else {
+			cf.cmd.Println("no function", fname)
+		}
+
+		return
+	}
+
+	block, _, err := cf.ctx.ReadBlock(body, "", cf.cmd.ContinuationPrompt)
+	if err != nil {
+		cf.cmd.Println(err)
+		return true
+	}
+
+	if block.Lines == nil {
+		block.Lines = []string{}
+	}
+
+	ns := cf.currentNamespace()
+	if ns != "" && !strings.Contains(fname, ".") {
+		fname = ns + "." + fname
+	}
+
+	cf.setFunction(fname, &function{params: params, body: block.Lines, pos: block.Pos, namespace: ns, complete: complete})
+	return
+}
+
+// findModule returns the path of a module: a file or URL, or name.cmd in the interpreter directory
+// or in one of the directories listed in the importpath variable
+func (cf *controlFlow) findModule(name string) (string, error) {
+	if strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://") {
+		return name, nil
+	}
+
+	candidates := []string{cf.cmd.Path(name)}
+	if filepath.Ext(name) == "" {
+		candidates = append(candidates, cf.cmd.Path(name+".cmd"))
+	}
+
+	if !filepath.IsAbs(name) {
+		dirs, _ := cf.cmd.GetVar("importpath")
+
+		for _, dir := range filepath.SplitList(dirs) {
+			candidates = append(candidates, filepath.Join(cf.cmd.Path(dir), name))
+			if filepath.Ext(name) == "" {
+				candidates = append(candidates, filepath.Join(cf.cmd.Path(dir), name+".cmd"))
+			}
+		}
+	}
+
+	for _, path := range candidates {
+		if st, err := os.Stat(path); err == nil && !st.IsDir() {
+			return filepath.Abs(path)
+		}
+	}
+
+	return "", fmt.Errorf("module %v not found", name)
+}
+
+// import [--as=namespace] name-or-path
+//
+// Loads a script file (see findModule) only once in each namespace, so that modules can import each other.
+// With --as the functions it defines are named namespace.function, and the module functions
+// can call each other without the namespace.
+func (cf *controlFlow) command_import(line string) (stop bool) {
+	// import
+	if line == "" {
+		cf.RLock()
+		modules := append([]module{}, cf.modules...)
+		cf.RUnlock()
+
+		if len(modules) == 0 {
+			cf.cmd.Println("no modules")
+		}
+		for _, m := range modules {
+			cf.cmd.Println(" ", m)
+		}
+		return
+	}
+
+	var ns string
+
+	if strings.HasPrefix(line, "--as=") {
+		arg, rest, _ := strings.Cut(line, " ")
+		ns, line = arg[5:], internal.Unquote(strings.TrimSpace(rest))
+
+		if !internal.IsName(ns) {
+			cf.cmd.Println("invalid namespace", ns)
+			return
+		}
+	}
+
+	path, err := cf.findModule(internal.Unquote(line))
+	if err != nil {
+		cf.cmd.Println(err)
+		cf.cmd.SetVar("error", err)
+		return
+	}
+
+	m := module{path: path, namespace: ns}
+
+	cf.Lock()
+	loaded := false
+	for _, lm := range cf.modules {
+		if lm == m {
+			loaded = true
+			break
+		}
+	}
+	if !loaded { // marked before loading it, in case of circular imports
+		cf.modules = append(cf.modules, m)
+	}
+	cf.Unlock()
+
+	if loaded {
+		return
+	}
+
+	cf.pushNamespace(ns)
+	defer cf.popNamespace()
+
+	return cf.command_load(path)
+}
+
+type opType int
+
+const (
+	opNone = iota
+	opSet
+	opRemove
+	opIncr
+	opDecr
+	opList
+	opMap
+)
+
+// changeVar sets (or removes, if newv is NoVar) a variable in the specified scope, via OnChange
+func (cf *controlFlow) changeVar(name string, newv interface{}, scope internal.Scope) {
+	var oldv interface{} = cmd.NoVar
+	if cur, ok := cf.ctx.GetVar(name); ok {
+		oldv = cur
+	}
+
+	if newv = cf.cmd.OnChange(name, oldv, newv); newv == cmd.NoVar {
+		cf.ctx.UnsetVar(name, scope)
+	} else {
+		cf.ctx.SetVar(name, newv, scope)
+	}
+}
+
+func (cf *controlFlow) command_variable(aline string) (stop bool) {
+	options, line := args.GetOptions(aline)
+
+	var scope internal.Scope
+	var op = opSet
+	var export bool
+
+	for _, opt := range options {
+		switch opt {
+		case "-g", "--global":
+			scope = internal.GlobalScope
+
+		case "-x", "--export":
+			export = true
+
+		case "-p", "--parent", "--return":
+			scope = internal.ParentScope
+
+		case "-l", "--local":
+			scope = internal.LocalScope
+
+		case "-r", "-rm", "--remove", "-u", "--unset":
+			op = opRemove
+
+		case "-i", "-incr", "--incr":
+			op = opIncr
+
+		case "-d", "-decr", "--decr":
+			op = opDecr
+
+		case "-a", "--array", "--list":
+			op = opList
+
+		case "-m", "--map":
+			op = opMap
+
+		default:
+			cf.cmd.Printf("invalid option -%v in %q\n", op, aline)
+			return
+		}
+	}
+
+	// var
+	if len(line) == 0 {
+		if scope != internal.InvalidScope {
+			cf.cmd.Printf("invalid use of %v scope option in %q\n", scope, aline)
+			return
+		}
+
+		if cf.cmd.JSONOutput() {
+			cf.cmd.PrintJSON(cf.ctx.GetAllVars())
+			return
+		}
+
+		for _, kv := range sortedmap.AsSortedMap(cf.ctx.GetAllVars()) {
+			cf.cmd.Println(" ", kv)
+		}
+
+		return
+	}
+
+	// var name[index] value, var -r name[index]
+	if words := internal.Words(line, 2); strings.HasSuffix(words[0], "]") && strings.Contains(words[0], "[") {
+		name, index, _ := strings.Cut(strings.TrimSuffix(words[0], "]"), "[")
+
+		var err error
+
+		switch {
+		case op == opRemove:
+			err = cf.ctx.SetVarIndex(name, index, nil)
+
+		case op == opSet && len(words) == 2:
+			err = cf.ctx.SetVarIndex(name, index, internal.Unquote(words[1]))
+
+		default:
+			err = fmt.Errorf("usage: var name[index] value, or var --remove name[index]")
+		}
+
+		if err != nil {
+			cf.cmd.Println(err)
+		}
+
+		return
+	}
+
+	parts := args.GetArgsN(line, 2) // [ name, value ]
+	if len(parts) == 1 {            // see if it's name=value
+		matches := reVarAssign.FindStringSubmatch(line)
+		if len(matches) > 0 { // [name=var name =var var]
+			parts = []string{matches[1], matches[3]}
+		}
+	}
+
+	name := parts[0]
+
+	if export && op == opSet {
+		cf.cmd.Export(name)
+	}
+
+	// var -a name items...
+	if op == opList {
+		items := internal.List{}
+		if len(parts) == 2 {
+			for _, item := range args.GetArgs(parts[1]) {
+				items = append(items, item)
+			}
+		}
+
+		cf.changeVar(name, items, scope)
+		return
+	}
+
+	// var -m name key=value...
+	if op == opMap {
+		m := internal.Dict{}
+		if len(parts) == 2 {
+			for _, item := range internal.Words(parts[1], 0) {
+				k, v, ok := strings.Cut(item, "=")
+				if !ok {
+					cf.cmd.Println("expected key=value, got", item)
+					return
+				}
+
+				m[k] = internal.Unquote(v)
+			}
+		}
+
+		cf.changeVar(name, m, scope)
+		return
+	}
+
+	// var name value
+	if len(parts) == 2 {
+		if op != opSet {
+			cf.cmd.Printf("invalid option with name and value in %q\n", aline)
+			return
+		}
+
+		cf.changeVar(name, parts[1], scope)
+		return
+	}
+
+	// var -r|-incr|-decr name|
+	switch op {
+	case opRemove:
+		if export { // var --export --remove name: only remove the export mark
+			cf.cmd.Unexport(name)
+			return
+		}
+
+		cf.changeVar(name, cmd.NoVar, scope)
+		return
+
+	case opIncr, opDecr:
+		incr := 1
+		if op == opDecr {
+			incr = -1
+		}
+
+		if cf.cmd.ObservedVar(name) {
+			// not atomic, since OnChange can't be called while the variables are locked
+			cur, _ := cf.ctx.GetVar(name)
+			v, _ := parseInt(cur)
+			cf.changeVar(name, v+incr, scope)
+		} else {
+			cf.ctx.UpdateVar(name, scope, func(cur string) interface{} {
+				v, _ := parseInt(cur)
+				return v + incr
+			})
+		}
+		return
+	}
+
+	// var name
+	if export {
+		return
+	}
+
+	if scope != internal.InvalidScope {
+		cf.cmd.Printf("invalid use of %v scope option in %q\n", scope, aline)
+		return
+	}
+
+	value, ok := cf.ctx.GetVar(name)
+	if cf.cmd.JSONOutput() {
+		if ok {
+			cf.cmd.PrintJSON(map[string]string{name: value})
+		} else {
+			cf.cmd.PrintJSON(map[string]string{})
+		}
+	} else if ok {
+		cf.cmd.Println(name, "=", value)
+	}
+	return
+}
+
+// read [--prompt=text] [-s|--silent] name
+//
+// Reads a line entered by the user and sets the variable (--silent doesn't echo the input, i.e. for passwords).
+// At the end of the input the status is 1 and the variable is not changed.
+func (cf *controlFlow) command_read(line string) (stop bool) {
+	var prompt, name string
+	var silent bool
+
+	for _, w := range internal.Words(line, 0) {
+		switch {
+		case strings.HasPrefix(w, "--prompt="):
+			prompt = internal.Unquote(w[9:])
+
+		case w == "-s" || w == "--silent":
+			silent = true
+
+		case strings.HasPrefix(w, "-"):
+			cf.cmd.Println("invalid option", w)
+			return
+
+		case name == "":
+			name = w
+
+		default:
+			name = ""
+		}
+	}
+
+	if !internal.IsName(name) {
+		cf.cmd.Println("usage: read [--prompt=text] [--silent] name")
+		return
+	}
+
+	text, err := cf.cmd.ReadInput(prompt, silent)
+	if err == io.EOF {
+		cf.cmd.SetStatus(1)
+		return
+	}
+	if err != nil {
+		cf.cmd.Println(err)
+		cf.cmd.SetVar("error", err)
+		return
+	}
+
+	cf.changeVar(name, text, internal.InvalidScope)
+	return
+}
+
+func (cf *controlFlow) command_shift(line string) (stop bool) {
+	start := 1
+	args := args.GetArgs(line)
+	if len(args) > 1 {
+		cf.cmd.Println("too many arguments")
+		return
+	}
+
+	if len(args) == 1 {
+		if n, err := parseInt(args[0]); err != nil {
+			cf.cmd.Println(err)
+			return
+		} else {
+			start = n
+		}
+	}
+
+	cf.ctx.ShiftArgs(start)
+	return
+}
+
+// splitCondition splits a line in the condition and the body of if or while.
+//
+// The condition is the first argument, i.e. (gt# $x 10) or (x > 10), unless it's followed by an operator
+// or it's not in parentheses and the body is a block: then it's everything up to the opening brace,
+// i.e. $x > 10 && $name != "" {
+func splitCondition(line string) (cond, body string) {
+	if strings.HasPrefix(line, "!") && !strings.HasPrefix(line, "!=") { // negated condition
+		cond, body = splitCondition(line[1:])
+		return "!" + cond, body
+	}
+
+	parts := args.GetArgsN(line, 2) // [ condition, body ]
+	if len(parts) != 2 {
+		return line, ""
+	}
+
+	if strings.HasPrefix(parts[0], "(") && !isOperator(parts[1]) {
+		return parts[0], parts[1]
+	}
+
+	if strings.HasSuffix(line, "{") {
+		return strings.TrimSpace(strings.TrimSuffix(line, "{")), "{"
+	}
+
+	return parts[0], parts[1]
+}
+
+// isOperator returns true if the line starts with a binary operator of the infix expressions
+func isOperator(line string) bool {
+	for _, op := range []string{"&&", "||", "==", "!=", "<", ">", "+", "-", "*", "/", "%"} {
+		if strings.HasPrefix(line, op) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// conditions are the names of the conditions in the (cond arguments...) form
+var conditions = map[string]bool{
+	"z": true, "n": true, "t": true, "f": true,
+	"eq": true, "ne": true, "gt": true, "gte": true, "lt": true, "lte": true,
+	"eq#": true, "ne#": true, "gt#": true, "gte#": true, "lt#": true, "lte#": true,
+	"startswith": true, "endswith": true, "contains": true,
+	"and": true, "or": true, "not": true,
+}
+
+// evalCondition evaluates a condition: a (cond arguments...) form or a single argument, optionally negated with "!",
+// or an infix expression (see internal.EvalCondition)
+func (cf *controlFlow) evalCondition(line string) (bool, error) {
+	line = strings.TrimSpace(line)
+	cond, negate := line, false
+
+	if strings.HasPrefix(cond, "!") && !strings.HasPrefix(cond, "!=") { // negate condition
+		cond, negate = cond[1:], true
+	}
+
+	if len(cond) == 0 {
+		return false, errors.New("missing condition")
+	}
+
+	if parts := args.GetArgs(cond); len(parts) == 1 {
+		isForm := strings.HasPrefix(cond, "(") && strings.HasSuffix(cond, ")")
+		if isForm {
+			name, _, _ := strings.Cut(strings.TrimSpace(cond[1:]), " ")
+			isForm = conditions[name]
+		}
+
+		if isForm || (!strings.HasPrefix(cond, "(") && !strings.ContainsAny(cond, "=<>&|")) {
+			if !isForm {
+				cond = parts[0]
+			}
+
+			res, err := cf.evalConditional(cond)
+			return res != negate, err
+		}
+	}
+
+	return internal.EvalCondition(line)
+}
+
+func (cf *controlFlow) command_conditional(line string) (stop bool) {
+	if len(line) == 0 {
+		cf.cmd.Println("missing condition")
+		return
+	}
+
+	cond, body := splitCondition(line)
+	if body == "" {
+		cf.cmd.Println("missing body")
+		return
+	}
+
+	res, err := cf.evalCondition(cond)
+	if err != nil {
+		cf.cmd.Println(err)
+		return true
+	}
+
+	if body == "{" {
+		if sb := cf.ctx.StreamBlock(); sb != nil {
+			return cf.streamConditional(sb, res)
+		}
+	}
+
+	trueBlock, falseBlock, err := cf.ctx.ReadBlock(body, "else", cf.cmd.ContinuationPrompt)
+	if err != nil {
+		cf.cmd.Println(err)
+		return true
+	}
+
+	block := falseBlock
+	if res {
+		block = trueBlock
+	}
+
+	// propagate break/continue/return to the enclosing block
+	return cf.cmd.ExitBlock(cf.cmd.RunBlock(cmd.BlockSpec{Body: block.Lines, Pos: block.Pos}).Exit)
+}
+
+// streamConditional executes the blocks of an if command as they are read (see Context.StreamBlock):
+// the first one with a true condition in the chain of "} elif condition {" and "} else {" blocks, skipping the others.
+func (cf *controlFlow) streamConditional(sb *internal.ScanBraces, res bool) (stop bool) {
+	done := false
+
+	for {
+		if res && !done {
+			// propagate break/continue/return to the enclosing block
+			stop, done = cf.cmd.ExitBlock(cf.cmd.RunBlock(cmd.BlockSpec{Scanner: sb}).Exit), true
+		}
+
+		last, err := sb.Skip()
+		if err != nil {
+			cf.cmd.Println(err)
+			return true
+		}
+
+		next := strings.TrimSpace(strings.TrimPrefix(last, "}"))
+
+		if next == "" || strings.HasPrefix(next, "#") {
+			return
+		}
+
+		if rest, ok := strings.CutPrefix(next, "else"); ok && strings.TrimSpace(rest) == "{" {
+			res = true
+		} else if cond, ok := strings.CutPrefix(next, "elif "); ok && strings.HasSuffix(cond, "{") {
+			if res = false; !done {
+				if res, err = cf.evalElif(strings.TrimSuffix(cond, "{")); err != nil {
+					cf.cmd.Println(err)
+					done, stop = true, true // skip the rest of the chain
+				}
+			}
+		} else {
+			cf.cmd.Println(cf.ctx.Position().Errorf("expected else, got %q", next))
+			return true
+		}
+
+		sb = cf.ctx.StreamBlock()
+	}
+}
+
+// evalElif expands and evaluates the condition of an elif block
+func (cf *controlFlow) evalElif(cond string) (bool, error) {
+	cond = strings.TrimSpace(cond)
+	cf.cmd.TraceLine("elif " + cond + " {")
+
+	if canExpand(cond) {
+		var err error
+
+		if cond, err = cf.cmd.ExpandVariablesE(cond); err != nil {
+			return false, err
+		}
+	}
+
+	return cf.evalCondition(cond)
+}
+
+// switch value { case pattern command-or-block... default command-or-block }
+//
+// Executes the body of the first case with a pattern matching the value: a glob pattern (see path.Match)
+// or a regular expression enclosed in slashes (i.e. /^[0-9]+$/). The default body (that should be the last one)
+// is executed if no case matches.
+func (cf *controlFlow) command_switch(line string) (stop bool) {
+	if !strings.HasSuffix(line, "{") {
+		cf.cmd.Println("usage: switch value { case pattern command... }")
+		return
+	}
+
+	value := internal.Unquote(strings.TrimSpace(strings.TrimSuffix(line, "{")))
+
+	block, _, err := cf.ctx.ReadBlock("{", "", cf.cmd.ContinuationPrompt)
+	if err != nil {
+		cf.cmd.Println(err)
+		return true
+	}
+
+	body, err := cf.matchCase(block, value)
+	if err != nil {
+		cf.cmd.Println(err)
+		return true
+	}
+
+	if body.Lines == nil {
+		return
+	}
+
+	// propagate break/continue/return to the enclosing block
+	return cf.cmd.ExitBlock(cf.cmd.RunBlock(cmd.BlockSpec{Body: body.Lines, Pos: body.Pos}).Exit)
+}
+
+// matchCase returns the body of the first case in the block of a switch command with a pattern matching the value
+// (or of the default case), reading the block as a script, so that the cases are sliced from it
+func (cf *controlFlow) matchCase(block internal.Block, value string) (body internal.Block, err error) {
+	prev := cf.ctx.ScanBlock(block.Lines, block.Pos)
+	defer cf.ctx.SetScanner(prev)
+
+	for body.Lines == nil {
+		line, err := cf.ctx.ReadLine("", "")
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return body, err
+		}
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var match bool
+		var rest string
+
+		switch words := internal.Words(line, 3); words[0] {
+		case "case":
+			if len(words) < 3 {
+				return body, cf.ctx.Position().Errorf("missing pattern or body: %v", line)
+			}
+
+			if match, err = matchPattern(cf.cmd.ExpandVariables(words[1]), value); err != nil {
+				return body, err
+			}
+
+			rest = words[2]
+
+		case "default":
+			match, rest = true, strings.TrimSpace(strings.TrimPrefix(line, "default"))
+
+		default:
+			return body, cf.ctx.Position().Errorf("expected case or default, got %v", line)
+		}
+
+		caseBody := internal.Block{Lines: []string{rest}, Pos: cf.ctx.Position()}
+
+		if rest == "{" {
+			if caseBody, _, err = cf.ctx.ReadBlock(rest, "", ""); err != nil {
+				return body, err
+			}
+		} else if rest == "" {
+			return body, cf.ctx.Position().Errorf("missing body: %v", line)
+		}
+
+		if match {
+			body = caseBody
+			if body.Lines == nil {
+				body.Lines = []string{}
+			}
+		}
+	}
+
+	return body, nil
+}
+
+// matchPattern matches the value with a glob pattern, or a regular expression if enclosed in slashes
+func matchPattern(pattern, value string) (bool, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return false, err
+		}
+
+		return re.MatchString(value), nil
+	}
+
+	return path.Match(pattern, value)
+}
+
+func compare(args []string, num bool) (int, error) {
+	l := len(args)
+
+	if l > 2 || (num && l != 2) {
+		return 0, fmt.Errorf("expected 2 arguments, got %v", len(args))
+	}
 
 	var arg1, arg2 string
 
-	if l > 0 {
-		arg1 = args[0]
+	if l > 0 {
+		arg1 = args[0]
+	}
+	if l > 1 {
+		arg2 = args[1]
+	}
+
+	if num {
+		n1, _ := parseInt(arg1)
+		n2, _ := parseInt(arg2)
+		return n1 - n2, nil
+	} else {
+		return strings.Compare(arg1, arg2), nil
+	}
+}
+
+func boolValue(v string) bool {
+	if b, err := strconv.ParseBool(v); err == nil {
+		return b
+	}
+
+	return v != ""
+}
+
+func (cf *controlFlow) evalConditional(line string) (res bool, err error) {
+	if strings.HasPrefix(line, "(") && strings.HasSuffix(line, ")") { // (condition arg1 arg2...)
+		line = line[1:]
+		line = line[:len(line)-1]
+		args := args.GetArgs(line)
+		if len(args) == 0 {
+			return false, fmt.Errorf("invalid condition: %q", line)
+		}
+
+		cond, args := args[0], args[1:]
+		nargs := len(args)
+
+		var cres int
+
+		switch cond {
+		case "z":
+			switch nargs {
+			case 0:
+				res = true
+
+			case 1:
+				res = len(args[0]) == 0
+
+			default:
+				err = fmt.Errorf("expected 1 argument, got %v", nargs)
+			}
+		case "n":
+			switch nargs {
+			case 0:
+				res = false
+
+			case 1:
+				res = len(args[0]) != 0
+
+			default:
+				res = true
+			}
+		case "t":
+			switch nargs {
+			case 0:
+				res = false
+
+			case 1:
+				res = boolValue(args[0])
+
+			default:
+				res = true
+			}
+		case "f":
+			switch nargs {
+			case 0:
+				res = true
+
+			case 1:
+				res = !boolValue(args[0])
+
+			default:
+				res = false
+			}
+		case "eq":
+			cres, err = compare(args, false)
+			res = cres == 0
+		case "ne":
+			cres, err = compare(args, false)
+			res = cres != 0
+		case "gt":
+			cres, err = compare(args, false)
+			res = cres > 0
+		case "gte":
+			cres, err = compare(args, false)
+			res = cres >= 0
+		case "lt":
+			cres, err = compare(args, false)
+			res = cres < 0
+		case "lte":
+			cres, err = compare(args, false)
+			res = cres <= 0
+		case "eq#":
+			cres, err = compare(args, true)
+			res = cres == 0
+		case "ne#":
+			cres, err = compare(args, true)
+			res = cres != 0
+		case "gt#":
+			cres, err = compare(args, true)
+			res = cres > 0
+		case "gte#":
+			cres, err = compare(args, true)
+			res = cres >= 0
+		case "lt#":
+			cres, err = compare(args, true)
+			res = cres < 0
+		case "lte#":
+			cres, err = compare(args, true)
+			res = cres <= 0
+		case "startswith":
+			switch nargs {
+			case 0:
+				err = fmt.Errorf("expected 2 argument, got 0")
+
+			case 1:
+				res = false
+
+			case 2:
+				res = strings.HasPrefix(args[1], args[0])
+			}
+		case "endswith":
+			switch nargs {
+			case 0:
+				err = fmt.Errorf("expected 2 argument, got 0")
+
+			case 1:
+				res = false
+
+			case 2:
+				res = strings.HasSuffix(args[1], args[0])
+			}
+		case "contains":
+			switch nargs {
+			case 0:
+				err = fmt.Errorf("expected 2 argument, got 0")
+
+			case 1:
+				res = false
+
+			case 2:
+				res = strings.Contains(args[1], args[0])
+			}
+		case "and", "or": // true if all (or one) of the conditions are true
+			res = cond == "and"
+
+			for _, arg := range args {
+				r, err := cf.evalOperand(arg)
+				if err != nil {
+					return false, err
+				}
+
+				if r != res { // no need to check the others
+					res = r
+					break
+				}
+			}
+		case "not":
+			if nargs != 1 {
+				err = fmt.Errorf("expected 1 argument, got %v", nargs)
+				break
+			}
+
+			res, err = cf.evalOperand(args[0])
+			res = !res
+		default:
+			err = fmt.Errorf("invalid condition: %q", line)
+		}
+	} else if len(line) == 0 || line == "0" {
+		res = false
+	} else {
+		res = true
+	}
+
+	return
+}
+
+// evalOperand evaluates an argument of and, or, not: a condition in parentheses,
+// or a value that is true if not empty (and not 0)
+func (cf *controlFlow) evalOperand(arg string) (bool, error) {
+	if strings.HasPrefix(arg, "(") {
+		return cf.evalCondition(arg)
+	}
+
+	return cf.evalConditional(arg)
+}
+
+// parseInt64 parses a decimal, hexadecimal (0x), binary (0b) or octal (0o or 0) integer, optionally negative
+func parseInt64(v string) (int64, error) {
+	neg := strings.HasPrefix(v, "-")
+	if neg {
+		v = v[1:]
+	}
+
+	base := 10
+	if strings.HasPrefix(v, "0x") || strings.HasPrefix(v, "0X") {
+		base = 16
+		v = v[2:]
+	} else if strings.HasPrefix(v, "0b") || strings.HasPrefix(v, "0B") {
+		base = 2
+		v = v[2:]
+	} else if strings.HasPrefix(v, "0o") || strings.HasPrefix(v, "0O") {
+		base = 8
+		v = v[2:]
+	} else if len(v) > 1 && strings.HasPrefix(v, "0") {
+		base = 8
+		v = v[1:]
+	}
+
+	i, err := strconv.ParseInt(v, base, 64)
+	if neg {
+		i = -i
+	}
+
+	return i, err
+}
+
+func parseInt(v string) (int, error) {
+	i, err := parseInt64(v)
+	return int(i), err
+}
+
+func parseFloat(v string) (float64, error) {
+	if i, err := parseInt64(v); err == nil { // i.e. 0xff
+		return float64(i), nil
+	}
+
+	return strconv.ParseFloat(v, 64)
+}
+
+// intArgs parses the arguments as integers, and returns false if one of them is not an integer
+func intArgs(parts []string) ([]int64, bool) {
+	ints := make([]int64, len(parts))
+
+	for i, p := range parts {
+		n, err := parseInt64(p)
+		if err != nil {
+			return nil, false
+		}
+
+		ints[i] = n
+	}
+
+	return ints, true
+}
+
+// floatArgs parses the arguments as numbers
+func floatArgs(parts []string) ([]float64, error) {
+	floats := make([]float64, len(parts))
+
+	for i, p := range parts {
+		n, err := parseFloat(p)
+		if err != nil {
+			return nil, fmt.Errorf("not a number: %v", p)
+		}
+
+		floats[i] = n
+	}
+
+	return floats, nil
+}
+
+// intPow returns x**y (y >= 0)
+func intPow(x, y int64) int64 {
+	p := int64(1)
+
+	for ; y > 0; y >>= 1 {
+		if y&1 == 1 {
+			p *= x
+		}
+		x *= x
+	}
+
+	return p
+}
+
+func intString(v int64, base int) string {
+	if base == 0 {
+		base = 10
+	}
+
+	return strconv.FormatInt(v, base)
+}
+
+func floatString(v float64) string {
+	s := strconv.FormatFloat(v, 'f', 3, 64)
+	return strings.TrimSuffix(s, ".000")
+}
+
+const expr_help = `expr operator operands...
+
+operators:
+  +|-|*|/|%|** number number
+  abs number
+  min|max numbers...
+  int number
+  round [up|down] number
+  band|bor|bxor integer integer
+  shl|shr integer count
+  bnot integer
+  hex|oct|bin integers...
+  rand max [base]
+  upper string
+  lower string
+  trim string
+  len string|list
+  substr start:end string
+  re|regex|regexp expr string
+  or first rest`
+
+func (cf *controlFlow) command_expression(aline string) (stop bool) {
+	parts := args.GetArgsN(aline, 2) // [ op, arg1 ]
+	if len(parts) != 2 {
+		cf.cmd.Println("usage:", expr_help)
+		return
+	}
+
+	op, line := parts[0], parts[1]
+
+	var res interface{}
+
+	switch op {
+	case "hex", "oct", "bin": // integer...
+		base := map[string]int{"hex": 16, "oct": 8, "bin": 2}[op]
+
+		var li []string
+
+		for _, n := range args.GetArgs(line) {
+			i, _ := parseInt64(n)
+			li = append(li, intString(i, base))
+		}
+
+		res = strings.Join(li, " ")
+
+	case "int": // the integer part of a number, in decimal
+		if i, err := parseInt64(line); err == nil {
+			res = i
+		} else if f, err := parseFloat(line); err == nil {
+			res = int64(f)
+		} else {
+			cf.cmd.Println("not a number:", line)
+			return
+		}
+
+	case "abs":
+		if i, err := parseInt64(line); err == nil {
+			if i < 0 {
+				i = -i
+			}
+			res = i
+		} else if f, err := parseFloat(line); err == nil {
+			res = floatString(math.Abs(f))
+		} else {
+			cf.cmd.Println("not a number:", line)
+			return
+		}
+
+	case "min", "max": // number...
+		parts := args.GetArgs(line)
+		if len(parts) == 0 {
+			cf.cmd.Println("usage:", op, "numbers...")
+			return
+		}
+
+		if ints, ok := intArgs(parts); ok {
+			m := ints[0]
+			for _, i := range ints[1:] {
+				if (op == "min" && i < m) || (op == "max" && i > m) {
+					m = i
+				}
+			}
+
+			res = m
+			break
+		}
+
+		floats, err := floatArgs(parts)
+		if err != nil {
+			cf.cmd.Println(err)
+			return
+		}
+
+		m := floats[0]
+		for _, f := range floats[1:] {
+			if op == "min" {
+				m = math.Min(m, f)
+			} else {
+				m = math.Max(m, f)
+			}
+		}
+
+		res = floatString(m)
+
+	case "band", "bor", "bxor", "shl", "shr": // integer integer
+		parts := args.GetArgs(line) // [ arg1, arg2 ]
+		if len(parts) != 2 {
+			cf.cmd.Println("usage:", op, "arg1 arg2")
+			return
+		}
+
+		ints, ok := intArgs(parts)
+		if !ok {
+			cf.cmd.Println("not an integer:", line)
+			return
+		}
+
+		n1, n2 := ints[0], ints[1]
+
+		switch op {
+		case "band":
+			res = n1 & n2
+		case "bor":
+			res = n1 | n2
+		case "bxor":
+			res = n1 ^ n2
+		case "shl", "shr":
+			if n2 < 0 {
+				cf.cmd.Println("negative shift count:", n2)
+				return
+			}
+
+			if op == "shl" {
+				res = n1 << n2
+			} else {
+				res = n1 >> n2
+			}
+		}
+
+	case "bnot":
+		i, err := parseInt64(line)
+		if err != nil {
+			cf.cmd.Println("not an integer:", line)
+			return
+		}
+
+		res = ^i
+
+	case "round": // [up|down] number
+		roundFunction := func(n float64) float64 {
+			f := math.Floor(n)
+			if n-f > 0.5 {
+				return math.Ceil(n)
+			}
+
+			return f
+		}
+
+		if strings.HasPrefix(line, "up ") {
+			roundFunction = math.Ceil
+			line = strings.TrimSpace(line[3:])
+		} else if strings.HasPrefix(line, "down ") {
+			roundFunction = math.Floor
+			line = strings.TrimSpace(line[5:])
+		}
+
+		n, err := parseFloat(line)
+		if err != nil {
+			cf.cmd.Println("not a number")
+			return
+		}
+
+		res = floatString(roundFunction(n))
+
+	case "rand":
+		parts := args.GetArgs(line) // [ max, base ]
+		if len(parts) > 2 {
+			cf.cmd.Println("usage: rand max [base]")
+			return
+		}
+
+		neg := false
+		base := 10
+
+		max, err := parseInt64(parts[0])
+		if err != nil || max == 0 {
+			max = math.MaxInt64
+		} else if max < 0 {
+			neg = true
+			max = -max
+		}
+
+		if len(parts) == 2 {
+			base, err = parseInt(parts[1])
+			if err != nil {
+				cf.cmd.Println("base should be a number")
+				return
+			}
+
+			if base <= 0 {
+				base = 10
+			} else if base > 36 {
+				base = 36
+			}
+		}
+
+		r := rand.Int63n(max)
+		if neg {
+			r = -r
+		}
+		res = intString(r, base)
+
+	case "+", "-", "*", "/", "%", "**":
+		parts := args.GetArgs(line) // [ arg1, arg2 ]
+		if len(parts) != 2 {
+			cf.cmd.Println("usage:", op, "arg1 arg2")
+			return
+		}
+
+		if ints, ok := intArgs(parts); ok && (op == "%" || op == "**") { // integer operations
+			n1, n2 := ints[0], ints[1]
+
+			if op == "%" {
+				if n2 == 0 {
+					cf.cmd.Println("division by zero")
+					return
+				}
+
+				res = n1 % n2
+				break
+			}
+
+			if n2 >= 0 {
+				res = intPow(n1, n2)
+				break
+			}
+		}
+
+		floats, err := floatArgs(parts)
+		if err != nil {
+			cf.cmd.Println(err)
+			return
+		}
+
+		n1, n2 := floats[0], floats[1]
+
+		switch op {
+		case "+":
+			n1 += n2
+		case "-":
+			n1 -= n2
+		case "*":
+			n1 *= n2
+		case "/":
+			n1 /= n2
+		case "%":
+			n1 = math.Mod(n1, n2)
+		case "**":
+			n1 = math.Pow(n1, n2)
+		}
+		res = floatString(n1)
+
+	case "upper":
+		res = strings.ToUpper(line)
+
+	case "lower":
+		res = strings.ToLower(line)
+
+	case "trim":
+		res = strings.TrimSpace(line)
+
+	case "len": // the number of elements of a list (a JSON array), or the length of a string
+		if strings.HasPrefix(line, "[") {
+			if j, err := simplejson.LoadString(line); err == nil {
+				if list, err := j.Array(); err == nil {
+					res = len(list)
+					break
+				}
+			}
+		}
+
+		res = utf8.RuneCountInString(line)
+
+	case "substr":
+		parts := args.GetArgsN(line, 2) // [ start:end, line ]
+		if len(parts) == 0 {
+			cf.cmd.Println("usage: substr start:end line")
+			return
+		}
+
+		if len(parts) == 1 { // empty line ?
+			line = ""
+		} else {
+			line = parts[1]
+		}
+
+		srange := parts[0]
+		var start, end int
+
+		if !strings.Contains(srange, ":") {
+			cf.cmd.Println("expected start:end, got", srange)
+			return
+		}
+
+		parts = strings.Split(srange, ":")
+
+		start, _ = parseInt(parts[0])
+		if start < 0 {
+			start = len(line) + start
+		}
+		if start < 0 {
+			start = 0
+		} else if start > len(line) {
+			start = len(line)
+		}
+
+		if parts[1] == "" { // start:
+			end = len(line)
+		} else {
+			end, _ = parseInt(parts[1])
+		}
+
+		if end < 0 {
+			end = start + len(line) + end
+		}
+
+		if end < start {
+			end = start
+		} else if end > len(line) {
+			end = len(line)
+		}
+
+		res = line[start:end]
+
+	case "split":
+		parts := args.GetArgsN(line, 2) // [ sep, line ]
+		if len(parts) == 0 {
+			cf.cmd.Println("usage: split sep line")
+			return
+		}
+
+		if len(parts) == 1 { // empty line ?
+			res = ""
+		} else {
+			res = fmt.Sprintf("%q", strings.Split(parts[1], parts[0]))
+		}
+
+	case "re", "regex", "regexp":
+		parts := args.GetArgsN(line, 2) // [ regexp, line ]
+		if len(parts) == 0 {
+			cf.cmd.Println("usage: re expr line")
+			return
+		}
+
+		if len(parts) == 1 { // empty line ?
+			res = ""
+			break
+		}
+
+		re, err := regexp.Compile(parts[0])
+		if err != nil {
+			cf.cmd.Println(err)
+			return
+		}
+
+		parts = re.FindStringSubmatch(parts[1])
+		switch len(parts) {
+		case 0: // no results
+			res = ""
+		case 1: // no submatches
+			res = parts[0]
+		case 2: // one submatch
+			res = parts[1]
+		default:
+			res = fmt.Sprintf("%q", parts[1:])
+		}
+
+	case "or":
+		parts := args.GetArgsN(line, 2) // [ head, remain ]
+		switch len(parts) {
+		case 0:
+			res = ""
+
+		case 1:
+			res = parts[0]
+
+		case 2:
+			if len(parts[0]) > 0 {
+				res = parts[0]
+			} else {
+				res = parts[1]
+			}
+		}
+
+	default:
+
+		cf.cmd.Printf("invalid operator: %v in %q\n", op, aline)
+		return
 	}
-	if l > 1 {
-		arg2 = args[1]
+
+	if !cf.cmd.SilentResult() {
+		cf.cmd.Println(res)
 	}
 
-	if num {
-		n1, _ := parseInt(arg1)
-		n2, _ := parseInt(arg2)
-		return n1 - n2, nil
-	} else {
-		return strings.Compare(arg1, arg2), nil
+	cf.cmd.SetVar("result", res)
+	return
+}
+
+// let [name =] expression
+//
+// Evaluates an infix expression (see internal.EvalExpr), and sets the variable to the result,
+// or prints it and sets the "result" variable.
+func (cf *controlFlow) command_let(line string) (stop bool) {
+	name, expr := "", line
+
+	if n, e, ok := strings.Cut(line, "="); ok && internal.IsName(strings.TrimSpace(n)) && !strings.HasPrefix(e, "=") {
+		name, expr = strings.TrimSpace(n), e
+	}
+
+	if strings.TrimSpace(expr) == "" {
+		cf.cmd.Println("usage: let [name =] expression")
+		return
+	}
+
+	res, err := internal.EvalExpr(expr)
+	if err != nil {
+		cf.cmd.Println(err)
+		return
+	}
+
+	if name != "" {
+		cf.changeVar(name, res, internal.InvalidScope)
+		return
+	}
+
+	if !cf.cmd.SilentResult() {
+		cf.cmd.Println(res)
 	}
+
+	cf.cmd.SetVar("result", res)
+	return
 }
 
-func boolValue(v string) bool {
-	if b, err := strconv.ParseBool(v); err == nil {
-		return b
+// jsonValue converts complex types (maps and lists) to their JSON representation
+func jsonValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		v, _ = simplejson.DumpString(t)
+
+	case []interface{}:
+		v, _ = simplejson.DumpString(t)
+
+	case nil:
+		v = "null"
 	}
 
-	return v != ""
+	return v
 }
 
-func (cf *controlFlow) evalConditional(line string) (res bool, err error) {
-	if strings.HasPrefix(line, "(") && strings.HasSuffix(line, ")") { // (condition arg1 arg2...)
-		line = line[1:]
-		line = line[:len(line)-1]
-		args := args.GetArgs(line)
-		if len(args) == 0 {
-			return false, fmt.Errorf("invalid condition: %q", line)
+// getObject returns the JSON object in line (optionally in parentheses), or nil if it's not an object
+func getObject(line string) map[string]interface{} {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "(") && strings.HasSuffix(line, ")") { // i.e. ($(json ...))
+		line = strings.TrimSpace(line[1 : len(line)-1])
+	}
+
+	if !strings.HasPrefix(line, "{") {
+		return nil
+	}
+
+	j, err := simplejson.LoadString(line)
+	if err != nil {
+		return nil
+	}
+
+	m, err := j.Map()
+	if err != nil {
+		return nil
+	}
+
+	return m
+}
+
+func getList(line string) []interface{} {
+	if strings.HasPrefix(line, "[") {
+		j, err := simplejson.LoadString(line)
+		if err == nil {
+			return j.MustArray()
 		}
 
-		cond, args := args[0], args[1:]
-		nargs := len(args)
+		line = line[1:]
+		if strings.HasSuffix(line, "]") {
+			line = line[:len(line)-1]
+		}
+	} else if strings.HasPrefix(line, "(") {
+		line = line[1:]
+		if strings.HasSuffix(line, ")") {
+			line = line[:len(line)-1]
+		}
 
-		var cres int
+		if l := strings.TrimSpace(line); strings.HasPrefix(l, "[") { // i.e. ($(jsonpath $.items $json))
+			return getList(l)
+		}
+	}
 
-		switch cond {
-		case "z":
-			switch nargs {
-			case 0:
-				res = true
+	arr := args.GetArgs(line)
+	iarr := make([]interface{}, len(arr))
+	for i, v := range arr {
+		iarr[i] = v
+	}
+	return iarr
+}
 
-			case 1:
-				res = len(args[0]) == 0
+func (cf *controlFlow) command_repeat(line string) (stop bool) {
+	count := int64(math.MaxInt64) // almost forever
+	wait := time.Duration(0)      // no wait
+	arg := ""
 
-			default:
-				err = fmt.Errorf("expected 1 argument, got %v", nargs)
+	for {
+		if strings.HasPrefix(line, "-") {
+			// some options
+			parts := strings.SplitN(line, " ", 2)
+			if len(parts) < 2 {
+				// no command
+				cf.cmd.Println("nothing to repeat")
+				return
 			}
-		case "n":
-			switch nargs {
-			case 0:
-				res = false
 
-			case 1:
-				res = len(args[0]) != 0
+			arg, line = parts[0], strings.TrimSpace(parts[1])
+			if arg == "--" {
+				break
+			}
 
-			default:
-				res = true
+			if strings.HasPrefix(arg, "--count=") {
+				arg = cf.cmd.ExpandVariables(arg)
+				count, _ = strconv.ParseInt(arg[8:], 10, 64)
+			} else if strings.HasPrefix(arg, "--wait=") {
+				arg = cf.cmd.ExpandVariables(arg)
+				wait = parseWait(arg[7:])
+			} else {
+				// unknown option
+				cf.cmd.Println("invalid option", arg)
+				return
 			}
-		case "t":
-			switch nargs {
-			case 0:
-				res = false
+		} else {
+			break
+		}
+	}
 
-			case 1:
-				res = boolValue(args[0])
+	block, _, err := cf.ctx.ReadBlock(line, "", cf.cmd.ContinuationPrompt)
+	if err != nil {
+		cf.cmd.Println(err)
+		return
+	}
 
-			default:
-				res = true
-			}
-		case "f":
-			switch nargs {
-			case 0:
-				res = true
+	cf.ctx.PushScope(nil, nil)
+	cf.cmd.SetVar("count", count)
 
-			case 1:
-				res = !boolValue(args[0])
+	cf.Lock()
+	cf.inLoop = true
+	cf.Unlock()
 
-			default:
-				res = false
+	for l := newLoop(count); l.Next(); {
+		if wait > 0 && !l.First() {
+			if cf.sleepInterrupted(wait) {
+				break
 			}
-		case "eq":
-			cres, err = compare(args, false)
-			res = cres == 0
-		case "ne":
-			cres, err = compare(args, false)
-			res = cres != 0
-		case "gt":
-			cres, err = compare(args, false)
-			res = cres > 0
-		case "gte":
-			cres, err = compare(args, false)
-			res = cres >= 0
-		case "lt":
-			cres, err = compare(args, false)
-			res = cres < 0
-		case "lte":
-			cres, err = compare(args, false)
-			res = cres <= 0
-		case "eq#":
-			cres, err = compare(args, true)
-			res = cres == 0
-		case "ne#":
-			cres, err = compare(args, true)
-			res = cres != 0
-		case "gt#":
-			cres, err = compare(args, true)
-			res = cres > 0
-		case "gte#":
-			cres, err = compare(args, true)
-			res = cres >= 0
-		case "lt#":
-			cres, err = compare(args, true)
-			res = cres < 0
-		case "lte#":
-			cres, err = compare(args, true)
-			res = cres <= 0
-		case "startswith":
-			switch nargs {
-			case 0:
-				err = fmt.Errorf("expected 2 argument, got 0")
+		}
 
-			case 1:
-				res = false
+		cf.cmd.SetVar("index", l.Index)
+		if cf.runLoopBody(block, &stop) {
+			break
+		}
+	}
+
+	cf.Lock()
+	cf.inLoop = false
+	cf.Unlock()
+
+	cf.ctx.PopScope()
+	return
+}
+
+// while [--wait=duration] (condition) command
+//
+// Executes the command (or block) as long as the condition is true.
+// The condition is expanded and evaluated again before each iteration.
+func (cf *controlFlow) command_while(line string) (stop bool) {
+	wait := time.Duration(0) // no wait
+
+	if strings.HasPrefix(line, "--wait=") {
+		arg, rest, _ := strings.Cut(line, " ")
+		wait = parseWait(cf.cmd.ExpandVariables(arg)[7:])
+		line = strings.TrimSpace(rest)
+	}
+
+	cond, body := splitCondition(line)
+	if cond == "" || body == "" {
+		cf.cmd.Println("missing condition or body")
+		return
+	}
+
+	block, _, err := cf.ctx.ReadBlock(body, "", cf.cmd.ContinuationPrompt)
+	if err != nil {
+		cf.cmd.Println(err)
+		return
+	}
 
-			case 2:
-				res = strings.HasPrefix(args[1], args[0])
-			}
-		case "endswith":
-			switch nargs {
-			case 0:
-				err = fmt.Errorf("expected 2 argument, got 0")
+	cf.ctx.PushScope(nil, nil)
 
-			case 1:
-				res = false
+	cf.Lock()
+	cf.inLoop = true
+	cf.Unlock()
 
-			case 2:
-				res = strings.HasSuffix(args[1], args[0])
+	for i := 0; ; i++ {
+		if wait > 0 && i > 0 {
+			if cf.sleepInterrupted(wait) {
+				break
 			}
-		case "contains":
-			switch nargs {
-			case 0:
-				err = fmt.Errorf("expected 2 argument, got 0")
+		}
 
-			case 1:
-				res = false
+		res, err := cf.evalCondition(cf.cmd.ExpandVariables(cond))
+		if err != nil {
+			cf.cmd.Println(err)
+			stop = true
+			break
+		}
 
-			case 2:
-				res = strings.Contains(args[1], args[0])
-			}
-		default:
-			err = fmt.Errorf("invalid condition: %q", line)
+		if !res {
+			break
+		}
+
+		cf.cmd.SetVar("index", i)
+		if cf.runLoopBody(block, &stop) {
+			break
 		}
-	} else if len(line) == 0 || line == "0" {
-		res = false
-	} else {
-		res = true
 	}
 
+	cf.Lock()
+	cf.inLoop = false
+	cf.Unlock()
+
+	cf.ctx.PopScope()
 	return
 }
 
-func parseInt64(v string) (int64, error) {
-	base := 10
-	if strings.HasPrefix(v, "0x") {
-		base = 16
-		v = v[2:]
-	} else if strings.HasPrefix(v, "0") {
-		base = 8
-		v = v[1:]
+// runLoopBody executes one iteration of a loop and returns true if the loop should terminate.
+// If the body called "return", stop is set to propagate it to the enclosing function.
+func (cf *controlFlow) runLoopBody(block internal.Block, stop *bool) bool {
+	res := cf.cmd.RunBlock(cmd.BlockSpec{Body: block.Lines, Pos: block.Pos, NewScope: true})
+
+	switch res.Exit {
+	case cmd.BlockDone, cmd.BlockContinue:
+		return cf.cmd.Interrupted()
+
+	case cmd.BlockReturn:
+		*stop = cf.cmd.ExitBlock(cmd.BlockReturn)
 	}
 
-	return strconv.ParseInt(v, base, 64)
+	return true
 }
 
-func parseInt(v string) (int, error) {
-	i, err := parseInt64(v)
-	return int(i), err
+func (cf *controlFlow) command_break(string) (stop bool) {
+	return cf.cmd.ExitBlock(cmd.BlockBreak)
 }
 
-func parseFloat(v string) (float64, error) {
-	return strconv.ParseFloat(v, 64)
+func (cf *controlFlow) command_continue(string) (stop bool) {
+	return cf.cmd.ExitBlock(cmd.BlockContinue)
 }
 
-func intString(v int64, base int) string {
-	if base == 0 {
-		base = 10
+func (cf *controlFlow) command_return(string) (stop bool) {
+	return cf.cmd.ExitBlock(cmd.BlockReturn)
+}
+
+// rangeItems returns the numbers in a start:end[:step] range (end included), and their count
+func rangeItems(spec string) (next func() (interface{}, bool), count int, err error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, 0, fmt.Errorf("expected start:end[:step], got %q", spec)
 	}
 
-	return strconv.FormatInt(v, base)
+	nums, ok := intArgs(parts)
+	if !ok {
+		return nil, 0, fmt.Errorf("invalid range %q", spec)
+	}
+
+	start, end, step := nums[0], nums[1], int64(1)
+	if len(nums) == 3 {
+		step = nums[2]
+	} else if start > end {
+		step = -1
+	}
+
+	if step == 0 {
+		return nil, 0, fmt.Errorf("invalid step in range %q", spec)
+	}
+
+	if (step > 0 && start <= end) || (step < 0 && start >= end) {
+		count = int((end-start)/step) + 1
+	}
+
+	i := 0
+	next = func() (interface{}, bool) {
+		if i >= count {
+			return nil, false
+		}
+
+		v := start + int64(i)*step
+		i++
+		return v, true
+	}
+
+	return
 }
 
-func floatString(v float64) string {
-	s := strconv.FormatFloat(v, 'f', 3, 64)
-	return strings.TrimSuffix(s, ".000")
+// fileItems returns the lines of a file, read as needed (call done when finished)
+func fileItems(filename string) (next func() (interface{}, bool), done func() error, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+
+	next = func() (interface{}, bool) {
+		if !scanner.Scan() {
+			return nil, false
+		}
+
+		return scanner.Text(), true
+	}
+
+	done = func() error {
+		f.Close()
+		return scanner.Err()
+	}
+
+	return
 }
 
-const expr_help = `expr operator operands...
+// globItems returns the files matching a glob pattern, relative to the interpreter directory if the pattern is
+func (cf *controlFlow) globItems(pattern string) ([]interface{}, error) {
+	matches, err := filepath.Glob(cf.cmd.Path(pattern))
+	if err != nil {
+		return nil, err
+	}
 
-operators:
-  +|-|*|/ number number
-  round [up|down] number
-  rand max [base]
-  upper string
-  lower string
-  trim string
-  substr start:end string
-  re|regex|regexp expr string
-  or first rest`
+	items := make([]interface{}, len(matches))
+	for i, m := range matches {
+		if !filepath.IsAbs(pattern) {
+			if rel, err := filepath.Rel(cf.cmd.Dir(), m); err == nil {
+				m = rel
+			}
+		}
 
-func (cf *controlFlow) command_expression(aline string) (stop bool) {
-	parts := args.GetArgsN(aline, 2) // [ op, arg1 ]
-	if len(parts) != 2 {
-		fmt.Println("usage:", expr_help)
-		return
+		items[i] = m
 	}
 
-	op, line := parts[0], parts[1]
+	return items, nil
+}
 
-	var res interface{}
+// getItems returns the items of a list: a list variable ($name), the keys of a map variable or JSON object
+// (returned as object), or a list (i.e. (a b c), or a JSON array) after expanding the variables
+func (cf *controlFlow) getItems(list string) (items []interface{}, object map[string]interface{}) {
+	if name, ok := strings.CutPrefix(list, "$"); ok && internal.IsName(name) {
+		value, _ := cf.cmd.GetValue(name)
 
-	switch op {
-	case "hex": // hex number...
-		var li []string
+		switch t := value.(type) {
+		case internal.List: // a list variable
+			items = t
 
-		for _, n := range args.GetArgs(line) {
-			i, _ := parseInt64(n)
-			li = append(li, intString(i, 16))
+		case internal.Dict: // a map variable: iterate over the keys
+			object = t
 		}
+	}
 
-		res = strings.Join(li, " ")
+	if items == nil && object == nil {
+		list = cf.cmd.ExpandVariables(list)
 
-	case "round": // [up|down] number
-		roundFunction := func(n float64) float64 {
-			f := math.Floor(n)
-			if n-f > 0.5 {
-				return math.Ceil(n)
+		if object = getObject(list); object == nil {
+			items = getList(list)
+		}
+	}
+
+	if object != nil {
+		items = []interface{}{}
+		for _, k := range internal.SortedKeys(object) {
+			items = append(items, k)
+		}
+	}
+
+	return
+}
+
+// listItems returns a function that iterates over the items of a list
+func listItems(list []interface{}) func() (interface{}, bool) {
+	i := 0
+
+	return func() (interface{}, bool) {
+		if i >= len(list) {
+			return nil, false
+		}
+
+		i++
+		return list[i-1], true
+	}
+}
+
+// foreach [--wait=duration] (items...) command
+// foreach [--wait=duration] --file=path|--glob=pattern|--range=start:end[:step] command
+//
+// Executes the command (or block) for each item of the list, each line of the file,
+// each file matching the pattern or each number in the range (end included), setting $item and $index.
+// For a map variable or a JSON object the items are the keys (sorted), and $key and $value are also set.
+// $count is the number of items (not set for --file, since the lines are read as needed).
+func (cf *controlFlow) command_foreach(line string) (stop bool) {
+	arg := ""
+	wait := time.Duration(0) // no wait
+
+	var file, glob, srange string
+
+	for {
+		if strings.HasPrefix(line, "-") {
+			// some options
+			parts := strings.SplitN(line, " ", 2)
+			if len(parts) < 2 {
+				// no command
+				return
 			}
 
-			return f
+			arg, line = parts[0], strings.TrimSpace(parts[1])
+			if arg == "--" {
+				break
+			}
+
+			if strings.HasPrefix(arg, "--wait=") {
+				arg = cf.cmd.ExpandVariables(arg)
+				wait = parseWait(arg[7:])
+			} else if v, ok := strings.CutPrefix(arg, "--file="); ok {
+				file = internal.Unquote(cf.cmd.ExpandVariables(v))
+			} else if v, ok := strings.CutPrefix(arg, "--glob="); ok {
+				glob = internal.Unquote(cf.cmd.ExpandVariables(v))
+			} else if v, ok := strings.CutPrefix(arg, "--range="); ok {
+				srange = internal.Unquote(cf.cmd.ExpandVariables(v))
+			} else {
+				// unknown option
+				cf.cmd.Println("invalid option", arg)
+				return
+			}
+		} else {
+			break
 		}
+	}
 
-		if strings.HasPrefix(line, "up ") {
-			roundFunction = math.Ceil
-			line = strings.TrimSpace(line[3:])
-		} else if strings.HasPrefix(line, "down ") {
-			roundFunction = math.Floor
-			line = strings.TrimSpace(line[5:])
+	var next func() (interface{}, bool)
+	var command string
+	var object map[string]interface{} // iterating over the keys of a map, or JSON object
+
+	count := -1
+
+	switch {
+	case file != "":
+		var done func() error
+		var err error
+
+		if next, done, err = fileItems(cf.cmd.Path(file)); err != nil {
+			cf.cmd.Println(err)
+			return
 		}
 
-		n, err := parseFloat(line)
+		defer func() {
+			if err := done(); err != nil {
+				cf.cmd.Println(err)
+			}
+		}()
+
+		command = line
+
+	case glob != "":
+		items, err := cf.globItems(glob)
 		if err != nil {
-			fmt.Println("not a number")
+			cf.cmd.Println(err)
 			return
 		}
 
-		res = floatString(roundFunction(n))
+		next, count, command = listItems(items), len(items), line
 
-	case "rand":
-		parts := args.GetArgs(line) // [ max, base ]
-		if len(parts) > 2 {
-			fmt.Println("usage: rand max [base]")
+	case srange != "":
+		var err error
+
+		if next, count, err = rangeItems(srange); err != nil {
+			cf.cmd.Println(err)
 			return
 		}
 
-		neg := false
-		base := 10
+		command = line
+
+	default:
+		parts := args.GetArgsN(line, 2) // [ list, command ]
+		if len(parts) != 2 {
+			cf.cmd.Println("missing argument(s)")
+			return
+		}
+
+		var args []interface{}
+		args, object = cf.getItems(parts[0])
+		next, count, command = listItems(args), len(args), parts[1]
+	}
+
+	if command == "" {
+		cf.cmd.Println("missing command")
+		return
+	}
+
+	block, _, err := cf.ctx.ReadBlock(command, "", cf.cmd.ContinuationPrompt)
+	if err != nil {
+		cf.cmd.Println(err)
+		return
+	}
+
+	cf.ctx.PushScope(nil, nil)
+	if count >= 0 {
+		cf.cmd.SetVar("count", count)
+	}
+
+	cf.Lock()
+	cf.inLoop = true
+	cf.Unlock()
+
+	for i := 0; ; i++ {
+		if wait > 0 && i > 0 {
+			if cf.sleepInterrupted(wait) {
+				break
+			}
+		}
+
+		v, ok := next()
+		if !ok {
+			break
+		}
+
+		cf.cmd.SetVar("index", i)
+		cf.cmd.SetVar("item", jsonValue(v))
+
+		if object != nil {
+			cf.cmd.SetVar("key", v)
+			cf.cmd.SetVar("value", jsonValue(object[v.(string)]))
+		}
+		if cf.runLoopBody(block, &stop) {
+			break
+		}
+	}
+
+	cf.Lock()
+	cf.inLoop = false
+	cf.Unlock()
+
+	cf.ctx.PopScope()
+	return
+}
+
+// select [--prompt=text] name (options...) command
+//
+// Prints a numbered menu of the options and reads the choice of the user, then sets the variable
+// to the chosen option ($reply is the text entered) and executes the command (or block).
+// As for the other loops this is repeated, until the body calls break or the input ends.
+// An empty input prints the menu again.
+func (cf *controlFlow) command_select(line string) (stop bool) {
+	prompt := "#? "
+
+	if strings.HasPrefix(line, "--prompt=") {
+		words := internal.Words(line, 2)
+		prompt = internal.Unquote(cf.cmd.ExpandVariables(words[0][9:]))
+
+		if len(words) > 1 {
+			line = words[1]
+		} else {
+			line = ""
+		}
+	}
+
+	parts := args.GetArgsN(line, 3) // [ name, options, command ]
+	if len(parts) != 3 || !internal.IsName(parts[0]) {
+		cf.cmd.Println("usage: select [--prompt=text] name (options...) command")
+		return
+	}
+
+	name := parts[0]
+
+	options, _ := cf.getItems(parts[1])
+	if len(options) == 0 {
+		cf.cmd.Println("no options")
+		return
+	}
+
+	block, _, err := cf.ctx.ReadBlock(parts[2], "", cf.cmd.ContinuationPrompt)
+	if err != nil {
+		cf.cmd.Println(err)
+		return
+	}
 
-		max, err := parseInt64(parts[0])
-		if err != nil || max == 0 {
-			max = math.MaxInt64
-		} else if max < 0 {
-			neg = true
-			max = -max
+	menu := func() {
+		for i, o := range options {
+			cf.cmd.Printf("%d) %v\n", i+1, jsonValue(o))
 		}
+	}
 
-		if len(parts) == 2 {
-			base, err = parseInt(parts[1])
-			if err != nil {
-				fmt.Println("base should be a number")
-				return
-			}
+	cf.Lock()
+	cf.inLoop = true
+	cf.Unlock()
 
-			if base <= 0 {
-				base = 10
-			} else if base > 36 {
-				base = 36
-			}
+	for menu(); ; {
+		reply, err := cf.cmd.ReadInput(prompt, false)
+		if err == io.EOF {
+			break
 		}
-
-		r := rand.Int63n(max)
-		if neg {
-			r = -r
+		if err != nil {
+			cf.cmd.Println(err)
+			break
 		}
-		res = intString(r, base)
 
-	case "+", "-", "*", "/":
-		parts := args.GetArgs(line) // [ arg1, arg2 ]
-		if len(parts) != 2 {
-			fmt.Println("usage:", op, "arg1 arg2")
-			return
+		if reply = strings.TrimSpace(reply); reply == "" {
+			menu()
+			continue
 		}
 
-		n1, err := parseFloat(parts[0])
-		if err != nil {
-			fmt.Println("not a number:", parts[0])
-			return
+		n, err := strconv.Atoi(reply)
+		if err != nil || n < 1 || n > len(options) {
+			cf.cmd.Println("invalid choice:", reply)
+			continue
 		}
 
-		n2, err := parseFloat(parts[1])
-		if err != nil {
-			fmt.Println("not a number:", parts[1])
-			return
-		}
+		cf.changeVar(name, jsonValue(options[n-1]), internal.InvalidScope)
+		cf.cmd.SetVar("reply", reply)
 
-		if op == "+" {
-			n1 += n2
-		} else if op == "-" {
-			n1 -= n2
-		} else if op == "*" {
-			n1 *= n2
-		} else if op == "/" {
-			n1 /= n2
+		if cf.runLoopBody(block, &stop) {
+			break
 		}
-		res = floatString(n1)
+	}
 
-	case "upper":
-		res = strings.ToUpper(line)
+	cf.Lock()
+	cf.inLoop = false
+	cf.Unlock()
 
-	case "lower":
-		res = strings.ToLower(line)
+	return
+}
 
-	case "trim":
-		res = strings.TrimSpace(line)
+// the default timeout to load a script from a URL
+const loadTimeout = 30 * time.Second
 
-	case "substr":
-		parts := args.GetArgsN(line, 2) // [ start:end, line ]
-		if len(parts) == 0 {
-			fmt.Println("usage: substr start:end line")
-			return
+// openScript opens a script file, a URL (http or https, fetched with the timeout) or the standard input ("-")
+func (cf *controlFlow) openScript(name string, timeout time.Duration) (io.ReadCloser, error) {
+	if name == "-" {
+		in := cf.cmd.Input
+		if in == nil {
+			in = os.Stdin
 		}
 
-		if len(parts) == 1 { // empty line ?
-			line = ""
-		} else {
-			line = parts[1]
-		}
+		return io.NopCloser(in), nil
+	}
 
-		srange := parts[0]
-		var start, end int
+	if !strings.HasPrefix(name, "http://") && !strings.HasPrefix(name, "https://") {
+		return os.Open(cf.cmd.Path(name))
+	}
 
-		if !strings.Contains(srange, ":") {
-			fmt.Println("expected start:end, got", srange)
-			return
-		}
+	ctx, cancel := context.WithTimeout(cf.cmd.Context(), timeout)
 
-		parts = strings.Split(srange, ":")
+	req, err := http.NewRequestWithContext(ctx, "GET", name, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
 
-		start, _ = parseInt(parts[0])
-		if start < 0 {
-			start = len(line) + start
-		}
-		if start < 0 {
-			start = 0
-		} else if start > len(line) {
-			start = len(line)
-		}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
 
-		if parts[1] == "" { // start:
-			end = len(line)
-		} else {
-			end, _ = parseInt(parts[1])
-		}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("%v: %v", name, resp.Status)
+	}
 
-		if end < 0 {
-			end = start + len(line) + end
-		}
+	return &responseBody{ReadCloser: resp.Body, cancel: cancel}, nil
+}
 
-		if end < start {
-			end = start
-		} else if end > len(line) {
-			end = len(line)
-		}
+// responseBody releases the request context when the body is closed
+type responseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
 
-		res = line[start:end]
+func (r *responseBody) Close() error {
+	defer r.cancel()
+	return r.ReadCloser.Close()
+}
 
-	case "split":
-		parts := args.GetArgsN(line, 2) // [ sep, line ]
-		if len(parts) == 0 {
-			fmt.Println("usage: split sep line")
-			return
-		}
+// load [--timeout=duration] script-file|url|-
+//
+// Executes the commands in a script file, downloaded from a URL or read from the standard input ("-").
+func (cf *controlFlow) command_load(line string) (stop bool) {
+	timeout := loadTimeout
 
-		if len(parts) == 1 { // empty line ?
-			res = ""
-		} else {
-			res = fmt.Sprintf("%q", strings.Split(parts[1], parts[0]))
-		}
+	if strings.HasPrefix(line, "--timeout=") {
+		arg, rest, _ := strings.Cut(line, " ")
+		timeout = parseWait(arg[10:])
+		line = strings.TrimSpace(rest)
+	}
 
-	case "re", "regex", "regexp":
-		parts := args.GetArgsN(line, 2) // [ regexp, line ]
-		if len(parts) == 0 {
-			fmt.Println("usage: re expr line")
-			return
-		}
+	if len(line) == 0 {
+		cf.cmd.Println("missing script file")
+		return
+	}
 
-		if len(parts) == 1 { // empty line ?
-			res = ""
-			break
+	fname := line
+	f, err := cf.openScript(fname, timeout)
+	if err != nil {
+		cf.cmd.Println(err)
+		return
+	}
+
+	prev := cf.ctx.ScanReader(f, fname)
+	cf.pushTraps()
+
+	defer func() {
+		cf.ctx.SetScanner(prev)
+		f.Close()
+
+		t := cf.popTraps()
+		if cf.cmd.Interrupted() && t["INT"] != "" {
+			cf.runTrap(t["INT"])
+		}
+		if t["EXIT"] != "" {
+			cf.runTrap(t["EXIT"])
 		}
+	}()
 
-		re, err := regexp.Compile(parts[0])
+	for {
+		line, err = cf.ctx.ReadLine("load", "")
 		if err != nil {
-			fmt.Println(err)
-			return
+			if err != io.EOF {
+				cf.cmd.Println(err)
+			}
+			break
 		}
 
-		parts = re.FindStringSubmatch(parts[1])
-		switch len(parts) {
-		case 0: // no results
-			res = ""
-		case 1: // no submatches
-			res = parts[0]
-		case 2: // one submatch
-			res = parts[1]
-		default:
-			res = fmt.Sprintf("%q", parts[1:])
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			cf.cmd.EmptyLine()
+			continue
 		}
 
-	case "or":
-		parts := args.GetArgsN(line, 2) // [ head, remain ]
-		switch len(parts) {
-		case 0:
-			res = ""
+		// cf.cmd.Println("load-one", line)
+		failed := false
+		for _, line := range cmd.SplitCommands(line) {
+			failures := cf.cmd.Failures()
+			preverr, _ := cf.cmd.GetVar("error")
+			stop = cf.cmd.OneCmd(line)
 
-		case 1:
-			res = parts[0]
+			// with errexit, a failed command terminates the script
+			if curerr, _ := cf.cmd.GetVar("error"); cf.cmd.Failures() != failures || (curerr != "" && curerr != preverr) {
+				failed = cf.cmd.GetBoolVar("errexit")
+			}
 
-		case 2:
-			if len(parts[0]) > 0 {
-				res = parts[0]
-			} else {
-				res = parts[1]
+			if stop || failed || cf.cmd.Interrupted() {
+				break
 			}
 		}
+		if stop || failed || cf.cmd.Interrupted() {
+			break
+		}
+	}
 
-	default:
+	return
+}
 
-		fmt.Printf("invalid operator: %v in %q\n", op, aline)
-		return
+// pushTraps adds the traps of a script being loaded
+func (cf *controlFlow) pushTraps() {
+	cf.Lock()
+	cf.traps = append(cf.traps, traps{})
+	cf.Unlock()
+}
+
+// popTraps removes the traps of the script that terminated, and returns them
+func (cf *controlFlow) popTraps() (t traps) {
+	cf.Lock()
+	if l := len(cf.traps); l > 1 { // the first one is the session
+		t, cf.traps = cf.traps[l-1], cf.traps[:l-1]
 	}
+	cf.Unlock()
+	return
+}
 
-	if !cf.cmd.SilentResult() {
-		fmt.Println(res)
+// getTraps returns the commands of the trap, from the current script to the session
+// (or only the current script or the session, if all is false)
+func (cf *controlFlow) getTraps(name string, all bool) (commands []string) {
+	cf.RLock()
+	defer cf.RUnlock()
+
+	for i := len(cf.traps) - 1; i >= 0; i-- {
+		if c := cf.traps[i][name]; c != "" {
+			commands = append(commands, c)
+		}
+
+		if !all {
+			break
+		}
 	}
 
-	cf.cmd.SetVar("result", res)
 	return
 }
 
-func getList(line string) []interface{} {
-	if strings.HasPrefix(line, "[") {
-		j, err := simplejson.LoadString(line)
-		if err == nil {
-			return j.MustArray()
-		}
+// runTrap executes the commands of a trap
+func (cf *controlFlow) runTrap(commands string) {
+	for _, line := range cmd.SplitCommands(commands) {
+		cf.cmd.OneCmd(line)
+	}
+}
 
-		line = line[1:]
-		if strings.HasSuffix(line, "]") {
-			line = line[:len(line)-1]
+// trap [commands|- signal...]
+//
+// Sets the commands to execute when the script (or the session, if not in a script) receives a signal,
+// or terminates: INT when the script is interrupted (before it terminates, or instead of terminating
+// the application at the prompt), TERM when the application is terminated, EXIT when the script
+// (or the command loop) terminates. "-" removes the trap, and trap without arguments lists them.
+func (cf *controlFlow) command_trap(line string) (stop bool) {
+	words := internal.Words(line, 0)
+
+	if len(words) == 0 {
+		cf.RLock()
+		current := cf.traps[len(cf.traps)-1]
+		names := make([]string, 0, len(current))
+		for name := range current {
+			names = append(names, name)
 		}
-	} else if strings.HasPrefix(line, "(") {
-		line = line[1:]
-		if strings.HasSuffix(line, ")") {
-			line = line[:len(line)-1]
+		sort.Strings(names)
+
+		for _, name := range names {
+			cf.cmd.Printf("trap %q %v\n", current[name], name)
 		}
+		cf.RUnlock()
+		return
 	}
 
-	arr := args.GetArgs(line)
-	iarr := make([]interface{}, len(arr))
-	for i, v := range arr {
-		iarr[i] = v
+	if len(words) == 1 {
+		cf.cmd.Println("usage: trap commands|- INT|TERM|EXIT...")
+		return
 	}
-	return iarr
-}
 
-func (cf *controlFlow) command_repeat(line string) (stop bool) {
-	count := int64(math.MaxInt64) // almost forever
-	wait := time.Duration(0)      // no wait
-	arg := ""
+	commands := words[0]
 
-	for {
-		if strings.HasPrefix(line, "-") {
-			// some options
-			parts := strings.SplitN(line, " ", 2)
-			if len(parts) < 2 {
-				// no command
-				fmt.Println("nothing to repeat")
-				return
-			}
+	var names []string
 
-			arg, line = parts[0], strings.TrimSpace(parts[1])
-			if arg == "--" {
-				break
-			}
+	for _, w := range words[1:] {
+		name, ok := trapNames[strings.ToUpper(w)]
+		if !ok {
+			cf.cmd.Println("invalid signal", w)
+			return
+		}
 
-			if strings.HasPrefix(arg, "--count=") {
-				arg = cf.expandVariables(arg)
-				count, _ = strconv.ParseInt(arg[8:], 10, 64)
-			} else if strings.HasPrefix(arg, "--wait=") {
-				arg = cf.expandVariables(arg)
-				wait = parseWait(arg[7:])
-			} else {
-				// unknown option
-				fmt.Println("invalid option", arg)
-				return
-			}
+		names = append(names, name)
+	}
+
+	cf.Lock()
+	current := cf.traps[len(cf.traps)-1]
+	for _, name := range names {
+		if commands == "-" {
+			delete(current, name)
 		} else {
+			current[name] = commands
+		}
+	}
+	cf.Unlock()
+
+	return
+}
+
+// eval line
+//
+// Executes the line (unquoted, if it's a single argument), so that the variables are expanded again,
+// i.e. to execute a command built in a variable.
+func (cf *controlFlow) command_eval(line string) (stop bool) {
+	if words := internal.Words(line, 0); len(words) == 1 {
+		line = words[0]
+	}
+
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+
+	for _, line := range cmd.SplitCommands(line) {
+		if stop = cf.cmd.OneCmd(line); stop || cf.cmd.Interrupted() {
 			break
 		}
 	}
 
-	block, _, err := cf.ctx.ReadBlock(line, "", cf.cmd.ContinuationPrompt)
-	if err != nil {
-		fmt.Println(err)
+	return
+}
+
+// defer command
+//
+// Executes the command when the current block (i.e. the function body) terminates, however it terminates.
+// The variables are expanded when the command is executed.
+func (cf *controlFlow) command_defer(line string) (stop bool) {
+	if line == "" {
+		cf.cmd.Println("usage: defer command")
 		return
 	}
 
-	cf.ctx.PushScope(nil, nil)
-	cf.cmd.SetVar("count", count)
+	if !cf.cmd.Defer(line) {
+		cf.cmd.Println("defer: not in a function or block")
+	}
+
+	return
+}
+
+// debug [on|off], debug break function, debug clear [function]
+//
+// When the debugger is enabled the scripts and functions pause before each line, showing the line
+// (with the variables expanded), and accept the debugger commands (see debugHelp).
+// "continue" runs up to the next call of a function with a breakpoint.
+func (cf *controlFlow) command_debug(line string) (stop bool) {
+	op, name, _ := strings.Cut(line, " ")
+	name = strings.TrimSpace(name)
 
 	cf.Lock()
-	cf.inLoop = true
-	cf.Unlock()
+	defer cf.Unlock()
 
-	for l := newLoop(count); l.Next(); {
-		if wait > 0 && !l.First() {
-			if cf.sleepInterrupted(wait) {
-				break
-			}
+	switch op {
+	case "":
+		status := "off"
+		if cf.debug {
+			status = "on"
 		}
 
-		cf.cmd.SetVar("index", l.Index)
-		if cf.cmd.RunBlock("", block, nil, true) || cf.cmd.Interrupted() {
-			break
-		}
-	}
+		cf.cmd.Println("debug", status)
 
-	cf.Lock()
-	cf.inLoop = false
-	cf.Unlock()
+		names := make([]string, 0, len(cf.breakpoints))
+		for name := range cf.breakpoints {
+			names = append(names, name)
+		}
+		sort.Strings(names)
 
-	cf.ctx.PopScope()
-	return
-}
+		for _, name := range names {
+			cf.cmd.Println("  break", name)
+		}
 
-func (cf *controlFlow) command_foreach(line string) (stop bool) {
-	arg := ""
-	wait := time.Duration(0) // no wait
+	case "on", "off":
+		cf.debug = op == "on"
 
-	for {
-		if strings.HasPrefix(line, "-") {
-			// some options
-			parts := strings.SplitN(line, " ", 2)
-			if len(parts) < 2 {
-				// no command
-				return
-			}
+	case "break":
+		if name == "" {
+			cf.cmd.Println("usage: debug break function")
+			break
+		}
 
-			arg, line = parts[0], strings.TrimSpace(parts[1])
-			if arg == "--" {
-				break
-			}
+		cf.breakpoints[name] = true
 
-			if strings.HasPrefix(arg, "--wait=") {
-				arg = cf.expandVariables(arg)
-				wait = parseWait(arg[7:])
-			} else {
-				// unknown option
-				fmt.Println("invalid option", arg)
-				return
-			}
+	case "clear":
+		if name == "" {
+			cf.breakpoints = map[string]bool{}
 		} else {
-			break
+			delete(cf.breakpoints, name)
 		}
-	}
 
-	parts := args.GetArgsN(line, 2) // [ list, command ]
-	if len(parts) != 2 {
-		fmt.Println("missing argument(s)")
-		return
+	default:
+		cf.cmd.Println("usage: debug [on|off|break function|clear [function]]")
 	}
 
-	list, command := cf.expandVariables(parts[0]), parts[1]
+	return
+}
 
-	args := getList(list)
-	count := len(args)
+const debugHelp = `debugger commands:
+  s, step       execute the line and pause before the next one (also an empty line)
+  c, continue   continue up to the next breakpoint
+  p, print name print a variable
+  v, vars       print the variables of the current scope
+  q, quit       terminate the scripts and functions being executed
+  h, help       print this help`
 
-	block, _, err := cf.ctx.ReadBlock(command, "", cf.cmd.ContinuationPrompt)
-	if err != nil {
-		fmt.Println(err)
-		return
+// inScript returns true if a script or a block (i.e. a function) is being executed
+func (cf *controlFlow) inScript() bool {
+	cf.RLock()
+	loading := len(cf.traps) > 1 // a frame for each script
+	cf.RUnlock()
+
+	return loading || cf.cmd.InBlock()
+}
+
+// checkBreakpoint starts stepping, if the function has a breakpoint
+func (cf *controlFlow) checkBreakpoint(name string) {
+	cf.Lock()
+	if cf.debug && cf.breakpoints[name] {
+		cf.cmd.Println("[debug] break", name)
+		cf.stepping = true
 	}
+	cf.Unlock()
+}
 
-	cf.ctx.PushScope(nil, nil)
-	cf.cmd.SetVar("count", count)
+// debugLine pauses before executing a line of a script or function, if the debugger is stepping.
+// It returns false if the line should not be executed, since the debugger is terminating the scripts.
+func (cf *controlFlow) debugLine(line string) bool {
+	inScript := cf.inScript()
 
 	cf.Lock()
-	cf.inLoop = true
+	if !inScript { // a command from the command loop: start again
+		cf.aborting = false
+		cf.stepping = cf.debug
+	}
+	pause, aborting := cf.debug && cf.stepping && inScript, cf.aborting
 	cf.Unlock()
 
-	for i, v := range args {
-		if wait > 0 && i > 0 {
-			if cf.sleepInterrupted(wait) {
-				break
+	if aborting {
+		return false
+	}
+	if !pause {
+		return true
+	}
+
+	if pos := cf.ctx.Position(); pos.Line > 0 {
+		cf.cmd.Printf("[debug] %v: %v\n", pos, line)
+	} else {
+		cf.cmd.Println("[debug]", line)
+	}
+
+	for {
+		op, arg, _ := strings.Cut(strings.TrimSpace(cf.readDebugCommand()), " ")
+		arg = strings.TrimSpace(arg)
+
+		switch op {
+		case "", "s", "step":
+			return true
+
+		case "c", "continue":
+			cf.Lock()
+			cf.stepping = false
+			cf.Unlock()
+			return true
+
+		case "p", "print":
+			if v, ok := cf.ctx.GetVar(strings.TrimPrefix(arg, "$")); ok {
+				cf.cmd.Println(arg, "=", v)
+			} else {
+				cf.cmd.Println(arg, "is not set")
 			}
-		}
 
-		// here we should convert complex types to a meaningful
-		// string representation (i.e. json)
+		case "v", "vars":
+			for _, kv := range sortedmap.AsSortedMap(cf.ctx.GetScope(internal.LocalScope)) {
+				cf.cmd.Println(" ", kv)
+			}
 
-		switch t := v.(type) {
-		case map[string]interface{}:
-			v, _ = simplejson.DumpString(t)
+		case "q", "quit":
+			cf.Lock()
+			cf.aborting, cf.stepping = true, false
+			cf.Unlock()
+			return false
 
-		case []interface{}:
-			v, _ = simplejson.DumpString(t)
-		}
+		case "h", "help":
+			cf.cmd.Println(debugHelp)
 
-		cf.cmd.SetVar("index", i)
-		cf.cmd.SetVar("item", v)
-		if cf.cmd.RunBlock("", block, nil, true) || cf.cmd.Interrupted() {
-			break
+		default:
+			cf.cmd.Println("invalid debugger command", op, "(h for help)")
 		}
 	}
+}
 
-	cf.Lock()
-	cf.inLoop = false
-	cf.Unlock()
+// readDebugCommand reads a debugger command from the user. At the end of the input, the debugger continues.
+func (cf *controlFlow) readDebugCommand() string {
+	line, err := cf.cmd.ReadInput("debug> ", false)
+	if err != nil {
+		return "continue"
+	}
 
-	cf.ctx.PopScope()
-	return
+	return line
 }
 
-func (cf *controlFlow) command_load(line string) (stop bool) {
-	if len(line) == 0 {
-		fmt.Println("missing script file")
+// profileEntry is the cumulative execution time of a command or function
+type profileEntry struct {
+	Name     string        `json:"name"`
+	Function bool          `json:"function"`
+	Calls    int           `json:"calls"`
+	Total    time.Duration `json:"total"`
+}
+
+// profileCall records the execution time of a command or function, if profiling
+func (cf *controlFlow) profileCall(name string, function bool, start time.Time) {
+	elapsed := time.Since(start)
+
+	cf.Lock()
+	defer cf.Unlock()
+
+	if !cf.profiling || name == "" {
 		return
 	}
 
-	fname := line
-	f, err := os.Open(fname)
-	if err != nil {
-		fmt.Println(err)
-		return
+	key := name
+	if function {
+		key += "()"
 	}
 
-	prev := cf.ctx.ScanReader(f)
+	e, ok := cf.profile[key]
+	if !ok {
+		e = &profileEntry{Name: name, Function: function}
+		cf.profile[key] = e
+	}
 
-	defer func() {
-		cf.ctx.SetScanner(prev)
-		f.Close()
-	}()
+	e.Calls++
+	e.Total += elapsed
+}
 
-	for {
-		line, err = cf.ctx.ReadLine("load", "")
-		if err != nil {
-			if err != io.EOF {
-				fmt.Println(err)
-			}
-			break
+// profile [on|off|report]
+//
+// Records the number of calls and the cumulative execution time of each command and function
+// (including the commands and functions it calls), and prints them sorted by time.
+// "on" starts again from scratch, and the report is still available after "off".
+func (cf *controlFlow) command_profile(line string) (stop bool) {
+	switch line {
+	case "on":
+		cf.Lock()
+		cf.profiling, cf.profile = true, map[string]*profileEntry{}
+		cf.Unlock()
+
+	case "off":
+		cf.Lock()
+		cf.profiling = false
+		cf.Unlock()
+
+	case "", "report":
+		cf.RLock()
+		var entries []profileEntry
+		for _, e := range cf.profile {
+			entries = append(entries, *e)
 		}
+		cf.RUnlock()
 
-		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
-			cf.cmd.EmptyLine()
-			continue
+		sort.Slice(entries, func(i, j int) bool {
+			if entries[i].Total != entries[j].Total {
+				return entries[i].Total > entries[j].Total
+			}
+
+			return entries[i].Name < entries[j].Name
+		})
+
+		if cf.cmd.JSONOutput() {
+			cf.cmd.PrintJSON(entries)
+			return
 		}
 
-		// fmt.Println("load-one", line)
-		stop = cf.cmd.OneCmd(line)
-		if stop || cf.cmd.Interrupted() {
-			break
+		if len(entries) == 0 {
+			cf.cmd.Println("no profile data")
+			return
 		}
+
+		cf.cmd.WithPager(func() {
+			cf.cmd.Printf("%-30s %8s %12s %12s\n", "name", "calls", "total", "average")
+			for _, e := range entries {
+				name := e.Name
+				if e.Function {
+					name += "()"
+				}
+
+				avg := e.Total / time.Duration(e.Calls)
+				cf.cmd.Printf("%-30s %8d %12v %12v\n", name, e.Calls, e.Total.Round(time.Microsecond), avg.Round(time.Microsecond))
+			}
+		})
+
+	default:
+		cf.cmd.Println("usage: profile [on|off|report]")
 	}
 
 	return
 }
 
+// sleep duration [--jitter=duration]
+//
+// Sleeps for the duration (or number of seconds), plus a random duration up to the jitter
+// (i.e. sleep 5s --jitter=2s sleeps between 5 and 7 seconds).
 func (cf *controlFlow) command_sleep(line string) (stop bool) {
-	wait := parseWait(line)
+	var wait, jitter time.Duration
+
+	for _, arg := range strings.Fields(line) {
+		if v, ok := strings.CutPrefix(arg, "--jitter="); ok {
+			jitter = parseWait(v)
+		} else if strings.HasPrefix(arg, "-") && len(arg) > 1 && !('0' <= arg[1] && arg[1] <= '9') {
+			cf.cmd.Println("invalid option", arg)
+			return
+		} else {
+			wait = parseWait(arg)
+		}
+	}
+
+	if jitter > 0 {
+		wait += time.Duration(rand.Int63n(int64(jitter) + 1))
+	}
+
 	cf.sleepInterrupted(wait)
 	return
 }
@@ -1114,17 +3230,46 @@ func (cf *controlFlow) command_stop(string) (stop bool) {
 }
 
 func (cf *controlFlow) help(line string) (stop bool) {
+	if cf.cmd.JSONOutput() {
+		if line == "" || line == "--all" {
+			var list []map[string]string
+
+			for _, name := range cf.cmd.VisibleCommandNames() {
+				c, _ := cf.cmd.GetCommand(name)
+				list = append(list, map[string]string{"name": name, "type": "command", "help": strings.TrimSpace(c.Help)})
+			}
+
+			names, _ := cf.functionNames()
+			for _, f := range names {
+				list = append(list, map[string]string{"name": f, "type": "function"})
+			}
+
+			for _, name := range cf.cmd.AliasNames() {
+				expansion, _ := cf.cmd.GetAlias(name)
+				list = append(list, map[string]string{"name": name, "type": "alias", "alias": expansion})
+			}
+
+			cf.cmd.PrintJSON(list)
+		} else if _, ok := cf.getFunction(line); ok {
+			cf.cmd.PrintJSON(map[string]string{"name": line, "type": "function"})
+		} else {
+			cf._help(line)
+		}
+
+		return
+	}
+
 	if line == "" {
 		cf._help(line)
 
-		if len(cf.functions) > 0 {
-			fmt.Println()
-			fmt.Println("Available functions:")
-			fmt.Println("================================================================")
+		if names, max := cf.functionNames(); len(names) > 0 {
+			cf.cmd.Println()
+			cf.cmd.Println("Available functions:")
+			cf.cmd.Println("================================================================")
 
-			names, max := cf.functionNames()
+			width, _ := cf.cmd.TerminalSize()
 
-			tp := pretty.NewTabPrinter(80 / (max + 1))
+			tp := pretty.NewTabPrinter(width / (max + 1))
 			tp.TabWidth(max + 1)
 
 			for _, c := range names {
@@ -1132,8 +3277,8 @@ func (cf *controlFlow) help(line string) (stop bool) {
 			}
 			tp.Println()
 		}
-	} else if _, ok := cf.functions[line]; ok {
-		fmt.Println(line, "is a function")
+	} else if _, ok := cf.getFunction(line); ok {
+		cf.cmd.Println(line, "is a function")
 	} else {
 		cf._help(line)
 	}
@@ -1141,7 +3286,8 @@ func (cf *controlFlow) help(line string) (stop bool) {
 	return
 }
 
-// XXX: don't expand one-line body of "function" or "repeat"
+// XXX: don't expand one-line body of "function", "repeat", "foreach" or "select" (and the condition of "while",
+// and the commands of "trap" and "defer")
 func canExpand(line string) bool {
 	if strings.HasPrefix(line, "function ") {
 		return false
@@ -1152,34 +3298,125 @@ func canExpand(line string) bool {
 	if strings.HasPrefix(line, "foreach ") {
 		return false
 	}
+	if strings.HasPrefix(line, "while ") {
+		return false
+	}
+	if strings.HasPrefix(line, "select ") {
+		return false
+	}
+	if strings.HasPrefix(line, "trap ") || strings.HasPrefix(line, "defer ") {
+		return false
+	}
 	return true
 }
 
 func (cf *controlFlow) runFunction(line string) bool {
+	// the aliases, the commands and the pipeline stages before the variables, so that the line is expanded once
+	line, aliased := cf.cmd.ExpandAlias(line)
+
+	if aliased {
+		if commands := cmd.SplitCommands(line); len(commands) > 1 {
+			return cf.cmd.RunCommands(commands, cf.runAliased)
+		}
+	}
+
+	return cf.runAliased(line)
+}
+
+// runAliased executes a command line (or a pipeline) after resolving its aliases
+func (cf *controlFlow) runAliased(line string) bool {
+	if stages := cmd.SplitPipeline(line); len(stages) > 1 {
+		first := true
+
+		return cf.cmd.RunPipeline(stages, func(line, input string) bool {
+			if !first {
+				line, _ = cf.cmd.ExpandAlias(line)
+			}
+			first = false
+
+			return cf.runLine(line, input)
+		})
+	}
+
+	return cf.runLine(line, "")
+}
+
+// runLine expands and executes a command line (or a pipeline stage, with the output of the previous one as input)
+func (cf *controlFlow) runLine(line, input string) bool {
 	if canExpand(line) {
-		line = cf.expandVariables(line)
+		var err error
+
+		if line, err = cf.cmd.ExpandVariablesE(line); err != nil {
+			// not executed, and failed
+			cf.cmd.Println(err)
+			cf.cmd.SetVar("error", err)
+			return false
+		}
+	}
+
+	if input != "" {
+		line += " " + input
+	}
+
+	if !cf.debugLine(line) {
+		return true // terminate the script or function
 	}
 
 	if strings.HasPrefix(line, "@") {
 		line = "load " + line[1:]
 	} else {
-		parts := strings.SplitN(line, " ", 2)
+		cname, params, _ := strings.Cut(line, " ")
 
-		cname, params := parts[0], ""
-		if len(parts) > 1 {
-			params = strings.TrimSpace(parts[1])
-		}
+		if cname, f, ok := cf.findFunction(cname); ok {
+			defer cf.profileCall(cname, true, time.Now())
 
-		if function, ok := cf.functions[cname]; ok {
 			if cf.cmd.GetBoolVar("echo") {
-				fmt.Println(cf.cmd.Prompt, line)
+				cf.cmd.Println(cf.cmd.Prompt, line)
+			}
+
+			cf.cmd.TraceLine(line)
+			cf.checkBreakpoint(cname)
+
+			cf.pushNamespace(f.namespace)
+			res := cf.cmd.RunBlock(cmd.BlockSpec{Name: cname, Body: f.body, Pos: f.pos, Args: args.GetArgs(strings.TrimSpace(params)), Params: f.params, NewScope: true})
+			cf.popNamespace()
+
+			// unwind all the nested calls
+			return errors.Is(res.Err, cmd.ErrMaxCallDepth) && cf.cmd.InBlock()
+		}
+	}
+
+	if name, _, _ := strings.Cut(line, " "); name != "profile" {
+		defer cf.profileCall(name, false, time.Now())
+	}
+
+	return cf.cmd.RunExpanded(line, cf._oneCmd)
+}
+
+// substitute executes the command in a $(command ...) reference, returning its output
+// (or the "result" variable set by the command, if it didn't print anything).
+// It returns false if the command is not a command, function or alias.
+func (cf *controlFlow) substitute(line string) (string, bool) {
+	name, _, _ := strings.Cut(line, " ")
+
+	if _, ok := cf.cmd.GetCommand(name); !ok && !strings.HasPrefix(name, "!") {
+		if _, _, ok := cf.findFunction(name); !ok {
+			if _, ok := cf.cmd.GetAlias(name); !ok {
+				return "", false
 			}
+		}
+	}
 
-			return cf.cmd.RunBlock(cname, function, args.GetArgs(params), true)
+	prev, _ := cf.cmd.GetVar("result")
+
+	out, _ := cf.cmd.CaptureOutput(line)
+	if out == "" {
+		if result, _ := cf.cmd.GetVar("result"); result != prev {
+			out = result
 		}
 	}
 
-	return cf._oneCmd(line)
+	return out, true
 }
 
 func (cf *controlFlow) loopCommand() (looping bool) {
@@ -1194,46 +3431,144 @@ func (cf *controlFlow) interruptFunction(s os.Signal) bool {
 		return false
 	}
 
+	if s == os.Interrupt {
+		// at the prompt: the session trap replaces the default behavior
+		if commands := cf.getTraps("INT", false); len(commands) > 0 {
+			cf.runTrap(commands[0])
+			return false
+		}
+	} else {
+		for _, commands := range cf.getTraps("TERM", true) {
+			cf.runTrap(commands)
+		}
+	}
+
 	return cf._interrupt(s)
 }
 
+// exitFunction executes the EXIT trap of the session, when the command loop terminates
+func (cf *controlFlow) exitFunction() {
+	cf.RLock()
+	commands := cf.traps[0]["EXIT"]
+	cf.RUnlock()
+
+	if commands != "" {
+		cf.runTrap(commands)
+	}
+}
+
+// inherit copies the functions, the imported modules and the current namespace of the instance of parent,
+// for a background job (see cmd.Cmd.Parent)
+func (cf *controlFlow) inherit(parent *cmd.Cmd) {
+	if parent == nil {
+		return
+	}
+
+	fc, ok := parent.GetCompleter("function").(*functionCompleter)
+	if !ok {
+		return
+	}
+
+	pcf := fc.cf
+
+	pcf.RLock()
+	defer pcf.RUnlock()
+
+	for name, f := range pcf.functions {
+		cf.functions[name] = f
+	}
+
+	cf.modules = append(cf.modules, pcf.modules...)
+	cf.namespace = append(cf.namespace, pcf.namespace...)
+}
+
 // PluginInit initialize this plugin
 func (cf *controlFlow) PluginInit(c *cmd.Cmd, ctx *internal.Context) error {
-	if cf.cmd != nil {
+	if cf.cmd == c {
 		return nil // already initialized
 	}
 
+	if cf.cmd != nil { // a new session or job, with its own functions and loop state
+		return (&controlFlow{}).PluginInit(c, ctx)
+	}
+
 	rand.Seed(time.Now().Unix())
 
 	cf.cmd, cf.ctx = c, ctx
 	cf._oneCmd, c.OneCmd = c.OneCmd, cf.runFunction
 	cf._help, c.Help = c.Help, cf.help
 	cf._interrupt, c.Interrupt = c.Interrupt, cf.interruptFunction
-	cf.functions = make(map[string][]string)
-
-	cf.cmd.AddCompleter("function", cmd.NewWordCompleter(func() (names []string) {
-		names, _ = cf.functionNames()
-		return
-	}, func(s, l string) bool {
+	c.CommandSubstitution = cf.substitute
+	cf.functions = make(map[string]*function)
+	cf.traps = []traps{{}}
+	cf.inherit(c.Parent())
+	cf.breakpoints = map[string]bool{}
+	c.OnExit(cf.exitFunction)
+
+	cf.cmd.AddCompleter("function", &functionCompleter{cf: cf, cond: func(s, l string) bool {
 		return strings.HasPrefix(l, "function ")
-	}))
+	}})
+	cf.cmd.AddCompleter("functions", &functionCompleter{cf: cf, cond: func(s, l string) bool {
+		return s == l // the function names at the beginning of the line (if no command matches)
+	}})
+	cf.cmd.AddCompleter("function-arguments", &argumentCompleter{cf: cf})
 	cf.cmd.AddCompleter("var", cmd.NewWordCompleter(func() []string {
 		return cf.ctx.GetVarNames()
 	}, func(s, l string) bool {
 		return strings.HasPrefix(l, "var ") || strings.HasPrefix(l, "set ")
 	}))
 
-	c.Add(cmd.Command{"function", `function name body`, cf.command_function, nil})
-	c.Add(cmd.Command{"var", `var [-g|--global|--parent] [-r|--remove|-u|--unset|-i|-incr|-d|--decr] name value`, cf.command_variable, nil})
-	c.Add(cmd.Command{"shift", `shift [n]`, cf.command_shift, nil})
-	c.Add(cmd.Command{"if", `if (condition) command`, cf.command_conditional, nil})
-	c.Add(cmd.Command{"expr", expr_help, cf.command_expression, nil})
-	c.Add(cmd.Command{"foreach", `foreach [--wait=duration] (items...) command`, cf.command_foreach, nil})
-	c.Add(cmd.Command{"repeat", `repeat [--count=n] [--wait=duration] [--echo] command`, cf.command_repeat, nil})
-	c.Add(cmd.Command{"load", `load script-file`, cf.command_load, nil})
-	c.Add(cmd.Command{"sleep", `sleep duration`, cf.command_sleep, nil})
-	c.Add(cmd.Command{"stop", `stop function or block`, cf.command_stop, nil})
-
-	c.Commands["set"] = c.Commands["var"]
+	c.Add(cmd.Command{Name: "function", Help: `function [--save|--load file] [--list [namespace]] [--delete pattern] name[(param, param=default...)] [--complete="words"] body`, Options: []string{"--save", "--load", "--list", "--delete"}, Call: cf.command_function, Safe: true})
+	variable := cmd.Command{Name: "var", Help: `var [-l|--local|-g|--global|--parent] [-x|--export] [-r|--remove|-u|--unset|-i|-incr|-d|--decr|-a|--list|-m|--map] name value (--export adds the variable to the environment of the shell commands, --export --remove stops it)`, Options: []string{"--local", "--global", "--parent", "--export", "--remove", "--unset", "--incr", "--decr", "--list", "--map"}, Call: cf.command_variable, Safe: true}
+	c.Add(variable)
+	c.Add(cmd.Command{Name: "read", Help: `read [--prompt=text] [-s|--silent] name`, Options: []string{"--prompt=", "--silent"}, Call: cf.command_read})
+	c.Add(cmd.Command{Name: "shift", Help: `shift [n]`, Call: cf.command_shift, Safe: true})
+	c.Add(cmd.Command{Name: "if", Help: `if (condition) command, or if expression { block }`, Call: cf.command_conditional, Safe: true})
+	c.Add(cmd.Command{Name: "switch", Help: `switch value { case pattern command... default command }`, Call: cf.command_switch, Safe: true})
+	c.Add(cmd.Command{Name: "expr", Help: expr_help, Call: cf.command_expression, Safe: true})
+	c.Add(cmd.Command{Name: "let", Help: `let [name =] expression`, Call: cf.command_let, Safe: true})
+	c.Add(cmd.Command{Name: "foreach", Help: `foreach [--wait=duration] (items...)|--file=path|--glob=pattern|--range=start:end[:step] command`, Options: []string{"--wait=", "--file=", "--glob=", "--range="}, Call: cf.command_foreach, Safe: true})
+	c.Add(cmd.Command{Name: "while", Help: `while [--wait=duration] (condition) command, or while expression { block }`, Options: []string{"--wait="}, Call: cf.command_while, Safe: true})
+	c.Add(cmd.Command{Name: "select", Help: `select [--prompt=text] name (options...) command`, Options: []string{"--prompt="}, Call: cf.command_select})
+	c.Add(cmd.Command{Name: "repeat", Help: `repeat [--count=n] [--wait=duration] [--echo] command`, Options: []string{"--count=", "--wait=", "--echo"}, Call: cf.command_repeat})
+	c.Add(cmd.Command{Name: "load", Help: `load [--timeout=duration] script-file|url|-`, Options: []string{"--timeout="}, Call: cf.command_load,
+		Complete: (&cmd.FilePathCompleter{Dir: c.Dir}).Complete})
+	c.Add(cmd.Command{Name: "import", Help: `import [--as=namespace] name-or-path`, Options: []string{"--as="}, Call: cf.command_import,
+		Complete: (&cmd.FilePathCompleter{Dir: c.Dir}).Complete})
+	c.Add(cmd.Command{Name: "eval", Help: `eval line`, Call: cf.command_eval})
+	c.Add(cmd.Command{Name: "debug", Help: `debug [on|off|break function|clear [function]]`, Call: cf.command_debug, Safe: true})
+	c.Add(cmd.Command{Name: "profile", Help: `profile [on|off|report]`, Call: cf.command_profile, Safe: true})
+	c.Add(cmd.Command{Name: "defer", Help: `defer command`, Call: cf.command_defer, Safe: true})
+	c.Add(cmd.Command{Name: "trap", Help: `trap [commands|- INT|TERM|EXIT...]`, Call: cf.command_trap, Safe: true})
+	c.Add(cmd.Command{Name: "sleep", Help: `sleep duration [--jitter=duration]`, Options: []string{"--jitter="}, Call: cf.command_sleep})
+	c.Add(cmd.Command{Name: "stop", Help: `stop function or block`, Call: cf.command_stop, Safe: true})
+	c.Add(cmd.Command{Name: "break", Help: `terminate the current loop`, Call: cf.command_break, Safe: true})
+	c.Add(cmd.Command{Name: "continue", Help: `skip to the next iteration of the current loop`, Call: cf.command_continue, Safe: true})
+	c.Add(cmd.Command{Name: "return", Help: `return from the current function`, Call: cf.command_return, Safe: true})
+
+	variable.Name = "set" // the same as var
+	c.Add(variable)
 	return nil
 }
+
+// PluginName returns the name of this plugin
+func (cf *controlFlow) PluginName() string {
+	return "controlflow"
+}
+
+// PluginCleanup releases the interpreter, so that the plugin can be initialized again
+// (the wrapped hooks, commands and completers are restored by the interpreter)
+func (cf *controlFlow) PluginCleanup(c *cmd.Cmd) {
+	if cf.cmd != c {
+		return // a session instance, nothing to reuse
+	}
+
+	cf.Lock()
+	cf.cmd, cf.ctx = nil, nil
+	cf._oneCmd, cf._help, cf._interrupt = nil, nil, nil
+	cf.functions, cf.modules, cf.namespace, cf.traps = nil, nil, nil, nil
+	cf.debug, cf.stepping, cf.aborting, cf.breakpoints = false, false, false, nil
+	cf.profiling, cf.profile = false, nil
+	cf.interruptCount, cf.inLoop = 0, false
+	cf.Unlock()
+}
@@ -0,0 +1,162 @@
+package json
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// ParseCSV parses CSV records as a list of objects, with the fields of the first record (the header) as keys,
+// or as a list of lists of strings if header is false
+func ParseCSV(r io.Reader, header bool, comma rune) (interface{}, error) {
+	cr := csv.NewReader(r)
+	cr.Comma = comma
+	cr.FieldsPerRecord = -1
+
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	res := array_type{}
+
+	if !header {
+		for _, rec := range records {
+			row := make(array_type, len(rec))
+			for i, f := range rec {
+				row[i] = f
+			}
+
+			res = append(res, row)
+		}
+
+		return res, nil
+	}
+
+	if len(records) == 0 {
+		return res, nil
+	}
+
+	keys := records[0]
+
+	for n, rec := range records[1:] {
+		if len(rec) > len(keys) {
+			return nil, fmt.Errorf("record %v has %v fields, more than the header", n+1, len(rec))
+		}
+
+		row := make(map_type, len(keys))
+		for i, k := range keys {
+			if i < len(rec) {
+				row[k] = rec[i]
+			} else {
+				row[k] = ""
+			}
+		}
+
+		res = append(res, row)
+	}
+
+	return res, nil
+}
+
+// flatten adds the fields of a value to row, with the nested object members and list elements
+// named as parent.member and parent.index
+func flatten(row map[string]string, prefix string, v interface{}) {
+	name := func(k string) string {
+		if prefix == "" {
+			return k
+		}
+
+		return prefix + "." + k
+	}
+
+	switch v := v.(type) {
+	case map_type:
+		for k, e := range v {
+			flatten(row, name(k), e)
+		}
+
+	case array_type:
+		for i, e := range v {
+			flatten(row, name(strconv.Itoa(i)), e)
+		}
+
+	default:
+		row[prefix] = scalarText(v)
+	}
+}
+
+// WriteCSV writes a list of objects as CSV records, with a header with the (flattened) keys of all the objects,
+// or a list of lists as CSV records (without a header)
+func WriteCSV(w io.Writer, v interface{}, comma rune) error {
+	list, ok := v.(array_type)
+	if !ok {
+		return errors.New("expected a list of objects or lists")
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Comma = comma
+
+	var rows []map[string]string
+	columns := map[string]bool{}
+
+	for _, e := range list {
+		if jqType(e) != jqType(list[0]) {
+			return errors.New("expected a list of objects or lists, not both")
+		}
+
+		switch e := e.(type) {
+		case map_type:
+			row := map[string]string{}
+			flatten(row, "", e)
+
+			for k := range row {
+				columns[k] = true
+			}
+
+			rows = append(rows, row)
+
+		case array_type:
+			rec := make([]string, len(e))
+			for i, f := range e {
+				rec[i] = scalarText(f)
+			}
+
+			if err := cw.Write(rec); err != nil {
+				return err
+			}
+
+		default:
+			return fmt.Errorf("expected a list of objects or lists, got a %v", jqType(e))
+		}
+	}
+
+	if len(rows) > 0 {
+		header := make([]string, 0, len(columns))
+		for k := range columns {
+			header = append(header, k)
+		}
+		sort.Strings(header)
+
+		if err := cw.Write(header); err != nil {
+			return err
+		}
+
+		for _, row := range rows {
+			rec := make([]string, len(header))
+			for i, k := range header {
+				rec[i] = row[k]
+			}
+
+			if err := cw.Write(rec); err != nil {
+				return err
+			}
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,1841 @@
+package json
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gobs/simplejson"
+)
+
+// A subset of the jq language (https://jqlang.github.io/jq/manual), to query and reshape JSON documents:
+//
+//   - paths: . (the input), .name, ."name", .[index], .[start:end], .[] (all the elements), .. (all the values)
+//     and the suffix ? to ignore errors (i.e. .name? on an array)
+//   - pipes (|), multiple outputs (,) and parentheses
+//   - literals (numbers, strings, true, false, null), arrays [...] and objects {name: value, ...},
+//     where {name} is the same as {name: .name} and ("a" + .b): value computes the key
+//   - the operators + - * / %, == != < <= > >=, and, or, and the alternative a // b (b if a is false or null)
+//   - the functions in jqFunctions, i.e. length, keys, map(f), select(f), sort_by(f)...
+//
+// The numbers are float64, and the values are compared (and sorted) as in jq:
+// null < false < true < numbers < strings < arrays < objects.
+
+// jqFilter applies a filter to its input, returning its outputs (0, 1 or more)
+type jqFilter func(in interface{}) ([]interface{}, error)
+
+// compileJq parses a jq expression
+func compileJq(expr string) (jqFilter, error) {
+	tokens, err := jqTokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &jqParser{tokens: tokens}
+
+	f, err := p.pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+
+	return f, nil
+}
+
+// Jq applies a jq expression to a JSON document (as returned by simplejson), and returns the outputs
+func Jq(expr string, doc interface{}) ([]interface{}, error) {
+	f, err := compileJq(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	return f(jqNormalize(doc))
+}
+
+// jqNormalize converts all the numbers to float64
+func jqNormalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case interface{ Float64() (float64, error) }: // json.Number
+		f, _ := v.Float64()
+		return f
+	case map_type:
+		m := make(map_type, len(v))
+		for k, e := range v {
+			m[k] = jqNormalize(e)
+		}
+		return m
+	case array_type:
+		a := make(array_type, len(v))
+		for i, e := range v {
+			a[i] = jqNormalize(e)
+		}
+		return a
+	}
+
+	return v
+}
+
+// the operators and punctuation, longest first
+var jqOperators = []string{"..", "//", "==", "!=", "<=", ">=",
+	"|", ",", ".", "[", "]", "(", ")", "{", "}", ":", ";", "?", "<", ">", "+", "-", "*", "/", "%"}
+
+func isJqIdent(c byte, first bool) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || (!first && '0' <= c && c <= '9')
+}
+
+// jqTokenize splits an expression in numbers, strings (with the quotes), identifiers and operators
+func jqTokenize(expr string) (tokens []string, err error) {
+next:
+	for i := 0; i < len(expr); {
+		c := expr[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+
+		case c == '"':
+			j := i + 1
+			for ; j < len(expr) && expr[j] != '"'; j++ {
+				if expr[j] == '\\' {
+					j++
+				}
+			}
+
+			if j >= len(expr) {
+				return nil, fmt.Errorf("missing closing quote in %v", expr[i:])
+			}
+
+			tokens = append(tokens, expr[i:j+1])
+			i = j + 1
+			continue
+
+		case '0' <= c && c <= '9':
+			j := i + 1
+			for j < len(expr) && (('0' <= expr[j] && expr[j] <= '9') || expr[j] == '.' || expr[j] == 'e' || expr[j] == 'E' ||
+				((expr[j] == '-' || expr[j] == '+') && (expr[j-1] == 'e' || expr[j-1] == 'E'))) {
+				j++
+			}
+
+			tokens = append(tokens, expr[i:j])
+			i = j
+			continue
+
+		case isJqIdent(c, true):
+			j := i + 1
+			for j < len(expr) && isJqIdent(expr[j], false) {
+				j++
+			}
+
+			tokens = append(tokens, expr[i:j])
+			i = j
+			continue
+		}
+
+		for _, op := range jqOperators {
+			if strings.HasPrefix(expr[i:], op) {
+				tokens = append(tokens, op)
+				i += len(op)
+				continue next
+			}
+		}
+
+		return nil, fmt.Errorf("invalid character %q", c)
+	}
+
+	return
+}
+
+type jqParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *jqParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+
+	return ""
+}
+
+func (p *jqParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *jqParser) expect(t string) error {
+	if n := p.next(); n != t {
+		if n == "" {
+			return fmt.Errorf("missing %q", t)
+		}
+
+		return fmt.Errorf("expected %q, got %q", t, n)
+	}
+
+	return nil
+}
+
+func isJqString(t string) bool {
+	return strings.HasPrefix(t, `"`)
+}
+
+func isJqName(t string) bool {
+	return t != "" && isJqIdent(t[0], true)
+}
+
+// jqString decodes a string token
+func jqString(t string) (string, error) {
+	j, err := simplejson.LoadString(t)
+	if err != nil {
+		return "", fmt.Errorf("invalid string %v", t)
+	}
+
+	return j.MustString(), nil
+}
+
+// pipe parses a | b (the lowest precedence)
+func (p *jqParser) pipe() (jqFilter, error) {
+	left, err := p.comma()
+	if err != nil || p.peek() != "|" {
+		return left, err
+	}
+
+	p.next()
+
+	right, err := p.pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	return func(in interface{}) (outs []interface{}, err error) {
+		lv, err := left(in)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range lv {
+			rv, err := right(v)
+			if err != nil {
+				return outs, err
+			}
+
+			outs = append(outs, rv...)
+		}
+
+		return
+	}, nil
+}
+
+// comma parses a, b
+func (p *jqParser) comma() (jqFilter, error) {
+	left, err := p.alternative()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "," {
+		p.next()
+
+		right, err := p.alternative()
+		if err != nil {
+			return nil, err
+		}
+
+		left = func(l, r jqFilter) jqFilter {
+			return func(in interface{}) ([]interface{}, error) {
+				lv, err := l(in)
+				if err != nil {
+					return lv, err
+				}
+
+				rv, err := r(in)
+				return append(lv, rv...), err
+			}
+		}(left, right)
+	}
+
+	return left, nil
+}
+
+// alternative parses a // b
+func (p *jqParser) alternative() (jqFilter, error) {
+	left, err := p.logical("or")
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "//" {
+		p.next()
+
+		right, err := p.logical("or")
+		if err != nil {
+			return nil, err
+		}
+
+		left = func(l, r jqFilter) jqFilter {
+			return func(in interface{}) (outs []interface{}, err error) {
+				lv, _ := l(in) // errors are ignored, as false values
+
+				for _, v := range lv {
+					if jqTrue(v) {
+						outs = append(outs, v)
+					}
+				}
+
+				if len(outs) > 0 {
+					return
+				}
+
+				return r(in)
+			}
+		}(left, right)
+	}
+
+	return left, nil
+}
+
+// logical parses a or b (if op is "or") and a and b (if op is "and"), with short-circuit:
+// the right side is only evaluated if the left side doesn't determine the result
+func (p *jqParser) logical(op string) (jqFilter, error) {
+	short := op == "or" // the result if the left side is the same
+
+	operand := func() (jqFilter, error) {
+		if op == "or" {
+			return p.logical("and")
+		}
+
+		return p.comparison()
+	}
+
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == op {
+		p.next()
+
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+
+		left = func(l, r jqFilter) jqFilter {
+			return func(in interface{}) (outs []interface{}, err error) {
+				lv, err := l(in)
+				if err != nil {
+					return nil, err
+				}
+
+				for _, a := range lv {
+					if jqTrue(a) == short {
+						outs = append(outs, short)
+						continue
+					}
+
+					rv, err := r(in)
+					if err != nil {
+						return nil, err
+					}
+
+					for _, b := range rv {
+						outs = append(outs, jqTrue(b))
+					}
+				}
+
+				return
+			}
+		}(left, right)
+	}
+
+	return left, nil
+}
+
+// comparison parses a == b, a != b, a < b...
+func (p *jqParser) comparison() (jqFilter, error) {
+	left, err := p.arithmetic(0)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op := p.peek(); op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.next()
+
+		right, err := p.arithmetic(0)
+		if err != nil {
+			return nil, err
+		}
+
+		return jqBinary(left, right, func(a, b interface{}) (interface{}, error) {
+			c := jqCompare(a, b)
+
+			switch op {
+			case "==":
+				return c == 0, nil
+			case "!=":
+				return c != 0, nil
+			case "<":
+				return c < 0, nil
+			case "<=":
+				return c <= 0, nil
+			case ">":
+				return c > 0, nil
+			}
+
+			return c >= 0, nil
+		}), nil
+	}
+
+	return left, nil
+}
+
+// the arithmetic operators, by precedence
+var jqArithmetic = [][]string{{"+", "-"}, {"*", "/", "%"}}
+
+// arithmetic parses the arithmetic operators with a precedence of at least level
+func (p *jqParser) arithmetic(level int) (jqFilter, error) {
+	if level == len(jqArithmetic) {
+		return p.unary()
+	}
+
+	left, err := p.arithmetic(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := p.peek()
+
+		found := false
+		for _, o := range jqArithmetic[level] {
+			found = found || o == op
+		}
+		if !found {
+			return left, nil
+		}
+
+		p.next()
+
+		right, err := p.arithmetic(level + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		left = jqBinary(left, right, func(a, b interface{}) (interface{}, error) {
+			return jqArith(op, a, b)
+		})
+	}
+}
+
+// unary parses -a
+func (p *jqParser) unary() (jqFilter, error) {
+	if p.peek() != "-" {
+		return p.postfix()
+	}
+
+	p.next()
+
+	f, err := p.postfix()
+	if err != nil {
+		return nil, err
+	}
+
+	return jqMap(f, func(v interface{}) (interface{}, error) {
+		n, ok := v.(float64)
+		if !ok {
+			return nil, fmt.Errorf("%v cannot be negated", jqType(v))
+		}
+
+		return -n, nil
+	}), nil
+}
+
+// postfix parses a term followed by .name, [index], [start:end], [] and ?
+func (p *jqParser) postfix() (jqFilter, error) {
+	term, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		switch t := p.peek(); {
+		case t == "." && p.pos+1 < len(p.tokens) && (isJqName(p.tokens[p.pos+1]) || isJqString(p.tokens[p.pos+1])):
+			p.next()
+
+			if term, err = p.field(term); err != nil {
+				return nil, err
+			}
+
+		case t == "." && p.pos+1 < len(p.tokens) && p.tokens[p.pos+1] == "[":
+			p.next() // .[ is the same as [
+
+		case t == "[":
+			p.next()
+
+			if term, err = p.index(term); err != nil {
+				return nil, err
+			}
+
+		case t == "?":
+			p.next()
+
+			term = func(f jqFilter) jqFilter {
+				return func(in interface{}) ([]interface{}, error) {
+					outs, _ := f(in)
+					return outs, nil
+				}
+			}(term)
+
+		default:
+			return term, nil
+		}
+	}
+}
+
+// field parses name or "name" (after .), applied to the outputs of term
+func (p *jqParser) field(term jqFilter) (jqFilter, error) {
+	name := p.next()
+
+	if isJqString(name) {
+		var err error
+		if name, err = jqString(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return jqMap(term, func(v interface{}) (interface{}, error) {
+		return jqIndex(v, name)
+	}), nil
+}
+
+// index parses ], index], start:end] (after [), applied to the outputs of term.
+// The index is evaluated with the input of the term (i.e. .[.i]).
+func (p *jqParser) index(term jqFilter) (jqFilter, error) {
+	if p.peek() == "]" { // all the elements
+		p.next()
+
+		return func(in interface{}) (outs []interface{}, err error) {
+			tv, err := term(in)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, v := range tv {
+				values, err := jqValues(v)
+				if err != nil {
+					return outs, err
+				}
+
+				outs = append(outs, values...)
+			}
+
+			return
+		}, nil
+	}
+
+	var start, end jqFilter
+	var err error
+
+	if p.peek() != ":" {
+		if start, err = p.pipe(); err != nil {
+			return nil, err
+		}
+	}
+
+	slice := p.peek() == ":"
+	if slice {
+		p.next()
+
+		if p.peek() != "]" {
+			if end, err = p.pipe(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := p.expect("]"); err != nil {
+		return nil, err
+	}
+
+	null := func(interface{}) ([]interface{}, error) { return []interface{}{nil}, nil }
+	if start == nil {
+		start = null
+	}
+	if end == nil {
+		end = null
+	}
+
+	return func(in interface{}) (outs []interface{}, err error) {
+		tv, err := term(in)
+		if err != nil {
+			return nil, err
+		}
+
+		sv, err := start(in)
+		if err != nil {
+			return nil, err
+		}
+
+		ev := []interface{}{nil}
+		if slice {
+			if ev, err = end(in); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, v := range tv {
+			for _, s := range sv {
+				for _, e := range ev {
+					var r interface{}
+
+					if slice {
+						r, err = jqSlice(v, s, e)
+					} else {
+						r, err = jqIndex(v, s)
+					}
+					if err != nil {
+						return outs, err
+					}
+
+					outs = append(outs, r)
+				}
+			}
+		}
+
+		return
+	}, nil
+}
+
+// primary parses ., .., .name, literals, (expr), [expr], {...} and function calls
+func (p *jqParser) primary() (jqFilter, error) {
+	identity := func(in interface{}) ([]interface{}, error) { return []interface{}{in}, nil }
+
+	t := p.next()
+
+	switch {
+	case t == "":
+		return nil, errors.New("unexpected end of expression")
+
+	case t == ".":
+		if next := p.peek(); isJqName(next) || isJqString(next) {
+			return p.field(identity)
+		}
+
+		return identity, nil
+
+	case t == "..":
+		return func(in interface{}) ([]interface{}, error) {
+			return jqRecurse(in, nil), nil
+		}, nil
+
+	case '0' <= t[0] && t[0] <= '9':
+		n, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %v", t)
+		}
+
+		return jqConst(n), nil
+
+	case isJqString(t):
+		s, err := jqString(t)
+		if err != nil {
+			return nil, err
+		}
+
+		return jqConst(s), nil
+
+	case t == "(":
+		f, err := p.pipe()
+		if err != nil {
+			return nil, err
+		}
+
+		return f, p.expect(")")
+
+	case t == "[":
+		if p.peek() == "]" {
+			p.next()
+			return func(interface{}) ([]interface{}, error) { return []interface{}{array_type{}}, nil }, nil
+		}
+
+		f, err := p.pipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+
+		return func(in interface{}) ([]interface{}, error) {
+			outs, err := f(in)
+			if outs == nil {
+				outs = array_type{}
+			}
+
+			return []interface{}{outs}, err
+		}, nil
+
+	case t == "{":
+		return p.object()
+
+	case t == "true":
+		return jqConst(true), nil
+
+	case t == "false":
+		return jqConst(false), nil
+
+	case t == "null":
+		return jqConst(nil), nil
+
+	case isJqName(t) && t != "and" && t != "or":
+		var args []jqFilter
+
+		if p.peek() == "(" {
+			p.next()
+
+			for {
+				arg, err := p.pipe()
+				if err != nil {
+					return nil, err
+				}
+
+				args = append(args, arg)
+
+				if p.peek() != ";" {
+					break
+				}
+				p.next()
+			}
+
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+		}
+
+		fn, ok := jqFunctions[fmt.Sprintf("%v/%v", t, len(args))]
+		if !ok {
+			return nil, fmt.Errorf("%v/%v is not defined", t, len(args))
+		}
+
+		return fn(args), nil
+	}
+
+	return nil, fmt.Errorf("unexpected %q", t)
+}
+
+// object parses name: value, "name": value, (expr): value and name (after {)
+func (p *jqParser) object() (jqFilter, error) {
+	type entry struct {
+		key, value jqFilter
+	}
+
+	var entries []entry
+
+	for p.peek() != "}" {
+		var e entry
+		var name string
+		var computed bool
+		var err error
+
+		switch t := p.next(); {
+		case isJqName(t):
+			name = t
+
+		case isJqString(t):
+			if name, err = jqString(t); err != nil {
+				return nil, err
+			}
+
+		case t == "(":
+			computed = true
+
+			if e.key, err = p.pipe(); err != nil {
+				return nil, err
+			}
+			if err = p.expect(")"); err != nil {
+				return nil, err
+			}
+
+		default:
+			return nil, fmt.Errorf("invalid object key %q", t)
+		}
+
+		if !computed {
+			e.key = jqConst(name)
+		}
+
+		if p.peek() == ":" {
+			p.next()
+
+			if e.value, err = p.alternative(); err != nil {
+				return nil, err
+			}
+		} else if !computed { // {name} is {name: .name}
+			e.value = func(name string) jqFilter {
+				return func(in interface{}) ([]interface{}, error) {
+					v, err := jqIndex(in, name)
+					return []interface{}{v}, err
+				}
+			}(name)
+		} else {
+			return nil, errors.New("missing object value")
+		}
+
+		entries = append(entries, e)
+
+		if p.peek() != "," {
+			break
+		}
+		p.next()
+	}
+
+	if err := p.expect("}"); err != nil {
+		return nil, err
+	}
+
+	return func(in interface{}) ([]interface{}, error) {
+		objects := []map_type{{}}
+
+		// one object for each combination of the keys and values
+		for _, e := range entries {
+			keys, err := e.key(in)
+			if err != nil {
+				return nil, err
+			}
+
+			values, err := e.value(in)
+			if err != nil {
+				return nil, err
+			}
+
+			var next []map_type
+
+			for _, o := range objects {
+				for _, k := range keys {
+					name, ok := k.(string)
+					if !ok {
+						return nil, fmt.Errorf("object keys must be strings, not %v", jqType(k))
+					}
+
+					for _, v := range values {
+						m := make(map_type, len(o)+1)
+						for ok, ov := range o {
+							m[ok] = ov
+						}
+						m[name] = v
+						next = append(next, m)
+					}
+				}
+			}
+
+			objects = next
+		}
+
+		outs := make([]interface{}, len(objects))
+		for i, o := range objects {
+			outs[i] = o
+		}
+
+		return outs, nil
+	}, nil
+}
+
+// jqConst returns a filter that outputs v
+func jqConst(v interface{}) jqFilter {
+	return func(interface{}) ([]interface{}, error) {
+		return []interface{}{v}, nil
+	}
+}
+
+// jqMap returns a filter that applies fn to each output of f
+func jqMap(f jqFilter, fn func(v interface{}) (interface{}, error)) jqFilter {
+	return func(in interface{}) (outs []interface{}, err error) {
+		values, err := f(in)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range values {
+			r, err := fn(v)
+			if err != nil {
+				return outs, err
+			}
+
+			outs = append(outs, r)
+		}
+
+		return
+	}
+}
+
+// jqBinary returns a filter that applies op to each combination of the outputs of left and right
+func jqBinary(left, right jqFilter, op func(a, b interface{}) (interface{}, error)) jqFilter {
+	return func(in interface{}) (outs []interface{}, err error) {
+		rv, err := right(in)
+		if err != nil {
+			return nil, err
+		}
+
+		lv, err := left(in)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, b := range rv {
+			for _, a := range lv {
+				r, err := op(a, b)
+				if err != nil {
+					return outs, err
+				}
+
+				outs = append(outs, r)
+			}
+		}
+
+		return
+	}
+}
+
+// jqTrue returns false for false and null, and true for all the other values
+func jqTrue(v interface{}) bool {
+	return v != nil && v != false
+}
+
+func jqType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case array_type:
+		return "array"
+	case map_type:
+		return "object"
+	}
+
+	return fmt.Sprintf("%T", v)
+}
+
+// jqIndex returns v[index], where v is an object (and index a string) or an array (and index a number)
+func jqIndex(v, index interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+
+	case map_type:
+		if k, ok := index.(string); ok {
+			return v[k], nil
+		}
+
+	case array_type:
+		if n, ok := index.(float64); ok {
+			i := int(math.Floor(n))
+			if i < 0 {
+				i += len(v)
+			}
+			if i < 0 || i >= len(v) {
+				return nil, nil
+			}
+
+			return v[i], nil
+		}
+	}
+
+	if s, ok := index.(string); ok {
+		return nil, fmt.Errorf("cannot index %v with %q", jqType(v), s)
+	}
+
+	return nil, fmt.Errorf("cannot index %v with %v", jqType(v), jqType(index))
+}
+
+// jqSlice returns v[start:end], where v is an array or a string (the indexes can be null or negative)
+func jqSlice(v, start, end interface{}) (interface{}, error) {
+	var l int
+
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case array_type:
+		l = len(v)
+	case string:
+		l = utf8.RuneCountInString(v)
+	default:
+		return nil, fmt.Errorf("cannot slice %v", jqType(v))
+	}
+
+	bound := func(b interface{}, def int) (int, error) {
+		if b == nil {
+			return def, nil
+		}
+
+		n, ok := b.(float64)
+		if !ok {
+			return 0, fmt.Errorf("slice indexes must be numbers, not %v", jqType(b))
+		}
+
+		i := int(math.Floor(n))
+		if i < 0 {
+			i += l
+		}
+
+		return min(max(i, 0), l), nil
+	}
+
+	s, err := bound(start, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := bound(end, l)
+	if err != nil {
+		return nil, err
+	}
+
+	e = max(s, e)
+
+	if a, ok := v.(array_type); ok {
+		return append(array_type{}, a[s:e]...), nil
+	}
+
+	return string([]rune(v.(string))[s:e]), nil
+}
+
+// jqValues returns the elements of an array, or the values of an object (sorted by key)
+func jqValues(v interface{}) ([]interface{}, error) {
+	switch v := v.(type) {
+	case array_type:
+		return v, nil
+
+	case map_type:
+		values := make([]interface{}, 0, len(v))
+		for _, k := range jqKeys(v) {
+			values = append(values, v[k])
+		}
+		return values, nil
+	}
+
+	return nil, fmt.Errorf("cannot iterate over %v", jqType(v))
+}
+
+func jqKeys(m map_type) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// jqRecurse returns v and all the values it contains, recursively
+func jqRecurse(v interface{}, outs []interface{}) []interface{} {
+	outs = append(outs, v)
+
+	if values, err := jqValues(v); err == nil {
+		for _, e := range values {
+			outs = jqRecurse(e, outs)
+		}
+	}
+
+	return outs
+}
+
+// jqCompare compares two values: null < false < true < numbers < strings < arrays < objects
+func jqCompare(a, b interface{}) int {
+	rank := func(v interface{}) int {
+		switch v := v.(type) {
+		case nil:
+			return 0
+		case bool:
+			if v {
+				return 2
+			}
+			return 1
+		case float64:
+			return 3
+		case string:
+			return 4
+		case array_type:
+			return 5
+		}
+		return 6
+	}
+
+	if ra, rb := rank(a), rank(b); ra != rb {
+		return ra - rb
+	}
+
+	switch a := a.(type) {
+	case float64:
+		b := b.(float64)
+		if a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+
+	case string:
+		return strings.Compare(a, b.(string))
+
+	case array_type:
+		b := b.(array_type)
+		for i := 0; i < len(a) && i < len(b); i++ {
+			if c := jqCompare(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+		return len(a) - len(b)
+
+	case map_type:
+		b := b.(map_type)
+		ka, kb := jqKeys(a), jqKeys(b)
+
+		// first the keys, then the values
+		for i := 0; i < len(ka) && i < len(kb); i++ {
+			if c := strings.Compare(ka[i], kb[i]); c != 0 {
+				return c
+			}
+		}
+		if len(ka) != len(kb) {
+			return len(ka) - len(kb)
+		}
+
+		for _, k := range ka {
+			if c := jqCompare(a[k], b[k]); c != 0 {
+				return c
+			}
+		}
+	}
+
+	return 0
+}
+
+// jqArith applies an arithmetic operator
+func jqArith(op string, a, b interface{}) (interface{}, error) {
+	na, aok := a.(float64)
+	nb, bok := b.(float64)
+
+	if aok && bok {
+		switch op {
+		case "+":
+			return na + nb, nil
+		case "-":
+			return na - nb, nil
+		case "*":
+			return na * nb, nil
+		case "/":
+			if nb == 0 {
+				return nil, errors.New("division by zero")
+			}
+			return na / nb, nil
+		case "%":
+			if int64(nb) == 0 {
+				return nil, errors.New("division by zero")
+			}
+			return float64(int64(na) % int64(nb)), nil
+		}
+	}
+
+	switch op {
+	case "+":
+		if a == nil {
+			return b, nil
+		}
+		if b == nil {
+			return a, nil
+		}
+
+		switch a := a.(type) {
+		case string:
+			if b, ok := b.(string); ok {
+				return a + b, nil
+			}
+
+		case array_type:
+			if b, ok := b.(array_type); ok {
+				return append(append(array_type{}, a...), b...), nil
+			}
+
+		case map_type:
+			if b, ok := b.(map_type); ok {
+				m := make(map_type, len(a)+len(b))
+				for k, v := range a {
+					m[k] = v
+				}
+				for k, v := range b {
+					m[k] = v
+				}
+				return m, nil
+			}
+		}
+
+	case "-":
+		if a, ok := a.(array_type); ok {
+			if b, ok := b.(array_type); ok {
+				res := array_type{}
+
+			next:
+				for _, v := range a {
+					for _, r := range b {
+						if jqCompare(v, r) == 0 {
+							continue next
+						}
+					}
+
+					res = append(res, v)
+				}
+
+				return res, nil
+			}
+		}
+
+	case "*":
+		if a, ok := a.(map_type); ok {
+			if b, ok := b.(map_type); ok {
+				return merge_maps(jqNormalize(a).(map_type), jqNormalize(b).(map_type)), nil // deep merge (of copies)
+			}
+		}
+
+	case "/":
+		if a, ok := a.(string); ok {
+			if b, ok := b.(string); ok {
+				return jqSplit(a, b), nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("%v and %v cannot be combined with %v", jqType(a), jqType(b), op)
+}
+
+func jqSplit(s, sep string) array_type {
+	res := array_type{}
+	if s == "" {
+		return res
+	}
+
+	for _, p := range strings.Split(s, sep) {
+		res = append(res, p)
+	}
+
+	return res
+}
+
+// jqDump returns the JSON representation of v
+func jqDump(v interface{}) string {
+	return strings.TrimSpace(simplejson.MustDumpString(v))
+}
+
+// jqFunc returns a function with no arguments, that applies fn to each input
+func jqFunc(fn func(v interface{}) (interface{}, error)) func([]jqFilter) jqFilter {
+	return func([]jqFilter) jqFilter {
+		return func(in interface{}) ([]interface{}, error) {
+			v, err := fn(in)
+			if err != nil {
+				return nil, err
+			}
+
+			return []interface{}{v}, nil
+		}
+	}
+}
+
+// jqFunc1 returns a function with one argument, that applies fn to each input and output of the argument
+func jqFunc1(fn func(v, arg interface{}) (interface{}, error)) func([]jqFilter) jqFilter {
+	return func(args []jqFilter) jqFilter {
+		return func(in interface{}) (outs []interface{}, err error) {
+			av, err := args[0](in)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, a := range av {
+				v, err := fn(in, a)
+				if err != nil {
+					return outs, err
+				}
+
+				outs = append(outs, v)
+			}
+
+			return
+		}
+	}
+}
+
+// jqArray returns the input as an array, or an error
+func jqArray(v interface{}, fn string) (array_type, error) {
+	if a, ok := v.(array_type); ok {
+		return a, nil
+	}
+
+	return nil, fmt.Errorf("%v: %v is not an array", fn, jqType(v))
+}
+
+// jqStringArg returns the input (or argument) as a string, or an error
+func jqStringArg(v interface{}, fn string) (string, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+
+	return "", fmt.Errorf("%v: %v is not a string", fn, jqType(v))
+}
+
+// jqSortBy sorts the array by the outputs of f for each element (or by the elements, if f is nil)
+func jqSortBy(a array_type, f jqFilter) (array_type, error) {
+	keys := make([]interface{}, len(a))
+
+	for i, v := range a {
+		if f == nil {
+			keys[i] = v
+			continue
+		}
+
+		k, err := f(v)
+		if err != nil {
+			return nil, err
+		}
+
+		keys[i] = array_type(k)
+	}
+
+	idx := make([]int, len(a))
+	for i := range idx {
+		idx[i] = i
+	}
+
+	sort.SliceStable(idx, func(i, j int) bool {
+		return jqCompare(keys[idx[i]], keys[idx[j]]) < 0
+	})
+
+	res := make(array_type, len(a))
+	for i, j := range idx {
+		res[i] = a[j]
+	}
+
+	return res, nil
+}
+
+// the functions, as name/arity
+var jqFunctions map[string]func(args []jqFilter) jqFilter
+
+func init() {
+	jqFunctions = map[string]func(args []jqFilter) jqFilter{
+		"empty/0": func([]jqFilter) jqFilter {
+			return func(interface{}) ([]interface{}, error) { return nil, nil }
+		},
+
+		"not/0": jqFunc(func(v interface{}) (interface{}, error) {
+			return !jqTrue(v), nil
+		}),
+
+		"type/0": jqFunc(func(v interface{}) (interface{}, error) {
+			return jqType(v), nil
+		}),
+
+		"length/0": jqFunc(func(v interface{}) (interface{}, error) {
+			switch v := v.(type) {
+			case nil:
+				return 0.0, nil
+			case float64:
+				return math.Abs(v), nil
+			case string:
+				return float64(utf8.RuneCountInString(v)), nil
+			case array_type:
+				return float64(len(v)), nil
+			case map_type:
+				return float64(len(v)), nil
+			}
+
+			return nil, fmt.Errorf("%v has no length", jqType(v))
+		}),
+
+		"keys/0": jqFunc(func(v interface{}) (interface{}, error) {
+			switch v := v.(type) {
+			case map_type:
+				keys := array_type{}
+				for _, k := range jqKeys(v) {
+					keys = append(keys, k)
+				}
+				return keys, nil
+
+			case array_type:
+				keys := array_type{}
+				for i := range v {
+					keys = append(keys, float64(i))
+				}
+				return keys, nil
+			}
+
+			return nil, fmt.Errorf("%v has no keys", jqType(v))
+		}),
+
+		"has/1": jqFunc1(func(v, k interface{}) (interface{}, error) {
+			switch v := v.(type) {
+			case map_type:
+				if k, ok := k.(string); ok {
+					_, found := v[k]
+					return found, nil
+				}
+
+			case array_type:
+				if n, ok := k.(float64); ok {
+					return n >= 0 && int(n) < len(v), nil
+				}
+			}
+
+			return nil, fmt.Errorf("cannot check whether %v has a %v key", jqType(v), jqType(k))
+		}),
+
+		"map/1": func(args []jqFilter) jqFilter {
+			return func(in interface{}) ([]interface{}, error) {
+				values, err := jqValues(in)
+				if err != nil {
+					return nil, err
+				}
+
+				res := array_type{}
+				for _, v := range values {
+					outs, err := args[0](v)
+					if err != nil {
+						return nil, err
+					}
+
+					res = append(res, outs...)
+				}
+
+				return []interface{}{res}, nil
+			}
+		},
+
+		"select/1": func(args []jqFilter) jqFilter {
+			return func(in interface{}) (outs []interface{}, err error) {
+				conds, err := args[0](in)
+				if err != nil {
+					return nil, err
+				}
+
+				for _, c := range conds {
+					if jqTrue(c) {
+						outs = append(outs, in)
+					}
+				}
+
+				return
+			}
+		},
+
+		"add/0": jqFunc(func(v interface{}) (res interface{}, err error) {
+			values, err := jqValues(v)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, e := range values {
+				if res, err = jqArith("+", res, e); err != nil {
+					return nil, err
+				}
+			}
+
+			return
+		}),
+
+		"any/0": jqFunc(func(v interface{}) (interface{}, error) {
+			a, err := jqArray(v, "any")
+			if err != nil {
+				return nil, err
+			}
+
+			for _, e := range a {
+				if jqTrue(e) {
+					return true, nil
+				}
+			}
+
+			return false, nil
+		}),
+
+		"all/0": jqFunc(func(v interface{}) (interface{}, error) {
+			a, err := jqArray(v, "all")
+			if err != nil {
+				return nil, err
+			}
+
+			for _, e := range a {
+				if !jqTrue(e) {
+					return false, nil
+				}
+			}
+
+			return true, nil
+		}),
+
+		"first/0": jqFunc(func(v interface{}) (interface{}, error) {
+			return jqIndex(v, 0.0)
+		}),
+
+		"last/0": jqFunc(func(v interface{}) (interface{}, error) {
+			return jqIndex(v, -1.0)
+		}),
+
+		"first/1": func(args []jqFilter) jqFilter {
+			return func(in interface{}) ([]interface{}, error) {
+				outs, err := args[0](in)
+				if len(outs) > 0 {
+					return outs[:1], nil
+				}
+
+				return nil, err
+			}
+		},
+
+		"reverse/0": jqFunc(func(v interface{}) (interface{}, error) {
+			if v == nil {
+				return array_type{}, nil
+			}
+
+			a, err := jqArray(v, "reverse")
+			if err != nil {
+				return nil, err
+			}
+
+			res := make(array_type, len(a))
+			for i, e := range a {
+				res[len(a)-1-i] = e
+			}
+
+			return res, nil
+		}),
+
+		"sort/0": jqFunc(func(v interface{}) (interface{}, error) {
+			a, err := jqArray(v, "sort")
+			if err != nil {
+				return nil, err
+			}
+
+			return jqSortBy(a, nil)
+		}),
+
+		"sort_by/1": func(args []jqFilter) jqFilter {
+			return jqFunc(func(v interface{}) (interface{}, error) {
+				a, err := jqArray(v, "sort_by")
+				if err != nil {
+					return nil, err
+				}
+
+				return jqSortBy(a, args[0])
+			})(nil)
+		},
+
+		"unique/0": jqFunc(func(v interface{}) (interface{}, error) {
+			a, err := jqArray(v, "unique")
+			if err != nil {
+				return nil, err
+			}
+
+			sorted, _ := jqSortBy(a, nil)
+
+			res := array_type{}
+			for _, e := range sorted {
+				if len(res) == 0 || jqCompare(res[len(res)-1], e) != 0 {
+					res = append(res, e)
+				}
+			}
+
+			return res, nil
+		}),
+
+		"min/0": jqFunc(func(v interface{}) (interface{}, error) {
+			a, err := jqArray(v, "min")
+			if err != nil || len(a) == 0 {
+				return nil, err
+			}
+
+			sorted, _ := jqSortBy(a, nil)
+			return sorted[0], nil
+		}),
+
+		"max/0": jqFunc(func(v interface{}) (interface{}, error) {
+			a, err := jqArray(v, "max")
+			if err != nil || len(a) == 0 {
+				return nil, err
+			}
+
+			sorted, _ := jqSortBy(a, nil)
+			return sorted[len(sorted)-1], nil
+		}),
+
+		"to_entries/0": jqFunc(func(v interface{}) (interface{}, error) {
+			res := array_type{}
+
+			switch v := v.(type) {
+			case map_type:
+				for _, k := range jqKeys(v) {
+					res = append(res, map_type{"key": k, "value": v[k]})
+				}
+
+			case array_type:
+				for i, e := range v {
+					res = append(res, map_type{"key": float64(i), "value": e})
+				}
+
+			default:
+				return nil, fmt.Errorf("to_entries: %v is not an object", jqType(v))
+			}
+
+			return res, nil
+		}),
+
+		"from_entries/0": jqFunc(func(v interface{}) (interface{}, error) {
+			a, err := jqArray(v, "from_entries")
+			if err != nil {
+				return nil, err
+			}
+
+			res := map_type{}
+			for _, e := range a {
+				m, ok := e.(map_type)
+				if !ok {
+					return nil, fmt.Errorf("from_entries: %v is not an object", jqType(e))
+				}
+
+				var k interface{}
+				for _, name := range []string{"key", "k", "name"} {
+					if k = m[name]; k != nil {
+						break
+					}
+				}
+
+				switch key := k.(type) {
+				case string:
+					res[key] = m["value"]
+				case float64, bool:
+					res[jqDump(key)] = m["value"]
+				default:
+					return nil, fmt.Errorf("from_entries: invalid key %v", jqDump(k))
+				}
+			}
+
+			return res, nil
+		}),
+
+		"with_entries/1": func(args []jqFilter) jqFilter {
+			return func(in interface{}) ([]interface{}, error) {
+				entries, err := jqFunctions["to_entries/0"](nil)(in)
+				if err != nil {
+					return nil, err
+				}
+
+				mapped, err := jqFunctions["map/1"](args)(entries[0])
+				if err != nil {
+					return nil, err
+				}
+
+				return jqFunctions["from_entries/0"](nil)(mapped[0])
+			}
+		},
+
+		"tostring/0": jqFunc(func(v interface{}) (interface{}, error) {
+			if s, ok := v.(string); ok {
+				return s, nil
+			}
+
+			return jqDump(v), nil
+		}),
+
+		"tonumber/0": jqFunc(func(v interface{}) (interface{}, error) {
+			switch v := v.(type) {
+			case float64:
+				return v, nil
+			case string:
+				if n, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					return n, nil
+				}
+			}
+
+			return nil, fmt.Errorf("cannot parse %v as a number", jqDump(v))
+		}),
+
+		"ascii_downcase/0": jqFunc(func(v interface{}) (interface{}, error) {
+			s, err := jqStringArg(v, "ascii_downcase")
+			return strings.ToLower(s), err
+		}),
+
+		"ascii_upcase/0": jqFunc(func(v interface{}) (interface{}, error) {
+			s, err := jqStringArg(v, "ascii_upcase")
+			return strings.ToUpper(s), err
+		}),
+
+		"join/1": jqFunc1(func(v, sep interface{}) (interface{}, error) {
+			a, err := jqArray(v, "join")
+			if err != nil {
+				return nil, err
+			}
+
+			s, err := jqStringArg(sep, "join")
+			if err != nil {
+				return nil, err
+			}
+
+			parts := make([]string, len(a))
+			for i, e := range a {
+				switch e := e.(type) {
+				case nil:
+				case string:
+					parts[i] = e
+				case float64, bool:
+					parts[i] = jqDump(e)
+				default:
+					return nil, fmt.Errorf("join: cannot join %v", jqType(e))
+				}
+			}
+
+			return strings.Join(parts, s), nil
+		}),
+
+		"split/1": jqFunc1(func(v, sep interface{}) (interface{}, error) {
+			s, err := jqStringArg(v, "split")
+			if err != nil {
+				return nil, err
+			}
+
+			p, err := jqStringArg(sep, "split")
+			if err != nil {
+				return nil, err
+			}
+
+			return jqSplit(s, p), nil
+		}),
+
+		"startswith/1": jqFunc1(func(v, prefix interface{}) (interface{}, error) {
+			s, err := jqStringArg(v, "startswith")
+			if err != nil {
+				return nil, err
+			}
+
+			p, err := jqStringArg(prefix, "startswith")
+			return strings.HasPrefix(s, p), err
+		}),
+
+		"endswith/1": jqFunc1(func(v, suffix interface{}) (interface{}, error) {
+			s, err := jqStringArg(v, "endswith")
+			if err != nil {
+				return nil, err
+			}
+
+			p, err := jqStringArg(suffix, "endswith")
+			return strings.HasSuffix(s, p), err
+		}),
+
+		"contains/1": jqFunc1(func(v, x interface{}) (interface{}, error) {
+			return jqContains(v, x)
+		}),
+
+		"test/1": jqFunc1(func(v, re interface{}) (interface{}, error) {
+			s, err := jqStringArg(v, "test")
+			if err != nil {
+				return nil, err
+			}
+
+			p, err := jqStringArg(re, "test")
+			if err != nil {
+				return nil, err
+			}
+
+			r, err := regexp.Compile(p)
+			if err != nil {
+				return nil, err
+			}
+
+			return r.MatchString(s), nil
+		}),
+
+		"range/1": func(args []jqFilter) jqFilter {
+			return func(in interface{}) (outs []interface{}, err error) {
+				limits, err := args[0](in)
+				if err != nil {
+					return nil, err
+				}
+
+				for _, l := range limits {
+					n, ok := l.(float64)
+					if !ok {
+						return outs, fmt.Errorf("range: %v is not a number", jqType(l))
+					}
+
+					for i := 0.0; i < n; i++ {
+						outs = append(outs, i)
+					}
+				}
+
+				return
+			}
+		},
+	}
+}
+
+// jqContains returns true if b is contained in a: substrings, array elements and object fields (recursively)
+func jqContains(a, b interface{}) (bool, error) {
+	switch a := a.(type) {
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Contains(a, b), nil
+		}
+
+	case array_type:
+		if b, ok := b.(array_type); ok {
+		next:
+			for _, be := range b {
+				for _, ae := range a {
+					if ok, _ := jqContains(ae, be); ok {
+						continue next
+					}
+				}
+
+				return false, nil
+			}
+
+			return true, nil
+		}
+
+	case map_type:
+		if b, ok := b.(map_type); ok {
+			for k, bv := range b {
+				av, found := a[k]
+				if !found {
+					return false, nil
+				}
+
+				if ok, err := jqContains(av, bv); !ok || err != nil {
+					return false, err
+				}
+			}
+
+			return true, nil
+		}
+
+	default:
+		if jqType(a) == jqType(b) {
+			return jqCompare(a, b) == 0, nil
+		}
+	}
+
+	return false, fmt.Errorf("%v and %v cannot have their containment checked", jqType(a), jqType(b))
+}
@@ -2,16 +2,24 @@
 //
 // The new commands are:
 //
-//	json : creates a json object out of key/value pairs or lists
+//	json : creates a json object out of key/value pairs or lists, patches or validates a json object, loads or saves a json file
 //	jsonpath : parses a json object and extract specified fields
+//	yaml : parses a yaml document as json, or converts json to yaml
+//	xml : parses an xml document as json, or converts json to xml
+//	csv : parses csv records as json, or writes json as csv
+//	jq : queries and reshapes a json object with a jq expression (a subset of jq, see jq.go)
 //	format : pretty-print specified json object
 package json
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/gobs/args"
 	"github.com/gobs/cmd"
@@ -43,6 +51,17 @@ func unquote(s string, q byte) (string, error) {
 	return s, fmt.Errorf("unbalanced")
 }
 
+// loadJson parses a json document, that can also be quoted as a single word (i.e. the output of a pipeline stage)
+func loadJson(s string) (*simplejson.Json, error) {
+	if strings.HasPrefix(s, `"`) {
+		if j, err := simplejson.LoadString(internal.Unquote(s)); err == nil {
+			return j, nil
+		}
+	}
+
+	return simplejson.LoadString(s)
+}
+
 func parseValue(v string) (interface{}, error) {
 	switch {
 	case strings.HasPrefix(v, "{") || strings.HasPrefix(v, "["):
@@ -88,7 +107,12 @@ func parseValue(v string) (interface{}, error) {
 
 // Function PrintJson prints the specified object formatted as a JSON object
 func PrintJson(v interface{}) {
-	fmt.Println(simplejson.MustDumpString(v, simplejson.Indent("  ")))
+	FprintJson(os.Stdout, v)
+}
+
+// Function FprintJson writes the specified object formatted as a JSON object to w
+func FprintJson(w io.Writer, v interface{}) {
+	fmt.Fprintln(w, simplejson.MustDumpString(v, simplejson.Indent("  ")))
 }
 
 // Function StringJson return the specified object as a JSON string
@@ -128,33 +152,161 @@ func merge_array(dst array_type, src interface{}) array_type {
 	}
 }
 
+// PluginName returns the name of this plugin
+func (p *jsonPlugin) PluginName() string {
+	return "json"
+}
+
 // PluginInit initialize this plugin
 func (p *jsonPlugin) PluginInit(commander *cmd.Cmd, _ *internal.Context) error {
 
-	setError := func(err interface{}) {
-		fmt.Println(err)
-		commander.SetVar("error", err)
-	}
-
 	setJson := func(v interface{}) {
 		commander.SetVar("json", StringJson(v, true))
 		commander.SetVar("error", "")
 
 		if !commander.SilentResult() {
-			PrintJson(v)
+			FprintJson(commander.Stdout(), v)
 		}
 	}
 
-	commander.Add(cmd.Command{"json",
-		`
+	setYaml := func(v interface{}) error {
+		y, err := ToYAML(v)
+		if err != nil {
+			return err
+		}
+
+		commander.SetVar("yaml", y)
+		commander.SetVar("error", "")
+
+		if !commander.SilentResult() {
+			commander.Print(y)
+		}
+		return nil
+	}
+
+	commander.Add(cmd.Command{
+		Name: "json",
+		Help: `
                 json field1=value1 field2=value2...       // json object
                 json {"name1":"value1", "name2":"value2"}
                 json [value1, value2...]
-                json -a|--array value1 value2 value3`,
-		func(line string) (stop bool) {
+                json -a|--array value1 value2 value3
+                json patch {json} [json-patch...]           // RFC 6902
+                json mergepatch {json} {json-merge-patch}   // RFC 7386
+                json validate {json-schema} {json}          // sets $valid
+                json --from-yaml yaml-text
+                json --to-yaml {json}                       // sets $yaml
+                json --file=path                            // load a json document from a file
+                json save [--compact] path {json}           // save a json object (indented, by default)`,
+		CallE: func(line string) (bool, error) {
 			var res interface{}
 			var ares []interface{}
 
+			if file, ok := strings.CutPrefix(line, "--file="); ok {
+				line = "--file " + file
+			}
+
+			switch sub, rest, _ := strings.Cut(line, " "); sub {
+			case "--file":
+				b, err := os.ReadFile(commander.Path(internal.Unquote(strings.TrimSpace(rest))))
+				if err != nil {
+					return false, err
+				}
+
+				jbody, err := simplejson.LoadBytes(b)
+				if err != nil {
+					return false, err
+				}
+
+				setJson(jbody.Data())
+				return false, nil
+
+			case "save":
+				var options []simplejson.DumpOption
+
+				if compact, ok := strings.CutPrefix(rest, "--compact "); ok {
+					rest = compact
+				} else {
+					rest = strings.TrimPrefix(rest, "--pretty ")
+					options = append(options, simplejson.Indent("  "))
+				}
+
+				args := internal.Words(rest, 2)
+				if len(args) != 2 {
+					return false, errors.New("invalid-usage")
+				}
+
+				values, err := loadValues(args[1], 1)
+				if err != nil {
+					return false, err
+				}
+
+				b, err := simplejson.DumpBytes(values[0], options...)
+				if err != nil {
+					return false, err
+				}
+
+				return false, os.WriteFile(commander.Path(args[0]), b, 0644)
+
+			case "--from-yaml":
+				v, err := FromYAML(rest)
+				if err != nil {
+					return false, err
+				}
+
+				setJson(v)
+				return false, nil
+
+			case "--to-yaml":
+				values, err := loadValues(rest, 1)
+				if err != nil {
+					return false, err
+				}
+
+				return false, setYaml(values[0])
+
+			case "patch", "mergepatch":
+				values, err := loadValues(rest, 2)
+				if err != nil {
+					return false, err
+				}
+
+				if sub == "mergepatch" {
+					setJson(MergePatch(values[0], values[1]))
+					return false, nil
+				}
+
+				if res, err = ApplyPatch(values[0], values[1]); err != nil {
+					return false, err
+				}
+
+				setJson(res)
+				return false, nil
+
+			case "validate":
+				values, err := loadValues(rest, 2)
+				if err != nil {
+					return false, err
+				}
+
+				violations := Validate(values[0], values[1])
+				commander.SetVar("valid", len(violations) == 0)
+
+				if len(violations) > 0 {
+					for _, v := range violations {
+						commander.Println(v)
+					}
+
+					return false, fmt.Errorf("invalid document: %v violation(s)", len(violations))
+				}
+
+				commander.SetVar("error", "")
+				if !commander.SilentResult() {
+					commander.Println("valid")
+				}
+				return false, nil
+			}
+
 			if strings.HasPrefix(line, "-a ") {
 				line = strings.TrimSpace(line[3:])
 				ares = []interface{}{}
@@ -173,8 +325,7 @@ func (p *jsonPlugin) PluginInit(commander *cmd.Cmd, _ *internal.Context) error {
 					case map_type:
 						src, err := jbody.Map()
 						if err != nil {
-							setError(fmt.Errorf("merge source should be a map"))
-							return
+							return false, fmt.Errorf("merge source should be a map")
 						}
 						res = merge_maps(v, src)
 
@@ -182,15 +333,14 @@ func (p *jsonPlugin) PluginInit(commander *cmd.Cmd, _ *internal.Context) error {
 						res = merge_array(v, jbody.Data())
 					}
 				} else {
-					args := args.GetArgsN(line, 2, args.InfieldBrackets())
+					args := internal.Words(line, 2)
 
 					matches := reFieldValue.FindStringSubmatch(args[0])
 					if len(matches) > 0 { // [field=value field =value value]
 						name, svalue := matches[1], matches[3]
 						value, err := parseValue(svalue)
 						if err != nil {
-							setError(err)
-							return
+							return false, err
 						}
 
 						mval := map[string]interface{}{name: value}
@@ -206,8 +356,7 @@ func (p *jsonPlugin) PluginInit(commander *cmd.Cmd, _ *internal.Context) error {
 							res = merge_array(v, mval)
 						}
 					} else {
-						setError(fmt.Errorf("invalid name=value pair: %v", args[0]))
-						return
+						return false, fmt.Errorf("invalid name=value pair: %v", args[0])
 					}
 
 					if len(args) == 2 {
@@ -229,14 +378,13 @@ func (p *jsonPlugin) PluginInit(commander *cmd.Cmd, _ *internal.Context) error {
 			} else {
 				setJson(ares)
 			}
-			return
-		},
-		nil})
+			return false, nil
+		}})
 
 	commander.Add(cmd.Command{
-		"jsonpath",
-		`jsonpath [-v] [-e] [-c] path {json}`,
-		func(line string) (stop bool) {
+		Name: "jsonpath",
+		Help: `jsonpath [-v] [-e] [-c] path {json}`,
+		CallE: func(line string) (bool, error) {
 			var joptions jsonpath.ProcessOptions
 			var verbose bool
 
@@ -254,10 +402,9 @@ func (p *jsonPlugin) PluginInit(commander *cmd.Cmd, _ *internal.Context) error {
 				}
 			}
 
-			parts := args.GetArgsN(line, 2)
+			parts := internal.Words(line, 2)
 			if len(parts) != 2 {
-				setError("invalid-usage")
-				return
+				return false, errors.New("invalid-usage")
 			}
 
 			path := parts[0]
@@ -265,46 +412,234 @@ func (p *jsonPlugin) PluginInit(commander *cmd.Cmd, _ *internal.Context) error {
 				path = "$." + path
 			}
 
-			jbody, err := simplejson.LoadString(parts[1])
+			jbody, err := loadJson(parts[1])
 			if err != nil {
-				setError(err)
-				return
+				return false, err
 			}
 
 			jp := jsonpath.NewProcessor()
 			if !jp.Parse(path) {
-				setError(fmt.Errorf("failed to parse %q", path))
-				return // syntax error
+				return false, fmt.Errorf("failed to parse %q", path) // syntax error
 			}
 
 			if verbose {
-				fmt.Println("jsonpath", path)
+				commander.Println("jsonpath", path)
 				for _, n := range jp.Nodes {
-					fmt.Println(" ", n)
+					commander.Println(" ", n)
 				}
 			}
 
 			res := jp.Process(jbody, joptions)
 			setJson(res)
-			return
-		},
-		nil})
+			return false, nil
+		}})
+
+	commander.Add(cmd.Command{
+		Name: "jq",
+		Help: `jq 'expression' {json}`,
+		CallE: func(line string) (bool, error) {
+			parts := internal.Words(line, 2)
+			if len(parts) != 2 {
+				return false, errors.New("invalid-usage")
+			}
+
+			jbody, err := loadJson(parts[1])
+			if err != nil {
+				return false, err
+			}
+
+			res, err := Jq(parts[0], jbody.Data())
+			if err != nil {
+				return false, err
+			}
+
+			// a single result, or the list of results
+			if len(res) == 1 {
+				setJson(res[0])
+			} else if res == nil {
+				setJson([]interface{}{})
+			} else {
+				setJson(res)
+			}
+			return false, nil
+		}})
+
+	commander.Add(cmd.Command{
+		Name: "yaml",
+		Help: `
+                yaml yaml-text              // parse a yaml document, as json --from-yaml
+                yaml --file=path            // parse a yaml file
+                yaml --to-yaml {json}       // as json --to-yaml`,
+		CallE: func(line string) (bool, error) {
+			if rest, ok := strings.CutPrefix(line, "--to-yaml "); ok {
+				values, err := loadValues(rest, 1)
+				if err != nil {
+					return false, err
+				}
+
+				return false, setYaml(values[0])
+			}
+
+			if file, ok := strings.CutPrefix(line, "--file="); ok {
+				b, err := os.ReadFile(commander.Path(internal.Unquote(strings.TrimSpace(file))))
+				if err != nil {
+					return false, err
+				}
+
+				line = string(b)
+			}
+
+			v, err := FromYAML(line)
+			if err != nil {
+				return false, err
+			}
+
+			setJson(v)
+			return false, nil
+		}})
+
+	commander.Add(cmd.Command{
+		Name: "xml",
+		Help: `
+                xml xml-text                // parse an xml document as json
+                xml --file=path             // parse an xml file
+                xml --to-xml {json}         // convert json to xml (sets $xml)`,
+		CallE: func(line string) (bool, error) {
+			if rest, ok := strings.CutPrefix(line, "--to-xml "); ok {
+				values, err := loadValues(rest, 1)
+				if err != nil {
+					return false, err
+				}
+
+				x, err := ToXML(values[0])
+				if err != nil {
+					return false, err
+				}
+
+				commander.SetVar("xml", x)
+				commander.SetVar("error", "")
+
+				if !commander.SilentResult() {
+					commander.Println(x)
+				}
+				return false, nil
+			}
+
+			if file, ok := strings.CutPrefix(line, "--file="); ok {
+				b, err := os.ReadFile(commander.Path(internal.Unquote(strings.TrimSpace(file))))
+				if err != nil {
+					return false, err
+				}
+
+				line = string(b)
+			}
+
+			v, err := FromXML(line)
+			if err != nil {
+				return false, err
+			}
+
+			setJson(v)
+			return false, nil
+		}})
+
+	commander.Add(cmd.Command{
+		Name: "csv",
+		Help: `
+                csv parse [--header] [--delimiter=c] file|text     // parse csv records as json (objects, with --header)
+                csv write [--delimiter=c] file|- {json}            // write a list of objects (or lists) as csv`,
+		CallE: func(line string) (bool, error) {
+			sub, rest, _ := strings.Cut(line, " ")
+			if sub != "parse" && sub != "write" {
+				return false, errors.New("invalid-usage")
+			}
+
+			header, comma := false, ','
+
+			for {
+				opt, next, _ := strings.Cut(strings.TrimSpace(rest), " ")
+
+				if opt == "--header" {
+					header = true
+				} else if d, ok := strings.CutPrefix(opt, "--delimiter="); ok {
+					if d = internal.Unquote(d); d == `\t` {
+						d = "\t"
+					}
+					if utf8.RuneCountInString(d) != 1 {
+						return false, fmt.Errorf("invalid delimiter %q", d)
+					}
+
+					comma, _ = utf8.DecodeRuneInString(d)
+				} else {
+					break
+				}
+
+				rest = next
+			}
+
+			rest = strings.TrimSpace(rest)
+
+			if sub == "write" {
+				args := internal.Words(rest, 2)
+				if len(args) != 2 {
+					return false, errors.New("invalid-usage")
+				}
+
+				values, err := loadValues(args[1], 1)
+				if err != nil {
+					return false, err
+				}
+
+				if args[0] == "-" {
+					return false, WriteCSV(commander.Stdout(), values[0], comma)
+				}
+
+				f, err := os.Create(commander.Path(args[0]))
+				if err != nil {
+					return false, err
+				}
+
+				if err = WriteCSV(f, values[0], comma); err != nil {
+					f.Close()
+					return false, err
+				}
+
+				return false, f.Close()
+			}
+
+			// a file, if it exists, or the csv text
+			var r io.Reader
+
+			if f, err := os.Open(commander.Path(internal.Unquote(rest))); err == nil {
+				defer f.Close()
+				r = f
+			} else {
+				r = strings.NewReader(internal.Unquote(rest))
+			}
+
+			v, err := ParseCSV(r, header, comma)
+			if err != nil {
+				return false, err
+			}
+
+			setJson(v)
+			return false, nil
+		}})
 
 	commander.Add(cmd.Command{
-		"format",
-		`format object`,
-		func(line string) (stop bool) {
-			jbody, err := simplejson.LoadString(line)
+		Name: "format",
+		Help: `format object`,
+		Call: func(line string) (stop bool) {
+			jbody, err := loadJson(line)
 			if err != nil {
-				fmt.Println("format:", err)
-				fmt.Println("input:", line)
+				commander.Println("format:", err)
+				commander.Println("input:", line)
 				return
 			}
 
-			PrintJson(jbody.Data())
+			FprintJson(commander.Stdout(), jbody.Data())
 			return
-		},
-		nil})
+		}})
 
 	return nil
 }
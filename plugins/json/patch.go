@@ -0,0 +1,353 @@
+package json
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gobs/simplejson"
+)
+
+// loadValues parses n JSON values from line
+func loadValues(line string, n int) (values []interface{}, err error) {
+	for i := 0; i < n; i++ {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			return nil, fmt.Errorf("expected %v json values, got %v", n, i)
+		}
+
+		var j *simplejson.Json
+
+		if j, line, err = simplejson.LoadPartialString(line); err != nil {
+			return nil, err
+		}
+
+		values = append(values, j.Data())
+	}
+
+	if strings.TrimSpace(line) != "" {
+		return nil, fmt.Errorf("unexpected %v", strings.TrimSpace(line))
+	}
+
+	return
+}
+
+// copyValue returns a deep copy of a JSON value
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map_type:
+		m := make(map_type, len(v))
+		for k, e := range v {
+			m[k] = copyValue(e)
+		}
+		return m
+
+	case array_type:
+		a := make(array_type, len(v))
+		for i, e := range v {
+			a[i] = copyValue(e)
+		}
+		return a
+	}
+
+	return v
+}
+
+// pointerTokens splits a JSON pointer (RFC 6901) in its reference tokens
+func pointerTokens(ptr string) ([]string, error) {
+	if ptr == "" {
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(ptr, "/") {
+		return nil, fmt.Errorf("invalid json pointer %q", ptr)
+	}
+
+	tokens := strings.Split(ptr[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+
+	return tokens, nil
+}
+
+// arrayIndex parses an array index, that must be less than max (or "-", the end of the array, if max > len)
+func arrayIndex(a array_type, token string, max int) (int, error) {
+	if token == "-" && max > len(a) {
+		return len(a), nil
+	}
+
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+
+	if i >= max {
+		return 0, fmt.Errorf("array index %v out of range", i)
+	}
+
+	return i, nil
+}
+
+// pointerGet returns the value referenced by the pointer tokens
+func pointerGet(doc interface{}, tokens []string) (interface{}, error) {
+	for _, t := range tokens {
+		switch v := doc.(type) {
+		case map_type:
+			e, ok := v[t]
+			if !ok {
+				return nil, fmt.Errorf("member %q not found", t)
+			}
+
+			doc = e
+
+		case array_type:
+			i, err := arrayIndex(v, t, len(v))
+			if err != nil {
+				return nil, err
+			}
+
+			doc = v[i]
+
+		default:
+			return nil, fmt.Errorf("cannot reference %q in a value that is not an object or array", t)
+		}
+	}
+
+	return doc, nil
+}
+
+// pointerUpdate changes the container of the value referenced by the pointer tokens (the document, if tokens is empty),
+// calling update with the container and the last token, and returns the updated document
+func pointerUpdate(doc interface{}, tokens []string, update func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 0 {
+		return update(nil, "")
+	}
+
+	if len(tokens) == 1 {
+		return update(doc, tokens[0])
+	}
+
+	child, err := pointerGet(doc, tokens[:1])
+	if err != nil {
+		return nil, err
+	}
+
+	if child, err = pointerUpdate(child, tokens[1:], update); err != nil {
+		return nil, err
+	}
+
+	switch v := doc.(type) {
+	case map_type:
+		v[tokens[0]] = child
+
+	case array_type:
+		i, _ := arrayIndex(v, tokens[0], len(v))
+		v[i] = child
+	}
+
+	return doc, nil
+}
+
+// patchAdd adds the value at the location referenced by tokens (replacing an object member, or inserting in an array)
+func patchAdd(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	return pointerUpdate(doc, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch v := parent.(type) {
+		case nil:
+			if len(tokens) == 0 {
+				return value, nil // the whole document
+			}
+
+		case map_type:
+			v[token] = value
+			return v, nil
+
+		case array_type:
+			i, err := arrayIndex(v, token, len(v)+1)
+			if err != nil {
+				return nil, err
+			}
+
+			v = append(v, nil)
+			copy(v[i+1:], v[i:])
+			v[i] = value
+			return v, nil
+		}
+
+		return nil, fmt.Errorf("cannot add %q to a value that is not an object or array", token)
+	})
+}
+
+// patchRemove removes the value at the location referenced by tokens, that must exist
+func patchRemove(doc interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, errors.New("cannot remove the whole document")
+	}
+
+	return pointerUpdate(doc, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch v := parent.(type) {
+		case map_type:
+			if _, ok := v[token]; !ok {
+				return nil, fmt.Errorf("member %q not found", token)
+			}
+
+			delete(v, token)
+			return v, nil
+
+		case array_type:
+			i, err := arrayIndex(v, token, len(v))
+			if err != nil {
+				return nil, err
+			}
+
+			return append(v[:i], v[i+1:]...), nil
+		}
+
+		return nil, fmt.Errorf("cannot remove %q from a value that is not an object or array", token)
+	})
+}
+
+// patchValue returns a member of a patch operation
+func patchValue(op map_type, name string) (interface{}, error) {
+	v, ok := op[name]
+	if !ok {
+		return nil, fmt.Errorf("missing %q in %v", name, jqDump(op))
+	}
+
+	return v, nil
+}
+
+// patchPointer returns a member of a patch operation as a JSON pointer
+func patchPointer(op map_type, name string) ([]string, error) {
+	v, err := patchValue(op, name)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("%q should be a string in %v", name, jqDump(op))
+	}
+
+	return pointerTokens(s)
+}
+
+// ApplyPatch applies a JSON Patch (RFC 6902, a list of add, remove, replace, move, copy and test operations)
+// to a copy of the document, and returns the patched document
+func ApplyPatch(doc, patch interface{}) (interface{}, error) {
+	ops, ok := patch.(array_type)
+	if !ok {
+		return nil, errors.New("the patch should be a list of operations")
+	}
+
+	doc = copyValue(doc)
+
+	for n, o := range ops {
+		op, ok := o.(map_type)
+		if !ok {
+			return nil, fmt.Errorf("operation %v: not an object", n)
+		}
+
+		name, _ := op["op"].(string)
+
+		path, err := patchPointer(op, "path")
+		if err != nil {
+			return nil, fmt.Errorf("operation %v: %w", n, err)
+		}
+
+		switch name {
+		case "add", "replace", "test":
+			var value interface{}
+
+			if value, err = patchValue(op, "value"); err != nil {
+				break
+			}
+
+			if name == "replace" && len(path) > 0 { // the whole document is just replaced by add
+				if doc, err = patchRemove(doc, path); err != nil {
+					break
+				}
+			}
+
+			if name == "test" {
+				var current interface{}
+
+				if current, err = pointerGet(doc, path); err == nil && jqCompare(jqNormalize(current), jqNormalize(value)) != 0 {
+					err = fmt.Errorf("test failed: %v is %v", op["path"], jqDump(current))
+				}
+				break
+			}
+
+			doc, err = patchAdd(doc, path, copyValue(value))
+
+		case "remove":
+			doc, err = patchRemove(doc, path)
+
+		case "move", "copy":
+			var from []string
+			var value interface{}
+
+			if from, err = patchPointer(op, "from"); err != nil {
+				break
+			}
+
+			if value, err = pointerGet(doc, from); err != nil {
+				break
+			}
+
+			if name == "move" {
+				if len(path) > len(from) && strings.HasPrefix(op["path"].(string), op["from"].(string)+"/") {
+					err = errors.New("cannot move a value into one of its children")
+					break
+				}
+
+				if doc, err = patchRemove(doc, from); err != nil {
+					break
+				}
+			} else {
+				value = copyValue(value)
+			}
+
+			doc, err = patchAdd(doc, path, value)
+
+		default:
+			err = fmt.Errorf("invalid op %q", op["op"])
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("operation %v: %w", n, err)
+		}
+	}
+
+	return doc, nil
+}
+
+// MergePatch applies a JSON Merge Patch (RFC 7386) to a copy of the document, and returns the patched document:
+// the members of a patch object are merged recursively, and the members set to null are removed
+func MergePatch(doc, patch interface{}) interface{} {
+	p, ok := patch.(map_type)
+	if !ok {
+		return copyValue(patch)
+	}
+
+	d, ok := doc.(map_type)
+	if !ok {
+		d = map_type{}
+	}
+
+	res := make(map_type, len(d))
+	for k, v := range d {
+		res[k] = copyValue(v)
+	}
+
+	for k, v := range p {
+		if v == nil {
+			delete(res, k)
+		} else {
+			res[k] = MergePatch(res[k], v)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,360 @@
+package json
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Validation of JSON documents with a JSON Schema (https://json-schema.org), supporting the keywords:
+//
+//   - type, enum, const
+//   - properties, required, additionalProperties, patternProperties, minProperties, maxProperties
+//   - items (a schema, or a list of schemas), minItems, maxItems, uniqueItems
+//   - minLength, maxLength, pattern
+//   - minimum, maximum, exclusiveMinimum, exclusiveMaximum (numbers, or booleans as in draft 4), multipleOf
+//   - allOf, anyOf, oneOf, not
+//   - $ref, to the schema or one of its parts (i.e. #/definitions/name or #/$defs/name)
+//
+// The other keywords are ignored.
+
+// Violation is a part of a document that doesn't match the schema
+type Violation struct {
+	Path    string // the path of the value in the document, as in jsonpath (i.e. $.items[1].name)
+	Message string
+}
+
+func (v Violation) String() string {
+	return v.Path + ": " + v.Message
+}
+
+// Validate validates a document with a JSON Schema, and returns the violations (nil if the document is valid)
+func Validate(schema, doc interface{}) []Violation {
+	v := &validator{root: schema}
+	v.validate(schema, jqNormalize(doc), "$")
+	return v.violations
+}
+
+type validator struct {
+	root       interface{}
+	violations []Violation
+	depth      int // the nesting level of $ref, to stop recursive references
+}
+
+func (v *validator) fail(path, format string, args ...interface{}) {
+	v.violations = append(v.violations, Violation{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// valid returns true if the value matches the schema (without recording the violations)
+func (v *validator) valid(schema, value interface{}, path string) bool {
+	sub := &validator{root: v.root, depth: v.depth}
+	sub.validate(schema, value, path)
+	return len(sub.violations) == 0
+}
+
+var reMemberName = regexp.MustCompile(`^[\w-]+$`)
+
+// childPath returns the path of an object member or array element
+func childPath(path string, key interface{}) string {
+	if i, ok := key.(int); ok {
+		return fmt.Sprintf("%v[%v]", path, i)
+	}
+
+	k := key.(string)
+	if reMemberName.MatchString(k) {
+		return path + "." + k
+	}
+
+	return path + "[" + strconv.Quote(k) + "]"
+}
+
+// schemaNumber returns a schema keyword that should be a number
+func schemaNumber(schema map_type, name string) (float64, bool) {
+	switch n := jqNormalize(schema[name]).(type) {
+	case float64:
+		return n, true
+	}
+
+	return 0, false
+}
+
+// isType returns true if the value is of the schema type
+func isType(value interface{}, t string) bool {
+	switch t {
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	case "number":
+		return jqType(value) == "number"
+	}
+
+	return jqType(value) == t
+}
+
+func (v *validator) validate(schema, value interface{}, path string) {
+	switch s := schema.(type) {
+	case bool:
+		if !s {
+			v.fail(path, "not allowed")
+		}
+		return
+
+	case map_type:
+		v.validateObject(s, value, path)
+
+	default:
+		v.fail(path, "invalid schema %v", jqDump(schema))
+	}
+}
+
+func (v *validator) validateObject(schema map_type, value interface{}, path string) {
+	if ref, ok := schema["$ref"].(string); ok {
+		v.validateRef(ref, value, path)
+	}
+
+	switch t := schema["type"].(type) {
+	case string:
+		if !isType(value, t) {
+			v.fail(path, "expected %v, got %v", t, jqType(value))
+		}
+
+	case array_type:
+		found := false
+		types := make([]string, len(t))
+		for i, e := range t {
+			types[i] = fmt.Sprint(e)
+			found = found || isType(value, types[i])
+		}
+
+		if !found {
+			v.fail(path, "expected %v, got %v", strings.Join(types, " or "), jqType(value))
+		}
+	}
+
+	if enum, ok := schema["enum"].(array_type); ok {
+		found := false
+		for _, e := range enum {
+			found = found || jqCompare(jqNormalize(e), value) == 0
+		}
+
+		if !found {
+			v.fail(path, "%v is not one of %v", jqDump(value), jqDump(enum))
+		}
+	}
+
+	if c, ok := schema["const"]; ok && jqCompare(jqNormalize(c), value) != 0 {
+		v.fail(path, "%v should be %v", jqDump(value), jqDump(c))
+	}
+
+	switch value := value.(type) {
+	case map_type:
+		v.validateProperties(schema, value, path)
+
+	case array_type:
+		v.validateItems(schema, value, path)
+
+	case string:
+		l := float64(utf8.RuneCountInString(value))
+
+		if n, ok := schemaNumber(schema, "minLength"); ok && l < n {
+			v.fail(path, "length %v is less than %v", l, n)
+		}
+		if n, ok := schemaNumber(schema, "maxLength"); ok && l > n {
+			v.fail(path, "length %v is greater than %v", l, n)
+		}
+
+		if p, ok := schema["pattern"].(string); ok {
+			if re, err := regexp.Compile(p); err != nil {
+				v.fail(path, "invalid pattern %q", p)
+			} else if !re.MatchString(value) {
+				v.fail(path, "%q doesn't match %q", value, p)
+			}
+		}
+
+	case float64:
+		v.validateNumber(schema, value, path)
+	}
+
+	for _, name := range []string{"allOf", "anyOf", "oneOf"} {
+		list, ok := schema[name].(array_type)
+		if !ok {
+			continue
+		}
+
+		matches := 0
+		for _, s := range list {
+			if name == "allOf" {
+				v.validate(s, value, path)
+			} else if v.valid(s, value, path) {
+				matches++
+			}
+		}
+
+		if name == "anyOf" && matches == 0 {
+			v.fail(path, "doesn't match any of the schemas in anyOf")
+		}
+		if name == "oneOf" && matches != 1 {
+			v.fail(path, "matches %v schemas in oneOf, instead of 1", matches)
+		}
+	}
+
+	if not, ok := schema["not"]; ok && v.valid(not, value, path) {
+		v.fail(path, "matches the schema in not")
+	}
+}
+
+// validateRef validates the value with a schema referenced as #/path (a JSON pointer in the root schema)
+func (v *validator) validateRef(ref string, value interface{}, path string) {
+	if !strings.HasPrefix(ref, "#") {
+		v.fail(path, "unsupported $ref %q", ref)
+		return
+	}
+
+	if v.depth > 100 {
+		v.fail(path, "too many nested $ref (recursive schema?)")
+		return
+	}
+
+	tokens, err := pointerTokens(ref[1:])
+	if err == nil {
+		var schema interface{}
+
+		if schema, err = pointerGet(v.root, tokens); err == nil {
+			v.depth++
+			v.validate(schema, value, path)
+			v.depth--
+			return
+		}
+	}
+
+	v.fail(path, "invalid $ref %q: %v", ref, err)
+}
+
+func (v *validator) validateProperties(schema map_type, value map_type, path string) {
+	if required, ok := schema["required"].(array_type); ok {
+		for _, r := range required {
+			if name, ok := r.(string); ok {
+				if _, found := value[name]; !found {
+					v.fail(path, "missing required property %q", name)
+				}
+			}
+		}
+	}
+
+	l := float64(len(value))
+	if n, ok := schemaNumber(schema, "minProperties"); ok && l < n {
+		v.fail(path, "has %v properties, less than %v", l, n)
+	}
+	if n, ok := schemaNumber(schema, "maxProperties"); ok && l > n {
+		v.fail(path, "has %v properties, more than %v", l, n)
+	}
+
+	properties, _ := schema["properties"].(map_type)
+	patterns, _ := schema["patternProperties"].(map_type)
+	additional, hasAdditional := schema["additionalProperties"]
+
+	names := make([]string, 0, len(value))
+	for name := range value {
+		names = append(names, name)
+	}
+	sort.Strings(names) // report the violations in a stable order
+
+	for _, name := range names {
+		p := childPath(path, name)
+		matched := false
+
+		if s, ok := properties[name]; ok {
+			v.validate(s, value[name], p)
+			matched = true
+		}
+
+		for pattern, s := range patterns {
+			if re, err := regexp.Compile(pattern); err == nil && re.MatchString(name) {
+				v.validate(s, value[name], p)
+				matched = true
+			}
+		}
+
+		if !matched && hasAdditional {
+			if allowed, ok := additional.(bool); ok && !allowed {
+				v.fail(path, "property %q is not allowed", name)
+			} else if !ok {
+				v.validate(additional, value[name], p)
+			}
+		}
+	}
+}
+
+func (v *validator) validateItems(schema map_type, value array_type, path string) {
+	l := float64(len(value))
+	if n, ok := schemaNumber(schema, "minItems"); ok && l < n {
+		v.fail(path, "has %v items, less than %v", l, n)
+	}
+	if n, ok := schemaNumber(schema, "maxItems"); ok && l > n {
+		v.fail(path, "has %v items, more than %v", l, n)
+	}
+
+	if unique, _ := schema["uniqueItems"].(bool); unique {
+	check:
+		for i := range value {
+			for j := 0; j < i; j++ {
+				if jqCompare(value[i], value[j]) == 0 {
+					v.fail(childPath(path, i), "duplicate of item %v", j)
+					break check
+				}
+			}
+		}
+	}
+
+	switch items := schema["items"].(type) {
+	case array_type: // a schema for each item
+		for i, e := range value {
+			if i < len(items) {
+				v.validate(items[i], e, childPath(path, i))
+			} else if additional, ok := schema["additionalItems"]; ok {
+				v.validate(additional, e, childPath(path, i))
+			}
+		}
+
+	case nil:
+
+	default:
+		for i, e := range value {
+			v.validate(items, e, childPath(path, i))
+		}
+	}
+}
+
+func (v *validator) validateNumber(schema map_type, value float64, path string) {
+	// draft 4 uses booleans for exclusiveMinimum and exclusiveMaximum
+	exclusiveMin, _ := schema["exclusiveMinimum"].(bool)
+	exclusiveMax, _ := schema["exclusiveMaximum"].(bool)
+
+	if n, ok := schemaNumber(schema, "minimum"); ok {
+		if value < n || (exclusiveMin && value == n) {
+			v.fail(path, "%v is less than %v", value, n)
+		}
+	}
+	if n, ok := schemaNumber(schema, "maximum"); ok {
+		if value > n || (exclusiveMax && value == n) {
+			v.fail(path, "%v is greater than %v", value, n)
+		}
+	}
+
+	if n, ok := schemaNumber(schema, "exclusiveMinimum"); ok && value <= n {
+		v.fail(path, "%v is not greater than %v", value, n)
+	}
+	if n, ok := schemaNumber(schema, "exclusiveMaximum"); ok && value >= n {
+		v.fail(path, "%v is not less than %v", value, n)
+	}
+
+	if n, ok := schemaNumber(schema, "multipleOf"); ok && n > 0 {
+		if q := value / n; math.Abs(q-math.Round(q)) > 1e-9 {
+			v.fail(path, "%v is not a multiple of %v", value, n)
+		}
+	}
+}
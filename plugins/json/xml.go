@@ -0,0 +1,233 @@
+package json
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The XML documents are converted to JSON as:
+//
+//   - the root element is an object with a single member (the element name)
+//   - an element with only text is a string (an empty string, for an empty element)
+//   - an element with attributes or children is an object, with a member for each attribute (@name),
+//     a member for each child element (a list, if the element is repeated) and the text in #text (if any)
+//
+// i.e. <user id="1"><name>bob</name><role>a</role><role>b</role></user> is
+// {"user": {"@id": "1", "name": "bob", "role": ["a", "b"]}}. Namespace prefixes are removed.
+
+// xmlNode is an element of an XML document
+type xmlNode struct {
+	name     string
+	attrs    []xml.Attr
+	children []*xmlNode
+	text     strings.Builder
+}
+
+// value returns the JSON representation of the element content
+func (n *xmlNode) value() interface{} {
+	text := strings.TrimSpace(n.text.String())
+
+	if len(n.attrs) == 0 && len(n.children) == 0 {
+		return text
+	}
+
+	m := map_type{}
+
+	for _, a := range n.attrs {
+		m["@"+a.Name.Local] = a.Value
+	}
+
+	for _, c := range n.children {
+		v := c.value()
+
+		switch prev := m[c.name].(type) {
+		case nil:
+			m[c.name] = v
+		case array_type: // the element values are never lists, so this is a repeated element
+			m[c.name] = append(prev, v)
+		default:
+			m[c.name] = array_type{prev, v}
+		}
+	}
+
+	if text != "" {
+		m["#text"] = text
+	}
+
+	return m
+}
+
+// FromXML parses an XML document into a JSON compatible value
+func FromXML(text string) (interface{}, error) {
+	dec := xml.NewDecoder(strings.NewReader(text))
+
+	var root *xmlNode
+	var stack []*xmlNode
+
+	for {
+		t, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			var attrs []xml.Attr
+			for _, a := range t.Attr {
+				if a.Name.Space != "xmlns" && a.Name.Local != "xmlns" { // namespace declarations
+					attrs = append(attrs, a)
+				}
+			}
+
+			n := &xmlNode{name: t.Name.Local, attrs: attrs}
+
+			if l := len(stack); l > 0 {
+				stack[l-1].children = append(stack[l-1].children, n)
+			} else if root == nil {
+				root = n
+			} else {
+				return nil, errors.New("multiple root elements")
+			}
+
+			stack = append(stack, n)
+
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+
+		case xml.CharData:
+			if l := len(stack); l > 0 {
+				stack[l-1].text.Write(t)
+			}
+		}
+	}
+
+	if root == nil {
+		return nil, errors.New("no root element")
+	}
+
+	return map_type{root.name: root.value()}, nil
+}
+
+// ToXML returns the XML representation of a value converted as in FromXML.
+// If the value is not an object with a single member, the root element is named root.
+func ToXML(v interface{}) (string, error) {
+	var sb strings.Builder
+
+	enc := xml.NewEncoder(&sb)
+	enc.Indent("", "  ")
+
+	name := "root"
+	if m, ok := v.(map_type); ok && len(m) == 1 {
+		for k, e := range m {
+			name, v = k, e
+		}
+	}
+
+	if err := writeXML(enc, name, v); err != nil {
+		return "", err
+	}
+
+	if err := enc.Flush(); err != nil {
+		return "", err
+	}
+
+	return sb.String(), nil
+}
+
+// scalarText returns the text of a scalar value (an empty string for null)
+func scalarText(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	return fmt.Sprint(v)
+}
+
+// writeXML writes an element (or a repeated element, for a list)
+func writeXML(enc *xml.Encoder, name string, v interface{}) error {
+	if !xmlName(name) {
+		return fmt.Errorf("invalid element name %q", name)
+	}
+
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+
+	switch v := v.(type) {
+	case array_type:
+		for _, e := range v {
+			if err := writeXML(enc, name, e); err != nil {
+				return err
+			}
+		}
+
+		return nil
+
+	case map_type:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		var children []string
+
+		for _, k := range keys {
+			if attr, ok := strings.CutPrefix(k, "@"); ok {
+				start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: attr}, Value: scalarText(v[k])})
+			} else if k != "#text" {
+				children = append(children, k)
+			}
+		}
+
+		if err := enc.EncodeToken(start); err != nil {
+			return err
+		}
+
+		if text, ok := v["#text"]; ok {
+			if err := enc.EncodeToken(xml.CharData(scalarText(text))); err != nil {
+				return err
+			}
+		}
+
+		for _, k := range children {
+			if err := writeXML(enc, k, v[k]); err != nil {
+				return err
+			}
+		}
+
+	default:
+		if err := enc.EncodeToken(start); err != nil {
+			return err
+		}
+
+		if text := scalarText(v); text != "" {
+			if err := enc.EncodeToken(xml.CharData(text)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return enc.EncodeToken(start.End())
+}
+
+// xmlName returns true if name is a valid element name
+func xmlName(name string) bool {
+	if name == "" || strings.ContainsAny(name, " \t\n<>&\"'/=") {
+		return false
+	}
+
+	c := name[0]
+	return c == '_' || c == ':' || c >= 0x80 || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
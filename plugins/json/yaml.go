@@ -0,0 +1,86 @@
+package json
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FromYAML parses a YAML document into a JSON compatible value (a list of values, if there are multiple documents)
+func FromYAML(text string) (interface{}, error) {
+	dec := yaml.NewDecoder(strings.NewReader(text))
+
+	var docs array_type
+
+	for {
+		var v interface{}
+
+		if err := dec.Decode(&v); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		docs = append(docs, fromYAMLValue(v))
+	}
+
+	switch len(docs) {
+	case 0:
+		return nil, nil
+	case 1:
+		return docs[0], nil
+	}
+
+	return docs, nil
+}
+
+// fromYAMLValue converts the values that can't be represented in JSON (maps with non-string keys, timestamps)
+func fromYAMLValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = fromYAMLValue(e)
+		}
+		return v
+
+	case map[interface{}]interface{}:
+		m := make(map_type, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = fromYAMLValue(e)
+		}
+		return m
+
+	case []interface{}:
+		for i, e := range v {
+			v[i] = fromYAMLValue(e)
+		}
+		return v
+
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+
+	return v
+}
+
+// ToYAML returns the YAML representation of a value
+func ToYAML(v interface{}) (string, error) {
+	var sb strings.Builder
+
+	enc := yaml.NewEncoder(&sb)
+	enc.SetIndent(2)
+
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+
+	return sb.String(), nil
+}
@@ -6,7 +6,6 @@
 package stats
 
 import (
-	"fmt"
 	"math"
 	"sort"
 	"strconv"
@@ -80,20 +79,26 @@ func Percentile(input stats.Float64Data, percent float64) (percentile float64, e
 	return
 }
 
+// PluginName returns the name of this plugin
+func (p *statsPlugin) PluginName() string {
+	return "stats"
+}
+
 // PluginInit initialize this plugin
 func (p *statsPlugin) PluginInit(commander *cmd.Cmd, _ *internal.Context) error {
 
-	commander.Add(cmd.Command{"stats",
-		`
+	commander.Add(cmd.Command{
+		Name: "stats",
+		Help: `
                 stats {count|sort|min|max|mean|median|sum|variance|std|pN} value...
                 `,
-		func(line string) (stop bool) {
+		Call: func(line string) (stop bool) {
 			var res float64
 			var err error
 
 			parts := args.GetArgs(line) // [ type, value, ... ]
 			if len(parts) == 0 {
-				fmt.Println("usage: stats {count|sort|min|max|mean|median|sum|variance|std|pN} value...")
+				commander.Println("usage: stats {count|sort|min|max|mean|median|sum|variance|std|pN} value...")
 				return
 			}
 
@@ -137,7 +142,7 @@ func (p *statsPlugin) PluginInit(commander *cmd.Cmd, _ *internal.Context) error
 				if strings.HasPrefix(cmd, "p") {
 					pc, err = parseFloat(cmd[1:])
 					if err != nil {
-						fmt.Println("invalid percentile command:", cmd)
+						commander.Println("invalid percentile command:", cmd)
 						return
 					}
 
@@ -154,8 +159,12 @@ func (p *statsPlugin) PluginInit(commander *cmd.Cmd, _ *internal.Context) error
 					sres := strings.Join(ssort, " ")
 					commander.SetVar("error", "")
 					commander.SetVar("result", sres)
-					if !commander.SilentResult() {
-						fmt.Println(sres)
+					if commander.SilentResult() {
+						// no output
+					} else if commander.JSONOutput() {
+						commander.PrintJSON(map[string]interface{}{"result": []float64(sorted)})
+					} else {
+						commander.Println(sres)
 					}
 					return
 
@@ -202,7 +211,7 @@ func (p *statsPlugin) PluginInit(commander *cmd.Cmd, _ *internal.Context) error
 						res, err = Percentile(data, pc)
 					}
 				default:
-					fmt.Println("usage: stats {count|sort|min|max|mean|median|sum|variance|std|pN} value...")
+					commander.Println("usage: stats {count|sort|min|max|mean|median|sum|variance|std|pN} value...")
 					return
 				}
 			}
@@ -210,11 +219,19 @@ func (p *statsPlugin) PluginInit(commander *cmd.Cmd, _ *internal.Context) error
 			if err != nil {
 				commander.SetVar("error", err)
 				commander.SetVar("result", "0")
-				fmt.Println(err)
+				if commander.JSONOutput() {
+					commander.PrintJSON(map[string]interface{}{"error": err.Error()})
+				} else {
+					commander.Println(err)
+				}
 			} else {
 				sres := floatString(res)
-				if !commander.SilentResult() {
-					fmt.Println(sres)
+				if commander.SilentResult() {
+					// no output
+				} else if commander.JSONOutput() {
+					commander.PrintJSON(map[string]interface{}{"result": res})
+				} else {
+					commander.Println(sres)
 				}
 
 				commander.SetVar("error", "")
@@ -222,8 +239,7 @@ func (p *statsPlugin) PluginInit(commander *cmd.Cmd, _ *internal.Context) error
 			}
 
 			return
-		},
-		nil})
+		}})
 
 	return nil
 }
@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gobs/cmd/internal"
+)
+
+// the ANSI codes for the prompt color tags
+var promptColors = map[string]string{
+	"reset":     "0",
+	"bold":      "1",
+	"dim":       "2",
+	"italic":    "3",
+	"underline": "4",
+	"black":     "30",
+	"red":       "31",
+	"green":     "32",
+	"yellow":    "33",
+	"blue":      "34",
+	"magenta":   "35",
+	"cyan":      "36",
+	"white":     "37",
+}
+
+// ExpandPrompt expands the placeholders in a prompt template:
+//
+//	${name}          the value of the variable (i.e. ${user})
+//	${env.NAME}      the value of the environment variable
+//	${?}             the status of the last command (the same as ${status})
+//	${time}          the current time, as 15:04:05
+//	${time:layout}   the current time, formatted with a Go time layout (i.e. ${time:Jan 2 15:04})
+//	${date}          the current date, as 2006-01-02
+//	<red> ... </red> an ANSI color or style (black, red, green, yellow, blue, magenta, cyan, white,
+//	                 bold, dim, italic, underline). </name> or <reset> reset the attributes.
+//
+// The color tags are removed if the NO_COLOR environment variable is set.
+// Note that in the input line (the last line of a multi-line prompt) the colors are not displayed,
+// since the line editor can't position the cursor correctly.
+func (cmd *Cmd) ExpandPrompt(template string) string {
+	if !strings.ContainsAny(template, "$<") {
+		return template
+	}
+
+	color := os.Getenv("NO_COLOR") == ""
+
+	var b strings.Builder
+
+	for i := 0; i < len(template); {
+		rest := template[i:]
+
+		if strings.HasPrefix(rest, "${") {
+			if end := strings.IndexByte(rest, '}'); end > 0 {
+				b.WriteString(cmd.promptValue(rest[2:end]))
+				i += end + 1
+				continue
+			}
+		}
+
+		if rest[0] == '<' {
+			if end := strings.IndexByte(rest, '>'); end > 0 {
+				name := rest[1:end]
+				closing := strings.HasPrefix(name, "/")
+				if closing {
+					name = name[1:]
+				}
+
+				if code, ok := promptColors[name]; ok || (closing && name == "") {
+					if closing {
+						code = "0"
+					}
+					if color {
+						b.WriteString("\x1b[" + code + "m")
+					}
+
+					i += end + 1
+					continue
+				}
+			}
+		}
+
+		b.WriteByte(rest[0])
+		i++
+	}
+
+	return b.String()
+}
+
+// promptValue returns the value of a prompt placeholder
+func (cmd *Cmd) promptValue(name string) string {
+	switch {
+	case name == "time":
+		return time.Now().Format("15:04:05")
+
+	case strings.HasPrefix(name, "time:"):
+		return time.Now().Format(name[5:])
+
+	case name == "date":
+		return time.Now().Format("2006-01-02")
+
+	case name == "?":
+		name = "status"
+
+	case strings.HasPrefix(name, "env."):
+		return os.Getenv(name[4:])
+	}
+
+	v, _ := cmd.GetVar(name)
+	return v
+}
+
+// prompt returns the prompt for the next command line, with the right prompt in the main loop
+func (cmd *Cmd) prompt(mainLoop bool) string {
+	prompt := cmd.GetPrompt(false)
+	if !mainLoop || cmd.RightPrompt == "" || !cmd.context.ScanningLiner() {
+		return prompt
+	}
+
+	width := 80
+	if w, _, ok := terminalSize(os.Stdout); ok { // the line editor writes to stdout
+		width = w
+	}
+
+	return internal.RightPrompt(prompt, cmd.ExpandPrompt(cmd.RightPrompt), width)
+}
+
+// truncatePrompt shortens the (visible part of the) prompt to max characters, replacing the beginning with "..."
+func truncatePrompt(prompt string, max int) string {
+	if max <= 3 || len(prompt) <= max {
+		return prompt
+	}
+
+	if plain := internal.StripANSI(prompt); len(plain) > max {
+		max -= 3 // for "..."
+		return "..." + plain[len(plain)-max:]
+	}
+
+	return prompt
+}
@@ -0,0 +1,372 @@
+package cmd_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gobs/cmd"
+	"github.com/gobs/cmd/internal"
+	"github.com/gobs/cmd/plugins/controlflow"
+)
+
+// benchInterpreter returns an interpreter with the controlflow plugin and a "nop" command,
+// that counts the times it's called
+func benchInterpreter(count *int) *cmd.Cmd {
+	c := &cmd.Cmd{Output: &syncBuffer{}}
+	c.Init(controlflow.Plugin)
+
+	c.Add(cmd.Command{Name: "nop", Call: func(string) bool {
+		*count++
+		return false
+	}})
+
+	return c
+}
+
+// script returns a script with n commands, nested in depth blocks
+func script(n, depth int) string {
+	var b strings.Builder
+
+	for i := 0; i < depth; i++ {
+		b.WriteString(strings.Repeat("  ", i) + "if 1 == 1 {\n")
+	}
+
+	for i := 0; i < n; i++ {
+		b.WriteString(strings.Repeat("  ", depth) + "nop $item\n")
+	}
+
+	for i := depth - 1; i >= 0; i-- {
+		b.WriteString(strings.Repeat("  ", i) + "}\n")
+	}
+
+	return b.String()
+}
+
+func benchmarkScript(b *testing.B, n, depth int) {
+	var count int
+	c := benchInterpreter(&count)
+	s := script(n, depth)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if !c.RunScript(strings.NewReader(s)) {
+			b.Fatal("script failed")
+		}
+	}
+
+	if count != n*b.N {
+		b.Fatalf("executed %v commands, want %v", count, n*b.N)
+	}
+}
+
+func BenchmarkScript(b *testing.B)       { benchmarkScript(b, 10000, 0) }
+func BenchmarkBlock(b *testing.B)        { benchmarkScript(b, 10000, 1) }
+func BenchmarkNestedBlocks(b *testing.B) { benchmarkScript(b, 10000, 8) }
+
+func BenchmarkLoadScript(b *testing.B) {
+	var count int
+	c := benchInterpreter(&count)
+
+	path := filepath.Join(b.TempDir(), "script.cmd")
+	if err := os.WriteFile(path, []byte(script(10000, 8)), 0o644); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if !c.RunScript(strings.NewReader("load " + path)) {
+			b.Fatal("load failed")
+		}
+	}
+
+	if count != 10000*b.N {
+		b.Fatalf("executed %v commands, want %v", count, 10000*b.N)
+	}
+}
+
+func BenchmarkLoopBody(b *testing.B) {
+	var count int
+	c := benchInterpreter(&count)
+
+	s := "foreach --range=1:100 {\n" + script(100, 2) + "}\n"
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if !c.RunScript(strings.NewReader(s)) {
+			b.Fatal("script failed")
+		}
+	}
+
+	if count != 100*100*b.N {
+		b.Fatalf("executed %v commands, want %v", count, 100*100*b.N)
+	}
+}
+
+func TestErrExitScript(t *testing.T) {
+	var records syncBuffer
+	c := newInterpreter(&records)
+
+	script := `
+set errexit on
+record one
+nosuchcommand
+record two
+`
+	if c.RunScript(strings.NewReader(script)) {
+		t.Error("the script didn't fail")
+	}
+
+	if out := records.String(); out != "one\n" {
+		t.Errorf("got %q, want the script to terminate after the failed command", out)
+	}
+
+	// the interpreter can still execute commands, and other scripts
+	if !c.RunScript(strings.NewReader("record three")) || records.String() != "one\nthree\n" {
+		t.Errorf("got %q after the failed script", records.String())
+	}
+}
+
+func TestErrExitScriptBlock(t *testing.T) {
+	var records syncBuffer
+	c := newInterpreter(&records)
+
+	script := `
+set errexit on
+if 1 == 1 {
+    record one
+    nosuchcommand
+    record two
+}
+record three
+`
+	c.RunScript(strings.NewReader(script))
+
+	if out := records.String(); out != "one\n" {
+		t.Errorf("got %q, want the script to terminate after the failed command", out)
+	}
+}
+
+func TestNoErrExitScript(t *testing.T) {
+	var records syncBuffer
+	c := newInterpreter(&records)
+
+	if c.RunScript(strings.NewReader("record one\nnosuchcommand\nrecord two\n")) {
+		t.Error("the script didn't fail")
+	}
+
+	if out := records.String(); out != "one\ntwo\n" {
+		t.Errorf("got %q, want all the commands executed", out)
+	}
+}
+
+func TestDryRunLoad(t *testing.T) {
+	var records syncBuffer
+	c := newInterpreter(&records)
+
+	path := filepath.Join(t.TempDir(), "functions.cmd")
+	if err := os.WriteFile(path, []byte("record loaded\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := filepath.Join(t.TempDir(), "saved.cmd")
+
+	script := `
+function f {
+    record called
+}
+set dryrun on
+function --save ` + saved + `
+load ` + path + `
+import ` + path + `
+eval record evaluated
+`
+	c.RunScript(strings.NewReader(script))
+
+	if out := records.String(); out != "" {
+		t.Errorf("got %q, want no commands executed", out)
+	}
+
+	if _, err := os.Stat(saved); err == nil {
+		t.Error("function --save wrote a file in dry-run mode")
+	}
+}
+
+func TestImportNamespaces(t *testing.T) {
+	var records syncBuffer
+	c := newInterpreter(&records)
+
+	path := filepath.Join(t.TempDir(), "lib.cmd")
+	if err := os.WriteFile(path, []byte("record loaded\nfunction f {\n    record f $1\n}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	script := `
+import ` + path + `
+import ` + path + `
+import --as=ns ` + path + `
+import --as=ns ` + path + `
+f one
+ns.f two
+`
+	if !c.RunScript(strings.NewReader(script)) {
+		t.Fatal("script failed")
+	}
+
+	if out := records.String(); out != "loaded\nloaded\nf one\nf two\n" {
+		t.Errorf("got %q", out)
+	}
+}
+
+func TestAliasCommands(t *testing.T) {
+	for _, plugin := range []bool{false, true} {
+		var records syncBuffer
+		c := newInterpreter(&records)
+
+		if !plugin {
+			c = &cmd.Cmd{Output: &syncBuffer{}}
+			c.Init()
+			c.Add(cmd.Command{Name: "record", Call: func(line string) bool {
+				fmt.Fprintln(&records, line)
+				return false
+			}})
+		}
+
+		c.AddAlias("both", "record one; record two")
+
+		if !c.RunScript(strings.NewReader("both three")) {
+			t.Fatal("script failed")
+		}
+
+		// the expansion is not expanded again
+		c.AddAlias("record", "record first; record")
+
+		if !c.RunScript(strings.NewReader("record last")) {
+			t.Fatal("script failed")
+		}
+
+		if out := records.String(); out != "one\ntwo three\nfirst\nlast\n" {
+			t.Errorf("controlflow %v: got %q", plugin, out)
+		}
+	}
+}
+
+// positions is a plugin with a "pos" command, that records the position of the line that called it
+type positions struct {
+	records *syncBuffer
+}
+
+func (p positions) PluginInit(c *cmd.Cmd, ctx *internal.Context) error {
+	c.Add(cmd.Command{Name: "pos", Call: func(line string) bool {
+		fmt.Fprintln(p.records, ctx.Position(), line)
+		return false
+	}})
+
+	return nil
+}
+
+// loadScript writes the script to a file and loads it, returning the path of the file
+func loadScript(t *testing.T, c *cmd.Cmd, script string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "script.cmd")
+	if err := os.WriteFile(path, []byte(script), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c.RunScript(strings.NewReader("load " + path))
+	return path
+}
+
+func TestBlockPositions(t *testing.T) {
+	var records syncBuffer
+	c := &cmd.Cmd{Output: &syncBuffer{}}
+	c.Init(controlflow.Plugin, positions{&records})
+
+	script := `pos one
+function f {
+    pos f \
+        continued
+    if 1 == 1 {
+        pos <<EOF
+text
+EOF
+        pos nested
+    }
+}
+if 1 == 2 {
+    pos no
+} elif 1 == 1 {
+    # a comment
+    pos elif
+    f
+} else {
+    pos no
+}
+foreach (a) {
+    switch $item {
+    case a {
+        pos case
+    }
+    }
+}
+`
+	path := loadScript(t, c, script)
+
+	var want strings.Builder
+	for _, p := range []struct {
+		line int
+		text string
+	}{
+		{1, "one"},
+		{16, "elif"},
+		{4, "f continued"},
+		{8, "text"},
+		{9, "nested"},
+		{24, "case"},
+	} {
+		fmt.Fprintf(&want, "%v:%v %v\n", path, p.line, p.text)
+	}
+
+	if out := records.String(); out != want.String() {
+		t.Errorf("got:\n%v\nwant:\n%v", out, want.String())
+	}
+}
+
+func TestBlockErrors(t *testing.T) {
+	var records syncBuffer
+	c := newInterpreter(&records)
+
+	var output syncBuffer
+	c.Output = &output
+
+	path := loadScript(t, c, "record one\nif 1 == 1 {\n    record two\n    if 1 == 2 {\n    }\n")
+
+	if out := records.String(); out != "one\ntwo\n" {
+		t.Errorf("got %q", out)
+	}
+
+	if want := path + ":2: missing }"; !strings.Contains(output.String(), want) {
+		t.Errorf("got %q, want %q", output.String(), want)
+	}
+
+	records, output = syncBuffer{}, syncBuffer{}
+
+	path = loadScript(t, c, "if 1 == 1 {\n    record one\n} otherwise {\n    record two\n}\n")
+
+	if out := records.String(); out != "one\n" {
+		t.Errorf("got %q", out)
+	}
+
+	if want := path + `:3: expected else, got "otherwise {"`; !strings.Contains(output.String(), want) {
+		t.Errorf("got %q, want %q", output.String(), want)
+	}
+}
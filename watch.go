@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const clearScreen = "\033[H\033[2J"
+
+// parseInterval parses an interval as a number of seconds (i.e. 2 or 0.5) or a duration (i.e. 1m30s)
+func parseInterval(s string) (time.Duration, error) {
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+
+	return time.ParseDuration(s)
+}
+
+func (cmd *Cmd) command_watch(line string) (stop bool) {
+	interval := 2 * time.Second
+
+	for strings.HasPrefix(line, "-") {
+		arg, rest, _ := strings.Cut(line, " ")
+		line = strings.TrimSpace(rest)
+
+		if arg == "--" {
+			break
+		}
+
+		name, value, ok := strings.Cut(arg, "=")
+		if name != "--interval" && name != "-n" {
+			cmd.Println("invalid option", arg)
+			return
+		}
+
+		if !ok { // --interval value
+			value, rest, _ = strings.Cut(line, " ")
+			line = strings.TrimSpace(rest)
+		}
+
+		d, err := parseInterval(value)
+		if err != nil || d <= 0 {
+			cmd.Println("invalid interval", value)
+			return
+		}
+
+		interval = d
+	}
+
+	if line == "" {
+		cmd.Println("nothing to watch")
+		return
+	}
+
+	out, ok := cmd.Stdout().(*os.File)
+	terminal := ok && isTerminal(out)
+
+	for {
+		var output strings.Builder
+		var done bool
+
+		// the output is collected first, so that the screen is redrawn at once
+		failures := cmd.startStatus()
+		cmd.streamOutput(func() {
+			done = cmd.OneCmd(line)
+		}, func(b []byte) { output.Write(b) })
+		cmd.endStatus(failures)
+
+		header := fmt.Sprintf("Every %v: %v", interval, line)
+		now := time.Now().Format("Mon Jan 2 15:04:05 2006")
+
+		if width, _ := cmd.TerminalSize(); len(header)+len(now)+1 < width {
+			header += strings.Repeat(" ", width-len(header)-len(now)) + now
+		} else {
+			header += " " + now
+		}
+
+		if terminal {
+			cmd.Print(clearScreen)
+		}
+
+		cmd.Print(header, "\n\n", output.String())
+
+		if done || cmd.Sleep(interval) {
+			break
+		}
+	}
+
+	return
+}